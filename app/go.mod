@@ -5,4 +5,9 @@ go 1.25.5
 require (
 	github.com/joho/godotenv v1.5.1
 	github.com/lib/pq v1.10.9
+	github.com/m-tln/notes v0.0.0-00010101000000-000000000000
 )
+
+require gopkg.in/yaml.v3 v3.0.1 // indirect
+
+replace github.com/m-tln/notes => ../
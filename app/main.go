@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
@@ -15,37 +17,33 @@ import (
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
+	"github.com/m-tln/notes/config"
+	"github.com/m-tln/notes/logging"
 )
 
 type Note struct {
 	ID        int       `json:"id"`
 	Title     string    `json:"title"`
 	Content   string    `json:"content"`
+	OwnerID   *int      `json:"owner_id,omitempty"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
 var db *sql.DB
 
-func initDB() {
-	dbHost := getEnv("DB_HOST", "postgres")
-	dbPort := getEnv("DB_PORT", "5432")
-	dbUser := getEnv("DB_USER", "notes_user")
-	dbPassword := getEnv("DB_PASSWORD", "notes_pass")
-	dbName := getEnv("DB_NAME", "notes_db")
-
+func initDB(dbHost string, dbPort int, dbUser, dbPassword, dbName string) {
 	connStr := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		"host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
 		dbHost, dbPort, dbUser, dbPassword, dbName,
 	)
 
-	log.Printf("Connecting to database: host=%s, db=%s", dbHost, dbName)
-	log.Printf("Conn str=%s", connStr)
+	slog.Info("Connecting to database", "host", dbHost, "port", dbPort, "db", dbName, "user", dbUser)
 
 	var err error
 	db, err = sql.Open("postgres", connStr)
 	if err != nil {
-		log.Fatalf("Failed to open database connection: %v", err)
+		logging.Fatal("Failed to open database connection", "error", err)
 	}
 
 	db.SetMaxOpenConns(25)
@@ -56,65 +54,88 @@ func initDB() {
 	defer cancel()
 
 	if err := db.PingContext(ctx); err != nil {
-		log.Fatalf("Failed to ping to database: %v", err)
+		logging.Fatal("Failed to ping the database", "error", err)
 	}
 
-	log.Println("Successfully connected to database")
-}
-
-func getEnv(key, defaultValue string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		return defaultValue
-	}
-	return value
+	slog.Info("Connected to database")
 }
 
 func main() {
-	if os.Getenv("APP_ENV") != "production" {
-		err := godotenv.Load()
-		if err != nil {
-			log.Println("No .env file found, using environment variables")
+	configErr := config.Load("APP_CONFIG", os.Args[1:])
+	if config.String("APP_ENV", "") != "production" {
+		if err := godotenv.Load(); err != nil {
+			slog.Info("No .env file found, using environment variables")
 		}
 	}
+	logging.Setup("app")
+	if configErr != nil {
+		logging.Fatal("Invalid configuration", "error", configErr)
+	}
+
+	dbHost := config.String("DB_HOST", "postgres")
+	dbPort := config.Int("DB_PORT", 5432)
+	dbUser := config.String("DB_USER", "notes_user")
+	dbPassword := config.Secret("DB_PASSWORD", "notes_pass")
+	dbName := config.String("DB_NAME", "notes_db")
+	port := config.Int("PORT", 8080)
+	adminPort := config.String("ADMIN_PORT", "")
+	adminBind := config.String("ADMIN_BIND", "127.0.0.1")
+	loadEmailConfig()
+
+	config.Dump()
+	if err := config.Err(); err != nil {
+		logging.Fatal("Invalid configuration", "error", err)
+	}
 
 	maxRetries := 5
 	for i := range maxRetries {
-		initDB()
+		initDB(dbHost, dbPort, dbUser, dbPassword, dbName)
 		if db != nil {
 			break
 		}
 		if i < maxRetries-1 {
-			log.Printf("Retrying database connection (%d/%d)...", i+1, maxRetries)
+			slog.Warn("Retrying database connection", "attempt", i+1, "max_attempts", maxRetries)
 			time.Sleep(2 * time.Second)
 		}
 	}
 
 	defer db.Close()
 
-	port := getEnv("PORT", "8080")
-
 	http.HandleFunc("/notes", notesHandler)
 	http.HandleFunc("/notes/", noteHandler)
+	http.HandleFunc("/users", usersHandler)
+	http.HandleFunc("/users/", userHandler)
 	http.HandleFunc("/health", healthHandler)
 
-	log.Printf("Starting server on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	if adminPort != "" {
+		admin := http.NewServeMux()
+		admin.Handle("/log/level", logging.LevelHandler())
+		go func() {
+			// /log/level has no authentication, so only local callers reach it.
+			addr := net.JoinHostPort(adminBind, adminPort)
+			slog.Info("Admin endpoints listening", "addr", addr)
+			logging.Fatal("Admin server failed", "error", http.ListenAndServe(addr, admin))
+		}()
+	}
+
+	slog.Info("Starting server", "port", port)
+	logging.Fatal("Server failed", "error", http.ListenAndServe(":"+strconv.Itoa(port), logging.Middleware(http.DefaultServeMux)))
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
 	defer cancel()
 
-	log.Println("Health check: checking database connection")
+	logger := logging.FromContext(r.Context())
+	logger.Debug("Health check: checking database connection")
 	if err := db.PingContext(ctx); err != nil {
-		log.Printf("Health check FAILED: database unavailable: %v", err)
+		logger.Error("Health check failed: database unavailable", "error", err)
 		w.WriteHeader(http.StatusServiceUnavailable)
 		w.Write([]byte("Database unavailable"))
 		return
 	}
 
-	log.Println("Health check: database connection OK")
+	logger.Debug("Health check: database connection OK")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
@@ -155,46 +176,79 @@ func noteHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func addNote(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
 	var note Note
 	if err := json.NewDecoder(r.Body).Decode(&note); err != nil {
-		log.Printf("Failed to decode JSON for new note: %v", err)
+		logger.Warn("Failed to decode JSON for new note", "error", err)
 		http.Error(w, `{"error": "Invalid JSON"}`, http.StatusBadRequest)
 		return
 	}
 
 	if note.Title == "" {
-		log.Printf("Attempt to create note with empty title")
+		logger.Warn("Attempt to create note with empty title")
 		http.Error(w, `{"error": "Title is required"}`, http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Attempting to create new note with title: '%s'", note.Title)
+	if note.OwnerID != nil {
+		var exists bool
+		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", *note.OwnerID).Scan(&exists)
+		if err != nil {
+			logger.Error("Database error while checking owner", "owner_id", *note.OwnerID, "error", err)
+			http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			logger.Warn("Attempt to create note for unknown owner", "owner_id", *note.OwnerID)
+			http.Error(w, `{"error": "Owner not found"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	logger.Debug("Creating note", "title", note.Title)
 
-	query := `INSERT INTO notes (title, content) VALUES ($1, $2) RETURNING id, created_at, updated_at`
-	err := db.QueryRow(query, note.Title, note.Content).Scan(&note.ID, &note.CreatedAt, &note.UpdatedAt)
+	tx, err := db.Begin()
 	if err != nil {
-		log.Printf("Database error while creating note: %v", err)
+		logger.Error("Database error while creating note", "error", err)
 		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
 
-	go func() {
-		if err := sendToEmailService(note); err != nil {
-			log.Printf("Failed to send to email service: %v", err)
-		}
-	}()
+	query := `INSERT INTO notes (title, content, owner_id) VALUES ($1, $2, $3) RETURNING id, created_at, updated_at`
+	err = tx.QueryRow(query, note.Title, note.Content, note.OwnerID).Scan(&note.ID, &note.CreatedAt, &note.UpdatedAt)
+	if err == nil && emailOutboxEnabled() {
+		err = writeOutbox(tx, "created", note)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		logger.Error("Database error while creating note", "error", err)
+		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
 
-	log.Printf("Successfully created note ID=%d with title: '%s'", note.ID, note.Title)
+	if !emailOutboxEnabled() {
+		go func() {
+			if err := sendToEmailService(logger, note); err != nil {
+				logger.Error("Failed to send to email service", "note_id", note.ID, "error", err)
+			}
+		}()
+	}
+
+	logger.Info("Created note", "note_id", note.ID, "title", note.Title)
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(note)
 }
 
 func getNotes(w http.ResponseWriter, r *http.Request) {
-	log.Println("Attempting to fetch all notes")
+	logger := logging.FromContext(r.Context())
+	logger.Debug("Fetching all notes")
 
-	rows, err := db.Query("SELECT id, title, content, created_at, updated_at FROM notes ORDER BY created_at DESC")
+	rows, err := db.Query("SELECT id, title, content, owner_id, created_at, updated_at FROM notes ORDER BY created_at DESC")
 	if err != nil {
-		log.Printf("Database error while fetching notes: %v", err)
+		logger.Error("Database error while fetching notes", "error", err)
 		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
 		return
 	}
@@ -204,107 +258,214 @@ func getNotes(w http.ResponseWriter, r *http.Request) {
 	noteCount := 0
 	for rows.Next() {
 		var note Note
-		if err := rows.Scan(&note.ID, &note.Title, &note.Content, &note.CreatedAt, &note.UpdatedAt); err != nil {
-			log.Printf("Row scan error for note: %v", err)
+		if err := rows.Scan(&note.ID, &note.Title, &note.Content, &note.OwnerID, &note.CreatedAt, &note.UpdatedAt); err != nil {
+			logger.Error("Row scan error for note", "error", err)
 			continue
 		}
 		notes = append(notes, note)
 		noteCount++
 	}
 
-	log.Printf("Successfully fetched %d notes", noteCount)
+	logger.Info("Fetched notes", "count", noteCount)
 	json.NewEncoder(w).Encode(notes)
 }
 
 func getNote(w http.ResponseWriter, r *http.Request, id int) {
-	log.Printf("Attempting to fetch note ID=%d", id)
+	logger := logging.FromContext(r.Context()).With("note_id", id)
+	logger.Debug("Fetching note")
 
 	var note Note
-	query := "SELECT id, title, content, created_at, updated_at FROM notes WHERE id = $1"
-	err := db.QueryRow(query, id).Scan(&note.ID, &note.Title, &note.Content, &note.CreatedAt, &note.UpdatedAt)
+	query := "SELECT id, title, content, owner_id, created_at, updated_at FROM notes WHERE id = $1"
+	err := db.QueryRow(query, id).Scan(&note.ID, &note.Title, &note.Content, &note.OwnerID, &note.CreatedAt, &note.UpdatedAt)
 
 	if err == sql.ErrNoRows {
-		log.Printf("Note ID=%d not found", id)
+		logger.Info("Note not found")
 		http.Error(w, `{"error": "Note not found"}`, http.StatusNotFound)
 		return
 	}
 	if err != nil {
-		log.Printf("Database error while fetching note ID=%d: %v", id, err)
+		logger.Error("Database error while fetching note", "error", err)
 		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Successfully fetched note ID=%d with title: '%s'", note.ID, note.Title)
+	logger.Info("Fetched note", "title", note.Title)
 	json.NewEncoder(w).Encode(note)
 }
 
 func updateNote(w http.ResponseWriter, r *http.Request, id int) {
-	log.Printf("Attempting to update note ID=%d", id)
+	logger := logging.FromContext(r.Context()).With("note_id", id)
 
 	var note Note
 	if err := json.NewDecoder(r.Body).Decode(&note); err != nil {
-		log.Printf("Failed to decode JSON for update note ID=%d: %v", id, err)
+		logger.Warn("Failed to decode JSON for note update", "error", err)
 		http.Error(w, `{"error": "Invalid JSON"}`, http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Updating note ID=%d, new title: '%s'", id, note.Title)
+	logger.Debug("Updating note", "title", note.Title)
+
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Database error while updating note", "error", err)
+		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
 
 	query := `UPDATE notes SET title = $1, content = $2, updated_at = CURRENT_TIMESTAMP 
-			  WHERE id = $3 RETURNING updated_at`
-	err := db.QueryRow(query, note.Title, note.Content, id).Scan(&note.UpdatedAt)
+			  WHERE id = $3 RETURNING owner_id, created_at, updated_at`
+	err = tx.QueryRow(query, note.Title, note.Content, id).Scan(&note.OwnerID, &note.CreatedAt, &note.UpdatedAt)
+	note.ID = id
+	if err == nil && emailOutboxEnabled() {
+		err = writeOutbox(tx, "updated", note)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 
 	if err == sql.ErrNoRows {
-		log.Printf("Note ID=%d not found for update", id)
+		logger.Info("Note not found for update")
 		http.Error(w, `{"error": "Note not found"}`, http.StatusNotFound)
 		return
 	}
 	if err != nil {
-		log.Printf("Database error while updating note ID=%d: %v", id, err)
+		logger.Error("Database error while updating note", "error", err)
 		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
 		return
 	}
 
-	note.ID = id
-	log.Printf("Successfully updated note ID=%d", id)
+	logger.Info("Updated note")
 	json.NewEncoder(w).Encode(note)
 }
 
 func deleteNote(w http.ResponseWriter, r *http.Request, id int) {
-	log.Printf("Attempting to delete note ID=%d", id)
+	logger := logging.FromContext(r.Context()).With("note_id", id)
+	logger.Debug("Deleting note")
 
 	var exists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM notes WHERE id = $1)", id).Scan(&exists)
 	if err != nil {
-		log.Printf("Database error while checking existence of note ID=%d: %v", id, err)
+		logger.Error("Database error while checking that the note exists", "error", err)
 		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
 		return
 	}
 
 	if !exists {
-		log.Printf("Note ID=%d not found for deletion", id)
+		logger.Info("Note not found for deletion")
 		http.Error(w, `{"error": "Note not found"}`, http.StatusNotFound)
 		return
 	}
 
 	result, err := db.Exec("DELETE FROM notes WHERE id = $1", id)
 	if err != nil {
-		log.Printf("Database error while deleting note ID=%d: %v", id, err)
+		logger.Error("Database error while deleting note", "error", err)
 		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
 		return
 	}
 
 	rowsAffected, _ := result.RowsAffected()
-	log.Printf("Successfully deleted note ID=%d (rows affected: %d)", id, rowsAffected)
+	logger.Info("Deleted note", "rows_affected", rowsAffected)
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func sendToEmailService(note Note) error {
-	emailServiceURL := os.Getenv("EMAIL_SERVICE_URL")
-	if emailServiceURL == "" {
-		emailServiceURL = "https://email-service:8443"
+// emailConfig is how the app reaches the email service, read at startup.
+var emailConfig struct {
+	url        string
+	token      string
+	tokenURL   string
+	audience   string
+	caCert     string
+	clientCert string
+	clientKey  string
+	outbox     bool
+}
+
+func loadEmailConfig() {
+	emailConfig.url = config.String("EMAIL_SERVICE_URL", "https://email-service:8443")
+	emailConfig.token = config.Secret("EMAIL_SERVICE_TOKEN", "")
+	emailConfig.tokenURL = config.String("EMAIL_TOKEN_URL", "")
+	emailConfig.audience = config.String("EMAIL_TOKEN_AUDIENCE", "email")
+	emailConfig.caCert = config.String("EMAIL_CA_CERT", "")
+	emailConfig.clientCert = config.String("EMAIL_CLIENT_CERT", "")
+	emailConfig.clientKey = config.String("EMAIL_CLIENT_KEY", "")
+	emailConfig.outbox = config.Bool("EMAIL_OUTBOX", false)
+	config.Check((emailConfig.clientCert == "") == (emailConfig.clientKey == ""),
+		"EMAIL_CLIENT_CERT and EMAIL_CLIENT_KEY must be set together")
+}
+
+func emailServiceClient() (string, *http.Client) {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &bearerTransport{
+			token:    emailConfig.token,
+			tokenURL: emailConfig.tokenURL,
+			audience: emailConfig.audience,
+			next: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: emailServiceTLS(),
+			},
+		},
+	}
+	return emailConfig.url, client
+}
+
+// bearerTransport authenticates to the email service with the shared secret
+// from EMAIL_SERVICE_TOKEN, if one is set, or else with a workload JWT from
+// EMAIL_TOKEN_URL.
+type bearerTransport struct {
+	token    string
+	tokenURL string
+	audience string
+	next     http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	token := t.token
+	if token == "" && t.tokenURL != "" {
+		var err error
+		if token, err = emailToken.get(t.tokenURL, t.audience); err != nil {
+			return nil, err
+		}
+	}
+	if token == "" {
+		return t.next.RoundTrip(r)
+	}
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return t.next.RoundTrip(r)
+}
+
+// emailServiceTLS verifies the email service against EMAIL_CA_CERT and
+// presents EMAIL_CLIENT_CERT/EMAIL_CLIENT_KEY when it requires client
+// certificates. Without a CA the certificate is not checked, as before.
+func emailServiceTLS() *tls.Config {
+	cfg := &tls.Config{InsecureSkipVerify: true}
+	if caFile := emailConfig.caCert; caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			slog.Error("Failed to read EMAIL_CA_CERT", "error", err)
+		} else {
+			pool := x509.NewCertPool()
+			pool.AppendCertsFromPEM(pem)
+			cfg = &tls.Config{RootCAs: pool}
+		}
+	}
+	certFile, keyFile := emailConfig.clientCert, emailConfig.clientKey
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			slog.Error("Failed to load email service client certificate", "error", err)
+		} else {
+			cfg.Certificates = []tls.Certificate{cert}
+		}
 	}
+	return cfg
+}
+
+func sendToEmailService(logger *slog.Logger, note Note) error {
+	emailServiceURL, client := emailServiceClient()
 
 	storeData := map[string]any{
 		"id":          strconv.Itoa(note.ID),
@@ -313,40 +474,34 @@ func sendToEmailService(note Note) error {
 		"description": note.Title,
 		"created_at":  note.CreatedAt,
 	}
+	if note.OwnerID != nil {
+		storeData["owner_id"] = strconv.Itoa(*note.OwnerID)
+	}
 
 	jsonData, err := json.Marshal(storeData)
 	if err != nil {
 		return err
 	}
 
-	client := &http.Client{
-		Timeout: 5 * time.Second,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		},
+	storeResp, err := client.Post(emailServiceURL+"/email/store",
+		"application/json", bytes.NewBuffer(jsonData))
+	if err != nil || storeResp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("failed to store note in email service")
 	}
-
-	storeResp, err := client.Post(emailServiceURL+"/email/store", 
-        "application/json", bytes.NewBuffer(jsonData))
-    if err != nil || storeResp.StatusCode != http.StatusAccepted {
-        return fmt.Errorf("failed to store note in email service")
-    }
-    storeResp.Body.Close()
+	storeResp.Body.Close()
 
 	extractData := map[string]string{
-        "note_id": strconv.Itoa(note.ID),
-    }
-    
-    extractJson, _ := json.Marshal(extractData)
-    extractResp, err := client.Post(emailServiceURL+"/email/extract", 
-        "application/json", bytes.NewBuffer(extractJson))
-    if err != nil || extractResp.StatusCode != http.StatusAccepted {
-        return fmt.Errorf("failed to extract note from email service")
-    }
-    extractResp.Body.Close()
-
-	log.Printf("Note ID=%d sent to email service successfully", note.ID)
+		"note_id": strconv.Itoa(note.ID),
+	}
+
+	extractJson, _ := json.Marshal(extractData)
+	extractResp, err := client.Post(emailServiceURL+"/email/extract",
+		"application/json", bytes.NewBuffer(extractJson))
+	if err != nil || extractResp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("failed to extract note from email service")
+	}
+	extractResp.Body.Close()
+
+	logger.Info("Sent note to email service", "note_id", note.ID)
 	return nil
 }
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+)
+
+// With EMAIL_OUTBOX=true note changes don't call the email service directly.
+// Instead an email_outbox row is written in the same transaction as the note,
+// and the email service polls the table, so an email is sent exactly when the
+// change committed.
+func emailOutboxEnabled() bool {
+	return emailConfig.outbox
+}
+
+func writeOutbox(tx *sql.Tx, eventType string, note Note) error {
+	payload, err := json.Marshal(map[string]any{
+		"type": eventType,
+		"note": note,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO email_outbox (payload) VALUES ($1)`, payload)
+	return err
+}
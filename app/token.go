@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// workloadToken is a JWT from the mesh CA that the app presents to the email
+// service instead of a shared secret. EMAIL_TOKEN_URL is the CA's /token,
+// reached through the sidecar's egress, which authenticates the request with
+// the app's mesh certificate. The token is kept until a minute before it
+// expires.
+type workloadToken struct {
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+var emailToken workloadToken
+
+var tokenClient = &http.Client{
+	Timeout:   5 * time.Second,
+	Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+}
+
+func (t *workloadToken) get(url, audience string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Until(t.expiresAt) > time.Minute {
+		return t.token, nil
+	}
+
+	body, _ := json.Marshal(map[string]string{"audience": audience})
+	resp, err := tokenClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("get a token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("get a token: %s", resp.Status)
+	}
+	var token struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("get a token: %w", err)
+	}
+	t.token, t.expiresAt = token.Token, token.ExpiresAt
+	return t.token, nil
+}
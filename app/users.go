@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-tln/notes/logging"
+)
+
+var emailEvents = []string{"note_created", "note_updated", "reminder_due", "digest"}
+
+type EmailPreferences struct {
+	Delivery   string   `json:"delivery"`
+	Events     []string `json:"events"`
+	Timezone   string   `json:"timezone,omitempty"`
+	SendWindow string   `json:"send_window,omitempty"`
+	QuietHours string   `json:"quiet_hours,omitempty"`
+}
+
+var windowPattern = regexp.MustCompile(`^([01]\d|2[0-3]):[0-5]\d-([01]\d|2[0-3]):[0-5]\d$`)
+
+type User struct {
+	ID          int              `json:"id"`
+	Email       string           `json:"email"`
+	Preferences EmailPreferences `json:"preferences"`
+	CreatedAt   time.Time        `json:"created_at"`
+	UpdatedAt   time.Time        `json:"updated_at"`
+}
+
+func (u *User) validate() error {
+	addr, err := mail.ParseAddress(u.Email)
+	if err != nil {
+		return fmt.Errorf("Invalid email")
+	}
+	u.Email = addr.Address
+
+	switch u.Preferences.Delivery {
+	case "":
+		u.Preferences.Delivery = "immediate"
+	case "immediate", "digest":
+	default:
+		return fmt.Errorf("Delivery must be immediate or digest")
+	}
+	if u.Preferences.Events == nil {
+		u.Preferences.Events = emailEvents
+	}
+	for _, event := range u.Preferences.Events {
+		if !slices.Contains(emailEvents, event) {
+			return fmt.Errorf("Unknown event %s", event)
+		}
+	}
+
+	prefs := u.Preferences
+	if prefs.Timezone != "" {
+		if _, err := time.LoadLocation(prefs.Timezone); err != nil {
+			return fmt.Errorf("Unknown timezone %s", prefs.Timezone)
+		}
+	}
+	if prefs.SendWindow != "" && prefs.QuietHours != "" {
+		return fmt.Errorf("Set either send_window or quiet_hours")
+	}
+	for _, window := range []string{prefs.SendWindow, prefs.QuietHours} {
+		if window != "" && !windowPattern.MatchString(window) {
+			return fmt.Errorf("Window must look like 08:00-21:00")
+		}
+	}
+	return nil
+}
+
+func scanUser(row interface{ Scan(...any) error }) (User, error) {
+	var user User
+	var events string
+	err := row.Scan(&user.ID, &user.Email, &user.Preferences.Delivery, &events,
+		&user.Preferences.Timezone, &user.Preferences.SendWindow, &user.Preferences.QuietHours,
+		&user.CreatedAt, &user.UpdatedAt)
+	user.Preferences.Events = []string{}
+	if events != "" {
+		user.Preferences.Events = strings.Split(events, ",")
+	}
+	return user, err
+}
+
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		getUsers(w, r)
+	case "POST":
+		addUser(w, r)
+	default:
+		http.Error(w, `{"error": "Method not allowed"}`, http.StatusMethodNotAllowed)
+	}
+}
+
+func userHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	idStr := r.URL.Path[len("/users/"):]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid user ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		getUser(w, r, id)
+	case "PUT":
+		updateUser(w, r, id)
+	default:
+		http.Error(w, `{"error": "Method not allowed"}`, http.StatusMethodNotAllowed)
+	}
+}
+
+func addUser(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+	var user User
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		logger.Warn("Failed to decode JSON for new user", "error", err)
+		http.Error(w, `{"error": "Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	if err := user.validate(); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	prefs := user.Preferences
+	query := `INSERT INTO users (email, email_delivery, email_events, timezone, send_window, quiet_hours)
+			  VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at, updated_at`
+	err := db.QueryRow(query, user.Email, prefs.Delivery, strings.Join(prefs.Events, ","),
+		prefs.Timezone, prefs.SendWindow, prefs.QuietHours).
+		Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		logger.Error("Database error while creating user", "error", err)
+		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("Created user", "user_id", user.ID)
+	go syncPreferences(logger, user)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
+
+func getUsers(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+	rows, err := db.Query(`SELECT id, email, email_delivery, email_events, timezone, send_window, quiet_hours, created_at, updated_at
+			  FROM users ORDER BY id`)
+	if err != nil {
+		logger.Error("Database error while fetching users", "error", err)
+		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			logger.Error("Row scan error for user", "error", err)
+			continue
+		}
+		users = append(users, user)
+	}
+	json.NewEncoder(w).Encode(users)
+}
+
+func getUser(w http.ResponseWriter, r *http.Request, id int) {
+	row := db.QueryRow(`SELECT id, email, email_delivery, email_events, timezone, send_window, quiet_hours, created_at, updated_at
+			  FROM users WHERE id = $1`, id)
+	user, err := scanUser(row)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Database error while fetching user", "user_id", id, "error", err)
+		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(user)
+}
+
+func updateUser(w http.ResponseWriter, r *http.Request, id int) {
+	logger := logging.FromContext(r.Context()).With("user_id", id)
+	var user User
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		logger.Warn("Failed to decode JSON for user update", "error", err)
+		http.Error(w, `{"error": "Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	if err := user.validate(); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	prefs := user.Preferences
+	query := `UPDATE users SET email = $1, email_delivery = $2, email_events = $3,
+			  timezone = $4, send_window = $5, quiet_hours = $6, updated_at = CURRENT_TIMESTAMP
+			  WHERE id = $7 RETURNING created_at, updated_at`
+	err := db.QueryRow(query, user.Email, prefs.Delivery, strings.Join(prefs.Events, ","),
+		prefs.Timezone, prefs.SendWindow, prefs.QuietHours, id).
+		Scan(&user.CreatedAt, &user.UpdatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Error("Database error while updating user", "error", err)
+		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	user.ID = id
+	logger.Info("Updated user preferences")
+	go syncPreferences(logger, user)
+	json.NewEncoder(w).Encode(user)
+}
+
+// syncPreferences pushes the user's settings to the email service so the
+// change applies before its cache would expire.
+func syncPreferences(logger *slog.Logger, user User) {
+	emailServiceURL, client := emailServiceClient()
+
+	body, _ := json.Marshal(map[string]any{
+		"users": []map[string]any{{
+			"user_id":     strconv.Itoa(user.ID),
+			"email":       user.Email,
+			"delivery":    user.Preferences.Delivery,
+			"events":      user.Preferences.Events,
+			"timezone":    user.Preferences.Timezone,
+			"send_window": user.Preferences.SendWindow,
+			"quiet_hours": user.Preferences.QuietHours,
+			"updated_at":  user.UpdatedAt,
+		}},
+	})
+
+	resp, err := client.Post(emailServiceURL+"/email/preferences/sync", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		logger.Error("Failed to sync user preferences", "user_id", user.ID, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		logger.Error("Failed to sync user preferences", "user_id", user.ID, "status", resp.Status)
+	}
+}
@@ -0,0 +1,685 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-tln/notes/logging"
+)
+
+const (
+	acmeNonceLifetime = time.Hour
+	acmeOrderLifetime = time.Hour
+	acmeMaxBody       = 64 << 10
+	acmeALPNProto     = "acme-tls/1"
+
+	challengeTLSALPN = "tls-alpn-01"
+	challengeHTTP    = "http-01"
+)
+
+// id-pe-acmeIdentifier, the extension of a tls-alpn-01 challenge
+// certificate (RFC 8737).
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// ACMEServer lets sidecars and the load balancer get certificates from the
+// CA with a standard ACME (RFC 8555) client such as autocert. A client
+// proves it holds a name with a tls-alpn-01 or http-01 challenge, which the
+// CA checks on tlsPort or httpPort of that name. Only names of known
+// services are issued, and every name in an order must belong to the same
+// service, whose SPIFFE ID the certificate gets.
+type ACMEServer struct {
+	issuer       *Issuer
+	policy       Policy
+	accountsFile string
+	tlsPort      string
+	httpPort     string
+
+	nonceMu sync.Mutex
+	nonces  map[string]time.Time
+
+	mu       sync.Mutex
+	accounts map[string]*acmeAccount
+	orders   map[string]*acmeOrder
+	authzs   map[string]*acmeAuthz
+}
+
+// acmeAccount is an ACME account, keyed by the thumbprint of its key.
+// Accounts are kept in accountsFile, so clients keep them across restarts.
+type acmeAccount struct {
+	Key     json.RawMessage `json:"key"`
+	Contact []string        `json:"contact,omitempty"`
+	Created time.Time       `json:"created_at"`
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeOrder struct {
+	account     string
+	service     string
+	status      string
+	expires     time.Time
+	identifiers []acmeIdentifier
+	authzs      []string
+	cert        []byte
+}
+
+// acmeAuthz is the authorization for one name. Of its challenges, the first
+// one the client answers decides it.
+type acmeAuthz struct {
+	account   string
+	name      string
+	token     string
+	status    string
+	expires   time.Time
+	challenge string
+	validated time.Time
+	err       string
+}
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+// acmeRequest is a verified JWS request.
+type acmeRequest struct {
+	payload []byte
+	account string
+	jwk     json.RawMessage
+}
+
+func NewACMEServer(issuer *Issuer, policy Policy, accountsFile, tlsPort, httpPort string) (*ACMEServer, error) {
+	a := &ACMEServer{
+		issuer:       issuer,
+		policy:       policy,
+		accountsFile: accountsFile,
+		tlsPort:      tlsPort,
+		httpPort:     httpPort,
+		nonces:       make(map[string]time.Time),
+		accounts:     make(map[string]*acmeAccount),
+		orders:       make(map[string]*acmeOrder),
+		authzs:       make(map[string]*acmeAuthz),
+	}
+	data, err := os.ReadFile(accountsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &a.accounts); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", accountsFile, err)
+	}
+	return a, nil
+}
+
+func (a *ACMEServer) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /acme/directory", a.handleDirectory)
+	mux.HandleFunc("GET /acme/new-nonce", a.handleNonce)
+	mux.HandleFunc("POST /acme/new-account", a.handleNewAccount)
+	mux.HandleFunc("POST /acme/account/{id}", a.handleAccount)
+	mux.HandleFunc("POST /acme/new-order", a.handleNewOrder)
+	mux.HandleFunc("POST /acme/order/{id}", a.handleOrder)
+	mux.HandleFunc("POST /acme/authz/{id}", a.handleAuthz)
+	mux.HandleFunc("POST /acme/chall/{id}/{type}", a.handleChallenge)
+	mux.HandleFunc("POST /acme/finalize/{id}", a.handleFinalize)
+	mux.HandleFunc("POST /acme/cert/{id}", a.handleCert)
+}
+
+func baseURL(r *http.Request) string {
+	return "https://" + r.Host + "/acme"
+}
+
+func (a *ACMEServer) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	base := baseURL(r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"newNonce":   base + "/new-nonce",
+		"newAccount": base + "/new-account",
+		"newOrder":   base + "/new-order",
+		"meta":       map[string]any{"externalAccountRequired": false},
+	})
+}
+
+func (a *ACMEServer) handleNonce(w http.ResponseWriter, r *http.Request) {
+	a.setNonce(w)
+	if r.Method == http.MethodGet {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (a *ACMEServer) handleNewAccount(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.verify(w, r, true)
+	if !ok {
+		return
+	}
+	var payload struct {
+		Contact            []string `json:"contact"`
+		OnlyReturnExisting bool     `json:"onlyReturnExisting"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		a.problem(w, http.StatusBadRequest, "malformed", "invalid account request: "+err.Error())
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	account, exists := a.accounts[req.account]
+	status := http.StatusOK
+	if !exists {
+		if payload.OnlyReturnExisting {
+			a.problem(w, http.StatusBadRequest, "accountDoesNotExist", "no account for this key")
+			return
+		}
+		account = &acmeAccount{Key: req.jwk, Contact: payload.Contact, Created: time.Now().UTC()}
+		a.accounts[req.account] = account
+		if err := a.saveAccounts(); err != nil {
+			delete(a.accounts, req.account)
+			logging.FromContext(r.Context()).Error("Saving accounts failed", "component", "acme", "error", err)
+			a.problem(w, http.StatusInternalServerError, "serverInternal", "could not save the account")
+			return
+		}
+		logging.FromContext(r.Context()).Info("New account", "component", "acme", "account", req.account)
+		status = http.StatusCreated
+	}
+	w.Header().Set("Location", baseURL(r)+"/account/"+req.account)
+	a.write(w, status, accountJSON(account))
+}
+
+func (a *ACMEServer) handleAccount(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.verify(w, r, false)
+	if !ok {
+		return
+	}
+	if req.account != r.PathValue("id") {
+		a.problem(w, http.StatusForbidden, "unauthorized", "not your account")
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.write(w, http.StatusOK, accountJSON(a.accounts[req.account]))
+}
+
+func accountJSON(account *acmeAccount) map[string]any {
+	return map[string]any{"status": "valid", "contact": account.Contact}
+}
+
+// saveAccounts writes the accounts to accountsFile. The caller holds a.mu.
+func (a *ACMEServer) saveAccounts() error {
+	data, err := json.MarshalIndent(a.accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(a.accountsFile, data, 0644)
+}
+
+func (a *ACMEServer) handleNewOrder(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.verify(w, r, false)
+	if !ok {
+		return
+	}
+	var payload struct {
+		Identifiers []acmeIdentifier `json:"identifiers"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil || len(payload.Identifiers) == 0 {
+		a.problem(w, http.StatusBadRequest, "malformed", "an order needs identifiers")
+		return
+	}
+	var names []string
+	for i, id := range payload.Identifiers {
+		if id.Type != "dns" {
+			a.problem(w, http.StatusBadRequest, "rejectedIdentifier", fmt.Sprintf("identifier type %q is not supported", id.Type))
+			return
+		}
+		name := strings.ToLower(id.Value)
+		if strings.HasPrefix(name, "*.") {
+			// Wildcards need dns-01, which the CA doesn't check.
+			a.problem(w, http.StatusBadRequest, "rejectedIdentifier", "wildcard names are only issued through /sign")
+			return
+		}
+		if slices.Contains(names, name) {
+			a.problem(w, http.StatusBadRequest, "malformed", "duplicate identifier "+name)
+			return
+		}
+		names = append(names, name)
+		payload.Identifiers[i].Value = name
+	}
+	service, err := a.policy.serviceFor(names)
+	if err != nil {
+		a.problem(w, http.StatusBadRequest, "rejectedIdentifier", err.Error())
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	a.expire(now)
+	order := &acmeOrder{
+		account:     req.account,
+		service:     service,
+		status:      "pending",
+		expires:     now.Add(acmeOrderLifetime),
+		identifiers: payload.Identifiers,
+	}
+	for _, name := range names {
+		id := randomID()
+		a.authzs[id] = &acmeAuthz{account: req.account, name: name, token: randomID(), status: "pending", expires: order.expires}
+		order.authzs = append(order.authzs, id)
+	}
+	id := randomID()
+	a.orders[id] = order
+	w.Header().Set("Location", baseURL(r)+"/order/"+id)
+	a.write(w, http.StatusCreated, a.orderJSON(baseURL(r), id, order))
+}
+
+// expire drops orders and authorizations past their expiry. The caller
+// holds a.mu.
+func (a *ACMEServer) expire(now time.Time) {
+	maps.DeleteFunc(a.orders, func(_ string, o *acmeOrder) bool { return now.After(o.expires) })
+	maps.DeleteFunc(a.authzs, func(_ string, z *acmeAuthz) bool { return now.After(z.expires) })
+}
+
+func (a *ACMEServer) handleOrder(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.verify(w, r, false)
+	if !ok {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	id := r.PathValue("id")
+	order, ok := a.orders[id]
+	if !ok || order.account != req.account {
+		a.problem(w, http.StatusNotFound, "malformed", "no such order")
+		return
+	}
+	a.write(w, http.StatusOK, a.orderJSON(baseURL(r), id, order))
+}
+
+// orderJSON brings the order's status up to date with its authorizations
+// and renders it. The caller holds a.mu.
+func (a *ACMEServer) orderJSON(base, id string, order *acmeOrder) map[string]any {
+	if order.status == "pending" {
+		ready := true
+		for _, authzID := range order.authzs {
+			authz, ok := a.authzs[authzID]
+			switch {
+			case !ok || authz.status == "invalid":
+				order.status = "invalid"
+			case authz.status != "valid":
+				ready = false
+			}
+		}
+		if ready && order.status == "pending" {
+			order.status = "ready"
+		}
+	}
+	authzURLs := make([]string, len(order.authzs))
+	for i, authzID := range order.authzs {
+		authzURLs[i] = base + "/authz/" + authzID
+	}
+	resp := map[string]any{
+		"status":         order.status,
+		"expires":        order.expires.UTC().Format(time.RFC3339),
+		"identifiers":    order.identifiers,
+		"authorizations": authzURLs,
+		"finalize":       base + "/finalize/" + id,
+	}
+	if order.status == "valid" {
+		resp["certificate"] = base + "/cert/" + id
+	}
+	return resp
+}
+
+func (a *ACMEServer) handleAuthz(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.verify(w, r, false)
+	if !ok {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	id := r.PathValue("id")
+	authz, ok := a.authzs[id]
+	if !ok || authz.account != req.account {
+		a.problem(w, http.StatusNotFound, "malformed", "no such authorization")
+		return
+	}
+	challenges := []map[string]any{}
+	for _, typ := range []string{challengeTLSALPN, challengeHTTP} {
+		challenges = append(challenges, challengeJSON(baseURL(r), id, typ, authz))
+	}
+	a.write(w, http.StatusOK, map[string]any{
+		"status":     authz.status,
+		"expires":    authz.expires.UTC().Format(time.RFC3339),
+		"identifier": acmeIdentifier{Type: "dns", Value: authz.name},
+		"challenges": challenges,
+	})
+}
+
+func challengeJSON(base, authzID, typ string, authz *acmeAuthz) map[string]any {
+	c := map[string]any{
+		"type":   typ,
+		"url":    base + "/chall/" + authzID + "/" + typ,
+		"token":  authz.token,
+		"status": "pending",
+	}
+	if authz.challenge == typ {
+		switch authz.status {
+		case "pending":
+			c["status"] = "processing"
+		case "valid":
+			c["status"] = "valid"
+			c["validated"] = authz.validated.UTC().Format(time.RFC3339)
+		case "invalid":
+			c["status"] = "invalid"
+			c["error"] = acmeProblem{Type: "urn:ietf:params:acme:error:incorrectResponse", Detail: authz.err, Status: http.StatusForbidden}
+		}
+	}
+	return c
+}
+
+// handleChallenge starts checking the challenge the client says is ready.
+// The client learns the outcome by polling the authorization.
+func (a *ACMEServer) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.verify(w, r, false)
+	if !ok {
+		return
+	}
+	id, typ := r.PathValue("id"), r.PathValue("type")
+	if typ != challengeTLSALPN && typ != challengeHTTP {
+		a.problem(w, http.StatusNotFound, "malformed", "no such challenge")
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	authz, ok := a.authzs[id]
+	if !ok || authz.account != req.account {
+		a.problem(w, http.StatusNotFound, "malformed", "no such authorization")
+		return
+	}
+	if authz.status == "pending" && authz.challenge == "" {
+		authz.challenge = typ
+		go a.validate(id, typ, authz.name, authz.token+"."+req.account)
+	}
+	w.Header().Add("Link", fmt.Sprintf(`<%s/authz/%s>;rel="up"`, baseURL(r), id))
+	a.write(w, http.StatusOK, challengeJSON(baseURL(r), id, typ, authz))
+}
+
+func (a *ACMEServer) validate(id, typ, name, keyAuth string) {
+	var err error
+	if typ == challengeTLSALPN {
+		err = checkTLSALPN(name, a.tlsPort, keyAuth)
+	} else {
+		err = checkHTTP(name, a.httpPort, keyAuth)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	authz, ok := a.authzs[id]
+	if !ok {
+		return
+	}
+	if err != nil {
+		slog.Warn("Challenge failed", "component", "acme", "type", typ, "name", name, "error", err)
+		authz.status, authz.err = "invalid", err.Error()
+		return
+	}
+	authz.status, authz.validated = "valid", time.Now()
+}
+
+func checkTLSALPN(name, port, keyAuth string) error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", net.JoinHostPort(name, port), &tls.Config{
+		ServerName: name,
+		NextProtos: []string{acmeALPNProto},
+		// The challenge certificate is self-signed; what matters is the
+		// key authorization in it.
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	cs := conn.ConnectionState()
+	if cs.NegotiatedProtocol != acmeALPNProto {
+		return fmt.Errorf("%s did not negotiate %s", name, acmeALPNProto)
+	}
+	leaf := cs.PeerCertificates[0]
+	if len(leaf.DNSNames) != 1 || !strings.EqualFold(leaf.DNSNames[0], name) {
+		return fmt.Errorf("challenge certificate is not for %s", name)
+	}
+	want := sha256.Sum256([]byte(keyAuth))
+	for _, ext := range leaf.Extensions {
+		if !ext.Id.Equal(idPeACMEIdentifier) {
+			continue
+		}
+		var got []byte
+		if _, err := asn1.Unmarshal(ext.Value, &got); err != nil || !ext.Critical || !bytes.Equal(got, want[:]) {
+			return errors.New("challenge certificate has the wrong key authorization")
+		}
+		return nil
+	}
+	return errors.New("challenge certificate has no acmeIdentifier extension")
+}
+
+func checkHTTP(name, port, keyAuth string) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	token, _, _ := strings.Cut(keyAuth, ".")
+	resp, err := client.Get("http://" + net.JoinHostPort(name, port) + "/.well-known/acme-challenge/" + token)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(body)) != keyAuth {
+		return fmt.Errorf("%s answered %d without the key authorization", name, resp.StatusCode)
+	}
+	return nil
+}
+
+// handleFinalize issues the certificate of a ready order. The CSR must ask
+// for exactly the names of the order.
+func (a *ACMEServer) handleFinalize(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.verify(w, r, false)
+	if !ok {
+		return
+	}
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		a.problem(w, http.StatusBadRequest, "malformed", "invalid finalize request")
+		return
+	}
+	der, err := b64.DecodeString(payload.CSR)
+	if err != nil {
+		a.problem(w, http.StatusBadRequest, "badCSR", "invalid CSR encoding")
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		a.problem(w, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	id := r.PathValue("id")
+	order, ok := a.orders[id]
+	if !ok || order.account != req.account {
+		a.problem(w, http.StatusNotFound, "malformed", "no such order")
+		return
+	}
+	a.orderJSON(baseURL(r), id, order)
+	if order.status != "ready" {
+		a.problem(w, http.StatusForbidden, "orderNotReady", "order is "+order.status)
+		return
+	}
+	var names []string
+	for _, identifier := range order.identifiers {
+		names = append(names, identifier.Value)
+	}
+	requested := slices.Clone(csr.DNSNames)
+	if cn := strings.ToLower(csr.Subject.CommonName); cn != "" && !slices.Contains(requested, cn) {
+		requested = append(requested, cn)
+	}
+	for i := range requested {
+		requested[i] = strings.ToLower(requested[i])
+	}
+	slices.Sort(requested)
+	if !slices.Equal(requested, slices.Sorted(slices.Values(names))) || len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		a.problem(w, http.StatusBadRequest, "badCSR", fmt.Sprintf("CSR must request exactly %v", names))
+		return
+	}
+	cert, err := a.issuer.issue(a.policy.request(order.service, "acme:"+order.account, names, nil, ""), csr.PublicKey)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Signing failed", "component", "acme", "error", err)
+		a.problem(w, http.StatusInternalServerError, "serverInternal", "signing failed")
+		return
+	}
+	order.status, order.cert = "valid", a.issuer.bundle(cert)
+	logging.FromContext(r.Context()).Info("Issued a certificate", "component", "acme", "service", order.service, "serial", fmt.Sprintf("%x", cert.SerialNumber), "names", names, "not_after", cert.NotAfter.Format(time.DateOnly))
+	a.write(w, http.StatusOK, a.orderJSON(baseURL(r), id, order))
+}
+
+func (a *ACMEServer) handleCert(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.verify(w, r, false)
+	if !ok {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	order, ok := a.orders[r.PathValue("id")]
+	if !ok || order.account != req.account || order.status != "valid" {
+		a.problem(w, http.StatusNotFound, "malformed", "no such certificate")
+		return
+	}
+	a.setNonce(w)
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(order.cert)
+}
+
+// verify reads and checks a signed request. New accounts send their key
+// (jwk); every other request names its account (kid).
+func (a *ACMEServer) verify(w http.ResponseWriter, r *http.Request, newAccount bool) (*acmeRequest, bool) {
+	var msg jws
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, acmeMaxBody)).Decode(&msg); err != nil {
+		a.problem(w, http.StatusBadRequest, "malformed", "invalid JWS: "+err.Error())
+		return nil, false
+	}
+	var header jwsHeader
+	raw, err := b64.DecodeString(msg.Protected)
+	if err == nil {
+		err = json.Unmarshal(raw, &header)
+	}
+	if err != nil {
+		a.problem(w, http.StatusBadRequest, "malformed", "invalid protected header")
+		return nil, false
+	}
+	if header.URL != baseURL(r)+strings.TrimPrefix(r.URL.Path, "/acme") {
+		a.problem(w, http.StatusUnauthorized, "unauthorized", "url in the header does not match the request")
+		return nil, false
+	}
+	if !a.useNonce(header.Nonce) {
+		a.problem(w, http.StatusBadRequest, "badNonce", "unknown or reused nonce")
+		return nil, false
+	}
+
+	req := &acmeRequest{}
+	if newAccount {
+		if header.JWK == nil || header.KID != "" {
+			a.problem(w, http.StatusBadRequest, "malformed", "a new account request carries jwk and no kid")
+			return nil, false
+		}
+		req.jwk = header.JWK
+	} else {
+		accountID, ok := strings.CutPrefix(header.KID, baseURL(r)+"/account/")
+		a.mu.Lock()
+		account, exists := a.accounts[accountID]
+		a.mu.Unlock()
+		if header.JWK != nil || !ok || !exists {
+			a.problem(w, http.StatusBadRequest, "accountDoesNotExist", "unknown account in kid")
+			return nil, false
+		}
+		req.jwk = account.Key
+	}
+	pub, thumbprint, err := parseJWK(req.jwk)
+	if err != nil {
+		a.problem(w, http.StatusBadRequest, "badPublicKey", err.Error())
+		return nil, false
+	}
+	if err := msg.verify(header.Alg, pub); err != nil {
+		a.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return nil, false
+	}
+	if req.payload, err = b64.DecodeString(msg.Payload); err != nil {
+		a.problem(w, http.StatusBadRequest, "malformed", "invalid payload encoding")
+		return nil, false
+	}
+	req.account = thumbprint
+	return req, true
+}
+
+func (a *ACMEServer) setNonce(w http.ResponseWriter) {
+	nonce := randomID()
+	now := time.Now()
+	a.nonceMu.Lock()
+	maps.DeleteFunc(a.nonces, func(_ string, issued time.Time) bool { return now.Sub(issued) > acmeNonceLifetime })
+	a.nonces[nonce] = now
+	a.nonceMu.Unlock()
+	w.Header().Set("Replay-Nonce", nonce)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+func (a *ACMEServer) useNonce(nonce string) bool {
+	a.nonceMu.Lock()
+	defer a.nonceMu.Unlock()
+	issued, ok := a.nonces[nonce]
+	delete(a.nonces, nonce)
+	return ok && time.Since(issued) <= acmeNonceLifetime
+}
+
+func (a *ACMEServer) write(w http.ResponseWriter, status int, v any) {
+	a.setNonce(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (a *ACMEServer) problem(w http.ResponseWriter, status int, typ, detail string) {
+	a.setNonce(w)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(acmeProblem{Type: "urn:ietf:params:acme:error:" + typ, Detail: detail, Status: status})
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return b64.EncodeToString(b)
+}
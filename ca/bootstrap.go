@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BootstrapConfig enables the gRPC port, where a workload with no mesh
+// certificate yet gets its first one with a one-time token from
+// ca bootstrap-token, instead of having its key handed to it on a volume.
+type BootstrapConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	Port          string        `yaml:"port"`
+	TokenLifetime time.Duration `yaml:"token_lifetime"`
+}
+
+// bootstrapToken is a token as the CA keeps it: the secret only as a hash.
+// A token is <id>.<secret>, and is good for one Sign call for Service.
+type bootstrapToken struct {
+	ID        string    `json:"id"`
+	Hash      string    `json:"hash"`
+	Service   string    `json:"service"`
+	CreatedBy string    `json:"created_by"`
+	Expires   time.Time `json:"expires"`
+}
+
+var errBadToken = errors.New("unknown, used or expired bootstrap token")
+
+// BootstrapTokens keeps the unused tokens in a JSON file, which the
+// commands that create them and a running CA share; it is read on every
+// use. A token is removed once used, and expired ones whenever the file is
+// written.
+type BootstrapTokens struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewBootstrapTokens(path string) *BootstrapTokens {
+	return &BootstrapTokens{path: path}
+}
+
+func (b *BootstrapTokens) load() ([]bootstrapToken, error) {
+	data, err := os.ReadFile(b.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tokens []bootstrapToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", b.path, err)
+	}
+	return tokens, nil
+}
+
+func (b *BootstrapTokens) save(tokens []bootstrapToken) error {
+	now := time.Now()
+	tokens = slices.DeleteFunc(tokens, func(t bootstrapToken) bool { return now.After(t.Expires) })
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(b.path, data, 0600)
+}
+
+// create makes a token for service, good for lifetime, and returns it.
+func (b *BootstrapTokens) create(service, createdBy string, lifetime time.Duration) (string, bootstrapToken, error) {
+	id, secret := make([]byte, 6), make([]byte, 16)
+	rand.Read(id)
+	rand.Read(secret)
+	t := bootstrapToken{
+		ID:        hex.EncodeToString(id),
+		Hash:      hashSecret(hex.EncodeToString(secret)),
+		Service:   service,
+		CreatedBy: createdBy,
+		Expires:   time.Now().Add(lifetime).UTC(),
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tokens, err := b.load()
+	if err != nil {
+		return "", bootstrapToken{}, err
+	}
+	if err := b.save(append(tokens, t)); err != nil {
+		return "", bootstrapToken{}, err
+	}
+	return t.ID + "." + hex.EncodeToString(secret), t, nil
+}
+
+// lookup finds the unused, unexpired token for s; with take, it is used
+// up, so no other call gets it.
+func (b *BootstrapTokens) lookup(s string, take bool) (bootstrapToken, error) {
+	id, secret, ok := strings.Cut(s, ".")
+	if !ok {
+		return bootstrapToken{}, errBadToken
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tokens, err := b.load()
+	if err != nil {
+		return bootstrapToken{}, err
+	}
+	i := slices.IndexFunc(tokens, func(t bootstrapToken) bool { return t.ID == id })
+	if i < 0 || time.Now().After(tokens[i].Expires) ||
+		subtle.ConstantTimeCompare([]byte(tokens[i].Hash), []byte(hashSecret(secret))) != 1 {
+		return bootstrapToken{}, errBadToken
+	}
+	t := tokens[i]
+	if take {
+		if err := b.save(slices.Delete(tokens, i, i+1)); err != nil {
+			return bootstrapToken{}, err
+		}
+	}
+	return t, nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// caHash pins a root for a workload that doesn't trust it yet: the SHA-256
+// of its public key, as kubeadm's discovery-token-ca-cert-hash.
+func caHash(root *x509.Certificate) string {
+	sum := sha256.Sum256(root.RawSubjectPublicKeyInfo)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
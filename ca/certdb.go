@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math/big"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// IssuedCert is a certificate the CA has signed. Issuer is the subject key
+// ID of the signing CA, so entries from an earlier CA are told apart.
+// Requester is who asked for it: the SPIFFE ID of a /sign caller, the ACME
+// account, or the renewer.
+type IssuedCert struct {
+	Serial    string    `json:"serial"`
+	Issuer    string    `json:"issuer"`
+	Service   string    `json:"service"`
+	Subject   string    `json:"subject,omitempty"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+	URIs      []string  `json:"uris,omitempty"`
+	Usage     string    `json:"usage,omitempty"`
+	Requester string    `json:"requester,omitempty"`
+	IssuedAt  time.Time `json:"issued_at"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// CertDB records every certificate the CA issues in a JSON file, rewritten
+// whole on each issuance. The ca commands and a running CA share the file,
+// so it is read again whenever it has changed. It also hands out the
+// serials, so no two certificates of a CA share one.
+type CertDB struct {
+	path string
+
+	mu       sync.RWMutex
+	certs    map[string]IssuedCert
+	reserved map[string]bool
+	modTime  time.Time
+}
+
+func OpenCertDB(path string) (*CertDB, error) {
+	db := &CertDB{path: path, certs: make(map[string]IssuedCert), reserved: make(map[string]bool)}
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// load reads the file into db.certs; the caller holds db.mu. Entries only
+// in memory are kept.
+func (db *CertDB) load() error {
+	modTime := fileModTime(db.path)
+	data, err := os.ReadFile(db.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []IssuedCert
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("parse %s: %w", db.path, err)
+	}
+	for _, c := range list {
+		db.certs[c.Issuer+"/"+c.Serial] = c
+	}
+	db.modTime = modTime
+	return nil
+}
+
+// refresh picks up entries another process wrote since the last read.
+func (db *CertDB) refresh() {
+	db.mu.RLock()
+	changed := !fileModTime(db.path).Equal(db.modTime)
+	db.mu.RUnlock()
+	if !changed {
+		return
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.load(); err != nil {
+		// Keep what we have until the file changes again.
+		db.modTime = fileModTime(db.path)
+		slog.Error("Reloading the certificate database failed", "component", "db", "error", err)
+	}
+}
+
+// newSerial picks a random serial that no certificate of issuer, the
+// subject key ID of a CA in hex, has. It is held until release, so a
+// certificate being signed at the same time doesn't get it either.
+func (db *CertDB) newSerial(issuer string) (*big.Int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !fileModTime(db.path).Equal(db.modTime) {
+		if err := db.load(); err != nil {
+			return nil, err
+		}
+	}
+	for {
+		serial, err := randomSerial()
+		if err != nil {
+			return nil, err
+		}
+		key := issuer + "/" + serial.Text(16)
+		if _, used := db.certs[key]; used || db.reserved[key] {
+			continue
+		}
+		db.reserved[key] = true
+		return serial, nil
+	}
+}
+
+// release gives up a serial from newSerial once its certificate is
+// recorded or won't be.
+func (db *CertDB) release(issuer string, serial *big.Int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.reserved, issuer+"/"+serial.Text(16))
+}
+
+// add records cert and returns its entry, and the serial of the live
+// certificate it replaces, the latest one its requester had for the same
+// service and usage, if any. A serial the file already has for the CA,
+// which another process could only have picked by chance, is refused, so
+// the certificate is never handed out.
+func (db *CertDB) add(req certRequest, cert *x509.Certificate) (IssuedCert, string, error) {
+	c := IssuedCert{
+		Serial:    cert.SerialNumber.Text(16),
+		Issuer:    hex.EncodeToString(cert.AuthorityKeyId),
+		Service:   req.Service,
+		Subject:   cert.Subject.String(),
+		DNSNames:  cert.DNSNames,
+		Usage:     req.Usage,
+		Requester: req.Requester,
+		IssuedAt:  time.Now().UTC(),
+		NotAfter:  cert.NotAfter,
+	}
+	for _, u := range cert.URIs {
+		c.URIs = append(c.URIs, u.String())
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !fileModTime(db.path).Equal(db.modTime) {
+		if err := db.load(); err != nil {
+			return IssuedCert{}, "", err
+		}
+	}
+	if _, used := db.certs[c.Issuer+"/"+c.Serial]; used {
+		return IssuedCert{}, "", fmt.Errorf("serial %s is already in use", c.Serial)
+	}
+	var previous IssuedCert
+	for _, p := range db.certs {
+		if p.Service == c.Service && p.Usage == c.Usage && p.Requester == c.Requester &&
+			c.IssuedAt.Before(p.NotAfter) && p.IssuedAt.After(previous.IssuedAt) {
+			previous = p
+		}
+	}
+	db.certs[c.Issuer+"/"+c.Serial] = c
+	list := slices.SortedFunc(maps.Values(db.certs), func(a, b IssuedCert) int { return a.IssuedAt.Compare(b.IssuedAt) })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return IssuedCert{}, "", err
+	}
+	if err := writeFileAtomic(db.path, data, 0644); err != nil {
+		return IssuedCert{}, "", err
+	}
+	db.modTime = fileModTime(db.path)
+	return c, previous.Serial, nil
+}
+
+// lookup finds a certificate by the subject key ID of its CA and its serial,
+// both in hex.
+func (db *CertDB) lookup(issuer, serial string) (IssuedCert, bool) {
+	db.refresh()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	c, ok := db.certs[issuer+"/"+serial]
+	return c, ok
+}
+
+// list returns the certificates match accepts, soonest expiry first.
+func (db *CertDB) list(match func(IssuedCert) bool) []IssuedCert {
+	db.refresh()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var list []IssuedCert
+	for _, c := range db.certs {
+		if match(c) {
+			list = append(list, c)
+		}
+	}
+	slices.SortFunc(list, func(a, b IssuedCert) int { return a.NotAfter.Compare(b.NotAfter) })
+	return list
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"cmp"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// listFlag collects a flag given several times or as a comma-separated list.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for item := range strings.SplitSeq(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// cli is the CA as the commands other than init and serve find it: created
+// earlier, in the configured store. Commands close its events before they
+// exit, so the ones they caused are sent.
+type cli struct {
+	cfg    Config
+	certs  SecretStore
+	issuer *Issuer
+	crl    *CRLPublisher
+}
+
+func openCLI(fs *flag.FlagSet, args []string) (*cli, error) {
+	cfg, err := loadConfig(os.Getenv("CA_CONFIG"), fs, args)
+	if err != nil {
+		return nil, err
+	}
+	db, err := OpenCertDB(filepath.Join(cfg.Dir, "issued.json"))
+	if err != nil {
+		return nil, err
+	}
+	caStore, certStore, err := openStores(cfg)
+	if err != nil {
+		return nil, err
+	}
+	issuer, err := openIssuer(cfg, db, caStore)
+	if err != nil {
+		return nil, err
+	}
+	certStore, err = serviceStore(cfg, certStore, issuer)
+	if err != nil {
+		return nil, err
+	}
+	issuer.events = NewEventNotifier(cfg.Events, meshClient(issuer, certStore, cfg.clientCertName()))
+	crl := NewCRLPublisher(issuer, filepath.Join(cfg.Dir, "revoked.json"), filepath.Join(cfg.Dir, "ca.crl"), cfg.CRLValidity)
+	return &cli{cfg: cfg, certs: certStore, issuer: issuer, crl: crl}, nil
+}
+
+// cliRequester is who the database records as having asked for a
+// certificate or revocation from the command line.
+func cliRequester() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return "cli:" + u.Username
+	}
+	return "cli"
+}
+
+func runInit(args []string) error {
+	fs := newFlagSet("init", "", "Create the CA and write ca.crt and an empty CRL. In intermediate mode, create the root in -root-dir\nif there is none and sign a new intermediate CA.")
+	force := fs.Bool("force", false, "replace an existing root CA; the certificates it issued are no longer trusted")
+	cfg, err := loadConfig(os.Getenv("CA_CONFIG"), fs, args)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return err
+	}
+	db, err := OpenCertDB(filepath.Join(cfg.Dir, "issued.json"))
+	if err != nil {
+		return err
+	}
+	caStore, _, err := openStores(cfg)
+	if err != nil {
+		return err
+	}
+	if !cfg.Intermediate && !*force {
+		_, _, err := caStore.Load("ca")
+		if err == nil {
+			return fmt.Errorf("a CA already exists; use -force to replace it")
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	issuer, err := newIssuer(cfg, db, caStore, *force || cfg.Intermediate)
+	if err != nil {
+		return err
+	}
+	crl := NewCRLPublisher(issuer, filepath.Join(cfg.Dir, "revoked.json"), filepath.Join(cfg.Dir, "ca.crl"), cfg.CRLValidity)
+	if err := crl.publish(); err != nil {
+		return err
+	}
+	fmt.Printf("Created CA %s, serial %x, expires %s; peers trust %s\n",
+		issuer.cert.Subject.CommonName, issuer.cert.SerialNumber, issuer.cert.NotAfter.Format(time.DateOnly), filepath.Join(cfg.Dir, "ca.crt"))
+	return nil
+}
+
+func runIssue(args []string) error {
+	fs := newFlagSet("issue", "", "Issue a certificate with a new key for one service. Without -dns a known service gets its configured\nnames and addresses, another <service> and <service>.<domain> for each allowed domain.")
+	service := fs.String("service", "", "service name, the CN and SPIFFE ID of the certificate (required)")
+	var dns, ips listFlag
+	fs.Var(&dns, "dns", "DNS name, repeated or comma-separated")
+	fs.Var(&ips, "ip", "IP address, repeated or comma-separated")
+	usage := fs.String("usage", "", "server, client or dual (default: as configured, or dual)")
+	out := fs.String("out", "", "write <service>.crt and <service>.key to this directory instead of the store")
+	c, err := openCLI(fs, args)
+	if err != nil {
+		return err
+	}
+	defer c.issuer.events.Close()
+	if !serviceName.MatchString(*service) {
+		return fmt.Errorf("-service: %q is not a service name", *service)
+	}
+	policy := Policy{Services: c.cfg.Services, Domains: c.cfg.AllowedDomains}
+	req := policy.request(*service, cliRequester(), dns, nil, *usage)
+	if len(ips) > 0 {
+		req.IPAddresses = ips
+	}
+	for _, ip := range req.IPAddresses {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("-ip: %q is not an IP address", ip)
+		}
+	}
+	if req.Usage != usageServer && req.Usage != usageClient && req.Usage != usageDual {
+		return fmt.Errorf("-usage: unknown usage %q, want server, client or dual", req.Usage)
+	}
+
+	store, where := c.certs, "the store"
+	if *out != "" {
+		if err := os.MkdirAll(*out, 0755); err != nil {
+			return err
+		}
+		store, where = FileStore{dir: *out, keyPerm: 0600}, *out
+	}
+	key, err := generateKey(c.cfg.LeafKey)
+	if err != nil {
+		return err
+	}
+	cert, err := c.issuer.issue(req, key.Public())
+	if err != nil {
+		return err
+	}
+	if err := storeKeyPair(store, *service, cert, key); err != nil {
+		return err
+	}
+	fmt.Printf("Issued %s: serial %x, names %v, expires %s, written to %s\n",
+		*service, cert.SerialNumber, req.DNSNames, cert.NotAfter.Format(time.DateOnly), where)
+	return nil
+}
+
+func runRenew(args []string) error {
+	fs := newFlagSet("renew", "", "Issue new certificates and keys for configured services, as the running CA does when they are due.")
+	all := fs.Bool("all", false, "renew every configured service")
+	due := fs.Bool("due", false, "renew only certificates that are due, missing, revoked or out of date")
+	var services listFlag
+	fs.Var(&services, "service", "service to renew, or <service>-client for its client certificate; repeated or comma-separated")
+	c, err := openCLI(fs, args)
+	if err != nil {
+		return err
+	}
+	defer c.issuer.events.Close()
+	if *all && *due || (*all || *due) == (len(services) > 0) {
+		return fmt.Errorf("want exactly one of -all, -due and -service")
+	}
+	if err := c.crl.publish(); err != nil {
+		return err
+	}
+	renewer := NewRenewer(c.issuer, c.crl, c.certs, c.cfg.Services, c.cfg.RenewAt, c.cfg.LeafKey)
+	if *due {
+		return renewer.renewDue(time.Now())
+	}
+	if *all {
+		services = slices.Sorted(maps.Keys(managedCerts(c.cfg.Services)))
+	}
+	var errs []error
+	for _, service := range services {
+		if !renewer.manages(service) {
+			errs = append(errs, fmt.Errorf("%s is not a configured service or client certificate; use ca issue", service))
+			continue
+		}
+		if err := renewer.renew(service); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", service, err))
+			continue
+		}
+		r := renewer.current(service)
+		fmt.Printf("Renewed %s: serial %s, expires %s\n", service, r.Serial, r.NotAfter.Format(time.DateOnly))
+	}
+	return errors.Join(errs...)
+}
+
+func runRevoke(args []string) error {
+	fs := newFlagSet("revoke", "", "Revoke a certificate of the current CA and publish a new CRL. A running CA picks it up within\n10 seconds; run ca renew -due to replace a certificate the CA manages right away.")
+	serialFlag := fs.String("serial", "", "hex serial number, colons allowed (required)")
+	reason := fs.String("reason", "unspecified", "RFC 5280 reason, such as keyCompromise or superseded")
+	comment := fs.String("comment", "", "note recorded in revoked.json")
+	c, err := openCLI(fs, args)
+	if err != nil {
+		return err
+	}
+	defer c.issuer.events.Close()
+	serial, ok := parseSerial(*serialFlag)
+	if !ok {
+		return fmt.Errorf("-serial: want a hex serial number")
+	}
+	if _, ok := revocationReasons[*reason]; !ok {
+		return fmt.Errorf("-reason: unknown reason %q", *reason)
+	}
+	cert, ok := c.issuer.db.lookup(hex.EncodeToString(c.issuer.cert.SubjectKeyId), serial)
+	if !ok {
+		return fmt.Errorf("no certificate with serial %s from the current CA", serial)
+	}
+	rev := Revocation{
+		Serial:    cert.Serial,
+		RevokedAt: time.Now().UTC(),
+		Reason:    *reason,
+		Service:   cert.Service,
+		RevokedBy: cliRequester(),
+		Comment:   *comment,
+	}
+	if err := c.crl.revoke(rev); err != nil {
+		return err
+	}
+	slog.Info("Revoked a certificate", "component", "revoke", "by", rev.RevokedBy, "serial", rev.Serial, "service", rev.Service, "reason", rev.Reason, "comment", rev.Comment)
+	return nil
+}
+
+// runList only reads the database and revoked.json, so it doesn't need
+// access to the CA's key.
+func runList(args []string) error {
+	fs := newFlagSet("list", "", "List issued certificates, soonest expiry first, like GET /certs.")
+	service := fs.String("service", "", "only this service")
+	within := fs.Duration("expiring-within", 0, "only certificates that expire within this time, such as 720h")
+	expired := fs.Bool("expired", false, "include expired certificates")
+	asJSON := fs.Bool("json", false, "print JSON as GET /certs does")
+	cfg, err := loadConfig(os.Getenv("CA_CONFIG"), fs, args)
+	if err != nil {
+		return err
+	}
+	db, err := OpenCertDB(filepath.Join(cfg.Dir, "issued.json"))
+	if err != nil {
+		return err
+	}
+	revocations, err := readRevocations(filepath.Join(cfg.Dir, "revoked.json"))
+	if err != nil {
+		return err
+	}
+	certs := db.list(certFilter(*service, *within, *expired, time.Now()))
+	entries := make([]certEntry, len(certs))
+	for i, c := range certs {
+		revoked := slices.ContainsFunc(revocations, func(r Revocation) bool { return strings.EqualFold(r.Serial, c.Serial) })
+		entries[i] = certEntry{IssuedCert: c, Revoked: revoked}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERIAL\tSERVICE\tUSAGE\tNOT AFTER\tSTATUS\tREQUESTER\tNAMES")
+	for _, e := range entries {
+		status := "valid"
+		switch {
+		case e.Revoked:
+			status = "revoked"
+		case !time.Now().Before(e.NotAfter):
+			status = "expired"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Serial, e.Service, cmp.Or(e.Usage, "-"), e.NotAfter.Format(time.RFC3339), status, e.Requester, strings.Join(e.DNSNames, ","))
+	}
+	return w.Flush()
+}
+
+// runRotate leaves the CA ready to start under the new root; a CA that is
+// still running keeps signing under the previous one until it restarts.
+func runRotate(args []string) error {
+	fs := newFlagSet("rotate", "", "Replace the root CA with a new one, cross-signed by the current root, and reissue the service\ncertificates under it. ca.crt has both roots for -rotation-grace; restart every peer that reads it\nwithin that time. Stop the CA first and start it again afterwards.")
+	cfg, err := loadConfig(os.Getenv("CA_CONFIG"), fs, args)
+	if err != nil {
+		return err
+	}
+	db, err := OpenCertDB(filepath.Join(cfg.Dir, "issued.json"))
+	if err != nil {
+		return err
+	}
+	caStore, certStore, err := openStores(cfg)
+	if err != nil {
+		return err
+	}
+	issuer, err := rotate(cfg, db, caStore)
+	if err != nil {
+		return err
+	}
+	certStore, err = serviceStore(cfg, certStore, issuer)
+	if err != nil {
+		return err
+	}
+	issuer.events = NewEventNotifier(cfg.Events, meshClient(issuer, certStore, cfg.clientCertName()))
+	defer issuer.events.Close()
+	crl := NewCRLPublisher(issuer, filepath.Join(cfg.Dir, "revoked.json"), filepath.Join(cfg.Dir, "ca.crl"), cfg.CRLValidity)
+	if err := crl.publish(); err != nil {
+		return err
+	}
+	renewer := NewRenewer(issuer, crl, certStore, cfg.Services, cfg.RenewAt, cfg.LeafKey)
+	if err := renewer.renewDue(time.Now()); err != nil {
+		return err
+	}
+	fmt.Printf("Rotated to root serial %x, expires %s; %s trusts the previous root too until %s\n",
+		issuer.root.SerialNumber, issuer.root.NotAfter.Format(time.DateOnly), filepath.Join(cfg.Dir, "ca.crt"), issuer.rotation.RetireAt.Format(time.RFC3339))
+	return nil
+}
+
+func runToken(args []string) error {
+	fs := newFlagSet("token", "", "Print a JWT for a service, as POST /token issues it to the service itself.")
+	service := fs.String("service", "", "service the token is for; its SPIFFE ID is the subject (required)")
+	audience := fs.String("audience", "", "service that accepts the token (required)")
+	cfg, err := loadConfig(os.Getenv("CA_CONFIG"), fs, args)
+	if err != nil {
+		return err
+	}
+	if !cfg.Tokens.Enabled {
+		return fmt.Errorf("tokens are not enabled (tokens.enabled, CA_TOKENS_ENABLED)")
+	}
+	if !serviceName.MatchString(*service) {
+		return fmt.Errorf("-service: %q is not a service name", *service)
+	}
+	caStore, _, err := openStores(cfg)
+	if err != nil {
+		return err
+	}
+	tokens, err := NewTokenIssuer(cfg.Tokens, cfg.Services, caStore, cfg.CAKey, cfg.CALifetime)
+	if err != nil {
+		return err
+	}
+	if !tokens.allowed(*audience) {
+		return fmt.Errorf("-audience: tokens are not issued for %q", *audience)
+	}
+	token, _, err := tokens.mint(spiffeID(*service).String(), *audience)
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
+
+func runBootstrapToken(args []string) error {
+	fs := newFlagSet("bootstrap-token", "", "Create a one-time token a new workload gets its first certificate with from the bootstrap gRPC port,\nand print it with the hash of the root to pin, as the sidecar's environment.")
+	service := fs.String("service", "", "service the token gets certificates for (required)")
+	lifetime := fs.Duration("lifetime", 0, "how long the token may be used (default: bootstrap.token_lifetime)")
+	cfg, err := loadConfig(os.Getenv("CA_CONFIG"), fs, args)
+	if err != nil {
+		return err
+	}
+	if !cfg.Bootstrap.Enabled {
+		return fmt.Errorf("bootstrap is not enabled (bootstrap.enabled, CA_BOOTSTRAP_ENABLED)")
+	}
+	if !serviceName.MatchString(*service) {
+		return fmt.Errorf("-service: %q is not a service name", *service)
+	}
+	if *lifetime <= 0 {
+		*lifetime = cfg.Bootstrap.TokenLifetime
+	}
+	db, err := OpenCertDB(filepath.Join(cfg.Dir, "issued.json"))
+	if err != nil {
+		return err
+	}
+	caStore, _, err := openStores(cfg)
+	if err != nil {
+		return err
+	}
+	issuer, err := openIssuer(cfg, db, caStore)
+	if err != nil {
+		return err
+	}
+	tokens := NewBootstrapTokens(filepath.Join(cfg.Dir, "bootstrap-tokens.json"))
+	token, t, err := tokens.create(*service, cliRequester(), *lifetime)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("SIDECAR_BOOTSTRAP_SERVICE=%s\nSIDECAR_BOOTSTRAP_TOKEN=%s\nSIDECAR_BOOTSTRAP_CA_HASH=%s\n", *service, token, caHash(issuer.root))
+	fmt.Fprintf(os.Stderr, "Token %s for %s expires %s\n", t.ID, *service, t.Expires.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the CA's settings: defaults, then the environment, then the
+// YAML file in CA_CONFIG, then command-line flags.
+type Config struct {
+	Dir                  string          `yaml:"dir"`
+	Port                 string          `yaml:"port"`
+	CALifetime           time.Duration   `yaml:"ca_lifetime"`
+	Intermediate         bool            `yaml:"intermediate"`
+	IntermediateLifetime time.Duration   `yaml:"intermediate_lifetime"`
+	RootDir              string          `yaml:"root_dir"`
+	RotationGrace        time.Duration   `yaml:"rotation_grace"`
+	LeafLifetime         time.Duration   `yaml:"leaf_lifetime"`
+	CAKey                KeyConfig       `yaml:"ca_key"`
+	LeafKey              KeyConfig       `yaml:"leaf_key"`
+	RenewAt              float64         `yaml:"renew_at"`
+	RenewCheckInterval   time.Duration   `yaml:"renew_check_interval"`
+	CRLValidity          time.Duration   `yaml:"crl_validity"`
+	CRLInterval          time.Duration   `yaml:"crl_interval"`
+	OCSPURL              string          `yaml:"ocsp_url"`
+	OCSPValidity         time.Duration   `yaml:"ocsp_validity"`
+	AdminClients         []string        `yaml:"admin_clients"`
+	AllowedDomains       []string        `yaml:"allowed_domains"`
+	ACME                 ACMEConfig      `yaml:"acme"`
+	Store                StoreConfig     `yaml:"store"`
+	PKCS12               PKCS12Config    `yaml:"pkcs12"`
+	Alerts               AlertConfig     `yaml:"alerts"`
+	Events               EventConfig     `yaml:"events"`
+	Tokens               TokenConfig     `yaml:"tokens"`
+	Bootstrap            BootstrapConfig `yaml:"bootstrap"`
+	SANs                 SANConfig       `yaml:"sans"`
+
+	Services map[string]ServiceConfig `yaml:"services"`
+}
+
+// ServiceConfig is what the CA puts in a known service's certificate. The
+// CA keeps these certificates current itself and, through /sign and ACME,
+// issues the service no other names. With ClientCert, a service whose own
+// certificate is for serving also gets <name>-client, with its identity and
+// client usage only, for the connections it makes.
+type ServiceConfig struct {
+	DNSNames    []string `yaml:"dns_names"`
+	IPAddresses []string `yaml:"ip_addresses"`
+	Usage       string   `yaml:"usage"`
+	ClientCert  bool     `yaml:"client_cert"`
+}
+
+// Extended key usages a service certificate may be issued for.
+const (
+	usageServer = "server"
+	usageClient = "client"
+	usageDual   = "dual"
+)
+
+// defaultServices are the services of docker-compose, used when the config
+// file lists none.
+var defaultServices = map[string]ServiceConfig{
+	"app1":         {DNSNames: []string{"app1", "app1-sidecar", "app1.notes.internal", "app1-sidecar.notes.internal", "app1.notes_network"}},
+	"app2":         {DNSNames: []string{"app2", "app2-sidecar", "app2.notes.internal", "app2-sidecar.notes.internal", "app2.notes_network"}},
+	"app3":         {DNSNames: []string{"app3", "app3-sidecar", "app3.notes.internal", "app3-sidecar.notes.internal", "app3.notes_network"}},
+	"email":        {DNSNames: []string{"email", "email-sidecar", "email.notes.internal", "email-sidecar.notes.internal", "email.notes_network"}},
+	"loadbalancer": {DNSNames: []string{"loadbalancer", "loadbalancer.notes.internal", "loadbalancer.notes_network"}},
+	"ca-service":   {DNSNames: []string{"ca-service", "ca-service.notes.internal", "ca-service.notes_network"}},
+}
+
+// Where the CA keeps its key and publishes service certificates and keys.
+const (
+	storeFiles      = "files"
+	storeVault      = "vault"
+	storeKubernetes = "kubernetes"
+)
+
+// StoreConfig picks the SecretStore. With files, pairs are PEM files in
+// Dir; the other types leave only public files (ca.crt, the CRL, the
+// database) there.
+type StoreConfig struct {
+	Type       string           `yaml:"type"`
+	Vault      VaultConfig      `yaml:"vault"`
+	Kubernetes KubernetesConfig `yaml:"kubernetes"`
+}
+
+// ACMEConfig enables the ACME endpoint. Challenges are checked on TLSPort
+// (tls-alpn-01) or HTTPPort (http-01) of the name being validated.
+type ACMEConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	TLSPort  string `yaml:"tls_port"`
+	HTTPPort string `yaml:"http_port"`
+}
+
+// KeyConfig is the kind of key to generate. Unset fields of the service
+// key config are taken from the CA's.
+type KeyConfig struct {
+	Type    string `yaml:"type"`
+	RSABits int    `yaml:"rsa_bits"`
+	Curve   string `yaml:"curve"`
+}
+
+// clientCertName is the pair the CA presents when it calls other services:
+// its client certificate if ca-service has one, or else its own.
+func (c Config) clientCertName() string {
+	if c.Services["ca-service"].ClientCert {
+		return "ca-service" + clientCertSuffix
+	}
+	return "ca-service"
+}
+
+func (k KeyConfig) or(parent KeyConfig) KeyConfig {
+	if k.Type == "" {
+		k.Type = parent.Type
+	}
+	if k.RSABits == 0 {
+		k.RSABits = parent.RSABits
+	}
+	if k.Curve == "" {
+		k.Curve = parent.Curve
+	}
+	return k
+}
+
+func configFromEnv() Config {
+	return Config{
+		Dir:                  getEnv("CA_DIR", "/certs"),
+		Port:                 getEnv("CA_PORT", "8443"),
+		CALifetime:           getEnvDuration("CA_LIFETIME", 365*24*time.Hour),
+		LeafLifetime:         getEnvDuration("CA_LEAF_LIFETIME", 90*24*time.Hour),
+		Intermediate:         getEnvBool("CA_INTERMEDIATE", false),
+		IntermediateLifetime: getEnvDuration("CA_INTERMEDIATE_LIFETIME", 180*24*time.Hour),
+		RootDir:              os.Getenv("CA_ROOT_DIR"),
+		RotationGrace:        getEnvDuration("CA_ROTATION_GRACE", 7*24*time.Hour),
+		CAKey: KeyConfig{
+			Type:    getEnv("CA_KEY_TYPE", keyRSA),
+			RSABits: getEnvInt("CA_RSA_BITS", 2048),
+			Curve:   getEnv("CA_ECDSA_CURVE", "P-256"),
+		},
+		LeafKey: KeyConfig{
+			Type:    os.Getenv("CA_LEAF_KEY_TYPE"),
+			RSABits: getEnvInt("CA_LEAF_RSA_BITS", 0),
+			Curve:   os.Getenv("CA_LEAF_ECDSA_CURVE"),
+		},
+		RenewAt:            getEnvFloat("CA_RENEW_AT", 2.0/3),
+		RenewCheckInterval: getEnvDuration("CA_RENEW_CHECK_INTERVAL", time.Hour),
+		CRLValidity:        getEnvDuration("CA_CRL_VALIDITY", 24*time.Hour),
+		CRLInterval:        getEnvDuration("CA_CRL_INTERVAL", time.Hour),
+		OCSPURL:            getEnv("CA_OCSP_URL", "https://ca-service:8443/ocsp"),
+		OCSPValidity:       getEnvDuration("CA_OCSP_VALIDITY", time.Hour),
+		AdminClients:       envList("CA_ADMIN_CLIENTS", ""),
+		AllowedDomains:     envList("CA_ALLOWED_DOMAINS", "notes.internal"),
+		ACME: ACMEConfig{
+			Enabled:  getEnvBool("CA_ACME_ENABLED", false),
+			TLSPort:  getEnv("CA_ACME_TLS_PORT", "443"),
+			HTTPPort: getEnv("CA_ACME_HTTP_PORT", "80"),
+		},
+		Tokens: TokenConfig{
+			Enabled:   getEnvBool("CA_TOKENS_ENABLED", false),
+			Issuer:    getEnv("CA_TOKEN_ISSUER", "https://ca-service:8443"),
+			Lifetime:  getEnvDuration("CA_TOKEN_LIFETIME", 15*time.Minute),
+			Audiences: envList("CA_TOKEN_AUDIENCES", ""),
+		},
+		Bootstrap: BootstrapConfig{
+			Enabled:       getEnvBool("CA_BOOTSTRAP_ENABLED", false),
+			Port:          getEnv("CA_BOOTSTRAP_PORT", "9443"),
+			TokenLifetime: getEnvDuration("CA_BOOTSTRAP_TOKEN_LIFETIME", 24*time.Hour),
+		},
+		SANs: SANConfig{
+			IPRanges:   envList("CA_SAN_IP_RANGES", ""),
+			Wildcards:  getEnvBool("CA_SAN_WILDCARDS", false),
+			Requesters: envList("CA_SAN_REQUESTERS", ""),
+		},
+		Store: StoreConfig{
+			Type: getEnv("CA_STORE", storeFiles),
+			Vault: VaultConfig{
+				Address:   getEnv("CA_VAULT_ADDR", os.Getenv("VAULT_ADDR")),
+				TokenFile: os.Getenv("CA_VAULT_TOKEN_FILE"),
+				Mount:     getEnv("CA_VAULT_MOUNT", "secret"),
+				Path:      getEnv("CA_VAULT_PATH", "notes-ca"),
+				CACert:    os.Getenv("CA_VAULT_CA_CERT"),
+			},
+			Kubernetes: KubernetesConfig{
+				Namespace:    getEnv("CA_K8S_NAMESPACE", serviceAccountNamespace()),
+				SecretPrefix: getEnv("CA_K8S_SECRET_PREFIX", "notes-"),
+			},
+		},
+		PKCS12: PKCS12Config{
+			Enabled:      getEnvBool("CA_PKCS12", false),
+			PasswordFile: os.Getenv("CA_PKCS12_PASSWORD_FILE"),
+			Legacy:       getEnvBool("CA_PKCS12_LEGACY", false),
+		},
+		Alerts: AlertConfig{
+			Threshold:  getEnvDuration("CA_ALERT_THRESHOLD", 14*24*time.Hour),
+			Interval:   getEnvDuration("CA_ALERT_INTERVAL", time.Hour),
+			Webhook:    os.Getenv("CA_ALERT_WEBHOOK"),
+			EmailURL:   os.Getenv("CA_ALERT_EMAIL_URL"),
+			EmailTo:    envList("CA_ALERT_EMAIL_TO", ""),
+			EmailToken: os.Getenv("CA_ALERT_EMAIL_TOKEN"),
+		},
+		Events: EventConfig{
+			Webhook:    os.Getenv("CA_EVENTS_WEBHOOK"),
+			EmailURL:   os.Getenv("CA_EVENTS_EMAIL_URL"),
+			EmailTo:    envList("CA_EVENTS_EMAIL_TO", ""),
+			EmailToken: os.Getenv("CA_EVENTS_EMAIL_TOKEN"),
+		},
+	}
+}
+
+// loadConfig reads the environment, the file at path if it is set, and
+// flags from args, each on top of the one before. The config flags are
+// added to fs, which may already hold those of a command. Unknown keys in
+// the file are errors, so typos don't go unnoticed. Services listed in the
+// file replace the default ones rather than add to them.
+func loadConfig(path string, fs *flag.FlagSet, args []string) (Config, error) {
+	cfg := configFromEnv()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return Config{}, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+
+	fs.StringVar(&cfg.Dir, "dir", cfg.Dir, "directory for the CA, service certificates, CRL and database")
+	fs.DurationVar(&cfg.CALifetime, "ca-lifetime", cfg.CALifetime, "validity of the CA certificate")
+	fs.DurationVar(&cfg.LeafLifetime, "leaf-lifetime", cfg.LeafLifetime, "validity of service certificates")
+	fs.BoolVar(&cfg.Intermediate, "intermediate", cfg.Intermediate, "sign with an intermediate CA under a root kept in -root-dir")
+	fs.DurationVar(&cfg.IntermediateLifetime, "intermediate-lifetime", cfg.IntermediateLifetime, "validity of the intermediate CA certificate")
+	fs.StringVar(&cfg.RootDir, "root-dir", cfg.RootDir, "directory of the root CA in intermediate mode")
+	fs.DurationVar(&cfg.RotationGrace, "rotation-grace", cfg.RotationGrace, "how long peers trust the previous root after ca rotate")
+	fs.StringVar(&cfg.CAKey.Type, "key-type", cfg.CAKey.Type, "CA key type: rsa or ecdsa")
+	fs.IntVar(&cfg.CAKey.RSABits, "rsa-bits", cfg.CAKey.RSABits, "CA RSA key size")
+	fs.StringVar(&cfg.CAKey.Curve, "curve", cfg.CAKey.Curve, "CA ECDSA curve: P-256, P-384 or P-521")
+	fs.StringVar(&cfg.LeafKey.Type, "leaf-key-type", cfg.LeafKey.Type, "service key type: rsa, ecdsa or ed25519 (default: as the CA)")
+	fs.IntVar(&cfg.LeafKey.RSABits, "leaf-rsa-bits", cfg.LeafKey.RSABits, "service RSA key size (default: as the CA)")
+	fs.StringVar(&cfg.LeafKey.Curve, "leaf-curve", cfg.LeafKey.Curve, "service ECDSA curve (default: as the CA)")
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	cfg.LeafKey = cfg.LeafKey.or(cfg.CAKey)
+	if len(cfg.Services) == 0 {
+		cfg.Services = maps.Clone(defaultServices)
+	}
+	for name, svc := range cfg.Services {
+		if svc.Usage == "" {
+			svc.Usage = usageDual
+			cfg.Services[name] = svc
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	checkKey := func(k KeyConfig, key string, ca bool) {
+		err := validKeyType(k.Type, ca)
+		check(err == nil, "%s.type: %v", key, err)
+		check(k.Type != keyRSA || k.RSABits >= 2048 && k.RSABits <= 8192, "%s.rsa_bits must be between 2048 and 8192, got %d", key, k.RSABits)
+		_, ok := curves[k.Curve]
+		check(k.Type != keyECDSA || ok, "%s.curve: unknown curve %q, want P-256, P-384 or P-521", key, k.Curve)
+	}
+
+	check(c.Dir != "", "dir (CA_DIR) is required")
+	check(c.Port != "", "port (CA_PORT) is required")
+	check(c.CALifetime > 0 && c.LeafLifetime > 0, "ca_lifetime and leaf_lifetime must be positive")
+	check(c.RotationGrace > 0, "rotation_grace must be positive")
+	if c.Intermediate {
+		check(c.RootDir != "" && filepath.Clean(c.RootDir) != filepath.Clean(c.Dir), "intermediate needs a root_dir (CA_ROOT_DIR) other than dir")
+		check(c.LeafLifetime < c.IntermediateLifetime, "leaf_lifetime (%s) must be shorter than intermediate_lifetime (%s)", c.LeafLifetime, c.IntermediateLifetime)
+		check(c.IntermediateLifetime <= c.CALifetime, "intermediate_lifetime (%s) must not be longer than ca_lifetime (%s)", c.IntermediateLifetime, c.CALifetime)
+	} else {
+		check(c.LeafLifetime < c.CALifetime, "leaf_lifetime (%s) must be shorter than ca_lifetime (%s)", c.LeafLifetime, c.CALifetime)
+	}
+	checkKey(c.CAKey, "ca_key", true)
+	checkKey(c.LeafKey, "leaf_key", false)
+	check(c.RenewAt > 0 && c.RenewAt < 1, "renew_at must be between 0 and 1, got %g", c.RenewAt)
+	check(c.RenewCheckInterval > 0, "renew_check_interval must be positive")
+	window := time.Duration(float64(c.LeafLifetime) * (1 - c.RenewAt))
+	check(c.RenewAt >= 1 || c.RenewCheckInterval < window,
+		"renew_check_interval (%s) must be shorter than the %s between renewal and expiry, or certificates expire before they are renewed", c.RenewCheckInterval, window)
+	check(c.CRLInterval > 0, "crl_interval must be positive")
+	check(c.CRLValidity > c.CRLInterval, "crl_validity must be longer than crl_interval, or the CRL expires before the next one")
+	check(c.OCSPValidity > 0, "ocsp_validity must be positive")
+	if c.ACME.Enabled {
+		_, errTLS := strconv.ParseUint(c.ACME.TLSPort, 10, 16)
+		_, errHTTP := strconv.ParseUint(c.ACME.HTTPPort, 10, 16)
+		check(errTLS == nil && errHTTP == nil, "acme.tls_port and acme.http_port must be port numbers")
+	}
+	if c.Bootstrap.Enabled {
+		_, err := strconv.ParseUint(c.Bootstrap.Port, 10, 16)
+		check(err == nil && c.Bootstrap.Port != c.Port, "bootstrap.port (CA_BOOTSTRAP_PORT) must be a port number other than port, got %q", c.Bootstrap.Port)
+	}
+	check(c.Bootstrap.TokenLifetime > 0, "bootstrap.token_lifetime (CA_BOOTSTRAP_TOKEN_LIFETIME) must be positive")
+	for _, cidr := range c.SANs.IPRanges {
+		_, _, err := net.ParseCIDR(cidr)
+		check(err == nil, "sans.ip_ranges (CA_SAN_IP_RANGES): %q is not a CIDR like 172.16.0.0/12", cidr)
+	}
+	ca, ok := c.Services["ca-service"]
+	check(ok, "services: ca-service is required, its certificate serves the CA's own port")
+	check(!ok || ca.Usage != usageClient, "services.ca-service.usage: the certificate serves the CA's own port, it can't be client-only")
+	for _, name := range slices.Sorted(maps.Keys(c.Services)) {
+		svc := c.Services[name]
+		check(serviceName.MatchString(name), "services: %q is not a service name", name)
+		check(len(svc.DNSNames) > 0, "services.%s.dns_names: at least one name is required", name)
+		for _, dns := range svc.DNSNames {
+			check(validDNSName(dns), "services.%s.dns_names: %q is not a DNS name or a wildcard like *.%s.notes.internal", name, dns, name)
+		}
+		for _, ip := range svc.IPAddresses {
+			check(net.ParseIP(ip) != nil, "services.%s.ip_addresses: %q is not an IP address", name, ip)
+		}
+		check(svc.Usage == usageServer || svc.Usage == usageClient || svc.Usage == usageDual, "services.%s.usage: unknown usage %q, want server, client or dual", name, svc.Usage)
+		if svc.ClientCert {
+			_, clash := c.Services[name+clientCertSuffix]
+			check(svc.Usage != usageClient, "services.%s.client_cert: the certificate is client-only already", name)
+			check(!clash, "services.%s.client_cert: %s%s is a service of its own", name, name, clientCertSuffix)
+		}
+	}
+	switch c.Store.Type {
+	case storeFiles:
+	case storeVault:
+		v := c.Store.Vault
+		check(strings.HasPrefix(v.Address, "https://") || strings.HasPrefix(v.Address, "http://"), "store.vault.address (CA_VAULT_ADDR) must be an http or https URL, got %q", v.Address)
+		check(v.TokenFile != "" || os.Getenv("VAULT_TOKEN") != "", "store.vault needs a token_file (CA_VAULT_TOKEN_FILE) or VAULT_TOKEN")
+		check(v.Mount != "" && v.Path != "", "store.vault.mount and store.vault.path are required")
+	case storeKubernetes:
+		check(c.Store.Kubernetes.Namespace != "", "store.kubernetes.namespace (CA_K8S_NAMESPACE) is required outside a pod")
+	default:
+		check(false, "store.type: unknown store %q, want files, vault or kubernetes", c.Store.Type)
+	}
+	if c.PKCS12.Enabled {
+		check(c.Store.Type == storeFiles, "pkcs12 needs store.type files: keystores are written next to the PEM files in dir")
+		check(c.PKCS12.PasswordFile != "" || os.Getenv("CA_PKCS12_PASSWORD") != "", "pkcs12 needs a password_file (CA_PKCS12_PASSWORD_FILE) or CA_PKCS12_PASSWORD")
+	}
+	a := c.Alerts
+	check(a.Threshold > 0, "alerts.threshold must be positive")
+	check(a.Interval > 0, "alerts.interval must be positive")
+	httpURL := func(u string) bool { return strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "http://") }
+	check(a.Webhook == "" || httpURL(a.Webhook), "alerts.webhook (CA_ALERT_WEBHOOK) must be an http or https URL, got %q", a.Webhook)
+	check(a.EmailURL == "" || httpURL(a.EmailURL), "alerts.email_url (CA_ALERT_EMAIL_URL) must be an http or https URL, got %q", a.EmailURL)
+	check((a.EmailURL == "") == (len(a.EmailTo) == 0), "alerts.email_url (CA_ALERT_EMAIL_URL) and alerts.email_to (CA_ALERT_EMAIL_TO) go together")
+	e := c.Events
+	check(e.Webhook == "" || httpURL(e.Webhook), "events.webhook (CA_EVENTS_WEBHOOK) must be an http or https URL, got %q", e.Webhook)
+	check(e.EmailURL == "" || httpURL(e.EmailURL), "events.email_url (CA_EVENTS_EMAIL_URL) must be an http or https URL, got %q", e.EmailURL)
+	check((e.EmailURL == "") == (len(e.EmailTo) == 0), "events.email_url (CA_EVENTS_EMAIL_URL) and events.email_to (CA_EVENTS_EMAIL_TO) go together")
+	if t := c.Tokens; t.Enabled {
+		check(httpURL(t.Issuer), "tokens.issuer (CA_TOKEN_ISSUER) must be an http or https URL, got %q", t.Issuer)
+		check(t.Lifetime > 0 && t.Lifetime <= 24*time.Hour, "tokens.lifetime (CA_TOKEN_LIFETIME) must be positive and at most 24h, got %s", t.Lifetime)
+	}
+	return errors.Join(errs...)
+}
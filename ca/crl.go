@@ -0,0 +1,212 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Revocation reasons from RFC 5280, by the names used in the revocation list.
+var revocationReasons = map[string]int{
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"caCompromise":         2,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+	"privilegeWithdrawn":   9,
+}
+
+// Revocation is an entry of the revocation list file. Serial is in hex, as
+// the CA logs it. Entries added through /revoke also say who revoked the
+// certificate and why.
+type Revocation struct {
+	Serial    string    `json:"serial"`
+	RevokedAt time.Time `json:"revoked_at"`
+	Reason    string    `json:"reason,omitempty"`
+	Service   string    `json:"service,omitempty"`
+	RevokedBy string    `json:"revoked_by,omitempty"`
+	Comment   string    `json:"comment,omitempty"`
+}
+
+var errAlreadyRevoked = errors.New("certificate is already revoked")
+
+// CRLPublisher signs a CRL of the serials in listFile and writes it, PEM
+// encoded, to crlFile. It signs a new one whenever the list changes and
+// every interval, each valid for validity, so clients never hold an expired
+// CRL while the CA runs.
+type CRLPublisher struct {
+	issuer   *Issuer
+	listFile string
+	crlFile  string
+	validity time.Duration
+
+	// listMu serializes changes to listFile.
+	listMu sync.Mutex
+
+	mu        sync.RWMutex
+	der       []byte
+	revoked   map[string]x509.RevocationListEntry
+	modTime   time.Time
+	published time.Time
+}
+
+func NewCRLPublisher(issuer *Issuer, listFile, crlFile string, validity time.Duration) *CRLPublisher {
+	return &CRLPublisher{issuer: issuer, listFile: listFile, crlFile: crlFile, validity: validity}
+}
+
+func readRevocations(path string) ([]Revocation, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []Revocation
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return list, nil
+}
+
+// publish signs a CRL from the current list. An entry that doesn't parse
+// fails the whole CRL rather than leave a certificate unrevoked.
+func (p *CRLPublisher) publish() error {
+	modTime := fileModTime(p.listFile)
+	list, err := readRevocations(p.listFile)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	entries := make([]x509.RevocationListEntry, 0, len(list))
+	revoked := make(map[string]x509.RevocationListEntry, len(list))
+	for _, rev := range list {
+		serial, ok := new(big.Int).SetString(rev.Serial, 16)
+		if !ok {
+			return fmt.Errorf("%s: invalid serial %q", p.listFile, rev.Serial)
+		}
+		reason, ok := revocationReasons[cmp.Or(rev.Reason, "unspecified")]
+		if !ok {
+			return fmt.Errorf("%s: unknown reason %q for %s", p.listFile, rev.Reason, rev.Serial)
+		}
+		entry := x509.RevocationListEntry{SerialNumber: serial, RevocationTime: cmp.Or(rev.RevokedAt, now), ReasonCode: reason}
+		entries = append(entries, entry)
+		revoked[serial.Text(16)] = entry
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(now.UnixNano()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(p.validity),
+		RevokedCertificateEntries: entries,
+	}, p.issuer.cert, p.issuer.key)
+	if err != nil {
+		return fmt.Errorf("sign CRL: %w", err)
+	}
+	if err := writeFileAtomic(p.crlFile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.der, p.revoked, p.modTime, p.published = der, revoked, modTime, now
+	p.mu.Unlock()
+	slog.Info("Published the CRL", "component", "crl", "revoked", len(entries), "next_update", now.Add(p.validity).Format(time.RFC3339))
+	return nil
+}
+
+// revoke adds rev to the list and publishes a new CRL right away, so OCSP
+// and CRL readers see it without waiting for the next check, and reports
+// the revocation if the certificate is in the database.
+func (p *CRLPublisher) revoke(rev Revocation) error {
+	p.listMu.Lock()
+	defer p.listMu.Unlock()
+	list, err := readRevocations(p.listFile)
+	if err != nil {
+		return err
+	}
+	if slices.ContainsFunc(list, func(r Revocation) bool { return strings.EqualFold(r.Serial, rev.Serial) }) {
+		return errAlreadyRevoked
+	}
+	data, err := json.MarshalIndent(append(list, rev), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(p.listFile, data, 0644); err != nil {
+		return err
+	}
+	if err := p.publish(); err != nil {
+		return err
+	}
+	if c, ok := p.issuer.db.lookup(hex.EncodeToString(p.issuer.cert.SubjectKeyId), strings.ToLower(rev.Serial)); ok {
+		p.issuer.events.notify(certEvent{Type: eventRevoked, IssuedCert: c, Reason: cmp.Or(rev.Reason, "unspecified"), RevokedBy: rev.RevokedBy})
+	}
+	return nil
+}
+
+// Run checks the list for changes every check and signs a fresh CRL at
+// least every interval.
+func (p *CRLPublisher) Run(check, interval time.Duration) {
+	for now := range time.Tick(check) {
+		p.mu.RLock()
+		due := !fileModTime(p.listFile).Equal(p.modTime) || now.Sub(p.published) >= interval
+		p.mu.RUnlock()
+		if !due {
+			continue
+		}
+		if err := p.publish(); err != nil {
+			slog.Error("Publishing failed, keeping the current CRL", "component", "crl", "error", err)
+			// The same list is tried again with the next scheduled update.
+			p.mu.Lock()
+			p.modTime = fileModTime(p.listFile)
+			p.mu.Unlock()
+		}
+	}
+}
+
+// current is the latest CRL in DER.
+func (p *CRLPublisher) current() []byte {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.der
+}
+
+// revocation finds serial, in hex, in the current CRL.
+func (p *CRLPublisher) revocation(serial string) (x509.RevocationListEntry, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	entry, ok := p.revoked[serial]
+	return entry, ok
+}
+
+// verifyConnection refuses a client whose verified certificate is on the
+// current CRL, so a revoked service can't sign, list or revoke with it.
+func (p *CRLPublisher) verifyConnection(cs tls.ConnectionState) error {
+	for _, chain := range cs.VerifiedChains {
+		serial := chain[0].SerialNumber.Text(16)
+		if _, revoked := p.revocation(serial); revoked {
+			return fmt.Errorf("client certificate %s is revoked", serial)
+		}
+	}
+	return nil
+}
+
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCRLVerifyConnection(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := createCA(pkix.Name{CommonName: "test CA"}, time.Hour, key, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	p := NewCRLPublisher(&Issuer{cert: cert, key: key}, filepath.Join(dir, "revoked.json"), filepath.Join(dir, "ca.crl"), time.Hour)
+
+	revoked := &x509.Certificate{SerialNumber: big.NewInt(0xabc)}
+	valid := &x509.Certificate{SerialNumber: big.NewInt(0xdef)}
+	state := func(leaf *x509.Certificate) tls.ConnectionState {
+		return tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf, cert}}}
+	}
+
+	if err := p.publish(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.verifyConnection(state(revoked)); err != nil {
+		t.Fatalf("empty CRL refused a client: %v", err)
+	}
+
+	data, _ := json.Marshal([]Revocation{{Serial: "ABC", Reason: "keyCompromise"}})
+	if err := os.WriteFile(p.listFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.publish(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.verifyConnection(state(revoked)); err == nil {
+		t.Error("revoked client certificate accepted")
+	}
+	if err := p.verifyConnection(state(valid)); err != nil {
+		t.Errorf("valid client certificate refused: %v", err)
+	}
+	if err := p.verifyConnection(tls.ConnectionState{}); err != nil {
+		t.Errorf("connection without a client certificate refused: %v", err)
+	}
+}
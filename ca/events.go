@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// EventConfig reports every certificate the CA issues, renews or revokes,
+// so security can audit issuance as it happens. Webhook gets each event as
+// a JSON POST; EmailURL is the email-service, which mails EmailTo.
+type EventConfig struct {
+	Webhook    string   `yaml:"webhook"`
+	EmailURL   string   `yaml:"email_url"`
+	EmailTo    []string `yaml:"email_to"`
+	EmailToken string   `yaml:"email_token"`
+}
+
+func (e EventConfig) enabled() bool {
+	return e.Webhook != "" || e.EmailURL != ""
+}
+
+// Event types.
+const (
+	eventIssued  = "issued"
+	eventRenewed = "renewed"
+	eventRevoked = "revoked"
+)
+
+// certEvent is a certificate as the database has it and what happened to
+// it. A renewed certificate replaces the live one its requester had for
+// the same service and usage; Replaces is that one's serial.
+type certEvent struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	IssuedCert
+	Replaces  string `json:"replaces,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	RevokedBy string `json:"revoked_by,omitempty"`
+}
+
+func (e certEvent) String() string {
+	name := e.Service
+	if e.Usage != "" {
+		name += " " + e.Usage
+	}
+	switch e.Type {
+	case eventRevoked:
+		return fmt.Sprintf("revoked %s (serial %s) by %s, reason %s; it was valid until %s",
+			name, e.Serial, e.RevokedBy, e.Reason, e.NotAfter.Format(time.RFC3339))
+	case eventRenewed:
+		return fmt.Sprintf("renewed %s (serial %s, replaces %s) for %s: %s, expires %s",
+			name, e.Serial, e.Replaces, e.Requester, e.Subject, e.NotAfter.Format(time.RFC3339))
+	default:
+		return fmt.Sprintf("issued %s (serial %s) to %s: %s, expires %s",
+			name, e.Serial, e.Requester, e.Subject, e.NotAfter.Format(time.RFC3339))
+	}
+}
+
+const (
+	eventQueueSize = 256
+	eventAttempts  = 4
+)
+
+// EventNotifier sends events in the background, in the order they happen,
+// so issuing never waits for the webhook or the email-service. A delivery
+// that fails is tried again a few times with backoff, then dropped with a
+// log line; events are also dropped while the queue is full. A nil
+// notifier drops everything, for a CA without events configured.
+type EventNotifier struct {
+	cfg    EventConfig
+	client *http.Client
+	queue  chan certEvent
+	done   chan struct{}
+}
+
+func NewEventNotifier(cfg EventConfig, client *http.Client) *EventNotifier {
+	if !cfg.enabled() {
+		return nil
+	}
+	n := &EventNotifier{cfg: cfg, client: client, queue: make(chan certEvent, eventQueueSize), done: make(chan struct{})}
+	go n.run()
+	return n
+}
+
+func (n *EventNotifier) notify(e certEvent) {
+	if n == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	select {
+	case n.queue <- e:
+	default:
+		slog.Warn("Queue full, event dropped", "component", "event", "event", e.String())
+	}
+}
+
+// Close sends what is queued and returns once it is delivered or given
+// up on, for the commands, which exit right after.
+func (n *EventNotifier) Close() {
+	if n == nil {
+		return
+	}
+	close(n.queue)
+	<-n.done
+}
+
+// run sends each event to the webhook by itself, and everything queued
+// at once to the email-service in one message, as the renewer replaces
+// many certificates together.
+func (n *EventNotifier) run() {
+	defer close(n.done)
+	for e := range n.queue {
+		batch := []certEvent{e}
+	drain:
+		for {
+			select {
+			case e, ok := <-n.queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, e)
+			default:
+				break drain
+			}
+		}
+		if n.cfg.Webhook != "" {
+			for _, e := range batch {
+				n.deliver("webhook", func() error {
+					return postJSON(n.client, n.cfg.Webhook, "", map[string]any{"text": "Certificate " + e.String(), "event": e})
+				})
+			}
+		}
+		if n.cfg.EmailURL != "" {
+			subject := fmt.Sprintf("Certificate %s: %s", batch[0].Type, batch[0].Service)
+			if len(batch) > 1 {
+				subject = fmt.Sprintf("%d certificate events in the notes mesh", len(batch))
+			}
+			lines := make([]string, len(batch))
+			for i, e := range batch {
+				lines[i] = e.Time.Format(time.RFC3339) + " " + e.String()
+			}
+			n.deliver("email", func() error {
+				return postJSON(n.client, strings.TrimSuffix(n.cfg.EmailURL, "/")+"/email/alert", n.cfg.EmailToken,
+					map[string]any{"recipients": n.cfg.EmailTo, "subject": subject, "body": strings.Join(lines, "\n") + "\n"})
+			})
+		}
+	}
+}
+
+func (n *EventNotifier) deliver(dest string, send func() error) {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err := send()
+		if err == nil {
+			return
+		}
+		if attempt == eventAttempts {
+			slog.Error("Giving up on the event", "component", "event", "destination", dest, "attempts", attempt, "error", err)
+			return
+		}
+		slog.Warn("Sending the event failed", "component", "event", "destination", dest, "retry_in", delay, "error", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AlertConfig says when and where the CA warns about certificates close to
+// expiry. Webhook gets a JSON POST; EmailURL is the email-service, which
+// mails EmailTo. Without either, expiry is only reported on /metrics.
+type AlertConfig struct {
+	Threshold  time.Duration `yaml:"threshold"`
+	Interval   time.Duration `yaml:"interval"`
+	Webhook    string        `yaml:"webhook"`
+	EmailURL   string        `yaml:"email_url"`
+	EmailTo    []string      `yaml:"email_to"`
+	EmailToken string        `yaml:"email_token"`
+}
+
+func (a AlertConfig) enabled() bool {
+	return a.Webhook != "" || a.EmailURL != ""
+}
+
+// watchedCert is a certificate whose expiry the CA reports: kind is root,
+// intermediate or service.
+type watchedCert struct {
+	Kind     string    `json:"kind"`
+	Service  string    `json:"service,omitempty"`
+	Serial   string    `json:"serial"`
+	NotAfter time.Time `json:"not_after"`
+	DaysLeft float64   `json:"days_left"`
+}
+
+func (c watchedCert) key() string {
+	return c.Kind + "/" + c.Serial
+}
+
+func (c watchedCert) String() string {
+	name := c.Kind + " CA"
+	if c.Kind == "service" {
+		name = c.Service
+	}
+	return fmt.Sprintf("%s (serial %s) expires %s, in %.1f days", name, c.Serial, c.NotAfter.Format(time.RFC3339), c.DaysLeft)
+}
+
+// ExpiryMonitor exposes how long the CA's certificates and the ones it
+// issued have left on /metrics and sends an alert, once per certificate,
+// when one gets within the threshold.
+type ExpiryMonitor struct {
+	issuer *Issuer
+	crl    *CRLPublisher
+	cfg    AlertConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	alerted map[string]bool
+
+	alertsSent  atomic.Int64
+	alertErrors atomic.Int64
+}
+
+// NewExpiryMonitor sends alerts with client, made by meshClient.
+func NewExpiryMonitor(issuer *Issuer, crl *CRLPublisher, cfg AlertConfig, client *http.Client) *ExpiryMonitor {
+	return &ExpiryMonitor{
+		issuer:  issuer,
+		crl:     crl,
+		cfg:     cfg,
+		client:  client,
+		alerted: make(map[string]bool),
+	}
+}
+
+// watched returns the CA certificates and the live service certificates,
+// soonest expiry first. A service certificate is left out once revoked or
+// once its requester got a newer one for the same service and usage, as a
+// renewed certificate is never used again.
+func (m *ExpiryMonitor) watched(now time.Time) []watchedCert {
+	var list []watchedCert
+	add := func(kind, service, serial string, notAfter time.Time) {
+		list = append(list, watchedCert{
+			Kind:     kind,
+			Service:  service,
+			Serial:   serial,
+			NotAfter: notAfter,
+			DaysLeft: notAfter.Sub(now).Hours() / 24,
+		})
+	}
+	add("root", "", m.issuer.root.SerialNumber.Text(16), m.issuer.root.NotAfter)
+	if m.issuer.cert != m.issuer.root {
+		add("intermediate", "", m.issuer.cert.SerialNumber.Text(16), m.issuer.cert.NotAfter)
+	}
+
+	latest := make(map[string]IssuedCert)
+	for _, c := range m.issuer.db.list(func(c IssuedCert) bool { return now.Before(c.NotAfter) }) {
+		if _, revoked := m.crl.revocation(c.Serial); revoked {
+			continue
+		}
+		key := c.Service + "/" + c.Usage + "/" + c.Requester
+		if prev, ok := latest[key]; !ok || c.IssuedAt.After(prev.IssuedAt) {
+			latest[key] = c
+		}
+	}
+	for _, c := range latest {
+		add("service", c.Service, c.Serial, c.NotAfter)
+	}
+	slices.SortFunc(list, func(a, b watchedCert) int {
+		return cmp.Or(a.NotAfter.Compare(b.NotAfter), strings.Compare(a.Service, b.Service))
+	})
+	return list
+}
+
+func (m *ExpiryMonitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	certs := m.watched(now)
+	expiring := 0
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# HELP ca_certificate_expiry_days Days until a live service certificate expires.\n# TYPE ca_certificate_expiry_days gauge\n")
+	for _, c := range certs {
+		if c.Kind == "service" {
+			fmt.Fprintf(&buf, "ca_certificate_expiry_days{service=%q,serial=%q} %.3f\n", c.Service, c.Serial, c.DaysLeft)
+		}
+	}
+	fmt.Fprintf(&buf, "# HELP ca_authority_expiry_days Days until the CA's own certificates expire.\n# TYPE ca_authority_expiry_days gauge\n")
+	for _, c := range certs {
+		if c.Kind != "service" {
+			fmt.Fprintf(&buf, "ca_authority_expiry_days{cert=%q,serial=%q} %.3f\n", c.Kind, c.Serial, c.DaysLeft)
+		}
+		if c.NotAfter.Sub(now) <= m.cfg.Threshold {
+			expiring++
+		}
+	}
+	fmt.Fprintf(&buf, "# HELP ca_certificates_expiring Certificates, CA ones included, within the alert threshold of expiry.\n# TYPE ca_certificates_expiring gauge\nca_certificates_expiring %d\n", expiring)
+	fmt.Fprintf(&buf, "# HELP ca_expiry_alert_threshold_days The alert threshold.\n# TYPE ca_expiry_alert_threshold_days gauge\nca_expiry_alert_threshold_days %g\n", m.cfg.Threshold.Hours()/24)
+	fmt.Fprintf(&buf, "# HELP ca_expiry_alerts_total Expiry alerts sent.\n# TYPE ca_expiry_alerts_total counter\nca_expiry_alerts_total %d\n", m.alertsSent.Load())
+	fmt.Fprintf(&buf, "# HELP ca_expiry_alert_errors_total Expiry alerts that could not be delivered.\n# TYPE ca_expiry_alert_errors_total counter\nca_expiry_alert_errors_total %d\n", m.alertErrors.Load())
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// Run checks for certificates to alert about every interval. An alert that
+// could not be delivered is tried again at the next check.
+func (m *ExpiryMonitor) Run() {
+	if !m.cfg.enabled() {
+		return
+	}
+	m.check(time.Now())
+	for now := range time.Tick(m.cfg.Interval) {
+		m.check(now)
+	}
+}
+
+func (m *ExpiryMonitor) check(now time.Time) {
+	var due []watchedCert
+	m.mu.Lock()
+	for _, c := range m.watched(now) {
+		if c.NotAfter.Sub(now) <= m.cfg.Threshold && !m.alerted[c.key()] {
+			due = append(due, c)
+		}
+	}
+	m.mu.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	subject := fmt.Sprintf("%d certificate(s) of the notes mesh expire within %g days", len(due), m.cfg.Threshold.Hours()/24)
+	lines := make([]string, len(due))
+	for i, c := range due {
+		lines[i] = c.String()
+	}
+	body := subject + ":\n\n" + strings.Join(lines, "\n") + "\n"
+	for _, c := range due {
+		slog.Warn("Certificate expires soon", "component", "expiry", "certificate", c.String())
+	}
+
+	ok := true
+	if m.cfg.Webhook != "" {
+		err := postJSON(m.client, m.cfg.Webhook, "", map[string]any{"text": body, "threshold": m.cfg.Threshold.String(), "certificates": due})
+		if err != nil {
+			slog.Error("Expiry webhook failed", "component", "expiry", "error", err)
+			ok = false
+		}
+	}
+	if m.cfg.EmailURL != "" {
+		err := postJSON(m.client, strings.TrimSuffix(m.cfg.EmailURL, "/")+"/email/alert", m.cfg.EmailToken, map[string]any{"recipients": m.cfg.EmailTo, "subject": subject, "body": body})
+		if err != nil {
+			slog.Error("Expiry email failed", "component", "expiry", "error", err)
+			ok = false
+		}
+	}
+	if !ok {
+		m.alertErrors.Add(1)
+		return
+	}
+	m.alertsSent.Add(1)
+	m.mu.Lock()
+	for _, c := range due {
+		m.alerted[c.key()] = true
+	}
+	m.mu.Unlock()
+}
+
+// meshClient is what the CA calls webhooks and the email-service with. It
+// trusts the system roots and the mesh CA and presents the CA's pair stored
+// as name, read again for each connection, so the email-service can be
+// reached through its sidecar.
+func meshClient(issuer *Issuer, store SecretStore, name string) *http.Client {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	for _, root := range issuer.trusted() {
+		roots.AddCert(root)
+	}
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:    roots,
+			MinVersion: tls.VersionTLS12,
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				certPEM, keyPEM, err := store.Load(name)
+				if err != nil {
+					return nil, err
+				}
+				cert, err := tls.X509KeyPair(certPEM, keyPEM)
+				return &cert, err
+			},
+		}},
+	}
+}
+
+func postJSON(client *http.Client, url, token string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s: %s", url, resp.Status)
+	}
+	return nil
+}
@@ -1,3 +1,24 @@
 module ca
 
 go 1.25.5
+
+require (
+	github.com/m-tln/notes v0.0.0-00010101000000-000000000000
+	golang.org/x/crypto v0.51.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	google.golang.org/grpc v1.83.1
+	google.golang.org/protobuf v1.36.12
+	software.sslmate.com/src/go-pkcs12 v0.5.0
+)
+
+require (
+	golang.org/x/net v0.55.0 // indirect
+	golang.org/x/sys v0.45.0 // indirect
+	golang.org/x/text v0.37.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260526163538-3dc84a4a5aaa // indirect
+)
+
+replace github.com/m-tln/notes => ../
@@ -0,0 +1,116 @@
+//go:generate protoc -I proto --go_out=capb --go_opt=paths=source_relative --go-grpc_out=capb --go-grpc_opt=paths=source_relative ca.proto
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"log/slog"
+	"net"
+
+	"ca/capb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type grpcServer struct {
+	capb.UnimplementedCertificatesServer
+	server *Server
+}
+
+// ListenAndServeGRPC serves the Certificates API. Client certificates are
+// checked as on the HTTPS port, but not required.
+func (s *Server) ListenAndServeGRPC(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := grpc.NewServer(grpc.Creds(credentials.NewTLS(s.tlsConfig("h2"))))
+	capb.RegisterCertificatesServer(srv, &grpcServer{server: s})
+	slog.Info("Bootstrap gRPC service listening", "addr", addr)
+	return srv.Serve(lis)
+}
+
+func (g *grpcServer) Roots(context.Context, *capb.RootsRequest) (*capb.RootsResponse, error) {
+	return &capb.RootsResponse{Ca: g.server.issuer.trustPEM()}, nil
+}
+
+// Sign issues the service's own certificate for csr and, with client_csr,
+// its client certificate. The caller is the token's service, or the SPIFFE
+// ID of its client certificate, and is held to the policy of /sign. A
+// token is only used up once both CSRs are allowed.
+func (g *grpcServer) Sign(ctx context.Context, req *capb.SignRequest) (*capb.SignResponse, error) {
+	s := g.server
+	var caller, requester string
+	if req.BootstrapToken != "" {
+		token, err := s.bootstrap.lookup(req.BootstrapToken, false)
+		if err != nil {
+			slog.Warn("Refused a token", "component", "bootstrap", "error", err)
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		caller, requester = spiffeID(token.Service).String(), "bootstrap:"+token.ID
+	} else {
+		p, _ := peer.FromContext(ctx)
+		info, ok := p.AuthInfo.(credentials.TLSInfo)
+		if !ok || len(info.State.VerifiedChains) == 0 {
+			return nil, status.Error(codes.Unauthenticated, "a bootstrap token or a client certificate is required")
+		}
+		caller = peerSPIFFEID(info.State.VerifiedChains[0][0])
+		requester = caller
+	}
+
+	csr, err := parseCSR(string(req.Csr))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	service, err := s.policy.authorize(caller, csr, "")
+	if err != nil {
+		slog.Warn("Refused CSR", "component", "sign", "requester", requester, "error", err)
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	var clientCSR *x509.CertificateRequest
+	if len(req.ClientCsr) > 0 {
+		if clientCSR, err = parseCSR(string(req.ClientCsr)); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "client_%v", err)
+		}
+		if clientCSR.Subject.CommonName != service {
+			return nil, status.Errorf(codes.InvalidArgument, "client_csr is for %q, csr for %q", clientCSR.Subject.CommonName, service)
+		}
+		if _, err := s.policy.authorize(caller, clientCSR, usageClient); err != nil {
+			slog.Warn("Refused CSR", "component", "sign", "requester", requester, "error", err)
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+	}
+	if req.BootstrapToken != "" {
+		// Another call may have used the token meanwhile.
+		if _, err := s.bootstrap.lookup(req.BootstrapToken, true); err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		slog.Info("Used a token", "component", "bootstrap", "requester", requester, "service", service)
+	}
+
+	cert, err := s.sign(service, requester, csr, "")
+	if err != nil {
+		slog.Error("Signing failed", "component", "sign", "error", err)
+		return nil, status.Error(codes.Internal, "signing failed")
+	}
+	resp := &capb.SignResponse{
+		Certificate: s.issuer.bundle(cert),
+		Ca:          s.issuer.trustPEM(),
+		NotAfter:    timestamppb.New(cert.NotAfter),
+	}
+	if clientCSR != nil {
+		cert, err := s.sign(service, requester, clientCSR, usageClient)
+		if err != nil {
+			slog.Error("Signing failed", "component", "sign", "error", err)
+			return nil, status.Error(codes.Internal, "signing failed")
+		}
+		resp.ClientCertificate = s.issuer.bundle(cert)
+	}
+	return resp, nil
+}
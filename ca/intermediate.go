@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// loadIntermediate sets up the online intermediate CA, keeping it in store.
+// The intermediate already in store is used for as long as it outlives a
+// service certificate. A new one is signed when it doesn't, when there is
+// none or replace is set, which needs the root key in cfg.RootDir; the key
+// can be taken offline in between.
+func (i *Issuer) loadIntermediate(cfg Config, store SecretStore, replace bool) error {
+	root, rootKey, err := loadRoot(cfg)
+	if err != nil {
+		return err
+	}
+
+	cert, key, err := loadKeyPair(store, "intermediate")
+	var stale string
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		stale = "there is none"
+	case err != nil:
+		return fmt.Errorf("load the intermediate CA: %w", err)
+	case cert.CheckSignatureFrom(root) != nil:
+		stale = "the stored one is not signed by the root in " + cfg.RootDir
+	case time.Until(cert.NotAfter) < cfg.LeafLifetime:
+		stale = "the stored one expires " + cert.NotAfter.Format(time.DateOnly) + ", before a new service certificate would"
+	case replace:
+		stale = "a new one was asked for"
+	}
+
+	switch {
+	case stale == "":
+		slog.Info("Using the stored intermediate CA", "not_after", cert.NotAfter.Format(time.DateOnly))
+	case rootKey == nil:
+		return fmt.Errorf("an intermediate CA must be signed, as %s, but there is no root key in %s; put it back to sign one", stale, cfg.RootDir)
+	default:
+		key, err = generateKey(cfg.CAKey)
+		if err != nil {
+			return err
+		}
+		cert, err = createCA(intermediateSubject, cfg.IntermediateLifetime, key, root, rootKey)
+		if err != nil {
+			return err
+		}
+		if err := storeKeyPair(store, "intermediate", cert, key); err != nil {
+			return err
+		}
+		slog.Info("Signed a new intermediate CA; the root key is only needed to sign the next one and can be kept offline",
+			"reason", stale, "not_after", cert.NotAfter.Format(time.DateOnly), "root_key", filepath.Join(cfg.RootDir, "root.key"))
+	}
+	i.cert, i.key, i.root, i.chainPEM = cert, key, root, encodeCert(cert)
+	return nil
+}
+
+// loadRoot reads the root CA from cfg.RootDir, creating it if there is
+// none. The key is nil if only the certificate is there. The root stays in
+// files whatever the store, so its key can be taken offline.
+func loadRoot(cfg Config) (*x509.Certificate, crypto.Signer, error) {
+	rootStore := FileStore{dir: cfg.RootDir, keyPerm: 0600}
+	certFile := filepath.Join(cfg.RootDir, "root.crt")
+	if _, err := os.Stat(certFile); errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(cfg.RootDir, 0700); err != nil {
+			return nil, nil, err
+		}
+		key, err := generateKey(cfg.CAKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		cert, err := createCA(rootSubject, cfg.CALifetime, key, nil, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := storeKeyPair(rootStore, "root", cert, key); err != nil {
+			return nil, nil, err
+		}
+		slog.Info("Created a root CA", "dir", cfg.RootDir)
+		return cert, key, nil
+	}
+	if _, err := os.Stat(filepath.Join(cfg.RootDir, "root.key")); errors.Is(err, os.ErrNotExist) {
+		cert, err := readCert(certFile)
+		return cert, nil, err
+	}
+	return loadKeyPair(rootStore, "root")
+}
+
+func readCert(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM certificate", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
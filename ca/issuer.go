@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Issuer holds the CA that signs service certificates: the root itself or,
+// in intermediate mode, an intermediate under it. Every certificate it
+// signs is recorded in db and reported to events, and points at the OCSP
+// responder at ocspURL if that is set. While a rotation is in progress,
+// peers also trust the previous root, and the chain handed out with
+// certificates ends in the root cross-signed by it, for peers that only
+// trust the previous root.
+type Issuer struct {
+	cert         *x509.Certificate
+	key          crypto.Signer
+	root         *x509.Certificate
+	chainPEM     []byte
+	db           *CertDB
+	ocspURL      string
+	leafLifetime time.Duration
+	dir          string
+	events       *EventNotifier
+
+	mu       sync.RWMutex
+	rotation *rotation
+}
+
+// newIssuer sets up the CA, keeping its key in store: the CA already there
+// or, if there is none or replace is set, a fresh root. In intermediate
+// mode the root is in cfg.RootDir and signs the intermediate. Either way
+// ca.crt in cfg.Dir is the root, the one certificate peers need to trust.
+func newIssuer(cfg Config, db *CertDB, store SecretStore, replace bool) (*Issuer, error) {
+	i := &Issuer{db: db, ocspURL: cfg.OCSPURL, leafLifetime: cfg.LeafLifetime, dir: cfg.Dir}
+	if cfg.Intermediate {
+		if err := i.loadIntermediate(cfg, store, replace); err != nil {
+			return nil, err
+		}
+	} else {
+		cert, key, err := loadKeyPair(store, "ca")
+		switch {
+		case err == nil && !replace:
+			if time.Until(cert.NotAfter) < cfg.LeafLifetime {
+				return nil, fmt.Errorf("the CA expires %s, before a new service certificate would; replace it with ca init -force",
+					cert.NotAfter.Format(time.DateOnly))
+			}
+			slog.Info("Using the existing CA", "not_after", cert.NotAfter.Format(time.DateOnly))
+		case err == nil || errors.Is(err, os.ErrNotExist):
+			key, err = generateKey(cfg.CAKey)
+			if err != nil {
+				return nil, err
+			}
+			cert, err = createCA(rootSubject, cfg.CALifetime, key, nil, nil)
+			if err != nil {
+				return nil, err
+			}
+			if err := storeKeyPair(store, "ca", cert, key); err != nil {
+				return nil, err
+			}
+			slog.Info("Created a new CA", "not_after", cert.NotAfter.Format(time.DateOnly))
+		default:
+			// A CA that can't be read is never silently replaced: that
+			// would invalidate every certificate it issued.
+			return nil, fmt.Errorf("load the CA: %w", err)
+		}
+		i.cert, i.key, i.root = cert, key, cert
+	}
+	if err := i.loadRotation(true); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(cfg.Dir, "ca.crt"), i.trustPEM(), 0644); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// openIssuer loads the CA that ca init or a running CA left in store,
+// without creating or signing anything.
+func openIssuer(cfg Config, db *CertDB, store SecretStore) (*Issuer, error) {
+	i := &Issuer{db: db, ocspURL: cfg.OCSPURL, leafLifetime: cfg.LeafLifetime, dir: cfg.Dir}
+	name := "ca"
+	if cfg.Intermediate {
+		name = "intermediate"
+	}
+	cert, key, err := loadKeyPair(store, name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no CA yet, run ca init first: %w", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	i.cert, i.key, i.root = cert, key, cert
+	if cfg.Intermediate {
+		root, err := readCert(filepath.Join(cfg.RootDir, "root.crt"))
+		if err != nil {
+			return nil, err
+		}
+		if err := cert.CheckSignatureFrom(root); err != nil {
+			return nil, fmt.Errorf("stored intermediate CA is not signed by the root in %s: %w", cfg.RootDir, err)
+		}
+		i.root, i.chainPEM = root, encodeCert(cert)
+	}
+	if err := i.loadRotation(false); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+var (
+	rootSubject = pkix.Name{
+		Organization: []string{"Notes Service Mesh CA"},
+		CommonName:   "notes-ca",
+	}
+	intermediateSubject = pkix.Name{
+		Organization: []string{"Notes Service Mesh CA"},
+		CommonName:   "notes-intermediate-ca",
+	}
+)
+
+// createCA makes a CA certificate for key, signed by parent, or self-signed
+// if parent is nil. A CA under a parent can't sign further CAs. Every root
+// gets a random serial, so a rotated root never shares issuer and serial
+// with the one before it.
+func createCA(subject pkix.Name, lifetime time.Duration, key crypto.Signer, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(lifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if parent == nil {
+		parent, parentKey = &template, key
+	} else {
+		template.MaxPathLenZero = true
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// certRequest is what goes into a service certificate besides its key.
+// Requester is recorded with it in the database.
+type certRequest struct {
+	Service     string
+	Requester   string
+	DNSNames    []string
+	IPAddresses []string
+	Usage       string
+}
+
+// issue signs a certificate for req.Service with pub as its key. Its SPIFFE
+// ID is spiffe://notes/<service>, and its serial one the database has
+// never seen for this CA.
+func (i *Issuer) issue(req certRequest, pub crypto.PublicKey) (*x509.Certificate, error) {
+	service := req.Service
+	issuer := hex.EncodeToString(i.cert.SubjectKeyId)
+	serial, err := i.db.newSerial(issuer)
+	if err != nil {
+		return nil, err
+	}
+	defer i.db.release(issuer, serial)
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   service,
+			Organization: []string{"Notes Service Mesh"},
+		},
+		DNSNames:    req.DNSNames,
+		URIs:        []*url.URL{spiffeID(service)},
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().Add(i.leafLifetime),
+		KeyUsage:    keyUsage,
+		ExtKeyUsage: extKeyUsage(req.Usage),
+	}
+	for _, ip := range req.IPAddresses {
+		template.IPAddresses = append(template.IPAddresses, net.ParseIP(ip))
+	}
+	if i.ocspURL != "" {
+		template.OCSPServer = []string{i.ocspURL}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, i.cert, pub, i.key)
+	if err != nil {
+		return nil, fmt.Errorf("signing certificate for %s: %w", service, err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	// A certificate the database doesn't know would be unknown to OCSP, so
+	// it isn't handed out.
+	entry, previous, err := i.db.add(req, cert)
+	if err != nil {
+		return nil, fmt.Errorf("recording certificate for %s: %w", service, err)
+	}
+	event := certEvent{Type: eventIssued, IssuedCert: entry}
+	if previous != "" {
+		event.Type, event.Replaces = eventRenewed, previous
+	}
+	i.events.notify(event)
+	return cert, nil
+}
+
+// randomSerial is a positive serial of 127 random bits: more than the 64
+// the CA/Browser Forum asks for, and within the 20 octets of RFC 5280.
+func randomSerial() (*big.Int, error) {
+	max := new(big.Int).Lsh(big.NewInt(1), 127)
+	for {
+		serial, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return nil, fmt.Errorf("random serial: %w", err)
+		}
+		if serial.Sign() > 0 {
+			return serial, nil
+		}
+	}
+}
+
+func extKeyUsage(usage string) []x509.ExtKeyUsage {
+	switch usage {
+	case usageServer:
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	case usageClient:
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	default:
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+}
+
+// bundle is cert in PEM followed by the intermediates up to the root, as
+// TLS servers and clients present it.
+func (i *Issuer) bundle(cert *x509.Certificate) []byte {
+	return append(encodeCert(cert), i.chain()...)
+}
+
+// chain is the PEM that follows a certificate in its bundle: the
+// intermediate, if any, and during a rotation the cross-signed root.
+func (i *Issuer) chain() []byte {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.rotation == nil {
+		return i.chainPEM
+	}
+	return slices.Concat(i.chainPEM, encodeCert(i.rotation.cross))
+}
+
+// trusted is the roots peers trust, the current one first.
+func (i *Issuer) trusted() []*x509.Certificate {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.rotation == nil {
+		return []*x509.Certificate{i.root}
+	}
+	return []*x509.Certificate{i.root, i.rotation.previous}
+}
+
+// trustPEM is the trust bundle published as ca.crt.
+func (i *Issuer) trustPEM() []byte {
+	var pem []byte
+	for _, root := range i.trusted() {
+		pem = append(pem, encodeCert(root)...)
+	}
+	return pem
+}
+
+func (i *Issuer) roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, root := range i.trusted() {
+		pool.AddCert(root)
+	}
+	return pool
+}
+
+func spiffeID(service string) *url.URL {
+	return &url.URL{Scheme: "spiffe", Host: trustDomain, Path: "/" + service}
+}
+
+func encodeCert(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// jws is a request body in the flattened JSON serialization ACME uses
+// (RFC 8555, section 6.2).
+type jws struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+type jwsHeader struct {
+	Alg   string          `json:"alg"`
+	Nonce string          `json:"nonce"`
+	URL   string          `json:"url"`
+	JWK   json.RawMessage `json:"jwk"`
+	KID   string          `json:"kid"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// parseJWK reads an EC or RSA public key and its RFC 7638 thumbprint.
+func parseJWK(raw json.RawMessage) (crypto.PublicKey, string, error) {
+	var k jwk
+	if err := json.Unmarshal(raw, &k); err != nil {
+		return nil, "", fmt.Errorf("jwk: %w", err)
+	}
+	var canonical string
+	var pub crypto.PublicKey
+	switch k.Kty {
+	case "EC":
+		curve, ok := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384()}[k.Crv]
+		if !ok {
+			return nil, "", fmt.Errorf("jwk: unsupported curve %q", k.Crv)
+		}
+		x, errX := b64.DecodeString(k.X)
+		y, errY := b64.DecodeString(k.Y)
+		if errX != nil || errY != nil {
+			return nil, "", errors.New("jwk: invalid coordinates")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, "", errors.New("jwk: point is not on the curve")
+		}
+		pub = key
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, k.Crv, k.X, k.Y)
+	case "RSA":
+		n, errN := b64.DecodeString(k.N)
+		e, errE := b64.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			return nil, "", errors.New("jwk: invalid modulus or exponent")
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < 2048 {
+			return nil, "", errors.New("jwk: RSA keys must have at least 2048 bits")
+		}
+		pub = key
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	default:
+		return nil, "", fmt.Errorf("jwk: unsupported key type %q", k.Kty)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return pub, b64.EncodeToString(sum[:]), nil
+}
+
+// verify checks the signature of the JWS with pub under the algorithm its
+// header names.
+func (j *jws) verify(alg string, pub crypto.PublicKey) error {
+	sig, err := b64.DecodeString(j.Signature)
+	if err != nil {
+		return errors.New("invalid signature encoding")
+	}
+	input := []byte(j.Protected + "." + j.Payload)
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		var digest []byte
+		switch {
+		case alg == "ES256" && key.Curve == elliptic.P256():
+			sum := sha256.Sum256(input)
+			digest = sum[:]
+		case alg == "ES384" && key.Curve == elliptic.P384():
+			sum := sha512.Sum384(input)
+			digest = sum[:]
+		default:
+			return fmt.Errorf("algorithm %s does not match the key", alg)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return fmt.Errorf("algorithm %s does not match the key", alg)
+		}
+		sum := sha256.Sum256(input)
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) != nil {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return errors.New("unsupported key")
+}
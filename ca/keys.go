@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+)
+
+// Key types the CA generates keys of. OCSP responses can't be signed with
+// Ed25519, so it is only offered for service keys.
+const (
+	keyRSA     = "rsa"
+	keyECDSA   = "ecdsa"
+	keyEd25519 = "ed25519"
+)
+
+func validKeyType(keyType string, ca bool) error {
+	switch keyType {
+	case keyRSA, keyECDSA:
+		return nil
+	case keyEd25519:
+		if !ca {
+			return nil
+		}
+	}
+	if ca {
+		return fmt.Errorf("unknown key type %q, want %s or %s", keyType, keyRSA, keyECDSA)
+	}
+	return fmt.Errorf("unknown key type %q, want %s, %s or %s", keyType, keyRSA, keyECDSA, keyEd25519)
+}
+
+var curves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+func generateKey(k KeyConfig) (crypto.Signer, error) {
+	switch k.Type {
+	case keyECDSA:
+		return ecdsa.GenerateKey(curves[k.Curve], rand.Reader)
+	case keyEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return rsa.GenerateKey(rand.Reader, k.RSABits)
+	}
+}
+
+// encodeKey PEM-encodes key in the form OpenSSL writes it: PKCS#1 for RSA,
+// SEC 1 for ECDSA and PKCS#8 for Ed25519.
+func encodeKey(key crypto.Signer) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}), nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	default:
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The service account files every pod gets.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// KubernetesConfig says where the CA keeps its Kubernetes secrets. The CA
+// talks to the API server of the cluster it runs in, as its service
+// account, which needs get, create and update on secrets in Namespace.
+type KubernetesConfig struct {
+	Namespace    string `yaml:"namespace"`
+	SecretPrefix string `yaml:"secret_prefix"`
+}
+
+// KubernetesStore keeps each pair as a kubernetes.io/tls secret named
+// <prefix><name>, which pods can mount in place of the shared volume.
+type KubernetesStore struct {
+	cfg    KubernetesConfig
+	api    string
+	client *http.Client
+}
+
+type k8sSecret struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   k8sMetadata       `json:"metadata"`
+	Type       string            `json:"type"`
+	Data       map[string][]byte `json:"data"`
+}
+
+type k8sMetadata struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+}
+
+func NewKubernetesStore(cfg KubernetesConfig) (*KubernetesStore, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("kubernetes store: not running in a cluster (KUBERNETES_SERVICE_HOST is unset)")
+	}
+	pem, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes store: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("kubernetes store: no certificates in %s/ca.crt", serviceAccountDir)
+	}
+	return &KubernetesStore{
+		cfg: cfg,
+		api: "https://" + net.JoinHostPort(host, port) + "/api/v1/namespaces/" + cfg.Namespace + "/secrets",
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}},
+		},
+	}, nil
+}
+
+// serviceAccountNamespace is the namespace the CA's pod runs in, if any.
+func serviceAccountNamespace() string {
+	data, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func (k *KubernetesStore) Load(name string) ([]byte, []byte, error) {
+	var secret k8sSecret
+	status, err := k.do(http.MethodGet, "/"+k.cfg.SecretPrefix+name, nil, &secret)
+	if status == http.StatusNotFound {
+		return nil, nil, fmt.Errorf("kubernetes: secret %s%s: %w", k.cfg.SecretPrefix, name, os.ErrNotExist)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return secret.Data["tls.crt"], secret.Data["tls.key"], nil
+}
+
+// Store replaces the secret, or creates it if there is none yet.
+func (k *KubernetesStore) Store(name string, certPEM, keyPEM []byte) error {
+	secret := k8sSecret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata: k8sMetadata{
+			Name:      k.cfg.SecretPrefix + name,
+			Namespace: k.cfg.Namespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "ca-service"},
+		},
+		Type: "kubernetes.io/tls",
+		Data: map[string][]byte{"tls.crt": certPEM, "tls.key": keyPEM},
+	}
+	body, err := json.Marshal(secret)
+	if err != nil {
+		return err
+	}
+	status, err := k.do(http.MethodPut, "/"+secret.Metadata.Name, body, nil)
+	if status == http.StatusNotFound {
+		_, err = k.do(http.MethodPost, "", body, nil)
+	}
+	return err
+}
+
+// do sends a request to the secrets API and returns its status, with an
+// error for anything but success.
+func (k *KubernetesStore) do(method, path string, body []byte, out any) (int, error) {
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return 0, fmt.Errorf("kubernetes: %w", err)
+	}
+	req, err := http.NewRequest(method, k.api+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("kubernetes: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return resp.StatusCode, fmt.Errorf("kubernetes: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("kubernetes: %s %s: %s: %s", method, k.api+path, resp.Status, bytes.TrimSpace(data))
+	}
+	if out != nil {
+		return resp.StatusCode, json.Unmarshal(data, out)
+	}
+	return resp.StatusCode, nil
+}
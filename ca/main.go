@@ -1,120 +1,211 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
+	"flag"
 	"fmt"
-	"log"
-	"math/big"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/m-tln/notes/config"
+	"github.com/m-tln/notes/logging"
 )
 
+// trustDomain is the SPIFFE trust domain of the mesh; every service
+// certificate carries spiffe://notes/<service> as a URI SAN.
+const trustDomain = "notes"
+
+// command is a subcommand of the ca binary.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"serve", "run the CA service (the default)", serve},
+	{"init", "create the CA", runInit},
+	{"issue", "issue a certificate for one service", runIssue},
+	{"renew", "renew service certificates", runRenew},
+	{"revoke", "revoke a certificate", runRevoke},
+	{"list", "list issued certificates", runList},
+	{"rotate", "replace the root CA", runRotate},
+	{"token", "issue a workload JWT", runToken},
+	{"bootstrap-token", "create a one-time token for a new workload's first certificate", runBootstrapToken},
+}
+
+// main runs the command named by the first argument, or serve if there is
+// none, so the container keeps starting the CA with plain flags.
 func main() {
-	os.MkdirAll("/certs", 0755)
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	i := slices.IndexFunc(commands, func(c command) bool { return c.name == name })
+	if i < 0 {
+		if name != "help" {
+			fmt.Fprintf(os.Stderr, "ca: unknown command %q\n\n", name)
+		}
+		usage()
+		os.Exit(2)
+	}
+	if err := commands[i].run(args); err != nil {
+		logging.Fatal("Command failed", "command", name, "error", err)
+	}
+}
 
-	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		log.Fatal(err)
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: ca <command> [flags]\n\ncommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", c.name, c.summary)
 	}
+	fmt.Fprintf(os.Stderr, "\nRun ca <command> -h for its flags. Every command also takes the config flags and reads CA_CONFIG and the environment.\n")
+}
 
-	caTemplate := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject: pkix.Name{
-			Organization: []string{"Notes Service Mesh CA"},
-			CommonName:   "notes-ca",
-		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
-		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
-		BasicConstraintsValid: true,
-		IsCA:                  true,
+// newFlagSet makes the flag set of a command, with its usage line.
+func newFlagSet(name, args, help string) *flag.FlagSet {
+	fs := flag.NewFlagSet("ca "+name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: ca %s [flags]%s\n\n%s\n\nflags:\n", name, args, help)
+		fs.PrintDefaults()
 	}
+	return fs
+}
 
-	caCertDER, err := x509.CreateCertificate(rand.Reader, &caTemplate, &caTemplate, 
-		&caKey.PublicKey, caKey)
+// serve runs the CA: it creates the CA, keeps the service certificates
+// current and serves the API until it fails.
+func serve(args []string) error {
+	fs := newFlagSet("serve", "", "Run the CA: keep service certificates current and serve /sign, ACME, the CRL, OCSP and the bootstrap gRPC port.")
+	logging.Setup("ca")
+	if err := config.Err(); err != nil {
+		return err
+	}
+	cfg, err := loadConfig(os.Getenv("CA_CONFIG"), fs, args)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return err
 	}
 
-	caCertFile, _ := os.Create("/certs/ca.crt")
-	pem.Encode(caCertFile, &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: caCertDER,
-	})
-	caCertFile.Close()
+	db, err := OpenCertDB(filepath.Join(cfg.Dir, "issued.json"))
+	if err != nil {
+		return err
+	}
+	caStore, certStore, err := openStores(cfg)
+	if err != nil {
+		return err
+	}
+	issuer, err := newIssuer(cfg, db, caStore, false)
+	if err != nil {
+		return err
+	}
+	go issuer.retire()
+	certStore, err = serviceStore(cfg, certStore, issuer)
+	if err != nil {
+		return err
+	}
+	client := meshClient(issuer, certStore, cfg.clientCertName())
+	issuer.events = NewEventNotifier(cfg.Events, client)
 
-	caKeyFile, _ := os.Create("/certs/ca.key")
-	pem.Encode(caKeyFile, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(caKey),
-	})
-	caKeyFile.Close()
+	crl := NewCRLPublisher(issuer, filepath.Join(cfg.Dir, "revoked.json"), filepath.Join(cfg.Dir, "ca.crl"), cfg.CRLValidity)
+	if err := crl.publish(); err != nil {
+		return err
+	}
+	go crl.Run(10*time.Second, cfg.CRLInterval)
 
-	services := map[string][]string{
-		"app1":          {"app1-sidecar", "app1.notes.internal", "app1-sidecar.notes.internal"},
-		"app2":          {"app2-sidecar", "app2.notes.internal", "app2-sidecar.notes.internal"},
-		"app3":          {"app3-sidecar", "app3.notes.internal", "app3-sidecar.notes.internal"},
-		"email":         {"email-sidecar", "email.notes.internal", "email-sidecar.notes.internal"},
-		"loadbalancer":  {"loadbalancer.notes.internal"},
+	renewer := NewRenewer(issuer, crl, certStore, cfg.Services, cfg.RenewAt, cfg.LeafKey)
+	if err := renewer.renewDue(time.Now()); err != nil {
+		return err
 	}
+	go renewer.Run(cfg.RenewCheckInterval)
+
+	slog.Info("Service certificates are up to date")
 
-	for service, altNames := range services {
-		generateCertWithSAN(service, altNames, &caTemplate, caKey)
+	policy := Policy{
+		Services: cfg.Services,
+		Domains:  cfg.AllowedDomains,
+		Admins:   cfg.AdminClients,
+		SANs:     cfg.SANs,
+	}
+	server := &Server{
+		issuer:  issuer,
+		policy:  policy,
+		renewer: renewer,
+		crl:     crl,
+		ocsp:    &OCSPResponder{issuer: issuer, crl: crl, validity: cfg.OCSPValidity},
+		certs:   certStore,
+	}
+	server.expiry = NewExpiryMonitor(issuer, crl, cfg.Alerts, client)
+	go server.expiry.Run()
+	if cfg.ACME.Enabled {
+		server.acme, err = NewACMEServer(issuer, policy, filepath.Join(cfg.Dir, "acme-accounts.json"), cfg.ACME.TLSPort, cfg.ACME.HTTPPort)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.Tokens.Enabled {
+		server.tokens, err = NewTokenIssuer(cfg.Tokens, cfg.Services, caStore, cfg.CAKey, cfg.CALifetime)
+		if err != nil {
+			return err
+		}
+		go server.tokens.Run(cfg.RenewCheckInterval)
 	}
+	if cfg.Bootstrap.Enabled {
+		server.bootstrap = NewBootstrapTokens(filepath.Join(cfg.Dir, "bootstrap-tokens.json"))
+		go func() {
+			logging.Fatal("Bootstrap gRPC service failed", "error", server.ListenAndServeGRPC(":"+cfg.Bootstrap.Port))
+		}()
+	}
+	return server.ListenAndServe(":" + cfg.Port)
+}
 
-	log.Println("All certificates with SAN generated successfully")
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
 }
 
-func generateCertWithSAN(service string, dnsNames []string, caTemplate *x509.Certificate, caKey *rsa.PrivateKey) {
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	allDNSNames := append([]string{service}, dnsNames...)
-	
-	allDNSNames = append(allDNSNames, 
-		service+".notes_network",
-		strings.Replace(service, "-sidecar", "", 1),
-	)
-
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(time.Now().UnixNano()),
-		Subject: pkix.Name{
-			CommonName:   service,
-			Organization: []string{"Notes Service Mesh"},
-		},
-		DNSNames:    allDNSNames,
-		NotBefore:   time.Now(),
-		NotAfter:    time.Now().Add(90 * 24 * time.Hour),
-		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
-		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
-	}
-
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, caTemplate, 
-		&key.PublicKey, caKey)
-	if err != nil {
-		log.Fatal(err)
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return value
 	}
+	return defaultValue
+}
 
-	certFile, _ := os.Create(fmt.Sprintf("/certs/%s.crt", service))
-	pem.Encode(certFile, &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: certDER,
-	})
-	certFile.Close()
+func getEnvBool(key string, defaultValue bool) bool {
+	if value, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
 
-	keyFile, _ := os.Create(fmt.Sprintf("/certs/%s.key", service))
-	pem.Encode(keyFile, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
-	})
-	keyFile.Close()
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
 
-	log.Printf("Generated certificate for %s with SAN: %v", service, allDNSNames)
-}
\ No newline at end of file
+// envList splits a comma-separated variable.
+func envList(key, defaultValue string) []string {
+	var items []string
+	for _, item := range strings.Split(getEnv(key, defaultValue), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
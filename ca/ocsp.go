@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/m-tln/notes/logging"
+	"golang.org/x/crypto/ocsp"
+)
+
+const maxOCSPRequestSize = 4 << 10
+
+// OCSPResponder answers OCSP requests (RFC 6960) for certificates of the
+// current CA: revoked if the CRL lists the serial, good if the issuance
+// database has it, unknown otherwise. Responses are signed by the CA itself
+// and valid for validity.
+type OCSPResponder struct {
+	issuer   *Issuer
+	crl      *CRLPublisher
+	validity time.Duration
+}
+
+// ServeHTTP takes a DER request as a POST body or, base64 encoded, as the
+// rest of a GET path.
+func (o *OCSPResponder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var der []byte
+	var err error
+	if r.Method == http.MethodGet {
+		der, err = base64.StdEncoding.DecodeString(r.PathValue("request"))
+	} else {
+		der, err = io.ReadAll(http.MaxBytesReader(w, r.Body, maxOCSPRequestSize))
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	if err != nil {
+		w.Write(ocsp.MalformedRequestErrorResponse)
+		return
+	}
+	req, err := ocsp.ParseRequest(der)
+	if err != nil {
+		w.Write(ocsp.MalformedRequestErrorResponse)
+		return
+	}
+	if !o.issuedBy(req) {
+		w.Write(ocsp.UnauthorizedErrorResponse)
+		return
+	}
+
+	now := time.Now()
+	template := ocsp.Response{
+		Status:       ocsp.Unknown,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(o.validity),
+		IssuerHash:   req.HashAlgorithm,
+	}
+	serial := req.SerialNumber.Text(16)
+	if entry, ok := o.crl.revocation(serial); ok {
+		template.Status = ocsp.Revoked
+		template.RevokedAt = entry.RevocationTime
+		template.RevocationReason = entry.ReasonCode
+	} else if _, ok := o.issuer.db.lookup(hex.EncodeToString(o.issuer.cert.SubjectKeyId), serial); ok {
+		template.Status = ocsp.Good
+	}
+	resp, err := ocsp.CreateResponse(o.issuer.cert, o.issuer.cert, template, o.issuer.key)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Signing the response failed", "component", "ocsp", "serial", serial, "error", err)
+		w.Write(ocsp.InternalErrorErrorResponse)
+		return
+	}
+	w.Write(resp)
+}
+
+// issuedBy reports whether req asks about a certificate of this CA.
+func (o *OCSPResponder) issuedBy(req *ocsp.Request) bool {
+	if !req.HashAlgorithm.Available() {
+		return false
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(o.issuer.cert.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return false
+	}
+	h := req.HashAlgorithm.New()
+	h.Write(o.issuer.cert.RawSubject)
+	nameHash := h.Sum(nil)
+	h.Reset()
+	h.Write(spki.PublicKey.RightAlign())
+	return bytes.Equal(nameHash, req.IssuerNameHash) && bytes.Equal(h.Sum(nil), req.IssuerKeyHash)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// PKCS12Config adds a passphrase-protected PKCS#12 keystore next to each
+// service's PEM files, for Java tools that can only load keystores. The
+// passphrase is read from PasswordFile, or CA_PKCS12_PASSWORD without one.
+// Legacy bundles use 3DES and RC2, for Java older than 8u301.
+type PKCS12Config struct {
+	Enabled      bool   `yaml:"enabled"`
+	PasswordFile string `yaml:"password_file"`
+	Legacy       bool   `yaml:"legacy"`
+}
+
+// PKCS12Store writes <name>.p12 with the key, the certificate and its chain
+// up to the root whenever a pair is stored, and truststore.p12 with the
+// roots of ca.crt.
+type PKCS12Store struct {
+	SecretStore
+	dir      string
+	root     *x509.Certificate
+	encoder  *pkcs12.Encoder
+	password string
+}
+
+// NewPKCS12Store wraps store, which keeps the PEM files in dir, and brings
+// the keystores of services up to date with the current passphrase. roots
+// has the current root first.
+func NewPKCS12Store(store SecretStore, dir string, cfg PKCS12Config, roots []*x509.Certificate, services []string) (*PKCS12Store, error) {
+	password := os.Getenv("CA_PKCS12_PASSWORD")
+	if cfg.PasswordFile != "" {
+		data, err := os.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("pkcs12 password: %w", err)
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+	}
+	p := &PKCS12Store{SecretStore: store, dir: dir, root: roots[0], encoder: pkcs12.Modern2023, password: password}
+	if cfg.Legacy {
+		p.encoder = pkcs12.LegacyDES
+	}
+
+	trust, err := p.encoder.EncodeTrustStore(roots, password)
+	if err != nil {
+		return nil, fmt.Errorf("truststore.p12: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "truststore.p12"), trust, 0644); err != nil {
+		return nil, err
+	}
+	for _, name := range services {
+		certPEM, keyPEM, err := store.Load(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err == nil {
+			err = p.writeBundle(name, certPEM, keyPEM)
+		}
+		if err != nil {
+			// The renewer replaces a pair it can't read, and the keystore
+			// with it.
+			slog.Error("Writing the keystore failed", "component", "pkcs12", "service", name, "error", err)
+		}
+	}
+	return p, nil
+}
+
+func (p *PKCS12Store) Store(name string, certPEM, keyPEM []byte) error {
+	if err := p.SecretStore.Store(name, certPEM, keyPEM); err != nil {
+		return err
+	}
+	return p.writeBundle(name, certPEM, keyPEM)
+}
+
+func (p *PKCS12Store) writeBundle(name string, certPEM, keyPEM []byte) error {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	var chain []*x509.Certificate
+	for _, der := range pair.Certificate[1:] {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		// The root cross-signed during a rotation is the root itself as far
+		// as a keystore goes.
+		if bytes.Equal(cert.RawSubject, p.root.RawSubject) {
+			continue
+		}
+		chain = append(chain, cert)
+	}
+	chain = append(chain, p.root)
+	data, err := p.encoder.Encode(pair.PrivateKey, pair.Leaf, chain, p.password)
+	if err != nil {
+		return fmt.Errorf("%s.p12: %w", name, err)
+	}
+	return writeFileAtomic(filepath.Join(p.dir, name+".p12"), data, 0644)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"cmp"
+	"crypto/x509"
+	"fmt"
+	"maps"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var serviceName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// SANConfig lets CSRs carry more than a service's own names: IP addresses
+// within IPRanges (CIDRs), and with Wildcards *.<service>.<domain> for each
+// allowed domain, the namespace under the service's name. Only the admins
+// and Requesters (SPIFFE IDs) may ask for them. The addresses and names
+// configured for a known service need no permission.
+type SANConfig struct {
+	IPRanges   []string `yaml:"ip_ranges"`
+	Wildcards  bool     `yaml:"wildcards"`
+	Requesters []string `yaml:"requesters"`
+}
+
+// Policy decides which certificates the CA signs on request. A service may
+// renew its own certificate, proving who it is with the current one; the
+// Admins (SPIFFE IDs) may request certificates for any service. Services
+// the CA knows get the names configured for them, others get their name and
+// <name>.<domain> for each of Domains. A known service may ask for a
+// narrower usage than its own certificate's, or for client usage with
+// client_cert; others may ask for any. SANs says who may ask for IP
+// addresses and wildcard names.
+type Policy struct {
+	Services map[string]ServiceConfig
+	Domains  []string
+	Admins   []string
+	SANs     SANConfig
+}
+
+func (p Policy) allowedNames(service string) []string {
+	if svc, ok := p.Services[service]; ok {
+		return svc.DNSNames
+	}
+	names := []string{service}
+	for _, domain := range p.Domains {
+		names = append(names, service+"."+domain)
+	}
+	return names
+}
+
+// usages are the usages service may be issued certificates for.
+func (p Policy) usages(service string) []string {
+	svc, ok := p.Services[service]
+	switch {
+	case !ok || svc.Usage == usageDual:
+		return []string{usageServer, usageClient, usageDual}
+	case svc.ClientCert:
+		return []string{svc.Usage, usageClient}
+	default:
+		return []string{svc.Usage}
+	}
+}
+
+// authorize checks a CSR from caller, the SPIFFE ID of the client
+// certificate, for usage, or the service's own if it is empty, and returns
+// the service it is for.
+func (p Policy) authorize(caller string, csr *x509.CertificateRequest, usage string) (string, error) {
+	service := csr.Subject.CommonName
+	if !serviceName.MatchString(service) {
+		return "", fmt.Errorf("common name %q is not a service name", service)
+	}
+	if caller != spiffeID(service).String() && !slices.Contains(p.Admins, caller) {
+		return "", fmt.Errorf("%s may not request certificates for %s", caller, service)
+	}
+	if len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		return "", fmt.Errorf("only DNS names and IP addresses may be requested")
+	}
+	extended := slices.Contains(p.Admins, caller) || slices.Contains(p.SANs.Requesters, caller)
+	allowed := p.allowedNames(service)
+	for _, name := range csr.DNSNames {
+		switch {
+		case slices.Contains(allowed, name):
+		case !p.wildcardFor(service, name):
+			return "", fmt.Errorf("%s may not carry %s", service, name)
+		case !extended:
+			return "", fmt.Errorf("%s may not request wildcard names", caller)
+		}
+	}
+	configured := p.Services[service].IPAddresses
+	for _, ip := range csr.IPAddresses {
+		switch {
+		case slices.ContainsFunc(configured, func(s string) bool { return net.ParseIP(s).Equal(ip) }):
+		case !p.inRanges(ip):
+			return "", fmt.Errorf("%s may not carry %s", service, ip)
+		case !extended:
+			return "", fmt.Errorf("%s may not request IP addresses", caller)
+		}
+	}
+	if usage != "" && !slices.Contains(p.usages(service), usage) {
+		return "", fmt.Errorf("%s may not have %s certificates, only %s", service, usage, strings.Join(p.usages(service), ", "))
+	}
+	return service, nil
+}
+
+// wildcardFor says whether name is *.<service>.<domain> for an allowed
+// domain and wildcards are enabled.
+func (p Policy) wildcardFor(service, name string) bool {
+	if !p.SANs.Wildcards {
+		return false
+	}
+	return slices.ContainsFunc(p.Domains, func(domain string) bool { return name == "*."+service+"."+domain })
+}
+
+func (p Policy) inRanges(ip net.IP) bool {
+	for _, cidr := range p.SANs.IPRanges {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// request is the certificate a service gets for names and ips, or for all
+// the names it may have if both are empty, and for usage, or its
+// configured usage if that is empty. Without ips, only the configured
+// names come with the service's IP addresses.
+func (p Policy) request(service, requester string, names, ips []string, usage string) certRequest {
+	req := certRequest{Service: service, Requester: requester, DNSNames: names, IPAddresses: ips, Usage: usageDual}
+	svc, known := p.Services[service]
+	if known {
+		req.Usage = svc.Usage
+	}
+	req.Usage = cmp.Or(usage, req.Usage)
+	if len(names) == 0 && len(ips) == 0 {
+		req.DNSNames = p.allowedNames(service)
+		req.IPAddresses = svc.IPAddresses
+	}
+	return req
+}
+
+// validDNSName accepts a host name or a wildcard over one, *.<name>, where
+// the name has at least two labels.
+func validDNSName(name string) bool {
+	if rest, ok := strings.CutPrefix(name, "*."); ok {
+		return strings.Contains(rest, ".") && !strings.Contains(rest, "*") && rest[0] != '.'
+	}
+	return name != "" && !strings.Contains(name, "*")
+}
+
+// serviceFor finds the known service whose certificate may carry all of
+// names. Certificates over ACME are only issued for those.
+func (p Policy) serviceFor(names []string) (string, error) {
+	for _, service := range slices.Sorted(maps.Keys(p.Services)) {
+		allowed := p.allowedNames(service)
+		if !slices.ContainsFunc(names, func(name string) bool { return !slices.Contains(allowed, name) }) {
+			return service, nil
+		}
+	}
+	return "", fmt.Errorf("%v are not names of one known service", names)
+}
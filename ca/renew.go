@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Renewer keeps the certificates of the known services in store current,
+// under the names managedCerts gives them. A certificate is issued again,
+// with a new key, once RenewAt of its lifetime has passed, or right away if
+// it is missing, from another CA, revoked or no longer matches the service's
+// configuration or the CA's chain.
+type Renewer struct {
+	issuer  *Issuer
+	crl     *CRLPublisher
+	store   SecretStore
+	certs   map[string]certRequest
+	renewAt float64
+	key     KeyConfig
+
+	// renewMu keeps a scheduled check and one after a revocation from
+	// renewing the same certificate twice.
+	renewMu sync.Mutex
+
+	mu      sync.Mutex
+	tracked map[string]renewal
+}
+
+// renewal is when a managed certificate expires and will be renewed.
+// Service is the name it is stored under.
+type renewal struct {
+	Service  string    `json:"service"`
+	Serial   string    `json:"serial"`
+	NotAfter time.Time `json:"not_after"`
+	RenewAt  time.Time `json:"renew_at"`
+}
+
+func NewRenewer(issuer *Issuer, crl *CRLPublisher, store SecretStore, services map[string]ServiceConfig, renewAt float64, key KeyConfig) *Renewer {
+	return &Renewer{issuer: issuer, crl: crl, store: store, certs: managedCerts(services), renewAt: renewAt, key: key, tracked: make(map[string]renewal)}
+}
+
+// clientCertSuffix names the client certificate of a service with
+// client_cert.
+const clientCertSuffix = "-client"
+
+// managedCerts are the certificates the renewer keeps for services, by the
+// name they are stored under: one per service with its configured names,
+// addresses and usage, and <service>-client with client usage and no names
+// for a service with client_cert.
+func managedCerts(services map[string]ServiceConfig) map[string]certRequest {
+	certs := make(map[string]certRequest)
+	for service, svc := range services {
+		certs[service] = certRequest{
+			Service:     service,
+			Requester:   "renewer",
+			DNSNames:    svc.DNSNames,
+			IPAddresses: svc.IPAddresses,
+			Usage:       svc.Usage,
+		}
+		if svc.ClientCert {
+			certs[service+clientCertSuffix] = certRequest{Service: service, Requester: "renewer", Usage: usageClient}
+		}
+	}
+	return certs
+}
+
+// renewDue renews every certificate that is due and reports the first
+// failure; the others are still attempted.
+func (r *Renewer) renewDue(now time.Time) error {
+	r.renewMu.Lock()
+	defer r.renewMu.Unlock()
+	var first error
+	for _, name := range slices.Sorted(maps.Keys(r.certs)) {
+		cert, reason := r.due(name, now)
+		if reason == "" {
+			r.track(name, cert)
+			continue
+		}
+		if err := r.renew(name); err != nil {
+			slog.Error("Renewal failed", "component", "renew", "service", name, "reason", reason, "error", err)
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		slog.Info("Issued a new certificate", "component", "renew", "service", name, "reason", reason)
+	}
+	return first
+}
+
+// due says why the certificate stored as name needs replacing, or "" if it
+// doesn't.
+func (r *Renewer) due(name string, now time.Time) (*x509.Certificate, string) {
+	data, _, err := r.store.Load(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "no certificate"
+	}
+	if err != nil {
+		return nil, err.Error()
+	}
+	block, chain := pem.Decode(data)
+	if block == nil {
+		return nil, "unreadable certificate"
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, "unreadable certificate"
+	}
+	if cert.CheckSignatureFrom(r.issuer.cert) != nil {
+		return nil, "issued by another CA"
+	}
+	if !bytes.Equal(bytes.TrimSpace(chain), bytes.TrimSpace(r.issuer.chain())) {
+		return nil, "CA chain changed"
+	}
+	if _, revoked := r.crl.revocation(cert.SerialNumber.Text(16)); revoked {
+		return nil, "revoked"
+	}
+	if !matches(cert, r.certs[name]) {
+		return nil, "configuration changed"
+	}
+	if !now.Before(r.renewalTime(cert)) {
+		return nil, fmt.Sprintf("expires %s", cert.NotAfter.Format(time.DateOnly))
+	}
+	return cert, ""
+}
+
+func (r *Renewer) renew(name string) error {
+	key, err := generateKey(r.key)
+	if err != nil {
+		return err
+	}
+	cert, err := r.issuer.issue(r.certs[name], key.Public())
+	if err != nil {
+		return err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	if err := r.store.Store(name, r.issuer.bundle(cert), keyPEM); err != nil {
+		return err
+	}
+	r.track(name, cert)
+	return nil
+}
+
+// manages says whether name is a certificate the renewer keeps.
+func (r *Renewer) manages(name string) bool {
+	_, ok := r.certs[name]
+	return ok
+}
+
+// matches says whether cert has the names, addresses and usage of req.
+func matches(cert *x509.Certificate, req certRequest) bool {
+	ips := make([]string, len(cert.IPAddresses))
+	for i, ip := range cert.IPAddresses {
+		ips[i] = ip.String()
+	}
+	want := make([]string, len(req.IPAddresses))
+	for i, ip := range req.IPAddresses {
+		want[i] = net.ParseIP(ip).String()
+	}
+	return slices.Equal(cert.DNSNames, req.DNSNames) && slices.Equal(ips, want) &&
+		slices.Equal(cert.ExtKeyUsage, extKeyUsage(req.Usage))
+}
+
+func (r *Renewer) renewalTime(cert *x509.Certificate) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotBefore.Add(time.Duration(float64(lifetime) * r.renewAt))
+}
+
+func (r *Renewer) track(name string, cert *x509.Certificate) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tracked[name] = renewal{
+		Service:  name,
+		Serial:   fmt.Sprintf("%x", cert.SerialNumber),
+		NotAfter: cert.NotAfter,
+		RenewAt:  r.renewalTime(cert),
+	}
+}
+
+// current is the managed certificate stored as name.
+func (r *Renewer) current(name string) renewal {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tracked[name]
+}
+
+// renewals lists the managed certificates, soonest renewal first.
+func (r *Renewer) renewals() []renewal {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := slices.Collect(maps.Values(r.tracked))
+	slices.SortFunc(list, func(a, b renewal) int { return a.RenewAt.Compare(b.RenewAt) })
+	return list
+}
+
+// Run checks for due certificates every interval.
+func (r *Renewer) Run(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		r.renewDue(now)
+	}
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
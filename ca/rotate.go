@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// rotation is a root rotation in its grace period, kept in rotation.json
+// next to ca.crt. Until RetireAt peers trust both roots, and certificates
+// issued under the new one come with it cross-signed by the previous one,
+// so peers that only loaded the previous root accept them too.
+type rotation struct {
+	Previous    string    `json:"previous"`
+	CrossSigned string    `json:"cross_signed"`
+	StartedAt   time.Time `json:"started_at"`
+	RetireAt    time.Time `json:"retire_at"`
+
+	previous *x509.Certificate
+	cross    *x509.Certificate
+}
+
+// rotate replaces the root with a new one, cross-signed by the current
+// root, which peers keep trusting for cfg.RotationGrace. In intermediate
+// mode that is the root in cfg.RootDir, and a new intermediate is signed
+// under the new root.
+func rotate(cfg Config, db *CertDB, store SecretStore) (*Issuer, error) {
+	current, err := openIssuer(cfg, db, store)
+	if err != nil {
+		return nil, err
+	}
+	if current.rotation != nil {
+		return nil, fmt.Errorf("the previous root is trusted until %s; rotate again once it has retired",
+			current.rotation.RetireAt.Format(time.RFC3339))
+	}
+	rootStore, rootName := store, "ca"
+	if cfg.Intermediate {
+		rootStore, rootName = FileStore{dir: cfg.RootDir, keyPerm: 0600}, "root"
+	}
+	root, rootKey, err := loadKeyPair(rootStore, rootName)
+	if err != nil {
+		return nil, fmt.Errorf("the current root must sign the new one: %w", err)
+	}
+
+	now := time.Now()
+	key, err := generateKey(cfg.CAKey)
+	if err != nil {
+		return nil, err
+	}
+	// The new root gets a subject of its own, so peers and tools never
+	// mistake one root for the other.
+	subject := rootSubject
+	subject.SerialNumber = now.UTC().Format("20060102T150405Z")
+	next, err := createCA(subject, cfg.CALifetime, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	cross, err := crossSign(next, root, rootKey)
+	if err != nil {
+		return nil, err
+	}
+
+	r := rotation{
+		Previous:    string(encodeCert(root)),
+		CrossSigned: string(encodeCert(cross)),
+		StartedAt:   now.UTC(),
+		RetireAt:    now.Add(cfg.RotationGrace).UTC(),
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	// rotation.json goes first: if the new root never gets stored, it
+	// doesn't match the root and is dropped at the next start.
+	if err := writeFileAtomic(filepath.Join(cfg.Dir, "rotation.json"), data, 0644); err != nil {
+		return nil, err
+	}
+	if err := storeKeyPair(rootStore, rootName, next, key); err != nil {
+		return nil, err
+	}
+	slog.Info("Created a new root", "component", "rotate", "serial", fmt.Sprintf("%x", next.SerialNumber), "not_after", next.NotAfter.Format(time.DateOnly),
+		"previous_serial", fmt.Sprintf("%x", root.SerialNumber), "previous_trusted_until", r.RetireAt.Format(time.RFC3339))
+	return newIssuer(cfg, db, store, false)
+}
+
+// crossSign issues root's subject and key again under parent, so a chain
+// through it reaches parent for peers that don't trust root yet.
+func crossSign(root, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		RawSubject:            root.RawSubject,
+		SubjectKeyId:          root.SubjectKeyId,
+		NotBefore:             root.NotBefore,
+		NotAfter:              root.NotAfter,
+		KeyUsage:              root.KeyUsage,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if parent.NotAfter.Before(template.NotAfter) {
+		template.NotAfter = parent.NotAfter
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, parent, root.PublicKey, parentKey)
+	if err != nil {
+		return nil, fmt.Errorf("cross-signing the new root: %w", err)
+	}
+	return x509.ParseCertificate(der)
+}
+
+// loadRotation picks up the rotation in rotation.json, if there is one for
+// the current root whose grace period isn't over. Any other is left from a
+// rotation that was interrupted, a CA replaced since or a root that has
+// retired; with remove set, it is deleted.
+func (i *Issuer) loadRotation(remove bool) error {
+	path := filepath.Join(i.dir, "rotation.json")
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var r rotation
+	if err := json.Unmarshal(data, &r); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	if r.previous, err = parseCertPEM(r.Previous); err != nil {
+		return fmt.Errorf("%s: previous: %w", path, err)
+	}
+	if r.cross, err = parseCertPEM(r.CrossSigned); err != nil {
+		return fmt.Errorf("%s: cross_signed: %w", path, err)
+	}
+
+	var stale string
+	switch {
+	case !bytes.Equal(r.cross.RawSubjectPublicKeyInfo, i.root.RawSubjectPublicKeyInfo) || r.cross.CheckSignatureFrom(r.previous) != nil:
+		stale = "it is not for the current root"
+	case !time.Now().Before(r.RetireAt):
+		stale = fmt.Sprintf("the previous root, serial %x, retired %s", r.previous.SerialNumber, r.RetireAt.Format(time.RFC3339))
+	}
+	if stale == "" {
+		slog.Info("Rotation in progress", "component", "rotate",
+			"previous_serial", fmt.Sprintf("%x", r.previous.SerialNumber), "previous_trusted_until", r.RetireAt.Format(time.RFC3339))
+		i.mu.Lock()
+		i.rotation = &r
+		i.mu.Unlock()
+		return nil
+	}
+	if !remove {
+		return nil
+	}
+	slog.Info("Removing", "component", "rotate", "path", path, "reason", stale)
+	return os.Remove(path)
+}
+
+// retire waits for the grace period of the rotation in progress to end,
+// then drops the previous root from ca.crt and the cross-signed root from
+// the chain, which has the renewer reissue the service certificates at its
+// next check.
+func (i *Issuer) retire() {
+	i.mu.RLock()
+	r := i.rotation
+	i.mu.RUnlock()
+	if r == nil {
+		return
+	}
+	time.Sleep(time.Until(r.RetireAt))
+
+	i.mu.Lock()
+	i.rotation = nil
+	i.mu.Unlock()
+	if err := writeFileAtomic(filepath.Join(i.dir, "ca.crt"), i.trustPEM(), 0644); err != nil {
+		// rotation.json stays, so the next start retires the root again.
+		slog.Error("Retiring the previous root failed", "component", "rotate", "error", err)
+		return
+	}
+	if err := os.Remove(filepath.Join(i.dir, "rotation.json")); err != nil {
+		slog.Error("Removing rotation.json failed", "component", "rotate", "error", err)
+	}
+	slog.Info("The previous root retired; ca.crt only has the current root", "component", "rotate", "previous_serial", fmt.Sprintf("%x", r.previous.SerialNumber))
+}
+
+func parseCertPEM(s string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
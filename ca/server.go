@@ -0,0 +1,403 @@
+package main
+
+import (
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-tln/notes/logging"
+)
+
+const maxCSRSize = 64 << 10
+
+type signRequest struct {
+	CSR   string `json:"csr"`
+	Usage string `json:"usage,omitempty"`
+}
+
+type signResponse struct {
+	Certificate string    `json:"certificate"`
+	CA          string    `json:"ca"`
+	NotAfter    time.Time `json:"not_after"`
+}
+
+// Server issues certificates over HTTPS. Callers authenticate with their
+// mesh certificate. The listener uses the ca-service certificate the renewer
+// keeps in certs.
+type Server struct {
+	issuer    *Issuer
+	policy    Policy
+	renewer   *Renewer
+	crl       *CRLPublisher
+	ocsp      *OCSPResponder
+	acme      *ACMEServer
+	expiry    *ExpiryMonitor
+	tokens    *TokenIssuer
+	bootstrap *BootstrapTokens
+	certs     SecretStore
+
+	mu     sync.Mutex
+	cert   *tls.Certificate
+	serial string
+}
+
+func (s *Server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /sign", s.handleSign)
+	mux.HandleFunc("GET /ca.crt", s.handleCA)
+	mux.HandleFunc("GET /renewals", s.handleRenewals)
+	mux.HandleFunc("GET /certs", s.handleCerts)
+	mux.HandleFunc("GET /crl", s.handleCRL)
+	mux.HandleFunc("POST /revoke/{serial}", s.handleRevoke)
+	mux.Handle("POST /ocsp", s.ocsp)
+	mux.Handle("GET /ocsp/{request...}", s.ocsp)
+	mux.Handle("GET /metrics", s.expiry)
+	mux.HandleFunc("/admin/log/level", s.handleLogLevel)
+	if s.acme != nil {
+		s.acme.register(mux)
+	}
+	if s.tokens != nil {
+		s.tokens.register(mux)
+	}
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	return mux
+}
+
+// ListenAndServe serves the API over HTTPS.
+func (s *Server) ListenAndServe(addr string) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           logging.Middleware(s.routes()),
+		TLSConfig:         s.tlsConfig("h2", "http/1.1"),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	slog.Info("Signing service listening", "addr", addr)
+	return srv.ListenAndServeTLS("", "")
+}
+
+// tlsConfig serves the ca-service certificate and accepts client
+// certificates under the roots in ca.crt, which change when a rotated root
+// retires, unless the CRL revokes them.
+func (s *Server) tlsConfig(protos ...string) *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{
+				GetCertificate:   s.getCertificate,
+				ClientAuth:       tls.VerifyClientCertIfGiven,
+				ClientCAs:        s.issuer.roots(),
+				VerifyConnection: s.crl.verifyConnection,
+				MinVersion:       tls.VersionTLS12,
+				NextProtos:       protos,
+			}, nil
+		},
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// handleSign signs a PEM CSR posted as {"csr": "..."}. A CSR without DNS
+// names or IP addresses gets all those configured for the service;
+// "usage": "server", "client" or "dual" asks for a usage other than the
+// service's own.
+func (s *Server) handleSign(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		http.Error(w, "client certificate required", http.StatusUnauthorized)
+		return
+	}
+	caller := peerSPIFFEID(r.TLS.VerifiedChains[0][0])
+
+	var req signRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCSRSize)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	csr, err := parseCSR(req.CSR)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Usage != "" && req.Usage != usageServer && req.Usage != usageClient && req.Usage != usageDual {
+		http.Error(w, fmt.Sprintf("unknown usage %q, want server, client or dual", req.Usage), http.StatusBadRequest)
+		return
+	}
+	service, err := s.policy.authorize(caller, csr, req.Usage)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Refused CSR", "component", "sign", "caller", caller, "error", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	cert, err := s.sign(service, caller, csr, req.Usage)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Signing failed", "component", "sign", "error", err)
+		http.Error(w, "signing failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(signResponse{
+		Certificate: string(s.issuer.bundle(cert)),
+		CA:          string(s.issuer.trustPEM()),
+		NotAfter:    cert.NotAfter,
+	})
+}
+
+// sign issues the certificate for service that csr asks for, once
+// authorize has allowed it, to requester.
+func (s *Server) sign(service, requester string, csr *x509.CertificateRequest, usage string) (*x509.Certificate, error) {
+	ips := make([]string, len(csr.IPAddresses))
+	for i, ip := range csr.IPAddresses {
+		ips[i] = ip.String()
+	}
+	request := s.policy.request(service, requester, csr.DNSNames, ips, usage)
+	cert, err := s.issuer.issue(request, csr.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Issued a certificate", "component", "sign", "usage", request.Usage, "service", service, "requester", requester, "serial", fmt.Sprintf("%x", cert.SerialNumber),
+		"names", request.DNSNames, "addresses", request.IPAddresses, "not_after", cert.NotAfter.Format(time.DateOnly))
+	return cert, nil
+}
+
+// getCertificate loads the listener's pair again once the renewer has
+// replaced it.
+func (s *Server) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	current := s.renewer.current("ca-service")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cert == nil || current.Serial != s.serial {
+		cert, err := s.loadCertificate()
+		if err != nil && s.cert == nil {
+			return nil, err
+		}
+		if err == nil {
+			s.cert, s.serial = cert, current.Serial
+		}
+	}
+	return s.cert, nil
+}
+
+func (s *Server) loadCertificate() (*tls.Certificate, error) {
+	certPEM, keyPEM, err := s.certs.Load("ca-service")
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	return &cert, err
+}
+
+func (s *Server) handleRenewals(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.renewer.renewals())
+}
+
+// certEntry is an issued certificate as /certs lists it.
+type certEntry struct {
+	IssuedCert
+	Revoked bool `json:"revoked,omitempty"`
+}
+
+// handleCerts lists issued certificates, soonest expiry first. Admins see
+// all of them, services only their own. Expired certificates are left out
+// unless ?expired=true; ?expiring_within=720h keeps those that expire
+// within that time and ?service=app1 those of one service.
+func (s *Server) handleCerts(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		http.Error(w, "client certificate required", http.StatusUnauthorized)
+		return
+	}
+	caller := peerSPIFFEID(r.TLS.VerifiedChains[0][0])
+	query := r.URL.Query()
+	service := query.Get("service")
+	if !slices.Contains(s.policy.Admins, caller) {
+		own, ok := strings.CutPrefix(caller, spiffeID("").String())
+		if !ok || service != "" && service != own {
+			http.Error(w, fmt.Sprintf("%s may only list its own certificates", caller), http.StatusForbidden)
+			return
+		}
+		service = own
+	}
+	var within time.Duration
+	if v := query.Get("expiring_within"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "expiring_within: want a positive duration such as 720h", http.StatusBadRequest)
+			return
+		}
+		within = d
+	}
+	var expired bool
+	if v := query.Get("expired"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "expired: want true or false", http.StatusBadRequest)
+			return
+		}
+		expired = b
+	}
+
+	certs := s.issuer.db.list(certFilter(service, within, expired, time.Now()))
+	entries := make([]certEntry, len(certs))
+	for i, c := range certs {
+		_, revoked := s.crl.revocation(c.Serial)
+		entries[i] = certEntry{IssuedCert: c, Revoked: revoked}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+type revokeRequest struct {
+	Reason  string `json:"reason"`
+	Comment string `json:"comment"`
+}
+
+// handleRevoke revokes a certificate of the current CA by its hex serial.
+// Admins may revoke any certificate, services only their own. The body,
+// {"reason": "keyCompromise", "comment": "..."}, is optional.
+func (s *Server) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		http.Error(w, "client certificate required", http.StatusUnauthorized)
+		return
+	}
+	caller := peerSPIFFEID(r.TLS.VerifiedChains[0][0])
+
+	var req revokeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCSRSize)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Reason = cmp.Or(req.Reason, "unspecified")
+	if _, ok := revocationReasons[req.Reason]; !ok {
+		http.Error(w, fmt.Sprintf("unknown reason %q", req.Reason), http.StatusBadRequest)
+		return
+	}
+	serial, ok := parseSerial(r.PathValue("serial"))
+	if !ok {
+		http.Error(w, "serial: want a hex serial number", http.StatusBadRequest)
+		return
+	}
+	cert, ok := s.issuer.db.lookup(hex.EncodeToString(s.issuer.cert.SubjectKeyId), serial)
+	if !ok {
+		http.Error(w, "no certificate with this serial from the current CA", http.StatusNotFound)
+		return
+	}
+	if caller != spiffeID(cert.Service).String() && !slices.Contains(s.policy.Admins, caller) {
+		logging.FromContext(r.Context()).Warn("Refused revocation", "component", "revoke", "serial", cert.Serial, "service", cert.Service, "caller", caller)
+		http.Error(w, fmt.Sprintf("%s may not revoke certificates of %s", caller, cert.Service), http.StatusForbidden)
+		return
+	}
+
+	rev := Revocation{
+		Serial:    cert.Serial,
+		RevokedAt: time.Now().UTC(),
+		Reason:    req.Reason,
+		Service:   cert.Service,
+		RevokedBy: caller,
+		Comment:   req.Comment,
+	}
+	err := s.crl.revoke(rev)
+	if errors.Is(err, errAlreadyRevoked) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Revocation failed", "component", "revoke", "serial", cert.Serial, "error", err)
+		http.Error(w, "revocation failed", http.StatusInternalServerError)
+		return
+	}
+	logging.FromContext(r.Context()).Info("Revoked a certificate", "component", "revoke", "by", caller, "serial", cert.Serial, "service", cert.Service, "reason", rev.Reason, "comment", rev.Comment)
+	// A certificate the CA manages is replaced now rather than at the next
+	// check.
+	go s.renewer.renewDue(time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rev)
+}
+
+// handleLogLevel shows and sets the log level, for admins only.
+func (s *Server) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		http.Error(w, "client certificate required", http.StatusUnauthorized)
+		return
+	}
+	if caller := peerSPIFFEID(r.TLS.VerifiedChains[0][0]); !slices.Contains(s.policy.Admins, caller) {
+		logging.FromContext(r.Context()).Warn("Refused log level access", "caller", caller)
+		http.Error(w, caller+" may not change the log level", http.StatusForbidden)
+		return
+	}
+	logging.LevelHandler().ServeHTTP(w, r)
+}
+
+func (s *Server) handleCRL(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(s.crl.current())
+}
+
+func (s *Server) handleCA(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(s.issuer.trustPEM())
+}
+
+// certFilter matches the certificates of service, or of all services if it
+// is empty, that expire within the given time if it is set. Expired ones
+// only match if expired is true.
+func certFilter(service string, within time.Duration, expired bool, now time.Time) func(IssuedCert) bool {
+	return func(c IssuedCert) bool {
+		switch {
+		case service != "" && c.Service != service:
+			return false
+		case !expired && !now.Before(c.NotAfter):
+			return false
+		case within > 0 && c.NotAfter.After(now.Add(within)):
+			return false
+		}
+		return true
+	}
+}
+
+// parseSerial normalizes a hex serial number, with or without the colons
+// OpenSSL prints, to the form the database uses.
+func parseSerial(s string) (string, bool) {
+	serial, ok := new(big.Int).SetString(strings.ReplaceAll(s, ":", ""), 16)
+	if !ok {
+		return "", false
+	}
+	return serial.Text(16), true
+}
+
+func parseCSR(s string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("csr: want a PEM CERTIFICATE REQUEST")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("csr: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("csr: %w", err)
+	}
+	return csr, nil
+}
+
+func peerSPIFFEID(cert *x509.Certificate) string {
+	for _, u := range cert.URIs {
+		if u.Scheme == "spiffe" {
+			return u.String()
+		}
+	}
+	return ""
+}
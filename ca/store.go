@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// SecretStore keeps certificates together with their private keys: the
+// CA's own and those the renewer issues to services. Certificates are PEM,
+// the leaf first if there is a chain.
+type SecretStore interface {
+	// Load returns the pair stored under name, or an error wrapping
+	// os.ErrNotExist if there is none.
+	Load(name string) (certPEM, keyPEM []byte, err error)
+	// Store replaces the pair under name.
+	Store(name string, certPEM, keyPEM []byte) error
+}
+
+// FileStore keeps pairs as <name>.crt and <name>.key in dir, the layout
+// sidecars read from the shared volume.
+type FileStore struct {
+	dir     string
+	keyPerm os.FileMode
+}
+
+func (f FileStore) Load(name string) ([]byte, []byte, error) {
+	certPEM, err := os.ReadFile(filepath.Join(f.dir, name+".crt"))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(f.dir, name+".key"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+// Store writes the key first: a sidecar that sees the new key with the old
+// certificate fails to load the pair and tries again on its next check.
+func (f FileStore) Store(name string, certPEM, keyPEM []byte) error {
+	if err := writeFileAtomic(filepath.Join(f.dir, name+".key"), keyPEM, f.keyPerm); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(f.dir, name+".crt"), certPEM, 0644)
+}
+
+// openStores returns the store for the CA's own keys and the one service
+// certificates are published to.
+func openStores(cfg Config) (caStore, certStore SecretStore, err error) {
+	switch cfg.Store.Type {
+	case storeVault:
+		caStore, err = NewVaultStore(cfg.Store.Vault, "ca")
+		if err != nil {
+			return nil, nil, err
+		}
+		certStore, err = NewVaultStore(cfg.Store.Vault, "services")
+		return caStore, certStore, err
+	case storeKubernetes:
+		store, err := NewKubernetesStore(cfg.Store.Kubernetes)
+		return store, store, err
+	default:
+		return FileStore{dir: cfg.Dir, keyPerm: 0600}, FileStore{dir: cfg.Dir, keyPerm: 0644}, nil
+	}
+}
+
+// serviceStore is where service certificates go: certStore, and with
+// pkcs12 enabled a keystore per managed certificate next to the PEM files.
+func serviceStore(cfg Config, certStore SecretStore, issuer *Issuer) (SecretStore, error) {
+	if !cfg.PKCS12.Enabled {
+		return certStore, nil
+	}
+	return NewPKCS12Store(certStore, cfg.Dir, cfg.PKCS12, issuer.trusted(), slices.Sorted(maps.Keys(managedCerts(cfg.Services))))
+}
+
+func storeKeyPair(store SecretStore, name string, cert *x509.Certificate, key crypto.Signer) error {
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	return store.Store(name, encodeCert(cert), keyPEM)
+}
+
+func loadKeyPair(store SecretStore, name string) (*x509.Certificate, crypto.Signer, error) {
+	certPEM, keyPEM, err := store.Load(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", name, err)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: unsupported key", name)
+	}
+	return pair.Leaf, key, nil
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-tln/notes/logging"
+)
+
+// TokenConfig enables JWTs for services that authenticate over plain HTTP.
+// A service gets one from POST /token with its mesh certificate, and the
+// service it calls checks it against the keys at /.well-known/jwks.json.
+// Audiences lists who tokens may be for; without it, any configured
+// service.
+type TokenConfig struct {
+	Enabled   bool          `yaml:"enabled"`
+	Issuer    string        `yaml:"issuer"`
+	Lifetime  time.Duration `yaml:"lifetime"`
+	Audiences []string      `yaml:"audiences"`
+}
+
+const maxTokenRequestSize = 4 << 10
+
+type tokenRequest struct {
+	Audience string `json:"audience"`
+}
+
+type tokenResponse struct {
+	Token     string    `json:"token"`
+	TokenType string    `json:"token_type"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// TokenIssuer signs workload JWTs whose subject is the caller's SPIFFE ID.
+// Its key is its own rather than the CA's, so a root rotation doesn't touch
+// tokens; the store keeps it as "token-signing" with a self-signed
+// certificate. A new key replaces it once a token signed now would outlive
+// it, and the old one moves to "token-signing-previous" and stays in the
+// JWKS until the last token it signed has expired.
+type TokenIssuer struct {
+	cfg         TokenConfig
+	services    map[string]ServiceConfig
+	store       SecretStore
+	keyCfg      KeyConfig
+	keyLifetime time.Duration
+
+	mu       sync.RWMutex
+	current  *signingKey
+	previous *signingKey
+}
+
+// signingKey is a token signing key with the certificate it is stored with
+// and its JWK.
+type signingKey struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	alg  string
+	jwk  map[string]string
+}
+
+func NewTokenIssuer(cfg TokenConfig, services map[string]ServiceConfig, store SecretStore, keyCfg KeyConfig, keyLifetime time.Duration) (*TokenIssuer, error) {
+	t := &TokenIssuer{cfg: cfg, services: services, store: store, keyCfg: keyCfg, keyLifetime: keyLifetime}
+
+	cert, key, err := loadKeyPair(store, "token-signing")
+	switch {
+	case err == nil:
+		if t.current, err = newSigningKey(cert, key); err != nil {
+			return nil, err
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("load the token signing key: %w", err)
+	}
+
+	cert, key, err = loadKeyPair(store, "token-signing-previous")
+	switch {
+	case err == nil:
+		if t.previous, err = newSigningKey(cert, key); err != nil {
+			return nil, err
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("load the previous token signing key: %w", err)
+	}
+
+	if err := t.rotateDue(time.Now()); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func newSigningKey(cert *x509.Certificate, key crypto.Signer) (*signingKey, error) {
+	k := &signingKey{cert: cert, key: key}
+	var canonical string
+	switch pub := key.Public().(type) {
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		crv := pub.Curve.Params().Name
+		k.alg = map[string]string{"P-256": "ES256", "P-384": "ES384", "P-521": "ES512"}[crv]
+		x, y := b64.EncodeToString(pub.X.FillBytes(make([]byte, size))), b64.EncodeToString(pub.Y.FillBytes(make([]byte, size)))
+		k.jwk = map[string]string{"kty": "EC", "crv": crv, "x": x, "y": y}
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, crv, x, y)
+	case *rsa.PublicKey:
+		k.alg = "RS256"
+		n, e := b64.EncodeToString(pub.N.Bytes()), b64.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		k.jwk = map[string]string{"kty": "RSA", "n": n, "e": e}
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, e, n)
+	}
+	if k.alg == "" {
+		return nil, errors.New("token signing key: unsupported key type")
+	}
+	// The key ID is the RFC 7638 thumbprint.
+	sum := sha256.Sum256([]byte(canonical))
+	k.jwk["kid"], k.jwk["alg"], k.jwk["use"] = b64.EncodeToString(sum[:]), k.alg, "sig"
+	return k, nil
+}
+
+// rotateDue makes a new signing key when there is none or a token minted at
+// now would expire after the current one.
+func (t *TokenIssuer) rotateDue(now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current != nil && now.Add(t.cfg.Lifetime).Before(t.current.cert.NotAfter) {
+		return nil
+	}
+
+	key, err := generateKey(t.keyCfg)
+	if err != nil {
+		return err
+	}
+	cert, err := tokenSigningCert(key, t.keyLifetime)
+	if err != nil {
+		return err
+	}
+	next, err := newSigningKey(cert, key)
+	if err != nil {
+		return err
+	}
+	if t.current != nil {
+		if err := storeKeyPair(t.store, "token-signing-previous", t.current.cert, t.current.key); err != nil {
+			return err
+		}
+	}
+	if err := storeKeyPair(t.store, "token-signing", cert, key); err != nil {
+		return err
+	}
+	if t.current != nil {
+		t.previous = t.current
+	}
+	t.current = next
+	slog.Info("Created a new token signing key", "component", "token", "kid", next.jwk["kid"], "not_after", cert.NotAfter.Format(time.DateOnly))
+	return nil
+}
+
+// Run replaces the signing key ahead of its expiry, checking every interval.
+func (t *TokenIssuer) Run(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if err := t.rotateDue(now); err != nil {
+			slog.Error("Failed to rotate the token signing key", "component", "token", "error", err)
+		}
+	}
+}
+
+// signer returns the key to sign with, rotating first if it is due; the
+// periodic check may not have run yet.
+func (t *TokenIssuer) signer(now time.Time) (*signingKey, error) {
+	t.mu.RLock()
+	k := t.current
+	t.mu.RUnlock()
+	if now.Add(t.cfg.Lifetime).Before(k.cert.NotAfter) {
+		return k, nil
+	}
+	if err := t.rotateDue(now); err != nil {
+		return nil, err
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.current, nil
+}
+
+// keys lists the JWKs to publish: the current key, and the previous one
+// while tokens it signed may still be valid. It signed nothing after its
+// certificate expired, so its tokens are gone one lifetime after that.
+func (t *TokenIssuer) keys(now time.Time) []map[string]string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	keys := []map[string]string{t.current.jwk}
+	if t.previous != nil && now.Before(t.previous.cert.NotAfter.Add(t.cfg.Lifetime)) {
+		keys = append(keys, t.previous.jwk)
+	}
+	return keys
+}
+
+// tokenSigningCert only carries the key in the store; nothing verifies it.
+func tokenSigningCert(key crypto.Signer, lifetime time.Duration) (*x509.Certificate, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"Notes Service Mesh CA"}, CommonName: "notes-token-signing"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// allowed says whether tokens may be issued for audience.
+func (t *TokenIssuer) allowed(audience string) bool {
+	if len(t.cfg.Audiences) > 0 {
+		return slices.Contains(t.cfg.Audiences, audience)
+	}
+	_, ok := t.services[audience]
+	return ok
+}
+
+// mint signs a token for subject, a SPIFFE ID, valid for audience until
+// the time it returns.
+func (t *TokenIssuer) mint(subject, audience string) (string, time.Time, error) {
+	now := time.Now()
+	exp := now.Add(t.cfg.Lifetime)
+	key, err := t.signer(now)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	header, err := json.Marshal(map[string]string{"alg": key.alg, "typ": "JWT", "kid": key.jwk["kid"]})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"iss": t.cfg.Issuer,
+		"sub": subject,
+		"aud": audience,
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": exp.Unix(),
+		"jti": hex.EncodeToString(id),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	input := b64.EncodeToString(header) + "." + b64.EncodeToString(claims)
+	sig, err := key.sign([]byte(input))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return input + "." + b64.EncodeToString(sig), exp, nil
+}
+
+// sign makes a JWS signature: r and s side by side for ECDSA (RFC 7518,
+// section 3.4), PKCS #1 v1.5 for RSA.
+func (k *signingKey) sign(input []byte) ([]byte, error) {
+	switch key := k.key.(type) {
+	case *ecdsa.PrivateKey:
+		hash := map[string]crypto.Hash{"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512}[k.alg]
+		h := hash.New()
+		h.Write(input)
+		r, s, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...), nil
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256(input)
+		return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	}
+	return nil, errors.New("unsupported key")
+}
+
+func (t *TokenIssuer) register(mux *http.ServeMux) {
+	mux.HandleFunc("POST /token", t.handleToken)
+	mux.HandleFunc("GET /.well-known/jwks.json", t.handleJWKS)
+	mux.HandleFunc("GET /.well-known/openid-configuration", t.handleDiscovery)
+}
+
+// handleToken issues a token to the service whose mesh certificate the
+// caller presents, for the audience posted as {"audience": "email"}.
+func (t *TokenIssuer) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		http.Error(w, "client certificate required", http.StatusUnauthorized)
+		return
+	}
+	caller := peerSPIFFEID(r.TLS.VerifiedChains[0][0])
+	if !strings.HasPrefix(caller, spiffeID("").String()) {
+		http.Error(w, "the client certificate has no SPIFFE ID of the mesh", http.StatusForbidden)
+		return
+	}
+	var req tokenRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxTokenRequestSize)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !t.allowed(req.Audience) {
+		logging.FromContext(r.Context()).Warn("Refused a token", "component", "token", "audience", req.Audience, "caller", caller)
+		http.Error(w, fmt.Sprintf("tokens are not issued for audience %q", req.Audience), http.StatusForbidden)
+		return
+	}
+	token, exp, err := t.mint(caller, req.Audience)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Signing failed", "component", "token", "error", err)
+		http.Error(w, "signing failed", http.StatusInternalServerError)
+		return
+	}
+	logging.FromContext(r.Context()).Info("Issued a token", "component", "token", "audience", req.Audience, "caller", caller, "expires", exp.Format(time.RFC3339))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(tokenResponse{Token: token, TokenType: "Bearer", ExpiresAt: exp.UTC()})
+}
+
+func (t *TokenIssuer) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=300")
+	json.NewEncoder(w).Encode(map[string]any{"keys": t.keys(time.Now())})
+}
+
+func (t *TokenIssuer) signingAlg() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.current.alg
+}
+
+// handleDiscovery is the OpenID Provider metadata, so OIDC libraries find
+// the keys from the issuer alone.
+func (t *TokenIssuer) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	issuer := strings.TrimSuffix(t.cfg.Issuer, "/")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                t.cfg.Issuer,
+		"jwks_uri":                              issuer + "/.well-known/jwks.json",
+		"token_endpoint":                        issuer + "/token",
+		"response_types_supported":              []string{"id_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{t.signingAlg()},
+	})
+}
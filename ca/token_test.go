@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenIssuerRotation(t *testing.T) {
+	store := FileStore{dir: t.TempDir(), keyPerm: 0600}
+	cfg := TokenConfig{Enabled: true, Issuer: "https://ca-service:8443", Lifetime: time.Hour}
+	keyCfg := KeyConfig{Type: keyECDSA, Curve: "P-256"}
+
+	issuer, err := NewTokenIssuer(cfg, nil, store, keyCfg, 90*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := issuer.current
+	if keys := issuer.keys(time.Now()); len(keys) != 1 {
+		t.Fatalf("JWKS of a new issuer has %d keys, want 1", len(keys))
+	}
+
+	// 31 minutes on, a token would outlive the key, so it is replaced.
+	now := time.Now().Add(31 * time.Minute)
+	if err := issuer.rotateDue(now); err != nil {
+		t.Fatal(err)
+	}
+	if issuer.current == first {
+		t.Fatal("rotateDue kept a key that expires before the tokens it would sign")
+	}
+	kids := map[string]bool{}
+	for _, k := range issuer.keys(now) {
+		kids[k["kid"]] = true
+	}
+	if !kids[first.jwk["kid"]] || !kids[issuer.current.jwk["kid"]] {
+		t.Errorf("JWKS after rotation = %v, want the current and the previous key", kids)
+	}
+
+	key, err := issuer.signer(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != issuer.current {
+		t.Error("signer did not return the new key")
+	}
+
+	// Restarted, the issuer keeps the new key and still publishes the old one.
+	restarted, err := NewTokenIssuer(cfg, nil, store, keyCfg, 90*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restarted.current.jwk["kid"] != issuer.current.jwk["kid"] {
+		t.Error("restart replaced a current key that is still good")
+	}
+	if keys := restarted.keys(time.Now()); len(keys) != 2 {
+		t.Errorf("JWKS after restart has %d keys, want 2", len(keys))
+	}
+
+	// Once every token the old key signed has expired, it is dropped.
+	if keys := issuer.keys(first.cert.NotAfter.Add(cfg.Lifetime + time.Second)); len(keys) != 1 {
+		t.Errorf("JWKS after the previous key's tokens expired has %d keys, want 1", len(keys))
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// VaultConfig points at a KV version 2 secrets engine in HashiCorp Vault.
+// The token is read from TokenFile on every request, so an agent can keep
+// it fresh; without a file, VAULT_TOKEN is used.
+type VaultConfig struct {
+	Address   string `yaml:"address"`
+	TokenFile string `yaml:"token_file"`
+	Mount     string `yaml:"mount"`
+	Path      string `yaml:"path"`
+	CACert    string `yaml:"ca_cert"`
+}
+
+// VaultStore keeps each pair as a secret <mount>/<path>/<dir>/<name> with
+// the keys certificate and private_key.
+type VaultStore struct {
+	cfg    VaultConfig
+	prefix string
+	client *http.Client
+}
+
+type vaultPair struct {
+	Certificate string `json:"certificate"`
+	PrivateKey  string `json:"private_key"`
+}
+
+func NewVaultStore(cfg VaultConfig, dir string) (*VaultStore, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CACert != "" {
+		pem, err := os.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CACert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	}
+	return &VaultStore{
+		cfg:    cfg,
+		prefix: strings.TrimSuffix(cfg.Address, "/") + "/v1/" + strings.Trim(cfg.Mount, "/") + "/data/" + strings.Trim(cfg.Path, "/") + "/" + dir + "/",
+		client: &http.Client{Timeout: 10 * time.Second, Transport: transport},
+	}, nil
+}
+
+func (v *VaultStore) Load(name string) ([]byte, []byte, error) {
+	var resp struct {
+		Data struct {
+			Data vaultPair `json:"data"`
+		} `json:"data"`
+	}
+	if err := v.do(http.MethodGet, name, nil, &resp); err != nil {
+		return nil, nil, err
+	}
+	pair := resp.Data.Data
+	return []byte(pair.Certificate), []byte(pair.PrivateKey), nil
+}
+
+func (v *VaultStore) Store(name string, certPEM, keyPEM []byte) error {
+	body, err := json.Marshal(map[string]vaultPair{
+		"data": {Certificate: string(certPEM), PrivateKey: string(keyPEM)},
+	})
+	if err != nil {
+		return err
+	}
+	return v.do(http.MethodPost, name, body, nil)
+}
+
+func (v *VaultStore) do(method, name string, body []byte, out any) error {
+	token := os.Getenv("VAULT_TOKEN")
+	if v.cfg.TokenFile != "" {
+		data, err := os.ReadFile(v.cfg.TokenFile)
+		if err != nil {
+			return fmt.Errorf("vault token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	req, err := http.NewRequest(method, v.prefix+url.PathEscape(name), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("vault: %w", err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound && method == http.MethodGet:
+		return fmt.Errorf("vault: %s: %w", name, os.ErrNotExist)
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("vault: %s %s: %s: %s", method, name, resp.Status, bytes.TrimSpace(data))
+	case out != nil:
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
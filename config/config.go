@@ -0,0 +1,256 @@
+// Package config reads a service's settings by their environment variable
+// names from three layers, each overriding the one before: the environment,
+// a YAML file of NAME: value pairs, and -name=value flags, where -db-host
+// sets DB_HOST. Values are parsed as they are read and fall back to the
+// default given; parse errors and failed checks are collected for Err, and
+// Dump logs what each setting came to and where from.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Where a setting's value came from.
+const (
+	FromDefault = "default"
+	FromEnv     = "env"
+	FromFile    = "file"
+	FromFlag    = "flag"
+)
+
+// Setting is a setting as it was read, for Dump. The value of a secret is
+// hidden.
+type Setting struct {
+	Name   string
+	Value  string
+	Source string
+}
+
+var (
+	mu       sync.Mutex
+	filePath string
+	file     map[string]string
+	flags    map[string]string
+	settings = map[string]Setting{}
+	errs     []error
+)
+
+// Load parses the flags in args and reads the file named by the setting
+// fileSetting, as an environment variable or a flag, if it is set. A flag
+// without a value, as -debug, is true.
+func Load(fileSetting string, args []string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	flags = map[string]string{}
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") || strings.Trim(arg, "-") == "" {
+			return fmt.Errorf("unexpected argument %q", arg)
+		}
+		name, value, ok := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !ok {
+			value = "true"
+		}
+		flags[normalize(name)] = value
+	}
+
+	file = map[string]string{}
+	if fileSetting == "" {
+		return nil
+	}
+	path, source, _ := lookup(fileSetting)
+	if path == "" {
+		return nil
+	}
+	filePath = path
+	settings[fileSetting] = Setting{fileSetting, path, source}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]any
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	for name, v := range values {
+		switch v := v.(type) {
+		case map[string]any:
+			return fmt.Errorf("%s: %s must be a value or a list", path, name)
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			file[normalize(name)] = strings.Join(items, ",")
+		case nil:
+			file[normalize(name)] = ""
+		default:
+			file[normalize(name)] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+func normalize(name string) string {
+	return strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// lookup is the value of the highest layer that sets name. An empty
+// environment variable counts as set, as for List.
+func lookup(name string) (value, source string, ok bool) {
+	if v, ok := flags[name]; ok {
+		return v, FromFlag, true
+	}
+	if v, ok := file[name]; ok {
+		return v, FromFile, true
+	}
+	if v, ok := os.LookupEnv(name); ok {
+		return v, FromEnv, true
+	}
+	return "", FromDefault, false
+}
+
+// read returns the value of name, or def if it is unset or empty, parsed
+// with parse. A value that doesn't parse is an error, and def is used.
+func read[T any](name string, def T, secret bool, parse func(string) (T, error), format func(T) string) T {
+	mu.Lock()
+	defer mu.Unlock()
+	v, source, _ := lookup(name)
+	result := def
+	if v != "" {
+		parsed, err := parse(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s (%s): invalid value %q", name, source, v))
+		} else {
+			result = parsed
+		}
+	} else {
+		source = FromDefault
+	}
+	shown := format(result)
+	if secret && shown != "" {
+		shown = "********"
+	}
+	settings[name] = Setting{name, shown, source}
+	return result
+}
+
+func parseString(v string) (string, error) { return v, nil }
+func formatString(v string) string         { return v }
+
+// String is a setting as it is.
+func String(name, def string) string {
+	return read(name, def, false, parseString, formatString)
+}
+
+// Secret is String for passwords, tokens and DSNs, which Dump doesn't show.
+func Secret(name, def string) string {
+	return read(name, def, true, parseString, formatString)
+}
+
+func Int(name string, def int) int {
+	return read(name, def, false, strconv.Atoi, strconv.Itoa)
+}
+
+func Float(name string, def float64) float64 {
+	return read(name, def, false, func(v string) (float64, error) {
+		return strconv.ParseFloat(v, 64)
+	}, func(f float64) string {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	})
+}
+
+func Bool(name string, def bool) bool {
+	return read(name, def, false, strconv.ParseBool, strconv.FormatBool)
+}
+
+func Duration(name string, def time.Duration) time.Duration {
+	return read(name, def, false, time.ParseDuration, time.Duration.String)
+}
+
+// List splits a comma-separated setting, or a list in the file. Setting it
+// to an empty value clears the default.
+func List(name, def string) []string {
+	mu.Lock()
+	defer mu.Unlock()
+	v, source, ok := lookup(name)
+	if !ok {
+		v = def
+	}
+	var items []string
+	for item := range strings.SplitSeq(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	settings[name] = Setting{name, strings.Join(items, ","), source}
+	return items
+}
+
+// Check records an error unless ok, for what can't be told from a single
+// value.
+func Check(ok bool, format string, args ...any) {
+	if ok {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	errs = append(errs, fmt.Errorf(format, args...))
+}
+
+// Err is every error so far, and the flags and file keys that name no
+// setting read so far: call it once all settings are read.
+func Err() error {
+	mu.Lock()
+	defer mu.Unlock()
+	all := slices.Clone(errs)
+	for _, name := range unread(flags) {
+		all = append(all, fmt.Errorf("flag -%s sets nothing this service reads", strings.ToLower(strings.ReplaceAll(name, "_", "-"))))
+	}
+	for _, name := range unread(file) {
+		all = append(all, fmt.Errorf("%s in %s sets nothing this service reads", name, filePath))
+	}
+	return errors.Join(all...)
+}
+
+func unread(values map[string]string) []string {
+	var names []string
+	for name := range values {
+		if _, ok := settings[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Settings is every setting read so far, by name.
+func Settings() []Setting {
+	mu.Lock()
+	defer mu.Unlock()
+	list := make([]Setting, 0, len(settings))
+	for _, s := range settings {
+		list = append(list, s)
+	}
+	slices.SortFunc(list, func(a, b Setting) int { return strings.Compare(a.Name, b.Name) })
+	return list
+}
+
+// Dump logs Settings in one line, each as a group of its value and source.
+func Dump() {
+	list := Settings()
+	attrs := make([]any, len(list))
+	for i, s := range list {
+		attrs[i] = slog.Group(s.Name, "value", s.Value, "source", s.Source)
+	}
+	slog.Info("Effective configuration", attrs...)
+}
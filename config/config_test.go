@@ -0,0 +1,135 @@
+package config
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reset forgets everything earlier tests loaded and read.
+func reset(t *testing.T) {
+	t.Helper()
+	mu.Lock()
+	defer mu.Unlock()
+	filePath, file, flags = "", nil, nil
+	settings, errs = map[string]Setting{}, nil
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPrecedence(t *testing.T) {
+	reset(t)
+	t.Setenv("CONFIG_FILE", writeFile(t, "FROM_FILE: file\nFILE_AND_FLAG: file\nHOSTS: [a, b]\n"))
+	t.Setenv("FROM_ENV", "env")
+	t.Setenv("FROM_FILE", "env")
+	t.Setenv("FILE_AND_FLAG", "env")
+	if err := Load("CONFIG_FILE", []string{"-file-and-flag=flag", "--debug"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, want, source string
+	}{
+		{"FROM_ENV", "env", FromEnv},
+		{"FROM_FILE", "file", FromFile},
+		{"FILE_AND_FLAG", "flag", FromFlag},
+		{"UNSET", "default", FromDefault},
+	}
+	for _, tt := range tests {
+		if got := String(tt.name, "default"); got != tt.want {
+			t.Errorf("String(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if !Bool("DEBUG", false) {
+		t.Error("a flag without a value is not true")
+	}
+	if got := List("HOSTS", "c"); strings.Join(got, ",") != "a,b" {
+		t.Errorf("List(HOSTS) = %v, want [a b]", got)
+	}
+
+	sources := map[string]string{}
+	for _, s := range Settings() {
+		sources[s.Name] = s.Source
+	}
+	for _, tt := range tests {
+		if sources[tt.name] != tt.source {
+			t.Errorf("%s came from %q, want %q", tt.name, sources[tt.name], tt.source)
+		}
+	}
+	if err := Err(); err != nil {
+		t.Errorf("Err() = %v", err)
+	}
+}
+
+func TestErr(t *testing.T) {
+	reset(t)
+	t.Setenv("CONFIG_FILE", writeFile(t, "PORT: 8080\nTYPO: x\n"))
+	t.Setenv("TIMEOUT", "soon")
+	if err := Load("CONFIG_FILE", []string{"-prot=1"}); err != nil {
+		t.Fatal(err)
+	}
+	Int("PORT", 0)
+	if got := Duration("TIMEOUT", time.Second); got != time.Second {
+		t.Errorf("Duration(TIMEOUT) = %v, want the default", got)
+	}
+	Check(false, "port and tls_port clash")
+
+	err := Err()
+	if err == nil {
+		t.Fatal("Err() = nil")
+	}
+	for _, want := range []string{`TIMEOUT (env): invalid value "soon"`, "port and tls_port clash", "flag -prot sets nothing", "TYPO in "} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Err() = %q, missing %q", err, want)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	reset(t)
+	if err := Load("", []string{"positional"}); err == nil {
+		t.Error("Load accepted a positional argument")
+	}
+	reset(t)
+	if err := Load("CONFIG_FILE", []string{"-config-file=" + writeFile(t, "DB:\n  host: x\n")}); err == nil {
+		t.Error("Load accepted a nested map")
+	}
+}
+
+func TestDump(t *testing.T) {
+	reset(t)
+	t.Setenv("DB_PASSWORD", "hunter2")
+	t.Setenv("DB_HOST", "postgres")
+	if err := Load("", nil); err != nil {
+		t.Fatal(err)
+	}
+	Secret("DB_PASSWORD", "")
+	String("DB_HOST", "localhost")
+	Int("WORKERS", 4)
+
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	Dump()
+
+	out := buf.String()
+	if strings.Contains(out, "hunter2") {
+		t.Errorf("Dump showed a secret: %s", out)
+	}
+	for _, want := range []string{"DB_PASSWORD.value=********", "DB_HOST.value=postgres DB_HOST.source=env", "WORKERS.value=4 WORKERS.source=default"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Dump() = %q, missing %q", out, want)
+		}
+	}
+}
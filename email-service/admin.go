@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errPurged = errors.New("purged by an operator")
+
+// Admin guards the destructive operator endpoints. Callers authenticate with
+// EMAIL_ADMIN_TOKEN, and every action takes two calls: the first returns what
+// would be affected plus a one-time confirmation token, the second repeats
+// the call with that token within ttl.
+type Admin struct {
+	token   string
+	ttl     time.Duration
+	mu      sync.Mutex
+	pending map[string]adminConfirmation
+}
+
+type adminConfirmation struct {
+	action    string
+	expiresAt time.Time
+}
+
+func NewAdmin(token string, ttl time.Duration) *Admin {
+	return &Admin{token: token, ttl: ttl, pending: make(map[string]adminConfirmation)}
+}
+
+func (a *Admin) authorized(r *http.Request) bool {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && a.token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(a.token)) == 1
+}
+
+func (a *Admin) issue(action string) (string, time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for token, c := range a.pending {
+		if now.After(c.expiresAt) {
+			delete(a.pending, token)
+		}
+	}
+	token := rand.Text()
+	expiresAt := now.Add(a.ttl)
+	a.pending[token] = adminConfirmation{action: action, expiresAt: expiresAt}
+	return token, expiresAt
+}
+
+// confirm consumes the token. It only matches the action it was issued for.
+func (a *Admin) confirm(action, token string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	c, ok := a.pending[token]
+	if !ok || c.action != action {
+		return false
+	}
+	delete(a.pending, token)
+	return time.Now().Before(c.expiresAt)
+}
+
+type adminFunc func(context.Context) (map[string]any, error)
+
+func (a *Admin) handler(action string, preview, run adminFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		audit := slog.With("audit", true, "action", action, "remote_addr", r.RemoteAddr)
+		if a.token == "" {
+			http.Error(w, "admin endpoints are disabled, set EMAIL_ADMIN_TOKEN", http.StatusForbidden)
+			return
+		}
+		if !a.authorized(r) {
+			audit.Warn("Admin request rejected")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			Confirm string `json:"confirm"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if req.Confirm == "" {
+			affected, err := preview(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			token, expiresAt := a.issue(action)
+			audit.Info("Admin action requested", "affected", affected)
+			json.NewEncoder(w).Encode(map[string]any{
+				"action":        action,
+				"affected":      affected,
+				"confirm_token": token,
+				"expires_at":    expiresAt,
+			})
+			return
+		}
+
+		if !a.confirm(action, req.Confirm) {
+			audit.Warn("Admin confirmation rejected")
+			http.Error(w, "invalid or expired confirmation token", http.StatusForbidden)
+			return
+		}
+		result, err := run(r.Context())
+		if err != nil {
+			audit.Error("Admin action failed", "result", result, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit.Info("Admin action executed", "result", result)
+		json.NewEncoder(w).Encode(map[string]any{
+			"action": action,
+			"status": "done",
+			"result": result,
+		})
+	}
+}
+
+// PurgeQueue drops every task that is queued, waiting for a retry or
+// scheduled. Tasks already being sent finish normally.
+func (s *EmailService) PurgeQueue(ctx context.Context) (map[string]any, error) {
+	queued, err := s.queue.Purge(ctx)
+	// Backends that hold scheduled tasks return them from Purge; only the
+	// in-memory scheduler needs emptying here.
+	var scheduled []EmailTask
+	for _, task := range s.scheduler.held() {
+		if task, ok := s.scheduler.Cancel(task.ID); ok {
+			scheduled = append(scheduled, task)
+		}
+	}
+
+	for _, task := range append(queued, scheduled...) {
+		s.attachments.Delete(task.Attachments)
+		s.history.Record(task, StatusCancelled, errPurged)
+		s.notifyOutcome(task, StatusCancelled, errPurged)
+	}
+	return map[string]any{"queued": len(queued), "scheduled": len(scheduled)}, err
+}
+
+// ClearStorage empties the note store and the notes API cache.
+func (s *EmailService) ClearStorage(ctx context.Context) (map[string]any, error) {
+	result := map[string]any{"notes": s.notes.Clear()}
+	if s.notesAPI != nil {
+		result["cached_notes"] = s.notesAPI.cache.Clear()
+	}
+	return result, nil
+}
+
+// ResetStats zeroes the counters behind /email/stats and /metrics. Queue
+// depth and stored notes are live values and are not affected.
+func (s *EmailService) ResetStats(ctx context.Context) (map[string]any, error) {
+	s.notes.ResetStats()
+	if s.notesAPI != nil {
+		s.notesAPI.cache.ResetStats()
+	}
+	s.scaleUps.Store(0)
+	s.scaleDowns.Store(0)
+	s.poolMu.Lock()
+	s.latency = 0
+	s.poolMu.Unlock()
+	return map[string]any{"reset": true}, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// AlertRequest is a plain-text message from another service of the mesh,
+// such as the CA warning about certificates that are about to expire. It
+// isn't tied to a note and skips the note templates and user preferences.
+type AlertRequest struct {
+	Recipients []string `json:"recipients"`
+	Subject    string   `json:"subject"`
+	Body       string   `json:"body"`
+	Priority   string   `json:"priority,omitempty"`
+}
+
+func (s *EmailService) SendAlert(ctx context.Context, req AlertRequest) (EmailTask, error) {
+	recipients, err := parseRecipients(req.Recipients, s.maxRecipients)
+	if err != nil {
+		return EmailTask{}, err
+	}
+	if len(recipients) == 0 {
+		return EmailTask{}, fmt.Errorf("%w: recipients is required", errInvalidRequest)
+	}
+	subject := strings.TrimSpace(req.Subject)
+	if subject == "" || strings.ContainsAny(subject, "\r\n") {
+		return EmailTask{}, fmt.Errorf("%w: subject must be a single non-empty line", errInvalidRequest)
+	}
+	priority := req.Priority
+	if priority == "" {
+		priority = PriorityHigh
+	}
+	if priority, err = parsePriority(priority); err != nil {
+		return EmailTask{}, err
+	}
+
+	task := EmailTask{
+		ID:         newTaskID(),
+		Type:       "alert",
+		Priority:   priority,
+		Recipients: recipients,
+		Subject:    subject,
+		Body:       req.Body,
+	}
+	if err := s.enqueue(ctx, task); err != nil {
+		return EmailTask{}, err
+	}
+	return task, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+type AttachmentRef struct {
+	ID          string `json:"id"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+}
+
+type AttachmentRequest struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Content     []byte `json:"content"`
+}
+
+// AttachmentStore keeps attachment payloads on disk so that queued tasks only
+// carry small references, which matters for the Postgres and Redis queues.
+type AttachmentStore struct {
+	dir     string
+	maxSize int
+}
+
+func NewAttachmentStore(dir string, maxSize int) (*AttachmentStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create attachment dir: %w", err)
+	}
+	return &AttachmentStore{dir: dir, maxSize: maxSize}, nil
+}
+
+func (s *AttachmentStore) Save(reqs []AttachmentRequest) ([]AttachmentRef, error) {
+	total := 0
+	for _, r := range reqs {
+		total += len(r.Content)
+	}
+	if total > s.maxSize {
+		return nil, fmt.Errorf("attachments total %d bytes, limit is %d", total, s.maxSize)
+	}
+
+	var refs []AttachmentRef
+	for _, r := range reqs {
+		if r.Filename == "" {
+			s.Delete(refs)
+			return nil, fmt.Errorf("attachment filename is required")
+		}
+		if r.ContentType == "" {
+			r.ContentType = "application/octet-stream"
+		}
+
+		ref := AttachmentRef{
+			ID:          newTaskID(),
+			Filename:    filepath.Base(r.Filename),
+			ContentType: r.ContentType,
+			Size:        len(r.Content),
+		}
+		if err := os.WriteFile(s.path(ref.ID), r.Content, 0o600); err != nil {
+			s.Delete(refs)
+			return nil, fmt.Errorf("store attachment %s: %w", r.Filename, err)
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+func (s *AttachmentStore) Load(refs []AttachmentRef) ([]Attachment, error) {
+	var attachments []Attachment
+	for _, ref := range refs {
+		data, err := os.ReadFile(s.path(ref.ID))
+		if err != nil {
+			return nil, fmt.Errorf("load attachment %s: %w", ref.Filename, err)
+		}
+		attachments = append(attachments, Attachment{
+			Filename:    ref.Filename,
+			ContentType: ref.ContentType,
+			Data:        data,
+		})
+	}
+	return attachments, nil
+}
+
+func (s *AttachmentStore) Delete(refs []AttachmentRef) {
+	for _, ref := range refs {
+		os.Remove(s.path(ref.ID))
+	}
+}
+
+func (s *AttachmentStore) path(id string) string {
+	return filepath.Join(s.dir, strings.ReplaceAll(id, string(filepath.Separator), "_"))
+}
+
+func noteMarkdown(note Note) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", note.Title)
+	if !note.CreatedAt.IsZero() {
+		fmt.Fprintf(&b, "_Created: %s_\n\n", note.CreatedAt.Format("2006-01-02 15:04"))
+	}
+	b.WriteString(note.Content)
+	b.WriteString("\n")
+	return []byte(b.String())
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"email-service/emailpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Permissions a caller can be granted. "*" grants all of them.
+const (
+	PermSend         = "send"
+	PermBatch        = "batch"
+	PermDigest       = "digest"
+	PermAlert        = "alert"
+	PermStore        = "store"
+	PermPreferences  = "preferences"
+	PermSuppressions = "suppressions"
+	PermRead         = "read"
+	PermAdmin        = "admin"
+)
+
+var permissions = []string{PermSend, PermBatch, PermDigest, PermAlert, PermStore, PermPreferences, PermSuppressions, PermRead, PermAdmin}
+
+type Caller struct {
+	Name        string
+	Token       string
+	Permissions []string
+}
+
+func (c Caller) Can(perm string) bool {
+	return slices.Contains(c.Permissions, "*") || slices.Contains(c.Permissions, perm)
+}
+
+// Authenticator identifies callers by a shared secret (Authorization: Bearer),
+// by a workload JWT from the mesh CA whose subject is the caller's SPIFFE ID
+// or service name, or by a client certificate verified against the mesh CA
+// whose CN or DNS SAN equals the caller name, then checks the permission the
+// route needs. With no callers configured every request is allowed.
+type Authenticator struct {
+	callers []Caller
+	jwt     *JWTVerifier
+}
+
+// NewAuthenticator parses EMAIL_AUTH_CALLERS ("notes-app=send,store;ops=*")
+// and EMAIL_AUTH_TOKENS ("notes-app:secret;ops:secret2").
+func NewAuthenticator(callers, tokens string) (*Authenticator, error) {
+	a := &Authenticator{}
+	for entry := range strings.SplitSeq(callers, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, perms, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("caller %q must look like name=perm,perm", entry)
+		}
+		caller := Caller{Name: strings.TrimSpace(name), Permissions: splitList(perms)}
+		for _, perm := range caller.Permissions {
+			if perm != "*" && !slices.Contains(permissions, perm) {
+				return nil, fmt.Errorf("unknown permission %q for caller %s", perm, caller.Name)
+			}
+		}
+		a.callers = append(a.callers, caller)
+	}
+
+	for entry := range strings.SplitSeq(tokens, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, token, ok := strings.Cut(entry, ":")
+		i := slices.IndexFunc(a.callers, func(c Caller) bool { return c.Name == strings.TrimSpace(name) })
+		if !ok || token == "" || i < 0 {
+			return nil, fmt.Errorf("token entry for %q must name a caller from EMAIL_AUTH_CALLERS", name)
+		}
+		a.callers[i].Token = token
+	}
+	return a, nil
+}
+
+func (a *Authenticator) Enabled() bool {
+	return len(a.callers) > 0
+}
+
+// identify returns the caller presenting token or, failing that, one of the
+// certificate names. A JWT stands for the names of its subject.
+func (a *Authenticator) identify(token string, names []string) (Caller, bool) {
+	if a.jwt != nil && strings.Count(token, ".") == 2 {
+		subject, err := a.jwt.verify(token)
+		if err != nil {
+			slog.Warn("Invalid JWT", "error", err)
+			return Caller{}, false
+		}
+		token, names = "", workloadNames(subject)
+	}
+	if token != "" {
+		for _, c := range a.callers {
+			if c.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(c.Token)) == 1 {
+				return c, true
+			}
+		}
+		return Caller{}, false
+	}
+	for _, c := range a.callers {
+		if slices.Contains(names, c.Name) {
+			return c, true
+		}
+	}
+	return Caller{}, false
+}
+
+func certNames(chains [][]*x509.Certificate) []string {
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil
+	}
+	leaf := chains[0][0]
+	return append([]string{leaf.Subject.CommonName}, leaf.DNSNames...)
+}
+
+// routePermission maps an HTTP request to the permission it needs. An empty
+// result means the route is public: health checks, unsubscribe links,
+// the SES and SendGrid bounce webhooks, which check the provider's signature
+// themselves, and the admin endpoints, which have their own token.
+func routePermission(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case !strings.HasPrefix(path, "/email/"):
+		return ""
+	case path == "/email/unsubscribe",
+		strings.HasPrefix(path, "/email/admin/"),
+		(path == "/email/bounces/ses" || path == "/email/bounces/sendgrid") && r.Method == http.MethodPost:
+		return ""
+	case r.Method == http.MethodGet || path == "/email/preview":
+		return PermRead
+	case path == "/email/extract",
+		strings.HasPrefix(path, "/email/scheduled/"),
+		strings.HasPrefix(path, "/email/tasks/"),
+		strings.HasPrefix(path, "/email/dlq/"):
+		return PermSend
+	case path == "/email/batch":
+		return PermBatch
+	case path == "/email/alert":
+		return PermAlert
+	case strings.HasPrefix(path, "/email/store"):
+		return PermStore
+	case strings.HasPrefix(path, "/email/digest/"):
+		return PermDigest
+	case strings.HasPrefix(path, "/email/preferences/"):
+		return PermPreferences
+	case strings.HasPrefix(path, "/email/suppressions"), path == "/email/bounces":
+		return PermSuppressions
+	}
+	return PermAdmin
+}
+
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	if !a.Enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		perm := routePermission(r)
+		if perm == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		var names []string
+		if r.TLS != nil {
+			names = certNames(r.TLS.VerifiedChains)
+		}
+		caller, ok := a.identify(token, names)
+		logger := slog.With("method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+		if !ok {
+			logger.Warn("Unauthenticated request rejected")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !caller.Can(perm) {
+			logger.Warn("Request forbidden", "caller", caller.Name, "permission", perm)
+			http.Error(w, fmt.Sprintf("caller %s may not %s", caller.Name, perm), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+var grpcPermissions = map[string]string{
+	"Enqueue":     PermSend,
+	"Cancel":      PermSend,
+	"Status":      PermRead,
+	"WatchEvents": PermRead,
+}
+
+func (a *Authenticator) authorizeGRPC(ctx context.Context, fullMethod string) error {
+	// Methods outside the map, such as the health service, stay public.
+	perm, ok := grpcPermissions[fullMethod[strings.LastIndex(fullMethod, "/")+1:]]
+	if !ok || !strings.HasPrefix(fullMethod, "/"+emailpb.EmailService_ServiceDesc.ServiceName+"/") {
+		return nil
+	}
+
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			token, _ = strings.CutPrefix(values[0], "Bearer ")
+		}
+	}
+	var names []string
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			names = certNames(info.State.VerifiedChains)
+		}
+	}
+
+	caller, ok := a.identify(token, names)
+	if !ok {
+		slog.Warn("Unauthenticated request rejected", "method", fullMethod)
+		return status.Error(codes.Unauthenticated, "unauthenticated")
+	}
+	if !caller.Can(perm) {
+		slog.Warn("Request forbidden", "method", fullMethod, "caller", caller.Name, "permission", perm)
+		return status.Errorf(codes.PermissionDenied, "caller %s may not %s", caller.Name, perm)
+	}
+	return nil
+}
+
+func (a *Authenticator) grpcOptions() []grpc.ServerOption {
+	if !a.Enabled() {
+		return nil
+	}
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := a.authorizeGRPC(ctx, info.FullMethod); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := a.authorizeGRPC(ss.Context(), info.FullMethod); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+}
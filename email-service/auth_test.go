@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoutePermission(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         string
+	}{
+		{"GET", "/health", ""},
+		{"GET", "/email/unsubscribe", ""},
+		{"POST", "/email/bounces/ses", ""},
+		{"POST", "/email/bounces/sendgrid", ""},
+		{"POST", "/email/bounces", PermSuppressions},
+		{"POST", "/email/bounces/other", PermAdmin},
+		{"GET", "/email/bounces", PermRead},
+		{"POST", "/email/extract", PermSend},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if got := routePermission(r); got != tt.want {
+			t.Errorf("routePermission(%s %s) = %q, want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
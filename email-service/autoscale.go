@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// AutoscaleConfig bounds the worker pool. With Max <= Min the pool stays at
+// its initial size.
+type AutoscaleConfig struct {
+	Min            int
+	Max            int
+	TasksPerWorker int
+	TargetLatency  time.Duration
+	Interval       time.Duration
+	Cooldown       time.Duration
+}
+
+func (c AutoscaleConfig) enabled() bool {
+	return c.Max > c.Min
+}
+
+func (s *EmailService) startWorker() {
+	s.poolMu.Lock()
+	defer s.poolMu.Unlock()
+
+	s.nextWorkerID++
+	id := s.nextWorkerID
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.workerCancels[id] = cancel
+
+	s.wg.Add(1)
+	go s.worker(ctx, id)
+}
+
+// stopWorker stops the most recently started worker after its current task.
+func (s *EmailService) stopWorker() {
+	s.poolMu.Lock()
+	defer s.poolMu.Unlock()
+
+	newest := 0
+	for id := range s.workerCancels {
+		newest = max(newest, id)
+	}
+	if cancel, ok := s.workerCancels[newest]; ok {
+		cancel()
+		delete(s.workerCancels, newest)
+	}
+}
+
+func (s *EmailService) WorkerCount() int {
+	s.poolMu.Lock()
+	defer s.poolMu.Unlock()
+	return len(s.workerCancels)
+}
+
+// recordLatency keeps an exponentially weighted average of task run time.
+func (s *EmailService) recordLatency(d time.Duration) {
+	s.poolMu.Lock()
+	defer s.poolMu.Unlock()
+	if s.latency == 0 {
+		s.latency = d
+		return
+	}
+	s.latency = (s.latency*4 + d) / 5
+}
+
+func (s *EmailService) averageLatency() time.Duration {
+	s.poolMu.Lock()
+	defer s.poolMu.Unlock()
+	return s.latency
+}
+
+// desiredWorkers sizes the pool to keep at most TasksPerWorker queued tasks
+// per worker, and adds a worker while tasks are waiting and the average run
+// time is above TargetLatency.
+func (s *EmailService) desiredWorkers(current, depth int, latency time.Duration) int {
+	cfg := s.autoscale
+	desired := (depth + cfg.TasksPerWorker - 1) / cfg.TasksPerWorker
+	if depth > 0 && latency > cfg.TargetLatency {
+		desired = max(desired, current+1)
+	}
+	return min(max(desired, cfg.Min), cfg.Max)
+}
+
+func (s *EmailService) runAutoscaler(ctx context.Context) {
+	cfg := s.autoscale
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	var lastScale time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := s.WorkerCount()
+		depth := readyLen(s.queue)
+		latency := s.averageLatency()
+		desired := s.desiredWorkers(current, depth, latency)
+
+		switch {
+		case desired > current:
+			for range desired - current {
+				s.startWorker()
+			}
+			s.scaleUps.Add(1)
+			lastScale = time.Now()
+			slog.Info("Scaled workers up", "from", current, "to", desired,
+				"queue_depth", depth, "avg_latency", latency.Round(time.Millisecond))
+		case desired < current && time.Since(lastScale) >= cfg.Cooldown:
+			// Scale down one worker at a time so a brief lull doesn't
+			// collapse the pool.
+			s.stopWorker()
+			s.scaleDowns.Add(1)
+			lastScale = time.Now()
+			slog.Info("Scaled workers down", "from", current, "to", current-1,
+				"queue_depth", depth, "avg_latency", latency.Round(time.Millisecond))
+		}
+	}
+}
+
+func (s *EmailService) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	queueLen, queueCap := s.GetQueueStats()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP email_workers Current number of email workers.\n# TYPE email_workers gauge\nemail_workers %d\n", s.WorkerCount())
+	fmt.Fprintf(w, "# HELP email_workers_busy Workers currently processing a task.\n# TYPE email_workers_busy gauge\nemail_workers_busy %d\n", s.inFlight.Load())
+	fmt.Fprintf(w, "# HELP email_workers_stuck Workers without a heartbeat for EMAIL_WORKER_STALL_TIMEOUT.\n# TYPE email_workers_stuck gauge\nemail_workers_stuck %d\n", len(s.stuckWorkers()))
+	fmt.Fprintf(w, "# HELP email_worker_scale_events_total Worker pool scaling events.\n# TYPE email_worker_scale_events_total counter\n")
+	fmt.Fprintf(w, "email_worker_scale_events_total{direction=\"up\"} %d\n", s.scaleUps.Load())
+	fmt.Fprintf(w, "email_worker_scale_events_total{direction=\"down\"} %d\n", s.scaleDowns.Load())
+	fmt.Fprintf(w, "# HELP email_task_latency_seconds Moving average of task processing time.\n# TYPE email_task_latency_seconds gauge\nemail_task_latency_seconds %g\n", s.averageLatency().Seconds())
+	fmt.Fprintf(w, "# HELP email_queue_depth Tasks waiting in the queue.\n# TYPE email_queue_depth gauge\nemail_queue_depth %d\n", queueLen)
+	fmt.Fprintf(w, "# HELP email_queue_capacity Queue capacity.\n# TYPE email_queue_capacity gauge\nemail_queue_capacity %d\n", queueCap)
+}
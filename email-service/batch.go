@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"sync"
+	"time"
+)
+
+type BatchRequest struct {
+	NoteIDs     []string          `json:"note_ids"`
+	Recipients  []string          `json:"recipients,omitempty"`
+	Priority    string            `json:"priority,omitempty"`
+	CallbackURL string            `json:"callback_url,omitempty"`
+	Retry       *RetryOverride    `json:"retry,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+type Batch struct {
+	ID        string    `json:"id"`
+	TaskIDs   []string  `json:"task_ids"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type BatchStatus struct {
+	ID        string         `json:"id"`
+	CreatedAt time.Time      `json:"created_at"`
+	Total     int            `json:"total"`
+	Counts    map[string]int `json:"counts"`
+	Done      bool           `json:"done"`
+	Tasks     []TaskStatus   `json:"tasks"`
+}
+
+// BatchTracker remembers which tasks belong to a batch. Task progress itself
+// lives in the StatusTracker.
+type BatchTracker struct {
+	mu         sync.RWMutex
+	batches    map[string]Batch
+	order      []string
+	maxSize    int
+	maxEntries int
+}
+
+func NewBatchTracker(maxSize, maxEntries int) *BatchTracker {
+	return &BatchTracker{
+		batches:    make(map[string]Batch),
+		maxSize:    maxSize,
+		maxEntries: maxEntries,
+	}
+}
+
+func (t *BatchTracker) Add(batch Batch) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.batches[batch.ID] = batch
+	t.order = append(t.order, batch.ID)
+	for len(t.order) > t.maxEntries {
+		delete(t.batches, t.order[0])
+		t.order = t.order[1:]
+	}
+}
+
+func (t *BatchTracker) Get(id string) (Batch, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	batch, ok := t.batches[id]
+	return batch, ok
+}
+
+func (s *EmailService) SendBatch(ctx context.Context, req BatchRequest) (Batch, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if s.draining.Load() {
+		return Batch{}, errDraining
+	}
+	if len(req.NoteIDs) == 0 {
+		return Batch{}, fmt.Errorf("%w: note_ids is required", errInvalidRequest)
+	}
+	recipients := req.Recipients
+	if len(recipients) == 0 {
+		recipients = []string{s.emailAddr}
+	}
+	if total := len(req.NoteIDs) * len(recipients); total > s.batches.maxSize {
+		return Batch{}, fmt.Errorf("%w: batch of %d emails exceeds the limit of %d", errInvalidRequest, total, s.batches.maxSize)
+	}
+	for _, rcpt := range recipients {
+		if _, err := mail.ParseAddress(rcpt); err != nil {
+			return Batch{}, fmt.Errorf("%w: invalid recipient %q", errInvalidRequest, rcpt)
+		}
+	}
+
+	priority, err := parsePriority(req.Priority)
+	if err != nil {
+		return Batch{}, err
+	}
+	if err := s.validateCallbackURL(req.CallbackURL); err != nil {
+		return Batch{}, err
+	}
+	if err := req.Retry.validate(s.retryLimits); err != nil {
+		return Batch{}, err
+	}
+	if err := validateMetadata(req.Metadata); err != nil {
+		return Batch{}, err
+	}
+
+	batch := Batch{ID: newTaskID(), CreatedAt: time.Now()}
+	var tasks []EmailTask
+
+	for _, noteID := range req.NoteIDs {
+		note, exists, err := s.lookupNote(ctx, noteID)
+		if err != nil {
+			return Batch{}, err
+		}
+		if !exists {
+			return Batch{}, fmt.Errorf("%w: note %s not found", errInvalidRequest, noteID)
+		}
+		for _, rcpt := range recipients {
+			task := EmailTask{
+				ID:          newTaskID(),
+				Type:        "send",
+				Priority:    priority,
+				NoteID:      noteID,
+				Note:        note,
+				Recipient:   rcpt,
+				CallbackURL: req.CallbackURL,
+				BatchID:     batch.ID,
+				Retry:       req.Retry,
+				Metadata:    req.Metadata,
+			}
+			tasks = append(tasks, task)
+			batch.TaskIDs = append(batch.TaskIDs, task.ID)
+		}
+	}
+
+	if err := s.queue.EnqueueBatch(ctx, tasks); err != nil {
+		return Batch{}, err
+	}
+	for _, task := range tasks {
+		s.history.Record(task, StatusQueued, nil)
+	}
+	s.batches.Add(batch)
+
+	slog.Info("Batch queued", "batch_id", batch.ID, "emails", len(tasks))
+	return batch, nil
+}
+
+func (s *EmailService) BatchStatus(id string) (BatchStatus, error) {
+	batch, ok := s.batches.Get(id)
+	if !ok {
+		return BatchStatus{}, errTaskNotFound
+	}
+
+	status := BatchStatus{
+		ID:        batch.ID,
+		CreatedAt: batch.CreatedAt,
+		Total:     len(batch.TaskIDs),
+		Counts:    make(map[string]int),
+		Done:      true,
+	}
+	for _, taskID := range batch.TaskIDs {
+		entry, ok := s.history.Get(taskID)
+		if !ok {
+			entry = TaskStatus{ID: taskID, Status: "unknown"}
+		}
+		entry.History = nil
+		status.Counts[entry.Status]++
+		switch entry.Status {
+		case StatusSent, StatusFailed, StatusCancelled, "unknown":
+		default:
+			status.Done = false
+		}
+		status.Tasks = append(status.Tasks, entry)
+	}
+	return status, nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/m-tln/notes/logging"
+)
+
+const (
+	BounceHard      = "hard"
+	BounceSoft      = "soft"
+	BounceComplaint = "complaint"
+)
+
+type BounceEvent struct {
+	Email  string    `json:"email"`
+	Type   string    `json:"type"`
+	Reason string    `json:"reason,omitempty"`
+	Source string    `json:"source"`
+	At     time.Time `json:"at"`
+}
+
+// BounceWebhookConfig says how provider webhooks are authenticated. SES
+// notifications are accepted only from the listed SNS topics; SendGrid events
+// only with a Signed Event Webhook key.
+type BounceWebhookConfig struct {
+	SNSTopics   []string
+	SendGridKey string
+}
+
+// BounceRecorder keeps recent bounce/complaint events and suppresses
+// addresses that hard-bounced or complained.
+type BounceRecorder struct {
+	mu          sync.Mutex
+	events      []BounceEvent
+	maxEvents   int
+	suppression *SuppressionList
+	sns         *SNSVerifier
+	sendGridKey *ecdsa.PublicKey
+}
+
+func NewBounceRecorder(suppression *SuppressionList, maxEvents int, webhooks BounceWebhookConfig) (*BounceRecorder, error) {
+	b := &BounceRecorder{
+		suppression: suppression,
+		maxEvents:   maxEvents,
+		sns:         NewSNSVerifier(webhooks.SNSTopics),
+	}
+	if webhooks.SendGridKey != "" {
+		key, err := parseSendGridWebhookKey(webhooks.SendGridKey)
+		if err != nil {
+			return nil, err
+		}
+		b.sendGridKey = key
+	}
+	return b, nil
+}
+
+func (b *BounceRecorder) Record(event BounceEvent) {
+	if event.At.IsZero() {
+		event.At = time.Now()
+	}
+
+	b.mu.Lock()
+	b.events = append(b.events, event)
+	if len(b.events) > b.maxEvents {
+		b.events = b.events[len(b.events)-b.maxEvents:]
+	}
+	b.mu.Unlock()
+
+	slog.Info("Bounce recorded", "kind", event.Type, "email", event.Email, "source", event.Source, "reason", event.Reason)
+
+	switch event.Type {
+	case BounceHard:
+		b.suppression.Add(event.Email, "hard bounce: "+event.Reason, event.Source)
+	case BounceComplaint:
+		b.suppression.Add(event.Email, "complaint", event.Source)
+	}
+}
+
+func (b *BounceRecorder) List() []BounceEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := make([]BounceEvent, len(b.events))
+	for i, e := range b.events {
+		list[len(b.events)-1-i] = e
+	}
+	return list
+}
+
+func (b *BounceRecorder) HandleGeneric(w http.ResponseWriter, r *http.Request) {
+	var event BounceEvent
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if event.Email == "" {
+		http.Error(w, "email is required", http.StatusBadRequest)
+		return
+	}
+	switch event.Type {
+	case BounceHard, BounceSoft, BounceComplaint:
+	default:
+		http.Error(w, "type must be hard, soft or complaint", http.StatusBadRequest)
+		return
+	}
+	if event.Source == "" {
+		event.Source = "api"
+	}
+
+	b.Record(event)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+type sesNotification struct {
+	NotificationType string `json:"notificationType"`
+	Bounce           struct {
+		BounceType        string `json:"bounceType"`
+		BounceSubType     string `json:"bounceSubType"`
+		BouncedRecipients []struct {
+			EmailAddress   string `json:"emailAddress"`
+			DiagnosticCode string `json:"diagnosticCode"`
+		} `json:"bouncedRecipients"`
+	} `json:"bounce"`
+	Complaint struct {
+		ComplainedRecipients []struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"complainedRecipients"`
+		ComplaintFeedbackType string `json:"complaintFeedbackType"`
+	} `json:"complaint"`
+}
+
+// HandleSES accepts SES bounce/complaint notifications delivered via SNS.
+// Every message must be signed by SNS for an allowed topic; subscription
+// confirmations that pass are confirmed automatically.
+func (b *BounceRecorder) HandleSES(w http.ResponseWriter, r *http.Request) {
+	// SNS messages are at most 256 KB; the envelope adds little to that.
+	var envelope snsEnvelope
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&envelope); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := b.sns.Verify(envelope); err != nil {
+		logging.FromContext(r.Context()).Warn("Rejected SNS message", "topic", envelope.TopicArn, "error", err)
+		http.Error(w, "Invalid SNS message", http.StatusForbidden)
+		return
+	}
+
+	switch envelope.Type {
+	case "SubscriptionConfirmation":
+		slog.Info("Confirming SNS subscription", "topic", envelope.TopicArn, "url", envelope.SubscribeURL)
+		if err := b.sns.Confirm(envelope.SubscribeURL); err != nil {
+			slog.Error("SNS subscription confirmation failed", "error", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	case "Notification":
+	default:
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var n sesNotification
+	if err := json.Unmarshal([]byte(envelope.Message), &n); err != nil {
+		http.Error(w, "Invalid SES notification", http.StatusBadRequest)
+		return
+	}
+
+	switch n.NotificationType {
+	case "Bounce":
+		bounceType := BounceSoft
+		if n.Bounce.BounceType == "Permanent" {
+			bounceType = BounceHard
+		}
+		for _, rcpt := range n.Bounce.BouncedRecipients {
+			reason := rcpt.DiagnosticCode
+			if reason == "" {
+				reason = n.Bounce.BounceSubType
+			}
+			b.Record(BounceEvent{Email: rcpt.EmailAddress, Type: bounceType, Reason: reason, Source: "ses"})
+		}
+	case "Complaint":
+		for _, rcpt := range n.Complaint.ComplainedRecipients {
+			b.Record(BounceEvent{Email: rcpt.EmailAddress, Type: BounceComplaint, Reason: n.Complaint.ComplaintFeedbackType, Source: "ses"})
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type sendGridEvent struct {
+	Email  string `json:"email"`
+	Event  string `json:"event"`
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// HandleSendGrid accepts SendGrid Event Webhook batches signed with the
+// configured key. Without a key every batch is refused.
+func (b *BounceRecorder) HandleSendGrid(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+	if b.sendGridKey == nil {
+		logger.Warn("Rejected SendGrid events, SENDGRID_WEBHOOK_PUBLIC_KEY is not set")
+		http.Error(w, "Signed webhooks are not configured", http.StatusForbidden)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 5<<20))
+	if err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if err := verifySendGridSignature(b.sendGridKey,
+		r.Header.Get("X-Twilio-Email-Event-Webhook-Timestamp"),
+		r.Header.Get("X-Twilio-Email-Event-Webhook-Signature"), body); err != nil {
+		logger.Warn("Rejected SendGrid events", "error", err)
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+
+	var events []sendGridEvent
+	if err := json.Unmarshal(body, &events); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	for _, e := range events {
+		switch e.Event {
+		case "bounce":
+			bounceType := BounceHard
+			if e.Type == "blocked" {
+				bounceType = BounceSoft
+			}
+			b.Record(BounceEvent{Email: e.Email, Type: bounceType, Reason: e.Reason, Source: "sendgrid"})
+		case "dropped":
+			b.Record(BounceEvent{Email: e.Email, Type: BounceSoft, Reason: e.Reason, Source: "sendgrid"})
+		case "spamreport":
+			b.Record(BounceEvent{Email: e.Email, Type: BounceComplaint, Source: "sendgrid"})
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
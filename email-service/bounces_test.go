@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testTopic = "arn:aws:sns:us-east-1:123456789012:ses-bounces"
+
+func signedSNS(t *testing.T, key *rsa.PrivateKey, e snsEnvelope) snsEnvelope {
+	t.Helper()
+	e.SignatureVersion = "2"
+	digest := sha256.Sum256([]byte(e.signedString()))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Signature = base64.StdEncoding.EncodeToString(sig)
+	return e
+}
+
+func TestSNSVerifier(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	certURL := "https://sns.us-east-1.amazonaws.com/SimpleNotificationService-test.pem"
+	v := NewSNSVerifier([]string{testTopic})
+	v.certs[certURL] = cert
+
+	valid := signedSNS(t, key, snsEnvelope{
+		Type:           "Notification",
+		MessageID:      "1",
+		TopicArn:       testTopic,
+		Message:        `{"notificationType":"Complaint"}`,
+		Timestamp:      "2026-01-01T00:00:00.000Z",
+		SigningCertURL: certURL,
+	})
+	if err := v.Verify(valid); err != nil {
+		t.Fatalf("Verify(valid) = %v", err)
+	}
+
+	tampered := valid
+	tampered.Message = `{"notificationType":"Bounce"}`
+	otherTopic := signedSNS(t, key, snsEnvelope{Type: "Notification", TopicArn: "arn:aws:sns:us-east-1:999:evil", SigningCertURL: certURL})
+	foreignCert := valid
+	foreignCert.SigningCertURL = "https://attacker.example/cert.pem"
+
+	for name, e := range map[string]snsEnvelope{
+		"tampered message": tampered,
+		"other topic":      otherTopic,
+		"foreign cert URL": foreignCert,
+	} {
+		if err := v.Verify(e); err == nil {
+			t.Errorf("Verify(%s) succeeded", name)
+		}
+	}
+
+	if err := NewSNSVerifier(nil).Verify(valid); err == nil {
+		t.Error("Verify succeeded with no allowed topics")
+	}
+}
+
+func TestSNSURL(t *testing.T) {
+	for raw, ok := range map[string]bool{
+		"https://sns.eu-west-1.amazonaws.com/?Action=ConfirmSubscription": true,
+		"https://sns.cn-north-1.amazonaws.com.cn/cert.pem":                true,
+		"http://sns.eu-west-1.amazonaws.com/":                             false,
+		"https://sns.eu-west-1.amazonaws.com.attacker.example/":           false,
+		"https://sns.eu-west-1.amazonaws.com:8443/":                       false,
+		"https://169.254.169.254/latest/meta-data/":                       false,
+	} {
+		if _, err := snsURL(raw); (err == nil) != ok {
+			t.Errorf("snsURL(%q) error = %v, want ok=%v", raw, err, ok)
+		}
+	}
+}
+
+func TestHandleSendGridSignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	suppression := NewSuppressionList()
+	b, err := NewBounceRecorder(suppression, 10, BounceWebhookConfig{SendGridKey: base64.StdEncoding.EncodeToString(der)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal([]sendGridEvent{{Email: "alice@example.com", Event: "spamreport"}})
+	timestamp := "1700000000"
+	digest := sha256.Sum256(append([]byte(timestamp), body...))
+	sig, _ := ecdsa.SignASN1(rand.Reader, key, digest[:])
+
+	post := func(body []byte, signature string) int {
+		req := httptest.NewRequest(http.MethodPost, "/email/bounces/sendgrid", bytes.NewReader(body))
+		req.Header.Set("X-Twilio-Email-Event-Webhook-Timestamp", timestamp)
+		req.Header.Set("X-Twilio-Email-Event-Webhook-Signature", signature)
+		rec := httptest.NewRecorder()
+		b.HandleSendGrid(rec, req)
+		return rec.Code
+	}
+
+	forged, _ := json.Marshal([]sendGridEvent{{Email: "bob@example.com", Event: "spamreport"}})
+	if code := post(forged, base64.StdEncoding.EncodeToString(sig)); code != http.StatusForbidden {
+		t.Errorf("forged body = %d, want 403", code)
+	}
+	if code := post(body, ""); code != http.StatusForbidden {
+		t.Errorf("unsigned body = %d, want 403", code)
+	}
+	if _, ok := suppression.Lookup("bob@example.com"); ok {
+		t.Error("forged event suppressed an address")
+	}
+
+	if code := post(body, base64.StdEncoding.EncodeToString(sig)); code != http.StatusOK {
+		t.Fatalf("signed body = %d, want 200", code)
+	}
+	if _, ok := suppression.Lookup("alice@example.com"); !ok {
+		t.Error("signed complaint did not suppress the address")
+	}
+}
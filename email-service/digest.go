@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"text/template"
+	"time"
+)
+
+type NoteEvent struct {
+	Type string    `json:"type"`
+	Note Note      `json:"note"`
+	At   time.Time `json:"at"`
+}
+
+type DigestData struct {
+	Recipient      string
+	Date           string
+	Created        []NoteEvent
+	Updated        []NoteEvent
+	UnsubscribeURL string
+}
+
+var digestTemplate = template.Must(template.New("digest").Parse(`Notes digest for {{.Date}}
+{{if .Created}}
+Created ({{len .Created}}):
+{{range .Created}}  - #{{.Note.ID}} {{.Note.Title}} ({{.At.Format "15:04"}})
+{{end}}{{end}}{{if .Updated}}
+Updated ({{len .Updated}}):
+{{range .Updated}}  - #{{.Note.ID}} {{.Note.Title}} ({{.At.Format "15:04"}})
+{{end}}{{end}}{{if .UnsubscribeURL}}
+--
+Unsubscribe: {{.UnsubscribeURL}}
+{{end}}`))
+
+type Digest struct {
+	mu          sync.Mutex
+	events      []NoteEvent
+	subscribers map[string]bool
+	hour        int
+	minute      int
+	location    *time.Location
+	enqueue     func(context.Context, EmailTask) error
+	unsubscribe func(string) string
+}
+
+func NewDigest(at string, location *time.Location) (*Digest, error) {
+	t, err := time.Parse("15:04", at)
+	if err != nil {
+		return nil, fmt.Errorf("invalid digest time %q: %w", at, err)
+	}
+	return &Digest{
+		subscribers: make(map[string]bool),
+		hour:        t.Hour(),
+		minute:      t.Minute(),
+		location:    location,
+	}, nil
+}
+
+func (d *Digest) Record(event NoteEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.subscribers) == 0 {
+		return
+	}
+	d.events = append(d.events, event)
+}
+
+func (d *Digest) Subscribe(email string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.subscribers[email] = true
+}
+
+func (d *Digest) Unsubscribe(email string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ok := d.subscribers[email]
+	delete(d.subscribers, email)
+	return ok
+}
+
+func (d *Digest) Subscribers() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]string, 0, len(d.subscribers))
+	for email := range d.subscribers {
+		list = append(list, email)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (d *Digest) Pending() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.events)
+}
+
+func (d *Digest) nextRun(now time.Time) time.Time {
+	now = now.In(d.location)
+	next := time.Date(now.Year(), now.Month(), now.Day(), d.hour, d.minute, 0, 0, d.location)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+func (d *Digest) Run(ctx context.Context) {
+	for {
+		next := d.nextRun(time.Now())
+		slog.Info("Next digest run scheduled", "at", next)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			if n, err := d.Send(ctx); err != nil {
+				slog.Error("Digest run failed", "sent", n, "error", err)
+			}
+		}
+	}
+}
+
+// Send enqueues one digest email per subscriber covering every event recorded
+// since the previous run. Events are kept if nothing could be enqueued.
+func (d *Digest) Send(ctx context.Context) (int, error) {
+	d.mu.Lock()
+	events := d.events
+	d.events = nil
+	d.mu.Unlock()
+
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	data := DigestData{Date: time.Now().In(d.location).Format("2006-01-02")}
+	for _, e := range events {
+		switch e.Type {
+		case "created":
+			data.Created = append(data.Created, e)
+		case "updated":
+			data.Updated = append(data.Updated, e)
+		}
+	}
+
+	sent := 0
+	for _, recipient := range d.Subscribers() {
+		data.Recipient = recipient
+		if d.unsubscribe != nil {
+			data.UnsubscribeURL = d.unsubscribe(recipient)
+		}
+
+		rendered, err := renderDigest(data)
+		if err != nil {
+			return sent, err
+		}
+
+		task := EmailTask{
+			ID:        newTaskID(),
+			Type:      "digest",
+			Priority:  PriorityLow,
+			Recipient: recipient,
+			Subject:   rendered.Subject,
+			Body:      rendered.Text,
+			HTML:      rendered.HTML,
+		}
+		if err := d.enqueue(ctx, task); err != nil {
+			if sent == 0 {
+				d.mu.Lock()
+				d.events = append(events, d.events...)
+				d.mu.Unlock()
+			}
+			return sent, err
+		}
+		sent++
+	}
+
+	slog.Info("Digest queued", "events", len(events), "recipients", sent)
+	return sent, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-tln/notes/config"
+)
+
+// dkimHeaders are signed when present. From is mandatory per RFC 6376.
+var dkimHeaders = []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type"}
+
+// DKIMSigner adds a relaxed/relaxed DKIM-Signature header to raw messages.
+// RSA keys sign with rsa-sha256, Ed25519 keys with ed25519-sha256 (RFC 8463).
+type DKIMSigner struct {
+	domain   string
+	selector string
+	key      crypto.Signer
+}
+
+func NewDKIMSigner(domain, selector, keyFile string) (*DKIMSigner, error) {
+	if domain == "" || selector == "" {
+		return nil, fmt.Errorf("DKIM domain and selector are required")
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read DKIM key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block in %s", keyFile)
+	}
+
+	var key crypto.Signer
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var parsed any
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err == nil {
+			switch k := parsed.(type) {
+			case *rsa.PrivateKey:
+				key = k
+			case ed25519.PrivateKey:
+				key = k
+			default:
+				err = fmt.Errorf("unsupported DKIM key type %T", parsed)
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse DKIM key: %w", err)
+	}
+
+	return &DKIMSigner{domain: domain, selector: selector, key: key}, nil
+}
+
+// NewDKIMSignerFromEnv returns nil when DKIM_PRIVATE_KEY_FILE is not set.
+// The signing domain defaults to the domain of the sender address.
+func NewDKIMSignerFromEnv() (*DKIMSigner, error) {
+	keyFile := config.String("DKIM_PRIVATE_KEY_FILE", "")
+	if keyFile == "" {
+		return nil, nil
+	}
+	domain := config.String("DKIM_DOMAIN", "")
+	if domain == "" {
+		domain = emailDomain(config.String("EMAIL_FROM", config.String("SMTP_FROM", "")))
+	}
+	return NewDKIMSigner(domain, config.String("DKIM_SELECTOR", "default"), keyFile)
+}
+
+func (d *DKIMSigner) algorithm() string {
+	if _, ok := d.key.(ed25519.PrivateKey); ok {
+		return "ed25519-sha256"
+	}
+	return "rsa-sha256"
+}
+
+func (d *DKIMSigner) Sign(raw []byte) ([]byte, error) {
+	headerEnd := bytes.Index(raw, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		return nil, fmt.Errorf("message has no header/body separator")
+	}
+	headers := splitHeaders(raw[:headerEnd+2])
+	body := raw[headerEnd+4:]
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+
+	var signed []string
+	var canonical strings.Builder
+	for _, name := range dkimHeaders {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if strings.EqualFold(headers[i].name, name) {
+				canonical.WriteString(relaxedHeader(headers[i].name, headers[i].value))
+				signed = append(signed, strings.ToLower(name))
+				break
+			}
+		}
+	}
+
+	value := fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%s; h=%s; bh=%s; b=",
+		d.algorithm(), d.domain, d.selector, strconv.FormatInt(time.Now().Unix(), 10),
+		strings.Join(signed, ":"), base64.StdEncoding.EncodeToString(bodyHash[:]))
+	canonical.WriteString(strings.TrimSuffix(relaxedHeader("DKIM-Signature", value), "\r\n"))
+
+	digest := sha256.Sum256([]byte(canonical.String()))
+	var signature []byte
+	var err error
+	if key, ok := d.key.(ed25519.PrivateKey); ok {
+		signature = ed25519.Sign(key, digest[:])
+	} else {
+		signature, err = d.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dkim sign: %w", err)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("DKIM-Signature: " + value + base64.StdEncoding.EncodeToString(signature) + "\r\n")
+	out.Write(raw)
+	return out.Bytes(), nil
+}
+
+type rawHeader struct {
+	name  string
+	value string
+}
+
+func splitHeaders(block []byte) []rawHeader {
+	var headers []rawHeader
+	for _, line := range strings.SplitAfter(string(block), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1].value += line
+			continue
+		}
+		name, value, _ := strings.Cut(line, ":")
+		headers = append(headers, rawHeader{name: name, value: value})
+	}
+	return headers
+}
+
+func relaxedHeader(name, value string) string {
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.Join(strings.Fields(value), " ")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value + "\r\n"
+}
+
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		var b strings.Builder
+		space := false
+		for _, r := range line {
+			if r == ' ' || r == '\t' {
+				space = true
+				continue
+			}
+			if space {
+				b.WriteByte(' ')
+				space = false
+			}
+			b.WriteRune(r)
+		}
+		lines[i] = b.String()
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type DrainStatus struct {
+	Draining  bool      `json:"draining"`
+	Since     time.Time `json:"since,omitzero"`
+	Queued    int       `json:"queued"`
+	InFlight  int64     `json:"in_flight"`
+	Scheduled int       `json:"scheduled"`
+	Drained   bool      `json:"drained"`
+}
+
+// StartDrain makes the service refuse new tasks while workers keep going
+// until the queue is empty. Scheduled tasks are not released while draining
+// and are reported separately.
+func (s *EmailService) StartDrain() DrainStatus {
+	if s.draining.CompareAndSwap(false, true) {
+		now := time.Now()
+		s.drainSince.Store(&now)
+		s.scheduler.Hold(now)
+		slog.Info("Drain started", "queued", readyLen(s.queue))
+	}
+	return s.DrainStatus()
+}
+
+func (s *EmailService) StopDrain() {
+	if s.draining.CompareAndSwap(true, false) {
+		s.drainSince.Store(nil)
+		s.scheduler.Hold(time.Time{})
+		slog.Info("Drain cancelled, accepting tasks again")
+	}
+}
+
+func (s *EmailService) DrainStatus() DrainStatus {
+	status := DrainStatus{
+		Draining:  s.draining.Load(),
+		Queued:    readyLen(s.queue),
+		InFlight:  s.inFlight.Load(),
+		Scheduled: s.scheduler.Len(),
+	}
+	if since := s.drainSince.Load(); since != nil {
+		status.Since = *since
+	}
+	status.Drained = status.Draining && status.Queued == 0 && status.InFlight == 0
+	return status
+}
+
+// WaitDrained blocks until the queue is empty and no worker holds a task, or
+// until ctx is done.
+func (s *EmailService) WaitDrained(ctx context.Context) error {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if status := s.DrainStatus(); status.Queued == 0 && status.InFlight == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *EmailService) HandleDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(s.StartDrain())
+	case http.MethodDelete:
+		s.StopDrain()
+		json.NewEncoder(w).Encode(s.DrainStatus())
+	default:
+		json.NewEncoder(w).Encode(s.DrainStatus())
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDrainWithScheduledTasks(t *testing.T) {
+	q, err := NewWALQueue(NewMemoryQueue(4), filepath.Join(t.TempDir(), "queue.wal"), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	s := &EmailService{queue: q, scheduler: NewScheduler(q.Enqueue, nil, q)}
+
+	ctx := context.Background()
+	later := EmailTask{ID: "later", Type: "send", SendAt: time.Now().Add(time.Hour)}
+	soon := EmailTask{ID: "soon", Type: "send", SendAt: time.Now().Add(time.Minute)}
+	for _, task := range []EmailTask{later, soon} {
+		if err := s.scheduler.Add(ctx, task); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status := s.StartDrain()
+	if status.Queued != 0 || status.Scheduled != 2 || !status.Drained {
+		t.Fatalf("StartDrain = %+v, want 0 queued, 2 scheduled, drained", status)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := s.WaitDrained(waitCtx); err != nil {
+		t.Fatalf("WaitDrained with only scheduled tasks: %v", err)
+	}
+
+	// "soon" comes due while draining and must stay held.
+	q.releaseDue(time.Now().Add(2 * time.Minute))
+	if n := q.Ready(); n != 0 {
+		t.Fatalf("Ready after releaseDue while draining = %d, want 0", n)
+	}
+
+	s.StopDrain()
+	q.releaseDue(time.Now().Add(2 * time.Minute))
+	if n := q.Ready(); n != 1 {
+		t.Errorf("Ready after drain stopped = %d, want 1", n)
+	}
+	if n := s.scheduler.Len(); n != 1 {
+		t.Errorf("scheduled after drain stopped = %d, want 1", n)
+	}
+}
+
+func TestWaitDrainedWithInFlightTask(t *testing.T) {
+	q := NewMemoryQueue(4)
+	defer q.Close()
+	s := &EmailService{queue: q, scheduler: NewScheduler(q.Enqueue, nil, nil)}
+	s.inFlight.Add(1)
+	s.StartDrain()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.WaitDrained(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("WaitDrained with a task in flight = %v, want deadline exceeded", err)
+	}
+
+	s.inFlight.Add(-1)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.WaitDrained(ctx); err != nil {
+		t.Errorf("WaitDrained after the task finished: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// BusEvent is a note event published by the notes app on the message bus.
+// Created and updated events carry the note itself; reminder_due may carry
+// only its ID.
+type BusEvent struct {
+	ID         string            `json:"id,omitempty"`
+	Type       string            `json:"type"`
+	NoteID     string            `json:"note_id,omitempty"`
+	Note       *apiNote          `json:"note,omitempty"`
+	Recipients []string          `json:"recipients,omitempty"`
+	SendAt     time.Time         `json:"send_at,omitzero"`
+	Retry      *RetryOverride    `json:"retry,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+}
+
+// EventSource delivers raw bus messages to handle. A message counts as
+// consumed only when handle returns nil or a permanent error; anything else
+// is redelivered later.
+type EventSource interface {
+	Name() string
+	Consume(ctx context.Context, handle func(context.Context, []byte) error) error
+	Close() error
+}
+
+// errPermanentEvent marks messages that will never succeed, such as malformed
+// payloads, so sources drop them instead of redelivering forever.
+var errPermanentEvent = errors.New("permanent event error")
+
+type EventSourceConfig struct {
+	Kind        string
+	NATSURL     string
+	NATSStream  string
+	KafkaBroker []string
+	Topic       string
+	Group       string
+}
+
+func NewEventSource(cfg EventSourceConfig) (EventSource, error) {
+	switch cfg.Kind {
+	case "nats":
+		return NewNATSEventSource(cfg.NATSURL, cfg.NATSStream, cfg.Topic, cfg.Group)
+	case "kafka":
+		return NewKafkaEventSource(cfg.KafkaBroker, cfg.Topic, cfg.Group), nil
+	default:
+		return nil, fmt.Errorf("unknown EMAIL_EVENTS_SOURCE %q", cfg.Kind)
+	}
+}
+
+// HandleBusEvent turns one bus message into an email the same way
+// /email/store followed by /email/extract would.
+func (s *EmailService) HandleBusEvent(ctx context.Context, payload []byte) error {
+	var event BusEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return fmt.Errorf("%w: decode event: %v", errPermanentEvent, err)
+	}
+	return s.handleEvent(ctx, event, "")
+}
+
+// handleEvent queues the email for an event. taskID may fix the task ID so
+// that replays of the same event can be detected.
+func (s *EmailService) handleEvent(ctx context.Context, event BusEvent, taskID string) error {
+	req := SendRequest{NoteID: event.NoteID, Recipients: event.Recipients, SendAt: event.SendAt, Retry: event.Retry, Metadata: event.Metadata, TaskID: taskID}
+	switch event.Type {
+	case "created", EventNoteCreated:
+		req.Event = EventNoteCreated
+	case "updated", EventNoteUpdated:
+		req.Event = EventNoteUpdated
+	case EventReminderDue:
+		req.Event = EventReminderDue
+	default:
+		return fmt.Errorf("%w: unknown event type %q", errPermanentEvent, event.Type)
+	}
+
+	if event.Note != nil {
+		note := event.Note.note()
+		if note.ID == "" {
+			return fmt.Errorf("%w: note without id", errPermanentEvent)
+		}
+		s.saveNote(note)
+		req.NoteID = note.ID
+	}
+	if req.NoteID == "" {
+		return fmt.Errorf("%w: event has neither note nor note_id", errPermanentEvent)
+	}
+
+	logger := slog.With("event_id", event.ID, "event", req.Event, "note_id", req.NoteID)
+	task, err := s.ExtractNote(ctx, req)
+	switch {
+	case errors.Is(err, errSkipped):
+		logger.Info("Bus event skipped", "reason", err)
+		return nil
+	case errors.Is(err, errInvalidRequest), errors.Is(err, errNoteNotFound):
+		return fmt.Errorf("%w: %v", errPermanentEvent, err)
+	case err != nil:
+		return err
+	}
+	logger.Info("Bus event queued", "task_id", task.ID)
+	return nil
+}
+
+// runEventSource consumes until ctx is cancelled, reconnecting with backoff
+// when the source fails.
+func (s *EmailService) runEventSource(ctx context.Context, source EventSource) {
+	defer source.Close()
+
+	logger := slog.With("source", source.Name())
+	logger.Info("Consuming note events")
+
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := source.Consume(ctx, s.HandleBusEvent)
+		if ctx.Err() != nil {
+			logger.Info("Stopped consuming note events")
+			return
+		}
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		logger.Error("Event source failed, reconnecting", "error", err, "retry_in", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+func defaultEventsTopic(kind string) string {
+	if kind == "nats" {
+		return "notes.events.>"
+	}
+	return "note-events"
+}
+
+func splitList(value string) []string {
+	var items []string
+	for item := range strings.SplitSeq(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
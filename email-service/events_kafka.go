@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaEventSource reads note events as a member of a consumer group and
+// commits an offset only after the event was handled, so a crash replays
+// anything not yet queued.
+type KafkaEventSource struct {
+	reader *kafka.Reader
+}
+
+func NewKafkaEventSource(brokers []string, topic, group string) *KafkaEventSource {
+	return &KafkaEventSource{
+		reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers:  brokers,
+			Topic:    topic,
+			GroupID:  group,
+			MaxWait:  time.Second,
+			MinBytes: 1,
+			MaxBytes: 10 << 20,
+		}),
+	}
+}
+
+func (k *KafkaEventSource) Name() string { return "kafka" }
+
+// Consume handles messages in partition order. A transient failure is
+// retried in place rather than skipped, since committing a later offset
+// would lose it.
+func (k *KafkaEventSource) Consume(ctx context.Context, handle func(context.Context, []byte) error) error {
+	for {
+		msg, err := k.reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		backoff := time.Second
+		for {
+			err := handle(ctx, msg.Value)
+			if err == nil {
+				break
+			}
+			if errors.Is(err, errPermanentEvent) {
+				slog.Error("Dropping note event", "partition", msg.Partition, "offset", msg.Offset, "error", err)
+				break
+			}
+			slog.Warn("Note event failed, retrying", "partition", msg.Partition, "offset", msg.Offset,
+				"retry_in", backoff, "error", err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, 30*time.Second)
+		}
+
+		if err := k.reader.CommitMessages(ctx, msg); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (k *KafkaEventSource) Close() error {
+	return k.reader.Close()
+}
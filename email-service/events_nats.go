@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// NATSEventSource reads note events from a JetStream stream through a
+// durable pull consumer, so events published while the service is down are
+// delivered once it comes back.
+type NATSEventSource struct {
+	conn    *nats.Conn
+	js      jetstream.JetStream
+	stream  string
+	subject string
+	durable string
+}
+
+func NewNATSEventSource(url, stream, subject, durable string) (*NATSEventSource, error) {
+	conn, err := nats.Connect(url, nats.Name("email-service"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, fmt.Errorf("connect to NATS: %w", err)
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &NATSEventSource{conn: conn, js: js, stream: stream, subject: subject, durable: durable}, nil
+}
+
+func (n *NATSEventSource) Name() string { return "nats" }
+
+func (n *NATSEventSource) Consume(ctx context.Context, handle func(context.Context, []byte) error) error {
+	consumer, err := n.js.CreateOrUpdateConsumer(ctx, n.stream, jetstream.ConsumerConfig{
+		Durable:       n.durable,
+		FilterSubject: n.subject,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       30 * time.Second,
+	})
+	if err != nil {
+		return fmt.Errorf("create consumer %s on stream %s: %w", n.durable, n.stream, err)
+	}
+
+	for ctx.Err() == nil {
+		fetchCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		batch, err := consumer.Fetch(10, jetstream.FetchContext(fetchCtx))
+		if err != nil {
+			cancel()
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		for msg := range batch.Messages() {
+			n.settle(msg, handle(ctx, msg.Data()))
+		}
+		cancel()
+		if err := batch.Error(); err != nil && !errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *NATSEventSource) settle(msg jetstream.Msg, err error) {
+	var ackErr error
+	switch {
+	case err == nil:
+		ackErr = msg.Ack()
+	case errors.Is(err, errPermanentEvent):
+		slog.Error("Dropping note event", "subject", msg.Subject(), "error", err)
+		ackErr = msg.Term()
+	default:
+		slog.Warn("Note event failed, redelivering", "subject", msg.Subject(), "error", err)
+		ackErr = msg.NakWithDelay(5 * time.Second)
+	}
+	if ackErr != nil {
+		slog.Error("Failed to acknowledge note event", "subject", msg.Subject(), "error", ackErr)
+	}
+}
+
+func (n *NATSEventSource) Close() error {
+	n.conn.Close()
+	return nil
+}
@@ -0,0 +1,171 @@
+//go:generate protoc -I proto --go_out=emailpb --go_opt=paths=source_relative --go-grpc_out=emailpb --go-grpc_opt=paths=source_relative email.proto
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"slices"
+	"time"
+
+	"email-service/emailpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type grpcServer struct {
+	emailpb.UnimplementedEmailServiceServer
+	service *EmailService
+}
+
+// newGRPCServer serves the EmailService API plus the standard gRPC health
+// service, which reports SERVING for both "" and the EmailService name.
+func newGRPCServer(service *EmailService, tlsConfig *tls.Config, auth *Authenticator) (*grpc.Server, *health.Server) {
+	opts := auth.grpcOptions()
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(opts...)
+	emailpb.RegisterEmailServiceServer(server, &grpcServer{service: service})
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(emailpb.EmailService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+
+	return server, healthServer
+}
+
+func (g *grpcServer) Enqueue(ctx context.Context, req *emailpb.EnqueueRequest) (*emailpb.EnqueueResponse, error) {
+	if req.GetNoteId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "note_id is required")
+	}
+
+	send := SendRequest{
+		NoteID:      req.GetNoteId(),
+		AttachNote:  req.GetAttachNote(),
+		CallbackURL: req.GetCallbackUrl(),
+		Priority:    priorityFromProto(req.GetPriority()),
+	}
+	if req.GetSendAt() != nil {
+		send.SendAt = req.GetSendAt().AsTime()
+	}
+
+	task, err := g.service.ExtractNote(ctx, send)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	state := StatusQueued
+	if task.SendAt.After(time.Now()) {
+		state = StatusScheduled
+	}
+	return &emailpb.EnqueueResponse{Id: task.ID, Status: state}, nil
+}
+
+func (g *grpcServer) Status(ctx context.Context, req *emailpb.StatusRequest) (*emailpb.TaskStatus, error) {
+	entry, ok := g.service.history.Get(req.GetId())
+	if !ok {
+		return nil, status.Error(codes.NotFound, errTaskNotFound.Error())
+	}
+	return taskStatusToProto(entry), nil
+}
+
+func (g *grpcServer) Cancel(ctx context.Context, req *emailpb.CancelRequest) (*emailpb.CancelResponse, error) {
+	if _, err := g.service.Cancel(ctx, req.GetId()); err != nil {
+		return nil, grpcError(err)
+	}
+	return &emailpb.CancelResponse{Id: req.GetId(), Status: StatusCancelled}, nil
+}
+
+func (g *grpcServer) WatchEvents(req *emailpb.WatchEventsRequest, stream grpc.ServerStreamingServer[emailpb.TaskEvent]) error {
+	events, unsubscribe := g.service.history.Subscribe(256)
+	defer unsubscribe()
+
+	ids := req.GetTaskIds()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-g.service.ctx.Done():
+			return status.Error(codes.Unavailable, "email service is shutting down")
+		case event := <-events:
+			// The proto has no recipient field, so per-recipient events of
+			// multi-recipient tasks would read as task transitions.
+			if event.Recipient != "" || (len(ids) > 0 && !slices.Contains(ids, event.TaskID)) {
+				continue
+			}
+			if err := stream.Send(&emailpb.TaskEvent{
+				TaskId: event.TaskID,
+				Type:   event.Type,
+				NoteId: event.NoteID,
+				Event:  statusEventToProto(event.Event),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, errInvalidRequest):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, errNoteNotFound), errors.Is(err, errTaskNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, errNotCancellable), errors.Is(err, errSkipped):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, errQueueFull):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, errQueueClosed), errors.Is(err, errDraining):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func priorityFromProto(p emailpb.Priority) string {
+	switch p {
+	case emailpb.Priority_PRIORITY_HIGH:
+		return PriorityHigh
+	case emailpb.Priority_PRIORITY_LOW:
+		return PriorityLow
+	default:
+		return PriorityNormal
+	}
+}
+
+func statusEventToProto(e StatusEvent) *emailpb.StatusEvent {
+	return &emailpb.StatusEvent{
+		Status:  e.Status,
+		Attempt: int32(e.Attempt),
+		Error:   e.Error,
+		At:      timestamppb.New(e.At),
+	}
+}
+
+func taskStatusToProto(t TaskStatus) *emailpb.TaskStatus {
+	out := &emailpb.TaskStatus{
+		Id:         t.ID,
+		Type:       t.Type,
+		NoteId:     t.NoteID,
+		Recipients: t.Recipients,
+		Status:     t.Status,
+		Attempts:   int32(t.Attempts),
+		Error:      t.Error,
+		CreatedAt:  timestamppb.New(t.CreatedAt),
+		UpdatedAt:  timestamppb.New(t.UpdatedAt),
+	}
+	for _, e := range t.History {
+		out.History = append(out.History, statusEventToProto(e))
+	}
+	return out
+}
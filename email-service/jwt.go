@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksMinRefresh keeps tokens with made-up key IDs from having the keys
+	// fetched on every request.
+	jwksMinRefresh = 30 * time.Second
+	jwtLeeway      = 30 * time.Second
+)
+
+// JWTVerifier accepts the workload tokens the mesh CA issues (POST /token
+// on ca-service): signed with a key from the JWKS at url, by issuer, for
+// audience and not expired. The keys are fetched on first use and again
+// when a token names a key that isn't known, as after the CA replaces its
+// signing key.
+type JWTVerifier struct {
+	url      string
+	issuer   string
+	audience string
+	client   *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// NewJWTVerifier fetches the keys trusting roots, or the system roots if it
+// is nil.
+func NewJWTVerifier(url, issuer, audience string, roots *x509.CertPool) *JWTVerifier {
+	return &JWTVerifier{
+		url:      url,
+		issuer:   issuer,
+		audience: audience,
+		client: &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}},
+		},
+	}
+}
+
+type jwtClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+}
+
+// audience is the aud claim, a string or a list of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// verify checks token and returns its subject.
+func (v *JWTVerifier) verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", fmt.Errorf("header: %w", err)
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return "", err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("invalid signature encoding")
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return "", err
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("claims: %w", err)
+	}
+	now := time.Now()
+	switch {
+	case claims.Issuer != v.issuer:
+		return "", fmt.Errorf("issuer %q is not %q", claims.Issuer, v.issuer)
+	case !slices.Contains(claims.Audience, v.audience):
+		return "", fmt.Errorf("token is not for %q", v.audience)
+	case claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(jwtLeeway)):
+		return "", errors.New("token expired")
+	case now.Add(jwtLeeway).Before(time.Unix(claims.NotBefore, 0)):
+		return "", errors.New("token not valid yet")
+	case claims.Subject == "":
+		return "", errors.New("token has no subject")
+	}
+	return claims.Subject, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (v *JWTVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(v.fetched) < jwksMinRefresh {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	v.fetched = time.Now()
+	keys, err := v.fetch()
+	if err != nil {
+		return nil, fmt.Errorf("fetch keys: %w", err)
+	}
+	v.keys = keys
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// fetch reads the JWKS, skipping keys of types it doesn't know.
+func (v *JWTVerifier) fetch() (map[string]crypto.PublicKey, error) {
+	resp, err := v.client.Get(v.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", v.url, resp.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if key := k.publicKey(); key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() crypto.PublicKey {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "EC":
+		curve, ok := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}[k.Crv]
+		x, errX := b64.DecodeString(k.X)
+		y, errY := b64.DecodeString(k.Y)
+		if !ok || errX != nil || errY != nil {
+			return nil
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil
+		}
+		return key
+	case "RSA":
+		n, errN := b64.DecodeString(k.N)
+		e, errE := b64.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			return nil
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return nil
+}
+
+// verifySignature checks a JWS signature under alg, which must suit key.
+func verifySignature(alg string, key crypto.PublicKey, input, sig []byte) error {
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		algs := map[string]struct {
+			curve elliptic.Curve
+			hash  func() hash.Hash
+		}{
+			"ES256": {elliptic.P256(), sha256.New},
+			"ES384": {elliptic.P384(), sha512.New384},
+			"ES512": {elliptic.P521(), sha512.New},
+		}
+		a, ok := algs[alg]
+		if !ok || a.curve != key.Curve {
+			return fmt.Errorf("algorithm %q does not match the key", alg)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature")
+		}
+		h := a.hash()
+		h.Write(input)
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, h.Sum(nil), r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return fmt.Errorf("algorithm %q does not match the key", alg)
+		}
+		sum := sha256.Sum256(input)
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) != nil {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return errors.New("unsupported key")
+}
+
+// workloadNames are the caller names a token subject matches: the SPIFFE
+// ID itself and, for spiffe://notes/app1, the service name app1.
+func workloadNames(subject string) []string {
+	names := []string{subject}
+	if u, err := url.Parse(subject); err == nil && u.Scheme == "spiffe" {
+		names = append(names, strings.TrimPrefix(u.Path, "/"))
+	}
+	return names
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testIssuer = "https://ca-service:8443"
+
+type testJWKS struct {
+	mu      sync.Mutex
+	keys    map[string]*ecdsa.PrivateKey
+	fetches atomic.Int32
+}
+
+func (s *testJWKS) add(t *testing.T, kid string) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.keys[kid] = key
+	s.mu.Unlock()
+	return key
+}
+
+func (s *testJWKS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.fetches.Add(1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	for kid, key := range s.keys {
+		set.Keys = append(set.Keys, jwk{
+			Kty: "EC", Kid: kid, Crv: "P-256",
+			X: base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			Y: base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		})
+	}
+	json.NewEncoder(w).Encode(set)
+}
+
+func signJWT(t *testing.T, key *ecdsa.PrivateKey, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	b64 := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return input + "." + b64.EncodeToString(sig)
+}
+
+func TestJWTVerifier(t *testing.T) {
+	jwks := &testJWKS{keys: map[string]*ecdsa.PrivateKey{}}
+	key := jwks.add(t, "k1")
+	srv := httptest.NewTLSServer(jwks)
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	v := NewJWTVerifier(srv.URL, testIssuer, "email", roots)
+
+	now := time.Now().Unix()
+	claims := func(change func(map[string]any)) map[string]any {
+		c := map[string]any{"iss": testIssuer, "sub": "spiffe://notes/app1", "aud": "email", "exp": now + 300, "nbf": now}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+
+	subject, err := v.verify(signJWT(t, key, "ES256", "k1", claims(nil)))
+	if err != nil || subject != "spiffe://notes/app1" {
+		t.Fatalf("verify(valid) = %q, %v", subject, err)
+	}
+	if _, err := v.verify(signJWT(t, key, "ES256", "k1", claims(func(c map[string]any) { c["aud"] = []string{"other", "email"} }))); err != nil {
+		t.Errorf("verify(audience list) = %v", err)
+	}
+
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	valid := strings.Split(signJWT(t, key, "ES256", "k1", claims(nil)), ".")
+	forged := strings.Split(signJWT(t, key, "ES256", "k1", claims(func(c map[string]any) { c["sub"] = "spiffe://notes/admin" })), ".")
+	tests := map[string]string{
+		"wrong issuer":    signJWT(t, key, "ES256", "k1", claims(func(c map[string]any) { c["iss"] = "https://evil" })),
+		"wrong audience":  signJWT(t, key, "ES256", "k1", claims(func(c map[string]any) { c["aud"] = "notes" })),
+		"expired":         signJWT(t, key, "ES256", "k1", claims(func(c map[string]any) { c["exp"] = now - 3600 })),
+		"no expiry":       signJWT(t, key, "ES256", "k1", claims(func(c map[string]any) { delete(c, "exp") })),
+		"not valid yet":   signJWT(t, key, "ES256", "k1", claims(func(c map[string]any) { c["nbf"] = now + 3600 })),
+		"no subject":      signJWT(t, key, "ES256", "k1", claims(func(c map[string]any) { delete(c, "sub") })),
+		"other key":       signJWT(t, other, "ES256", "k1", claims(nil)),
+		"algorithm swap":  signJWT(t, key, "HS256", "k1", claims(nil)),
+		"unsigned":        valid[0] + "." + valid[1] + ".",
+		"tampered claims": valid[0] + "." + forged[1] + "." + valid[2],
+		"malformed":       "not.a.jwt.at.all",
+		"unknown key":     signJWT(t, key, "ES256", "k9", claims(nil)),
+	}
+	for name, token := range tests {
+		if _, err := v.verify(token); err == nil {
+			t.Errorf("verify(%s) succeeded", name)
+		}
+	}
+
+	// Unknown key IDs don't refetch the keys on every request, but a new
+	// signing key is picked up once the last fetch is old enough.
+	fetches := jwks.fetches.Load()
+	rotated := jwks.add(t, "k2")
+	if _, err := v.verify(signJWT(t, rotated, "ES256", "k2", claims(nil))); err == nil {
+		t.Error("new key accepted before the refresh interval")
+	}
+	if jwks.fetches.Load() != fetches {
+		t.Error("unknown key refetched the keys within the refresh interval")
+	}
+	v.mu.Lock()
+	v.fetched = time.Now().Add(-jwksMinRefresh)
+	v.mu.Unlock()
+	if _, err := v.verify(signJWT(t, rotated, "ES256", "k2", claims(nil))); err != nil {
+		t.Errorf("verify(rotated key) = %v", err)
+	}
+}
+
+func TestWorkloadNames(t *testing.T) {
+	if got := workloadNames("spiffe://notes/app1"); !slices.Equal(got, []string{"spiffe://notes/app1", "app1"}) {
+		t.Errorf("workloadNames(spiffe) = %v", got)
+	}
+	if got := workloadNames("app1"); !slices.Equal(got, []string{"app1"}) {
+		t.Errorf("workloadNames(app1) = %v", got)
+	}
+}
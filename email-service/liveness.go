@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// heartbeatInterval bounds how long a worker may wait in Dequeue before it
+// reports in, so an idle worker is never mistaken for a stuck one.
+const heartbeatInterval = 5 * time.Second
+
+type workerBeat struct {
+	taskID   string
+	lastBeat time.Time
+}
+
+type WorkerHealth struct {
+	ID            int       `json:"id"`
+	TaskID        string    `json:"task_id,omitempty"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	SilentFor     string    `json:"silent_for"`
+}
+
+// heartbeat records that the worker is alive and which task, if any, it is
+// working on.
+func (s *EmailService) heartbeat(id int, taskID string) {
+	s.beatMu.Lock()
+	defer s.beatMu.Unlock()
+	s.beats[id] = workerBeat{taskID: taskID, lastBeat: time.Now()}
+}
+
+func (s *EmailService) forgetWorker(id int) {
+	s.beatMu.Lock()
+	defer s.beatMu.Unlock()
+	delete(s.beats, id)
+}
+
+// nextTask waits for a task for at most one heartbeat interval. ok is false
+// when the wait timed out and the worker should beat and try again.
+func (s *EmailService) nextTask(ctx context.Context) (task EmailTask, ok bool, err error) {
+	waitCtx, cancel := context.WithTimeout(ctx, heartbeatInterval)
+	defer cancel()
+
+	task, err = s.queue.Dequeue(waitCtx)
+	if err != nil && ctx.Err() == nil && waitCtx.Err() != nil {
+		return EmailTask{}, false, nil
+	}
+	return task, err == nil, err
+}
+
+// stuckWorkers lists workers that haven't reported in for longer than
+// stallTimeout, typically because a send hangs past its timeout.
+func (s *EmailService) stuckWorkers() []WorkerHealth {
+	s.beatMu.Lock()
+	defer s.beatMu.Unlock()
+
+	var stuck []WorkerHealth
+	for id, beat := range s.beats {
+		silent := time.Since(beat.lastBeat)
+		if silent < s.stallTimeout {
+			continue
+		}
+		stuck = append(stuck, WorkerHealth{
+			ID:            id,
+			TaskID:        beat.taskID,
+			LastHeartbeat: beat.lastBeat,
+			SilentFor:     silent.Round(time.Second).String(),
+		})
+	}
+	sort.Slice(stuck, func(i, j int) bool { return stuck[i].ID < stuck[j].ID })
+	return stuck
+}
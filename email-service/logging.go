@@ -0,0 +1,23 @@
+package main
+
+import "log/slog"
+
+// taskLogger carries the fields that tie every line about a task together,
+// so one email's journey can be found by task_id.
+func taskLogger(task EmailTask, workerID int) *slog.Logger {
+	logger := slog.With("task_id", task.ID, "type", task.Type, "attempt", task.Attempts)
+	noteID := task.NoteID
+	if noteID == "" {
+		noteID = task.Note.ID
+	}
+	if noteID != "" {
+		logger = logger.With("note_id", noteID)
+	}
+	if task.BatchID != "" {
+		logger = logger.With("batch_id", task.BatchID)
+	}
+	if workerID > 0 {
+		logger = logger.With("worker", workerID)
+	}
+	return logger
+}
@@ -2,13 +2,27 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/mail"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/m-tln/notes/config"
+	"github.com/m-tln/notes/logging"
 )
 
 type Note struct {
@@ -16,198 +30,1054 @@ type Note struct {
 	Title       string    `json:"title"`
 	Content     string    `json:"content"`
 	Description string    `json:"description"`
+	OwnerID     string    `json:"owner_id,omitempty"`
 	CreatedAt   time.Time `json:"created_at"`
 }
 
 type EmailTask struct {
-	Note    Note
-	Type    string
-	NoteID  string
+	ID          string            `json:"id"`
+	Note        Note              `json:"note"`
+	Type        string            `json:"type"`
+	Priority    string            `json:"priority,omitempty"`
+	NoteID      string            `json:"note_id"`
+	Attempts    int               `json:"attempts"`
+	LastError   string            `json:"last_error,omitempty"`
+	SendAt      time.Time         `json:"send_at,omitzero"`
+	Recipient   string            `json:"recipient,omitempty"`
+	Recipients  []string          `json:"recipients,omitempty"`
+	Delivered   []string          `json:"delivered,omitempty"`
+	Rejected    []string          `json:"rejected,omitempty"`
+	Subject     string            `json:"subject,omitempty"`
+	Body        string            `json:"body,omitempty"`
+	HTML        string            `json:"html,omitempty"`
+	Attachments []AttachmentRef   `json:"attachments,omitempty"`
+	AttachNote  string            `json:"attach_note,omitempty"`
+	CallbackURL string            `json:"callback_url,omitempty"`
+	BatchID     string            `json:"batch_id,omitempty"`
+	Event       string            `json:"event,omitempty"`
+	Retry       *RetryOverride    `json:"retry,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+
+	receipt string
+}
+
+type SendRequest struct {
+	NoteID      string              `json:"note_id"`
+	Recipients  []string            `json:"recipients,omitempty"`
+	SendAt      time.Time           `json:"send_at,omitzero"`
+	AttachNote  string              `json:"attach_note,omitempty"`
+	Attachments []AttachmentRequest `json:"attachments,omitempty"`
+	CallbackURL string              `json:"callback_url,omitempty"`
+	Priority    string              `json:"priority,omitempty"`
+	Event       string              `json:"event,omitempty"`
+	Retry       *RetryOverride      `json:"retry,omitempty"`
+	Metadata    map[string]string   `json:"metadata,omitempty"`
+	TaskID      string              `json:"-"`
 }
 
+var (
+	errQueueFull      = errors.New("email queue is full, try again later")
+	errQueueClosed    = errors.New("email queue is closed")
+	errTaskNotFound   = errors.New("task not found")
+	errLeaseLost      = errors.New("task lease expired, another worker claimed it")
+	errAbandoned      = errors.New("task was abandoned by its worker too many times")
+	errNoteNotFound   = errors.New("note not found")
+	errNotCancellable = errors.New("task can no longer be cancelled")
+	errDraining       = errors.New("email service is draining, not accepting new tasks")
+	errInvalidRequest = errors.New("invalid request")
+	errSkipped        = errors.New("skipped by recipient preferences")
+)
+
 type EmailService struct {
-	emailAddr    string
-	storage      map[string]Note
-	mu           sync.RWMutex
-	taskQueue    chan EmailTask
-	workerCount  int
-	maxQueueSize int
-	ctx          context.Context
-	cancel       context.CancelFunc
-	wg           sync.WaitGroup
+	emailAddr     string
+	from          string
+	sender        Sender
+	retry         RetryPolicy
+	retryLimits   RetryLimits
+	dlq           *DeadLetterQueue
+	scheduler     *Scheduler
+	digest        *Digest
+	maxRecipients int
+	attachments   *AttachmentStore
+	pdf           PDFRenderer
+	pdfTimeout    time.Duration
+	limiter       *RateLimiter
+	history       *StatusTracker
+	notifier      *Notifier
+	suppression   *SuppressionList
+	unsubscriber  *Unsubscriber
+	batches       *BatchTracker
+	notes         *NoteStore
+	preferences   *PreferenceStore
+	sendWindow    SendWindow
+	notesAPI      *NotesAPI
+	outbox        *Outbox
+	queue         TaskQueue
+	autoscale     AutoscaleConfig
+	poolMu        sync.Mutex
+	workerCancels map[int]context.CancelFunc
+	nextWorkerID  int
+	beatMu        sync.Mutex
+	beats         map[int]workerBeat
+	stallTimeout  time.Duration
+	latency       time.Duration
+	scaleUps      atomic.Int64
+	scaleDowns    atomic.Int64
+	draining      atomic.Bool
+	drainSince    atomic.Pointer[time.Time]
+	inFlight      atomic.Int64
+	maxQueueSize  int
+	ctx           context.Context
+	cancel        context.CancelFunc
+	wg            sync.WaitGroup
+}
+
+type ServiceConfig struct {
+	EmailAddr     string
+	From          string
+	Sender        Sender
+	Queue         TaskQueue
+	Retry         RetryPolicy
+	RetryLimits   RetryLimits
+	Digest        *Digest
+	MaxRecipients int
+	Attachments   *AttachmentStore
+	PDF           PDFRenderer
+	PDFTimeout    time.Duration
+	Limiter       *RateLimiter
+	History       *StatusTracker
+	Notifier      *Notifier
+	Suppression   *SuppressionList
+	Unsubscriber  *Unsubscriber
+	Batches       *BatchTracker
+	Notes         *NoteStore
+	NotesAPI      *NotesAPI
+	Preferences   *PreferenceStore
+	SendWindow    SendWindow
+	Events        EventSource
+	Outbox        *Outbox
+	Workers       int
+	Autoscale     AutoscaleConfig
+	StallTimeout  time.Duration
 }
 
-func NewEmailService(emailAddr string, workerCount, maxQueueSize int) *EmailService {
+func NewEmailService(cfg ServiceConfig) *EmailService {
 	ctx, cancel := context.WithCancel(context.Background())
-	
+	store, _ := cfg.Queue.(DeadLetterStore)
+
 	service := &EmailService{
-		emailAddr:    emailAddr,
-		storage:      make(map[string]Note),
-		taskQueue:    make(chan EmailTask, maxQueueSize),
-		workerCount:  workerCount,
-		maxQueueSize: maxQueueSize,
-		ctx:          ctx,
-		cancel:       cancel,
+		emailAddr:     cfg.EmailAddr,
+		from:          cfg.From,
+		sender:        cfg.Sender,
+		retry:         cfg.Retry,
+		retryLimits:   cfg.RetryLimits,
+		dlq:           NewDeadLetterQueue(store),
+		maxRecipients: cfg.MaxRecipients,
+		attachments:   cfg.Attachments,
+		pdf:           cfg.PDF,
+		pdfTimeout:    cfg.PDFTimeout,
+		limiter:       cfg.Limiter,
+		history:       cfg.History,
+		notifier:      cfg.Notifier,
+		suppression:   cfg.Suppression,
+		unsubscriber:  cfg.Unsubscriber,
+		batches:       cfg.Batches,
+		notes:         cfg.Notes,
+		notesAPI:      cfg.NotesAPI,
+		preferences:   cfg.Preferences,
+		sendWindow:    cfg.SendWindow,
+		outbox:        cfg.Outbox,
+		queue:         cfg.Queue,
+		autoscale:     cfg.Autoscale,
+		workerCancels: make(map[int]context.CancelFunc),
+		beats:         make(map[int]workerBeat),
+		stallTimeout:  cfg.StallTimeout,
+		maxQueueSize:  cfg.Queue.Cap(),
+		ctx:           ctx,
+		cancel:        cancel,
 	}
 
-	for i := range workerCount {
+	service.digest = cfg.Digest
+	service.digest.enqueue = service.enqueue
+	service.digest.unsubscribe = service.unsubscriber.URL
+	service.wg.Add(1)
+	go func() {
+		defer service.wg.Done()
+		service.digest.Run(ctx)
+	}()
+
+	service.wg.Add(1)
+	go func() {
+		defer service.wg.Done()
+		service.notes.Run(ctx)
+	}()
+
+	if service.notesAPI != nil {
 		service.wg.Add(1)
-		go service.worker(i + 1)
+		go func() {
+			defer service.wg.Done()
+			service.notesAPI.Run(ctx)
+		}()
 	}
 
-	log.Printf("[EMAIL] Started %d workers with queue size %d", workerCount, maxQueueSize)
+	if cfg.Events != nil {
+		service.wg.Add(1)
+		go func() {
+			defer service.wg.Done()
+			service.runEventSource(ctx, cfg.Events)
+		}()
+	}
+
+	if service.outbox != nil {
+		service.wg.Add(1)
+		go func() {
+			defer service.wg.Done()
+			service.outbox.Run(ctx, service)
+		}()
+	}
+
+	scheduleStore, _ := cfg.Queue.(ScheduleStore)
+	service.scheduler = NewScheduler(service.enqueue, service.history, scheduleStore)
+	service.wg.Add(1)
+	go func() {
+		defer service.wg.Done()
+		service.scheduler.Run(ctx)
+	}()
+
+	workers := cfg.Workers
+	if cfg.Autoscale.enabled() {
+		workers = min(max(workers, cfg.Autoscale.Min), cfg.Autoscale.Max)
+	}
+	for range workers {
+		service.startWorker()
+	}
+
+	if cfg.Autoscale.enabled() {
+		service.wg.Add(1)
+		go func() {
+			defer service.wg.Done()
+			service.runAutoscaler(ctx)
+		}()
+		slog.Info("Autoscaling workers", "min", cfg.Autoscale.Min, "max", cfg.Autoscale.Max)
+	}
+
+	slog.Info("Workers started", "workers", workers, "queue_size", cfg.Queue.Cap())
 	return service
 }
 
-func (s *EmailService) worker(id int) {
+func (s *EmailService) worker(ctx context.Context, id int) {
 	defer s.wg.Done()
-	
-	log.Printf("[EMAIL-WORKER-%d] Worker started", id)
-	
+
+	defer s.forgetWorker(id)
+
+	logger := slog.With("worker", id)
+	logger.Info("Worker started")
+
 	for {
-		select {
-		case <-s.ctx.Done():
-			log.Printf("[EMAIL-WORKER-%d] Worker stopped", id)
+		if ctx.Err() != nil {
+			logger.Info("Worker stopped")
+			return
+		}
+		s.heartbeat(id, "")
+		task, ok, err := s.nextTask(ctx)
+		if err != nil {
+			logger.Info("Worker stopped")
 			return
-		case task := <-s.taskQueue:
-			s.processTask(task, id)
 		}
+		if !ok {
+			continue
+		}
+
+		s.heartbeat(id, task.ID)
+		s.inFlight.Add(1)
+		start := time.Now()
+		s.runTask(task, id)
+		s.recordLatency(time.Since(start))
+		s.inFlight.Add(-1)
+	}
+}
+
+func (s *EmailService) runTask(task EmailTask, workerID int) {
+	// Only a task reclaimed from a worker that died or stalled on it arrives
+	// with its attempts already used up.
+	if task.Attempts > 0 && task.Attempts >= s.retry.With(task.Retry).MaxAttempts {
+		s.handleFailure(task, errAbandoned, workerID)
+		return
+	}
+	task.Attempts++
+	s.history.Record(task, StatusSending, nil)
+	if err := s.processTask(&task, workerID); err != nil {
+		s.handleFailure(task, err, workerID)
+		return
+	}
+	if err := s.queue.Complete(s.ctx, task); err != nil {
+		taskLogger(task, workerID).Error("Failed to mark task complete", "error", err)
+	}
+	s.history.Record(task, StatusSent, nil)
+	s.notifyOutcome(task, StatusSent, nil)
+	s.attachments.Delete(task.Attachments)
+}
+
+func (s *EmailService) handleFailure(task EmailTask, err error, workerID int) {
+	var limited *RateLimitedError
+	if errors.As(err, &limited) {
+		task.Attempts--
+		logger := taskLogger(task, workerID)
+		s.history.Record(task, StatusDeferred, err)
+		logger.Info("Task deferred", "retry_after", limited.RetryAfter, "error", err)
+		if qErr := s.queue.Retry(s.ctx, task, time.Now().Add(limited.RetryAfter)); qErr != nil {
+			logger.Error("Failed to defer task", "error", qErr)
+		}
+		return
+	}
+
+	logger := taskLogger(task, workerID)
+	task.LastError = err.Error()
+	policy := s.retry.With(task.Retry)
+
+	if IsPermanent(err) || task.Attempts >= policy.MaxAttempts {
+		if qErr := s.queue.Fail(s.ctx, task, err); qErr != nil {
+			logger.Error("Failed to record task failure", "error", qErr)
+		}
+		s.dlq.Add(task, err)
+		s.history.Record(task, StatusFailed, err)
+		s.notifyOutcome(task, StatusFailed, err)
+		logger.Error("Task moved to dead-letter queue", "permanent", IsPermanent(err), "error", err)
+		return
+	}
+
+	delay := policy.Backoff(task.Attempts)
+	s.history.Record(task, StatusRetrying, err)
+	logger.Warn("Task failed, retrying", "max_attempts", policy.MaxAttempts, "retry_in", delay, "error", err)
+
+	if qErr := s.queue.Retry(s.ctx, task, time.Now().Add(delay)); qErr != nil {
+		logger.Error("Failed to schedule retry", "error", qErr)
+	}
+}
+
+func (s *EmailService) notifyOutcome(task EmailTask, status string, err error) {
+	if task.CallbackURL == "" {
+		return
+	}
+	payload := CallbackPayload{
+		TaskID:   task.ID,
+		NoteID:   task.NoteID,
+		Status:   status,
+		Attempts: task.Attempts,
+		At:       time.Now(),
+	}
+	if err != nil {
+		payload.Error = err.Error()
+	}
+	s.notifier.Notify(task.CallbackURL, payload)
+}
+
+func (s *EmailService) RetryDeadLetter(ctx context.Context, id string) error {
+	if store, ok := s.queue.(DeadLetterStore); ok {
+		if s.draining.Load() {
+			return errDraining
+		}
+		task, err := store.Requeue(ctx, id)
+		if err != nil {
+			return err
+		}
+		s.history.Record(task, StatusQueued, nil)
+		taskLogger(task, 0).Info("Task queued", "priority", task.Priority)
+		return nil
 	}
+
+	item, ok := s.dlq.Take(id)
+	if !ok {
+		return errTaskNotFound
+	}
+
+	task := item.Task
+	resetDeadLetter(&task)
+	if err := s.enqueue(ctx, task); err != nil {
+		s.dlq.Add(item.Task, fmt.Errorf("%s", item.Error))
+		return err
+	}
+	return nil
 }
 
-func (s *EmailService) processTask(task EmailTask, workerID int) {
-	ctx, cancel := context.WithTimeout(s.ctx, 5*time.Second)
+func (s *EmailService) processTask(task *EmailTask, workerID int) error {
+	ctx, cancel := context.WithTimeout(s.ctx, s.retry.With(task.Retry).Timeout)
 	defer cancel()
+	logger := taskLogger(*task, workerID)
+	ctx = logging.NewContext(ctx, logger)
 
 	switch task.Type {
 	case "store":
-		s.mu.Lock()
-		s.storage[task.Note.ID] = task.Note
-		s.mu.Unlock()
-		log.Printf("[EMAIL-WORKER-%d] Stored note: %s (Title: %s)", 
-			workerID, task.Note.ID, task.Note.Title)
-		
+		event := s.saveNote(task.Note)
+		logger.Info("Stored note", "title", task.Note.Title, "event", event.Type)
+		return nil
+
 	case "send":
-		s.mu.RLock()
-		note, exists := s.storage[task.NoteID]
-		s.mu.RUnlock()
-		
+		note, exists, err := s.lookupNote(ctx, task.NoteID)
+		if err != nil {
+			logger.Warn("Failed to refresh note, using queued copy", "error", err)
+		}
+		if !exists && task.Note.ID != "" {
+			note, exists = task.Note, true
+		}
 		if !exists {
-			log.Printf("[EMAIL-WORKER-%d] Note not found for sending: %s", 
-				workerID, task.NoteID)
-			return
+			logger.Error("Note not found for sending")
+			return &SendError{Provider: "storage", Permanent: true, Err: fmt.Errorf("note %s not found", task.NoteID)}
 		}
-		
-		select {
-		case <-ctx.Done():
-			log.Printf("[EMAIL-WORKER-%d] Send task cancelled: %s", 
-				workerID, task.NoteID)
-			return
-		case <-time.After(100 * time.Millisecond):
-			log.Printf("[EMAIL-WORKER-%d] Sent email to %s: ID=%s, Title=%s", 
-				workerID, s.emailAddr, note.ID, note.Title)
+
+		attachments, err := s.attachments.Load(task.Attachments)
+		if err != nil {
+			return &SendError{Provider: "attachments", Permanent: true, Err: err}
+		}
+		if task.AttachNote == "pdf" {
+			if s.pdf == nil {
+				return &SendError{Provider: "pdf", Permanent: true, Err: fmt.Errorf("PDF rendering is not configured")}
+			}
+			pdf, err := s.notePDF(note)
+			if err != nil {
+				return err
+			}
+			attachments = append(attachments, pdf)
 		}
+
+		if len(task.Recipients) > 0 {
+			return s.sendToRecipients(ctx, task, note, attachments)
+		}
+
+		recipient := task.Recipient
+		if recipient == "" {
+			recipient = s.emailAddr
+		}
+		if err := s.sendNote(ctx, *task, note, recipient, attachments); err != nil {
+			return err
+		}
+		logger.Info("Sent email", "recipient", recipient, "provider", s.sender.Name(), "title", note.Title)
+		return nil
+
+	case "digest":
+		msg := Message{
+			From:        s.from,
+			To:          []string{task.Recipient},
+			Subject:     task.Subject,
+			Text:        task.Body,
+			HTML:        task.HTML,
+			Unsubscribe: s.unsubscriber.URL(task.Recipient),
+		}
+		if err := s.deliver(ctx, msg); err != nil {
+			return err
+		}
+		logger.Info("Sent digest", "recipient", task.Recipient, "provider", s.sender.Name())
+		return nil
+
+	case "alert":
+		msg := Message{
+			From:    s.from,
+			To:      task.Recipients,
+			Subject: task.Subject,
+			Text:    task.Body,
+		}
+		if err := s.deliver(ctx, msg); err != nil {
+			return err
+		}
+		logger.Info("Sent alert", "recipients", task.Recipients, "provider", s.sender.Name(), "subject", task.Subject)
+		return nil
+	}
+	return fmt.Errorf("unknown task type %q", task.Type)
+}
+
+// sendNote renders the note for one recipient and delivers it.
+func (s *EmailService) sendNote(ctx context.Context, task EmailTask, note Note, recipient string, attachments []Attachment) error {
+	unsubscribe := s.unsubscriber.URL(recipient)
+	rendered, err := renderNote(NoteEmailData{
+		Note:           note,
+		Event:          task.Event,
+		Recipient:      recipient,
+		UnsubscribeURL: unsubscribe,
+		Metadata:       task.Metadata,
+	})
+	if err != nil {
+		return &SendError{Provider: "template", Permanent: true, Err: err}
+	}
+
+	return s.deliver(ctx, Message{
+		From:        s.from,
+		To:          []string{recipient},
+		Subject:     rendered.Subject,
+		Text:        rendered.Text,
+		HTML:        rendered.HTML,
+		Attachments: attachments,
+		Unsubscribe: unsubscribe,
+	})
+}
+
+// saveNote keeps a note for later sends and records it for the digest.
+func (s *EmailService) saveNote(note Note) NoteEvent {
+	existed := s.notes.Put(note)
+	if s.notesAPI != nil {
+		s.notesAPI.Invalidate(note.ID)
+	}
+
+	event := NoteEvent{Type: "created", Note: note, At: time.Now()}
+	if existed {
+		event.Type = "updated"
+	}
+	s.digest.Record(event)
+	return event
+}
+
+// deliver drops suppressed recipients and fails permanently if none are left.
+func (s *EmailService) deliver(ctx context.Context, msg Message) error {
+	var allowed []string
+	var reasons []string
+	for _, rcpt := range msg.To {
+		if entry, suppressed := s.suppression.Lookup(rcpt); suppressed {
+			reasons = append(reasons, fmt.Sprintf("%s (%s)", rcpt, entry.Reason))
+			continue
+		}
+		allowed = append(allowed, rcpt)
+	}
+	if len(reasons) > 0 {
+		logging.FromContext(ctx).Info("Skipping suppressed recipients", "recipients", reasons)
+	}
+	if len(allowed) == 0 {
+		return &SendError{
+			Provider:  "suppression",
+			Permanent: true,
+			Code:      "suppressed",
+			Err:       fmt.Errorf("all recipients suppressed: %s", strings.Join(reasons, ", ")),
+		}
+	}
+	msg.To = allowed
+
+	if err := s.limiter.Reserve(msg.To); err != nil {
+		return err
+	}
+	return s.sender.Send(ctx, msg)
+}
+
+// lookupNote reads from the notes app when NOTES_API_URL is configured and
+// from the local store otherwise.
+func (s *EmailService) lookupNote(ctx context.Context, id string) (Note, bool, error) {
+	if s.notesAPI != nil {
+		return s.notesAPI.Get(ctx, id)
 	}
+	note, ok := s.notes.Get(id)
+	return note, ok, nil
 }
 
-func (s *EmailService) ExtractNote(ctx context.Context, noteID string) error {
+func (s *EmailService) ExtractNote(ctx context.Context, req SendRequest) (EmailTask, error) {
+	if s.draining.Load() {
+		return EmailTask{}, errDraining
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 	defer cancel()
 
-	s.mu.RLock()
-	note, exists := s.storage[noteID]
-	s.mu.RUnlock()
-
+	note, exists, err := s.lookupNote(ctx, req.NoteID)
+	if err != nil {
+		return EmailTask{}, err
+	}
 	if !exists {
-		return fmt.Errorf("note not found")
+		return EmailTask{}, errNoteNotFound
+	}
+
+	priority, err := parsePriority(req.Priority)
+	if err != nil {
+		return EmailTask{}, err
+	}
+
+	event := req.Event
+	switch event {
+	case "":
+		event = EventNoteCreated
+	case EventNoteCreated, EventNoteUpdated, EventReminderDue:
+	default:
+		return EmailTask{}, fmt.Errorf("%w: unsupported event %q", errInvalidRequest, req.Event)
+	}
+	// An explicit recipient list bypasses the note owner's preferences.
+	recipients, err := parseRecipients(req.Recipients, s.maxRecipients)
+	if err != nil {
+		return EmailTask{}, err
+	}
+	var prefs UserPreferences
+	if len(recipients) == 0 {
+		var skip string
+		prefs, skip, err = s.noteRecipient(ctx, note, event)
+		if err != nil {
+			return EmailTask{}, err
+		}
+		if skip != "" {
+			return EmailTask{}, fmt.Errorf("%w: %s", errSkipped, skip)
+		}
+		recipients = []string{prefs.Email}
+	}
+
+	if err := s.validateCallbackURL(req.CallbackURL); err != nil {
+		return EmailTask{}, err
+	}
+	if err := req.Retry.validate(s.retryLimits); err != nil {
+		return EmailTask{}, err
+	}
+	if err := validateMetadata(req.Metadata); err != nil {
+		return EmailTask{}, err
+	}
+
+	// Everything is validated before the uploads are stored, so a rejected
+	// request leaves no attachments behind.
+	uploads := req.Attachments
+	switch req.AttachNote {
+	case "":
+	case "markdown":
+		uploads = append(uploads, AttachmentRequest{
+			Filename:    fmt.Sprintf("note-%s.md", note.ID),
+			ContentType: "text/markdown; charset=utf-8",
+			Content:     noteMarkdown(note),
+		})
+	case "pdf":
+		// Rendered by the worker when the email goes out.
+		if s.pdf == nil {
+			return EmailTask{}, fmt.Errorf("%w: PDF rendering is not configured", errInvalidRequest)
+		}
+	default:
+		return EmailTask{}, fmt.Errorf("%w: unsupported attach_note format %q", errInvalidRequest, req.AttachNote)
+	}
+
+	refs, err := s.attachments.Save(uploads)
+	if err != nil {
+		return EmailTask{}, fmt.Errorf("%w: %v", errInvalidRequest, err)
 	}
 
 	task := EmailTask{
-		Type:   "send",
-		NoteID: noteID,
-		Note:   note,
+		ID:          req.TaskID,
+		Type:        "send",
+		Priority:    priority,
+		NoteID:      req.NoteID,
+		Note:        note,
+		SendAt:      req.SendAt,
+		Event:       event,
+		Attachments: refs,
+		AttachNote:  req.AttachNote,
+		CallbackURL: req.CallbackURL,
+		Retry:       req.Retry,
+		Metadata:    req.Metadata,
+	}
+
+	if task.ID == "" {
+		task.ID = newTaskID()
+	}
+	if len(recipients) == 1 {
+		task.Recipient = recipients[0]
+	} else {
+		task.Recipients = recipients
 	}
 
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case s.taskQueue <- task:
-		log.Printf("[EMAIL] Extraction task queued: %s", noteID)
+	// Emails that would arrive in the recipient's quiet hours wait for the
+	// send window to open.
+	due := time.Now()
+	if task.SendAt.After(due) {
+		due = task.SendAt
+	}
+	window := s.recipientWindow(prefs)
+	if next := window.Next(due); !next.Equal(due) {
+		task.SendAt = next
+		taskLogger(task, 0).Info("Task deferred to send window", "window", window.String(), "send_at", task.SendAt)
+	}
+
+	if task.SendAt.After(time.Now()) {
+		if err := s.scheduler.Add(ctx, task); err != nil {
+			s.attachments.Delete(refs)
+			return EmailTask{}, err
+		}
+		s.history.Record(task, StatusScheduled, nil)
+		s.history.SetRecipients(task.ID, recipients)
+		taskLogger(task, 0).Info("Task scheduled", "send_at", task.SendAt)
+		return task, nil
+	}
+
+	if err := s.enqueue(ctx, task); err != nil {
+		s.attachments.Delete(refs)
+		return EmailTask{}, err
+	}
+	s.history.SetRecipients(task.ID, recipients)
+	return task, nil
+}
+
+func (s *EmailService) validateCallbackURL(raw string) error {
+	if raw == "" {
 		return nil
-	default:
-		return fmt.Errorf("email queue is full, try again later")
 	}
+	if s.notifier == nil {
+		return fmt.Errorf("%w: callbacks are disabled", errInvalidRequest)
+	}
+	if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: invalid callback_url", errInvalidRequest)
+	}
+	return nil
 }
 
-func (s *EmailService) StoreNote(ctx context.Context, note Note) error {
+func (s *EmailService) StoreNote(ctx context.Context, note Note) (string, error) {
 	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 	defer cancel()
 
 	task := EmailTask{
+		ID:   newTaskID(),
 		Type: "store",
 		Note: note,
 	}
 
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case s.taskQueue <- task:
-		log.Printf("[EMAIL] Store task queued: %s", note.ID)
-		return nil
-	default:
-		return fmt.Errorf("email queue is full, try again later")
+	if err := s.enqueue(ctx, task); err != nil {
+		return "", err
+	}
+	return task.ID, nil
+}
+
+func (s *EmailService) enqueue(ctx context.Context, task EmailTask) error {
+	if s.draining.Load() {
+		return errDraining
+	}
+	if task.ID == "" {
+		task.ID = newTaskID()
+	}
+	if task.Priority == "" {
+		task.Priority = PriorityNormal
+	}
+
+	if err := s.queue.Enqueue(ctx, task); err != nil {
+		return err
+	}
+	s.history.Record(task, StatusQueued, nil)
+	taskLogger(task, 0).Info("Task queued", "priority", task.Priority)
+	return nil
+}
+
+// Cancel drops a scheduled task or one still waiting in the queue. Tasks a
+// worker has already picked up can't be cancelled.
+func (s *EmailService) Cancel(ctx context.Context, id string) (EmailTask, error) {
+	task, scheduled := s.scheduler.Cancel(id)
+	if !scheduled {
+		var err error
+		task, err = s.queue.Cancel(ctx, id)
+		if errors.Is(err, errTaskNotFound) {
+			if entry, known := s.history.Get(id); known {
+				return EmailTask{}, fmt.Errorf("%w: task is %s", errNotCancellable, entry.Status)
+			}
+		}
+		if err != nil {
+			return EmailTask{}, err
+		}
+	}
+	s.attachments.Delete(task.Attachments)
+	s.history.Record(task, StatusCancelled, nil)
+	s.notifyOutcome(task, StatusCancelled, nil)
+
+	taskLogger(task, 0).Info("Task cancelled")
+	return task, nil
+}
+
+// TaskDetail returns the tracked status of a task together with the task
+// itself while the scheduler or the queue still holds it. A task queued by
+// another replica of a shared queue has no tracked status, so one is made
+// from the task.
+func (s *EmailService) TaskDetail(ctx context.Context, id string) (TaskStatus, error) {
+	status, tracked := s.history.Get(id)
+	task, held := s.scheduler.Get(id)
+	if lookup, ok := s.queue.(TaskLookup); ok && !held {
+		var err error
+		task, err = lookup.Lookup(ctx, id)
+		if err != nil && !errors.Is(err, errTaskNotFound) {
+			return TaskStatus{}, err
+		}
+		held = err == nil
+	}
+	if !held {
+		if !tracked {
+			return TaskStatus{}, errTaskNotFound
+		}
+		return status, nil
 	}
+
+	if !tracked {
+		status = TaskStatus{
+			ID:         task.ID,
+			Type:       task.Type,
+			NoteID:     task.NoteID,
+			Recipients: task.recipientList(),
+			Priority:   task.Priority,
+			BatchID:    task.BatchID,
+			SendAt:     task.SendAt,
+			Status:     StatusQueued,
+			Attempts:   task.Attempts,
+			Error:      task.LastError,
+		}
+		if task.SendAt.After(time.Now()) {
+			status.Status = StatusScheduled
+		}
+	}
+	status.Task = &task
+	return status, nil
 }
 
 func (s *EmailService) GetQueueStats() (int, int) {
-	return len(s.taskQueue), cap(s.taskQueue)
+	return s.queue.Len(), s.queue.Cap()
+}
+
+func (s *EmailService) GetStorageStats() StoreStats {
+	return s.notes.Stats()
 }
 
-func (s *EmailService) GetStorageStats() int {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	return len(s.storage)
+func (s *EmailService) DeleteNote(id string) bool {
+	return s.notes.Delete(id)
 }
 
-func (s *EmailService) Shutdown() {
-	log.Println("[EMAIL] Shutting down email service...")
+func (s *EmailService) Shutdown(ctx context.Context) {
+	slog.Info("Shutting down email service")
 	s.cancel()
-	
 	s.wg.Wait()
-	close(s.taskQueue)
-	
-	log.Println("[EMAIL] Email service stopped gracefully")
+
+	// The workers are stopped, so no new callbacks start; the ones already
+	// sent get until ctx is done to land.
+	if err := s.notifier.Close(ctx); err != nil {
+		slog.Warn("Abandoned callbacks still in flight", "error", err)
+	}
+	s.queue.Close()
+	s.sender.Close()
+
+	slog.Info("Email service stopped gracefully")
 }
 
 func main() {
-	emailAddr := os.Getenv("EMAIL_ADDR")
-	if emailAddr == "" {
-		emailAddr = "admin@example.com"
+	configErr := config.Load("EMAIL_CONFIG", os.Args[1:])
+	logging.Setup("email")
+	if configErr != nil {
+		logging.Fatal("Invalid configuration", "error", configErr)
 	}
 
-	workerCount := 3
-	if wc := os.Getenv("EMAIL_WORKERS"); wc != "" {
-		if n, err := fmt.Sscanf(wc, "%d", &workerCount); n != 1 || err != nil {
-			workerCount = 3
+	emailAddr := config.String("EMAIL_ADDR", "admin@example.com")
+	workerCount := config.Int("EMAIL_WORKERS", 3)
+	queueSize := config.Int("EMAIL_QUEUE_SIZE", 100)
+
+	sender, err := NewSenderFromEnv()
+	if err != nil {
+		logging.Fatal("Invalid email provider configuration", "error", err)
+	}
+	from := config.String("EMAIL_FROM", config.String("SMTP_FROM", "noreply@notes.local"))
+	slog.Info("Email provider configured", "provider", sender.Name(), "from", from)
+
+	var queue TaskQueue
+	switch backend := config.String("EMAIL_QUEUE_BACKEND", "memory"); backend {
+	case "memory":
+		queue = NewMemoryQueue(queueSize)
+		if walPath := config.String("EMAIL_QUEUE_WAL", ""); walPath != "" {
+			queue, err = NewWALQueue(queue, walPath, config.Int("EMAIL_QUEUE_WAL_COMPACT", 1000))
+			if err != nil {
+				logging.Fatal("Failed to open queue WAL", "error", err)
+			}
+			slog.Info("Persisting memory queue", "wal", walPath)
+		}
+	case "postgres":
+		queue, err = NewPostgresQueue(
+			config.Secret("EMAIL_QUEUE_DSN", ""),
+			queueSize,
+			config.Duration("EMAIL_QUEUE_POLL_INTERVAL", time.Second),
+			config.Duration("EMAIL_QUEUE_VISIBILITY_TIMEOUT", time.Minute),
+		)
+		if err != nil {
+			logging.Fatal("Failed to open Postgres queue", "error", err)
+		}
+	case "redis":
+		queue, err = NewRedisQueue(
+			config.String("REDIS_ADDR", "redis:6379"),
+			config.Secret("REDIS_PASSWORD", ""),
+			config.String("EMAIL_QUEUE_PREFIX", "email"),
+			queueSize,
+			config.Duration("EMAIL_QUEUE_VISIBILITY_TIMEOUT", time.Minute),
+		)
+		if err != nil {
+			logging.Fatal("Failed to open Redis queue", "error", err)
 		}
+	default:
+		logging.Fatal("Unknown EMAIL_QUEUE_BACKEND", "backend", backend)
+	}
+	slog.Info("Task queue configured", "backend", config.String("EMAIL_QUEUE_BACKEND", "memory"))
+
+	digestLocation, err := time.LoadLocation(config.String("DIGEST_TIMEZONE", "UTC"))
+	if err != nil {
+		logging.Fatal("Invalid DIGEST_TIMEZONE", "error", err)
 	}
+	digest, err := NewDigest(config.String("DIGEST_TIME", "08:00"), digestLocation)
+	if err != nil {
+		logging.Fatal("Invalid digest configuration", "error", err)
+	}
+
+	attachments, err := NewAttachmentStore(
+		config.String("EMAIL_ATTACHMENT_DIR", filepath.Join(os.TempDir(), "email-attachments")),
+		config.Int("EMAIL_MAX_ATTACHMENT_SIZE", 10<<20),
+	)
+	if err != nil {
+		logging.Fatal("Failed to set up attachment storage", "error", err)
+	}
+
+	pdf, err := NewPDFRendererFromEnv()
+	if err != nil {
+		logging.Fatal("Invalid PDF renderer configuration", "error", err)
+	}
+	if pdf != nil {
+		slog.Info("PDF note attachments enabled", "renderer", pdf.Name())
+	}
+
+	limiter := NewRateLimiter(
+		config.Int("EMAIL_RATE_PER_RECIPIENT", 0),
+		config.Duration("EMAIL_RATE_RECIPIENT_WINDOW", time.Hour),
+		config.Int("EMAIL_RATE_PER_DOMAIN", 0),
+		config.Duration("EMAIL_RATE_DOMAIN_WINDOW", time.Minute),
+	)
 
-	queueSize := 100
-	if qs := os.Getenv("EMAIL_QUEUE_SIZE"); qs != "" {
-		if n, err := fmt.Sscanf(qs, "%d", &queueSize); n != 1 || err != nil {
-			queueSize = 100
+	var notesAPI *NotesAPI
+	if base := config.String("NOTES_API_URL", ""); base != "" {
+		notesAPI, err = NewNotesAPI(NotesAPIConfig{
+			BaseURL:            base,
+			Token:              config.Secret("NOTES_API_TOKEN", ""),
+			Timeout:            config.Duration("NOTES_API_TIMEOUT", 2*time.Second),
+			CAFile:             config.String("NOTES_API_CA_FILE", ""),
+			InsecureSkipVerify: config.Bool("NOTES_API_INSECURE", false),
+			CacheTTL:           config.Duration("NOTES_API_CACHE_TTL", 30*time.Second),
+			CacheSize:          config.Int("NOTES_API_CACHE_SIZE", 1000),
+		})
+		if err != nil {
+			logging.Fatal("Invalid notes API configuration", "error", err)
+		}
+		slog.Info("Fetching notes from the notes app", "url", base)
+	}
+
+	preferences := NewPreferenceStore(config.Duration("EMAIL_PREFERENCES_TTL", 5*time.Minute), digest)
+	if notesAPI != nil {
+		preferences.fetch = notesAPI.User
+	}
+
+	sendWindow, err := NewSendWindow(config.String("EMAIL_SEND_WINDOW", ""), config.String("EMAIL_QUIET_HOURS", ""), config.String("EMAIL_TIMEZONE", "UTC"))
+	if err != nil {
+		logging.Fatal("Invalid send window", "error", err)
+	}
+	if !sendWindow.Always() {
+		slog.Info("Emails limited to send window", "window", sendWindow.String())
+	}
+
+	var events EventSource
+	if kind := config.String("EMAIL_EVENTS_SOURCE", ""); kind != "" {
+		events, err = NewEventSource(EventSourceConfig{
+			Kind:        kind,
+			NATSURL:     config.String("EMAIL_EVENTS_NATS_URL", "nats://nats:4222"),
+			NATSStream:  config.String("EMAIL_EVENTS_NATS_STREAM", "NOTES"),
+			KafkaBroker: config.List("EMAIL_EVENTS_KAFKA_BROKERS", "kafka:9092"),
+			Topic:       config.String("EMAIL_EVENTS_TOPIC", defaultEventsTopic(kind)),
+			Group:       config.String("EMAIL_EVENTS_GROUP", "email-service"),
+		})
+		if err != nil {
+			logging.Fatal("Failed to set up note event source", "error", err)
+		}
+	}
+
+	var outbox *Outbox
+	if dsn := config.Secret("EMAIL_OUTBOX_DSN", ""); dsn != "" {
+		outbox, err = NewOutbox(OutboxConfig{
+			DSN:          dsn,
+			PollInterval: config.Duration("EMAIL_OUTBOX_POLL_INTERVAL", time.Second),
+			BatchSize:    max(config.Int("EMAIL_OUTBOX_BATCH_SIZE", 50), 1),
+			RetryDelay:   config.Duration("EMAIL_OUTBOX_RETRY_DELAY", 30*time.Second),
+		})
+		if err != nil {
+			logging.Fatal("Failed to open outbox", "error", err)
 		}
+		slog.Info("Polling the notes app outbox")
 	}
 
-	service := NewEmailService(emailAddr, workerCount, queueSize)
-	defer service.Shutdown()
+	retryStrategy := config.String("EMAIL_RETRY_BACKOFF", BackoffExponential)
+	if !validBackoff(retryStrategy) {
+		logging.Fatal("Invalid EMAIL_RETRY_BACKOFF", "backoff", retryStrategy)
+	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8081"
+	// Callback bodies are signed; without a secret receivers could not tell
+	// them from forgeries, so callbacks are either signed or switched off.
+	var notifier *Notifier
+	if config.Bool("EMAIL_CALLBACKS", true) {
+		notifier, err = NewNotifier(
+			config.Secret("EMAIL_WEBHOOK_SECRET", ""),
+			config.Duration("EMAIL_WEBHOOK_TIMEOUT", 5*time.Second),
+			config.Int("EMAIL_WEBHOOK_MAX_ATTEMPTS", 5),
+			config.Int("EMAIL_WEBHOOK_CONCURRENCY", 10),
+		)
+		if err != nil {
+			logging.Fatal("Invalid callback configuration", "error", err)
+		}
 	}
 
+	suppression := NewSuppressionList()
+	bounces, err := NewBounceRecorder(suppression, 1000, BounceWebhookConfig{
+		SNSTopics:   config.List("EMAIL_SNS_TOPIC_ARNS", ""),
+		SendGridKey: config.String("SENDGRID_WEBHOOK_PUBLIC_KEY", ""),
+	})
+	if err != nil {
+		logging.Fatal("Invalid bounce webhook configuration", "error", err)
+	}
+
+	service := NewEmailService(ServiceConfig{
+		EmailAddr: emailAddr,
+		From:      from,
+		Sender:    sender,
+		Queue:     queue,
+		Retry: RetryPolicy{
+			MaxAttempts: config.Int("EMAIL_MAX_ATTEMPTS", 5),
+			BaseDelay:   config.Duration("EMAIL_RETRY_BASE_DELAY", 2*time.Second),
+			MaxDelay:    config.Duration("EMAIL_RETRY_MAX_DELAY", 5*time.Minute),
+			Timeout:     config.Duration("EMAIL_SEND_TIMEOUT", 5*time.Second),
+			Strategy:    retryStrategy,
+		},
+		RetryLimits: RetryLimits{
+			MaxAttempts: config.Int("EMAIL_MAX_ATTEMPTS_LIMIT", 20),
+			MaxTimeout:  config.Duration("EMAIL_SEND_TIMEOUT_MAX", time.Minute),
+		},
+		Digest:        digest,
+		MaxRecipients: config.Int("EMAIL_MAX_RECIPIENTS", 50),
+		Attachments:   attachments,
+		PDF:           pdf,
+		PDFTimeout:    config.Duration("EMAIL_PDF_TIMEOUT", 30*time.Second),
+		Limiter:       limiter,
+		History:       NewStatusTracker(config.Int("EMAIL_HISTORY_SIZE", 10000)),
+		Notifier:      notifier,
+		Suppression:   suppression,
+		Unsubscriber: NewUnsubscriber(
+			config.String("EMAIL_PUBLIC_URL", "http://localhost:"+config.String("PORT", "8081")),
+			config.Secret("EMAIL_UNSUBSCRIBE_SECRET", ""),
+		),
+		Batches:     NewBatchTracker(config.Int("EMAIL_BATCH_MAX_SIZE", 100), 1000),
+		NotesAPI:    notesAPI,
+		Preferences: preferences,
+		SendWindow:  sendWindow,
+		Events:      events,
+		Outbox:      outbox,
+		Notes: NewNoteStore(
+			config.Duration("EMAIL_STORE_TTL", 24*time.Hour),
+			config.Int("EMAIL_STORE_MAX_ENTRIES", 10000),
+		),
+		Workers: workerCount,
+		Autoscale: AutoscaleConfig{
+			Min:            config.Int("EMAIL_WORKERS_MIN", workerCount),
+			Max:            config.Int("EMAIL_WORKERS_MAX", workerCount),
+			TasksPerWorker: max(config.Int("EMAIL_AUTOSCALE_TASKS_PER_WORKER", 10), 1),
+			TargetLatency:  config.Duration("EMAIL_AUTOSCALE_TARGET_LATENCY", 2*time.Second),
+			Interval:       config.Duration("EMAIL_AUTOSCALE_INTERVAL", 5*time.Second),
+			Cooldown:       config.Duration("EMAIL_AUTOSCALE_COOLDOWN", 30*time.Second),
+		},
+		StallTimeout: config.Duration("EMAIL_WORKER_STALL_TIMEOUT", 2*time.Minute),
+	})
+
+	port := config.String("PORT", "8081")
+	adminPort := config.String("ADMIN_PORT", "")
+	adminBind := config.String("ADMIN_BIND", "127.0.0.1")
+
 	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	shutdownTimeout := config.Duration("EMAIL_SHUTDOWN_TIMEOUT", 30*time.Second)
 
 	http.HandleFunc("/email/extract", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
@@ -215,9 +1085,7 @@ func main() {
 			return
 		}
 
-		var req struct {
-			NoteID string `json:"note_id"`
-		}
+		var req SendRequest
 
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "Invalid JSON", http.StatusBadRequest)
@@ -229,20 +1097,81 @@ func main() {
 			return
 		}
 
-		if err := service.ExtractNote(r.Context(), req.NoteID); err != nil {
-			log.Printf("[EMAIL] Extraction failed: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		task, err := service.ExtractNote(r.Context(), req)
+		if errors.Is(err, errSkipped) {
+			logging.FromContext(r.Context()).Info("Extraction skipped", "note_id", req.NoteID, "reason", err)
+			json.NewEncoder(w).Encode(map[string]string{
+				"status":  "skipped",
+				"note_id": req.NoteID,
+				"reason":  err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Extraction failed", "note_id", req.NoteID, "error", err)
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, errInvalidRequest):
+				status = http.StatusBadRequest
+			case errors.Is(err, errNoteNotFound):
+				status = http.StatusNotFound
+			case errors.Is(err, errQueueFull), errors.Is(err, errDraining):
+				status = http.StatusServiceUnavailable
+			}
+			http.Error(w, err.Error(), status)
 			return
 		}
 
-		w.WriteHeader(http.StatusAccepted)
-		json.NewEncoder(w).Encode(map[string]string{
-			"status": "extraction_queued",
-			"to":     service.emailAddr,
+		response := map[string]string{
+			"status":  "extraction_queued",
+			"id":      task.ID,
+			"to":      strings.Join(task.recipientList(), ", "),
 			"note_id": req.NoteID,
+		}
+		if !task.SendAt.IsZero() && task.SendAt.After(time.Now()) {
+			response["status"] = "extraction_scheduled"
+			response["send_at"] = task.SendAt.Format(time.RFC3339)
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(response)
+	})
+
+	http.HandleFunc("GET /email/scheduled", func(w http.ResponseWriter, r *http.Request) {
+		tasks, err := service.scheduler.List(r.Context())
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Failed to list scheduled tasks", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"count": len(tasks),
+			"tasks": tasks,
 		})
 	})
 
+	cancelTask := func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if _, err := service.Cancel(r.Context(), id); err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, errTaskNotFound):
+				status = http.StatusNotFound
+			case errors.Is(err, errNotCancellable):
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "cancelled",
+			"id":     id,
+		})
+	}
+	http.HandleFunc("DELETE /email/scheduled/{id}", cancelTask)
+	http.HandleFunc("DELETE /email/tasks/{id}", cancelTask)
+
 	http.HandleFunc("/email/store", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -260,16 +1189,35 @@ func main() {
 			return
 		}
 
-		if err := service.StoreNote(r.Context(), note); err != nil {
-			log.Printf("[EMAIL] Storage failed: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		taskID, err := service.StoreNote(r.Context(), note)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Storage failed", "note_id", note.ID, "error", err)
+			status := http.StatusInternalServerError
+			if errors.Is(err, errDraining) {
+				status = http.StatusServiceUnavailable
+			}
+			http.Error(w, err.Error(), status)
 			return
 		}
 
 		w.WriteHeader(http.StatusAccepted)
 		json.NewEncoder(w).Encode(map[string]string{
-			"status": "storage_queued",
-			"id":     note.ID,
+			"status":  "storage_queued",
+			"id":      note.ID,
+			"task_id": taskID,
+		})
+	})
+
+	http.HandleFunc("DELETE /email/store/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if !service.DeleteNote(id) {
+			http.Error(w, "note not found", http.StatusNotFound)
+			return
+		}
+		logging.FromContext(r.Context()).Info("Deleted note from store", "note_id", id)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "deleted",
+			"id":     id,
 		})
 	})
 
@@ -280,21 +1228,455 @@ func main() {
 		}
 
 		queueLen, queueCap := service.GetQueueStats()
-		storageCount := service.GetStorageStats()
+		storage := service.GetStorageStats()
 
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"queue_size":      queueLen,
 			"queue_capacity":  queueCap,
 			"queue_usage":     fmt.Sprintf("%.1f%%", float64(queueLen)/float64(queueCap)*100),
-			"storage_count":   storageCount,
-			"workers":         service.workerCount,
+			"storage_count":   storage.Entries,
+			"storage":         storage,
+			"dlq_count":       service.dlq.Len(),
+			"scheduled_count": service.scheduler.Len(),
+			"workers":         service.WorkerCount(),
 			"email_address":   service.emailAddr,
 			"status":          "operational",
 		})
 	})
 
+	admin := NewAdmin(config.Secret("EMAIL_ADMIN_TOKEN", ""), config.Duration("EMAIL_ADMIN_CONFIRM_TTL", time.Minute))
+	http.HandleFunc("POST /email/admin/queue/purge", admin.handler("purge_queue",
+		func(ctx context.Context) (map[string]any, error) {
+			return map[string]any{"queued": readyLen(service.queue), "scheduled": service.scheduler.Len()}, nil
+		},
+		service.PurgeQueue))
+	http.HandleFunc("POST /email/admin/storage/clear", admin.handler("clear_storage",
+		func(ctx context.Context) (map[string]any, error) {
+			affected := map[string]any{"notes": service.notes.Len()}
+			if service.notesAPI != nil {
+				affected["cached_notes"] = service.notesAPI.cache.Len()
+			}
+			return affected, nil
+		},
+		service.ClearStorage))
+	http.HandleFunc("POST /email/admin/stats/reset", admin.handler("reset_stats",
+		func(ctx context.Context) (map[string]any, error) {
+			return map[string]any{
+				"storage":     service.GetStorageStats(),
+				"scale_ups":   service.scaleUps.Load(),
+				"scale_downs": service.scaleDowns.Load(),
+			}, nil
+		},
+		service.ResetStats))
+
+	taskDetail := func(w http.ResponseWriter, r *http.Request) {
+		status, err := service.TaskDetail(r.Context(), r.PathValue("id"))
+		if errors.Is(err, errTaskNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Failed to look up task", "task_id", r.PathValue("id"), "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(status)
+	}
+	http.HandleFunc("GET /email/status/{id}", taskDetail)
+
+	http.HandleFunc("GET /email/history", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		if limit <= 0 {
+			limit = 100
+		}
+
+		tasks := service.history.List(HistoryFilter{
+			Status: query.Get("status"),
+			Type:   query.Get("type"),
+			NoteID: query.Get("note_id"),
+			Limit:  limit,
+		})
+		json.NewEncoder(w).Encode(map[string]any{
+			"count": len(tasks),
+			"tasks": tasks,
+		})
+	})
+
+	http.HandleFunc("GET /email/tasks", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		if limit <= 0 {
+			limit = 100
+		}
+
+		filter := HistoryFilter{
+			Status:  query.Get("status"),
+			Type:    query.Get("type"),
+			NoteID:  query.Get("note_id"),
+			Limit:   limit,
+			Pending: query.Get("status") == "",
+		}
+		if raw := query.Get("stale"); raw != "" {
+			stale, err := time.ParseDuration(raw)
+			if err != nil || stale < 0 {
+				http.Error(w, "stale must be a duration like 5m", http.StatusBadRequest)
+				return
+			}
+			filter.StaleFor = stale
+		}
+
+		tasks := service.history.List(filter)
+		json.NewEncoder(w).Encode(map[string]any{
+			"count":       len(tasks),
+			"queue_depth": service.queue.Len(),
+			"tasks":       tasks,
+		})
+	})
+
+	http.HandleFunc("GET /email/tasks/{id}", taskDetail)
+
+	http.HandleFunc("GET /email/outbox", func(w http.ResponseWriter, r *http.Request) {
+		if service.outbox == nil {
+			http.Error(w, "outbox is not configured", http.StatusNotFound)
+			return
+		}
+		stats, err := service.outbox.Stats(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		json.NewEncoder(w).Encode(stats)
+	})
+
+	http.HandleFunc("GET /email/dlq", func(w http.ResponseWriter, r *http.Request) {
+		items, err := service.dlq.List(r.Context())
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Failed to list dead letters", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"count": len(items),
+			"items": items,
+		})
+	})
+
+	http.HandleFunc("POST /email/dlq/{id}/retry", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if err := service.RetryDeadLetter(r.Context(), id); err != nil {
+			logging.FromContext(r.Context()).Error("Dead-letter retry failed", "task_id", id, "error", err)
+			status := http.StatusInternalServerError
+			if errors.Is(err, errTaskNotFound) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		logging.FromContext(r.Context()).Info("Task requeued from dead-letter queue", "task_id", id)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "requeued",
+			"id":     id,
+		})
+	})
+
+	http.HandleFunc("GET /email/preferences", func(w http.ResponseWriter, r *http.Request) {
+		users := service.preferences.List()
+		json.NewEncoder(w).Encode(map[string]any{
+			"count": len(users),
+			"users": users,
+		})
+	})
+
+	http.HandleFunc("GET /email/preferences/{user}", func(w http.ResponseWriter, r *http.Request) {
+		prefs, ok, err := service.preferences.Get(r.Context(), r.PathValue("user"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if !ok {
+			http.Error(w, "user not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(prefs)
+	})
+
+	// The notes app calls this after a user changes their settings, either
+	// pushing the new preferences or asking for them to be re-fetched.
+	http.HandleFunc("POST /email/preferences/sync", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Users   []UserPreferences `json:"users"`
+			UserIDs []string          `json:"user_ids"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		for _, prefs := range req.Users {
+			if err := service.preferences.Put(prefs); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		var failed []string
+		for _, id := range req.UserIDs {
+			if _, _, err := service.preferences.Refresh(r.Context(), id); err != nil {
+				logging.FromContext(r.Context()).Error("Preferences refresh failed", "user_id", id, "error", err)
+				failed = append(failed, id)
+			}
+		}
+		logging.FromContext(r.Context()).Info("Preferences synced", "pushed", len(req.Users), "refreshed", len(req.UserIDs)-len(failed))
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"status":  "synced",
+			"updated": len(req.Users) + len(req.UserIDs) - len(failed),
+			"failed":  failed,
+		})
+	})
+
+	http.HandleFunc("GET /email/digest/subscribers", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"subscribers":    service.digest.Subscribers(),
+			"pending_events": service.digest.Pending(),
+		})
+	})
+
+	http.HandleFunc("POST /email/digest/subscribers", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Email string `json:"email"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.Email == "" {
+			http.Error(w, "email is required", http.StatusBadRequest)
+			return
+		}
+
+		service.digest.Subscribe(req.Email)
+		logging.FromContext(r.Context()).Info("Subscribed to digest", "email", req.Email)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "subscribed",
+			"email":  req.Email,
+		})
+	})
+
+	http.HandleFunc("DELETE /email/digest/subscribers/{email}", func(w http.ResponseWriter, r *http.Request) {
+		email := r.PathValue("email")
+		if !service.digest.Unsubscribe(email) {
+			http.Error(w, "subscriber not found", http.StatusNotFound)
+			return
+		}
+
+		logging.FromContext(r.Context()).Info("Unsubscribed from digest", "email", email)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "unsubscribed",
+			"email":  email,
+		})
+	})
+
+	http.HandleFunc("POST /email/digest/run", func(w http.ResponseWriter, r *http.Request) {
+		sent, err := service.digest.Send(r.Context())
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Manual digest run failed", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]any{
+			"status":     "digest_queued",
+			"recipients": sent,
+		})
+	})
+
+	http.HandleFunc("POST /email/batch", func(w http.ResponseWriter, r *http.Request) {
+		var req BatchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		batch, err := service.SendBatch(r.Context(), req)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Batch failed", "error", err)
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, errInvalidRequest):
+				status = http.StatusBadRequest
+			case errors.Is(err, errQueueFull), errors.Is(err, errDraining):
+				status = http.StatusServiceUnavailable
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]any{
+			"status":   "batch_queued",
+			"batch_id": batch.ID,
+			"count":    len(batch.TaskIDs),
+			"task_ids": batch.TaskIDs,
+		})
+	})
+
+	http.HandleFunc("POST /email/alert", func(w http.ResponseWriter, r *http.Request) {
+		var req AlertRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		task, err := service.SendAlert(r.Context(), req)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Alert failed", "subject", req.Subject, "error", err)
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, errInvalidRequest):
+				status = http.StatusBadRequest
+			case errors.Is(err, errQueueFull), errors.Is(err, errDraining):
+				status = http.StatusServiceUnavailable
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "alert_queued",
+			"id":     task.ID,
+			"to":     strings.Join(task.Recipients, ", "),
+		})
+	})
+
+	http.HandleFunc("GET /email/batch/{id}", func(w http.ResponseWriter, r *http.Request) {
+		status, err := service.BatchStatus(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Batch not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+
+	http.HandleFunc("POST /email/preview", func(w http.ResponseWriter, r *http.Request) {
+		var req PreviewRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		preview, err := service.Preview(r.Context(), req)
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, errInvalidRequest):
+				status = http.StatusBadRequest
+			case errors.Is(err, errNoteNotFound):
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		json.NewEncoder(w).Encode(preview)
+	})
+
+	http.HandleFunc("GET /email/suppressions", func(w http.ResponseWriter, r *http.Request) {
+		list := service.suppression.List()
+		json.NewEncoder(w).Encode(map[string]any{
+			"count":        len(list),
+			"suppressions": list,
+		})
+	})
+
+	http.HandleFunc("POST /email/suppressions", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Email  string `json:"email"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if _, err := mail.ParseAddress(req.Email); err != nil {
+			http.Error(w, "valid email is required", http.StatusBadRequest)
+			return
+		}
+		if req.Reason == "" {
+			req.Reason = "manual"
+		}
+
+		service.suppression.Add(req.Email, req.Reason, "api")
+		logging.FromContext(r.Context()).Info("Added to suppression list", "email", req.Email, "reason", req.Reason)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "suppressed",
+			"email":  req.Email,
+		})
+	})
+
+	http.HandleFunc("DELETE /email/suppressions/{email}", func(w http.ResponseWriter, r *http.Request) {
+		email := r.PathValue("email")
+		if !service.suppression.Remove(email) {
+			http.Error(w, "address is not suppressed", http.StatusNotFound)
+			return
+		}
+		logging.FromContext(r.Context()).Info("Removed from suppression list", "email", email)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "removed",
+			"email":  email,
+		})
+	})
+
+	http.HandleFunc("GET /email/unsubscribe", service.HandleUnsubscribePage)
+	http.HandleFunc("POST /email/unsubscribe", service.HandleUnsubscribe)
+
+	http.HandleFunc("GET /email/bounces", func(w http.ResponseWriter, r *http.Request) {
+		events := bounces.List()
+		json.NewEncoder(w).Encode(map[string]any{
+			"count":  len(events),
+			"events": events,
+		})
+	})
+	http.HandleFunc("POST /email/bounces", bounces.HandleGeneric)
+	http.HandleFunc("POST /email/bounces/ses", bounces.HandleSES)
+	http.HandleFunc("POST /email/bounces/sendgrid", bounces.HandleSendGrid)
+
+	http.HandleFunc("GET /metrics", service.HandleMetrics)
+
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if service.draining.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{
+				"status": "draining",
+			})
+			return
+		}
+
 		queueLen, queueCap := service.GetQueueStats()
+
+		// Stuck workers only matter while work is waiting. When none is
+		// left to take tasks the instance should leave the pool.
+		if stuck := service.stuckWorkers(); len(stuck) > 0 && queueLen > 0 {
+			status, code := "degraded", http.StatusOK
+			if len(stuck) >= service.WorkerCount() {
+				status, code = "unhealthy", http.StatusServiceUnavailable
+			}
+			w.WriteHeader(code)
+			json.NewEncoder(w).Encode(map[string]any{
+				"status":        status,
+				"reason":        "workers_stuck",
+				"queue_depth":   queueLen,
+				"workers":       service.WorkerCount(),
+				"stuck_workers": stuck,
+			})
+			return
+		}
+
 		if float64(queueLen)/float64(queueCap) > 0.9 {
 			w.WriteHeader(http.StatusTooManyRequests)
 			json.NewEncoder(w).Encode(map[string]string{
@@ -316,25 +1698,120 @@ func main() {
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  120 * time.Second,
 	}
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		logging.Fatal("Invalid TLS configuration", "error", err)
+	}
+	server.TLSConfig = tlsConfig
 
+	auth, err := NewAuthenticator(config.String("EMAIL_AUTH_CALLERS", ""), config.Secret("EMAIL_AUTH_TOKENS", ""))
+	if err != nil {
+		logging.Fatal("Invalid authentication configuration", "error", err)
+	}
+	if !auth.Enabled() {
+		slog.Warn("EMAIL_AUTH_CALLERS is not set, email endpoints accept unauthenticated requests")
+	}
+	if jwksURL := config.String("EMAIL_AUTH_JWKS_URL", ""); jwksURL != "" {
+		var roots *x509.CertPool
+		if ca := config.String("CA_CERT", ""); ca != "" {
+			if roots, err = loadCertPool(ca); err != nil {
+				logging.Fatal("Invalid authentication configuration", "error", err)
+			}
+		}
+		issuer := config.String("EMAIL_AUTH_JWT_ISSUER", "https://ca-service:8443")
+		audience := config.String("EMAIL_AUTH_JWT_AUDIENCE", "email")
+		auth.jwt = NewJWTVerifier(jwksURL, issuer, audience, roots)
+		slog.Info("Accepting workload JWTs", "jwks", jwksURL, "issuer", issuer, "audience", audience)
+	}
+	server.Handler = logging.Middleware(auth.Middleware(http.DefaultServeMux))
+
+	grpcPort := config.String("GRPC_PORT", "9090")
+
+	config.Dump()
+	if err := config.Err(); err != nil {
+		logging.Fatal("Invalid configuration", "error", err)
+	}
+
+	grpcListener, err := net.Listen("tcp", ":"+grpcPort)
+	if err != nil {
+		logging.Fatal("Failed to listen for gRPC", "error", err)
+	}
+	grpcServer, grpcHealth := newGRPCServer(service, tlsConfig, auth)
+	go func() {
+		slog.Info("gRPC server starting", "port", grpcPort)
+		if err := grpcServer.Serve(grpcListener); err != nil {
+			slog.Error("gRPC server error", "error", err)
+		}
+	}()
+
+	if adminPort != "" {
+		admin := http.NewServeMux()
+		admin.Handle("/log/level", logging.LevelHandler())
+		admin.HandleFunc("/drain", service.HandleDrain)
+		go func() {
+			// /log/level and /drain have no authentication, so only local
+			// callers reach them.
+			addr := net.JoinHostPort(adminBind, adminPort)
+			slog.Info("Admin endpoints listening", "addr", addr)
+			logging.Fatal("Admin server failed", "error", http.ListenAndServe(addr, admin))
+		}()
+	}
+
+	shutdownDone := make(chan struct{})
 	go func() {
-		<-stop
-		log.Println("[EMAIL] Received shutdown signal")
-		
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer close(shutdownDone)
+		sig := <-stop
+		slog.Info("Received signal, shutting down", "signal", sig.String())
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 		defer cancel()
-		
-		if err := server.Shutdown(ctx); err != nil {
-			log.Printf("[EMAIL] Error during shutdown: %v", err)
+
+		// Stop intake first: handlers reject new tasks and /health reports
+		// draining, so the load balancer moves traffic elsewhere while the
+		// servers are still up.
+		service.StartDrain()
+		grpcHealth.Shutdown()
+
+		if err := service.WaitDrained(ctx); err != nil {
+			status := service.DrainStatus()
+			slog.Warn("Drain timed out", "queued", status.Queued, "in_flight", status.InFlight)
+		} else {
+			slog.Info("Queue drained")
+		}
+
+		service.Shutdown(ctx)
+
+		grpcStopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(grpcStopped)
+		}()
+		select {
+		case <-grpcStopped:
+		case <-ctx.Done():
+			grpcServer.Stop()
+		}
+
+		// Drain may have used up the budget; closing the listeners still
+		// gets a short grace period of its own.
+		serverCtx, serverCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer serverCancel()
+		if err := server.Shutdown(serverCtx); err != nil {
+			slog.Error("Error during shutdown", "error", err)
 		}
 	}()
 
-	log.Printf("[EMAIL] Email service starting on port %s", port)
-	log.Printf("[EMAIL] Config: %d workers, queue size %d", workerCount, queueSize)
-	
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("[EMAIL] Server error: %v", err)
+	slog.Info("Email service starting", "port", port, "workers", workerCount, "queue_size", queueSize,
+		"tls", tlsConfig != nil, "client_auth", config.String("TLS_CLIENT_AUTH", "none"))
+
+	serve := server.ListenAndServe
+	if tlsConfig != nil {
+		serve = func() error { return server.ListenAndServeTLS("", "") }
 	}
-	
-	log.Println("[EMAIL] Server stopped")
-}
\ No newline at end of file
+	if err := serve(); err != nil && err != http.ErrServerClosed {
+		logging.Fatal("Server error", "error", err)
+	}
+
+	<-shutdownDone
+	slog.Info("Server stopped")
+}
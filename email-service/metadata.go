@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Limits on request metadata. Metadata travels with every queued task, so it
+// is kept small.
+const (
+	maxMetadataKeys       = 20
+	maxMetadataValueRunes = 1000
+	maxMetadataBytes      = 8 << 10
+)
+
+// Well-known metadata keys used by the built-in templates. Other keys are
+// available to templates as .Metadata.<key>.
+const (
+	MetaSharerName = "sharer_name"
+	MetaMessage    = "message"
+)
+
+var metadataKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// validateMetadata enforces the size limits and rejects control characters
+// other than line breaks and tabs, so values can't smuggle headers into the
+// subject. HTML escaping is left to html/template.
+func validateMetadata(meta map[string]string) error {
+	if len(meta) > maxMetadataKeys {
+		return fmt.Errorf("%w: metadata has %d keys, at most %d allowed", errInvalidRequest, len(meta), maxMetadataKeys)
+	}
+	total := 0
+	for key, value := range meta {
+		if !metadataKeyPattern.MatchString(key) {
+			return fmt.Errorf("%w: metadata key %q must be lowercase letters, digits and underscores", errInvalidRequest, key)
+		}
+		if n := len([]rune(value)); n > maxMetadataValueRunes {
+			return fmt.Errorf("%w: metadata %s is %d characters, at most %d allowed", errInvalidRequest, key, n, maxMetadataValueRunes)
+		}
+		if strings.ContainsFunc(value, func(r rune) bool {
+			return unicode.IsControl(r) && r != '\n' && r != '\t'
+		}) {
+			return fmt.Errorf("%w: metadata %s contains control characters", errInvalidRequest, key)
+		}
+		total += len(key) + len(value)
+	}
+	if total > maxMetadataBytes {
+		return fmt.Errorf("%w: metadata is %d bytes, at most %d allowed", errInvalidRequest, total, maxMetadataBytes)
+	}
+	return nil
+}
+
+// singleLine flattens a value for use in a subject line.
+func singleLine(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
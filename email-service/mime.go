@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+)
+
+func buildMessage(msg Message) ([]byte, error) {
+	var buf bytes.Buffer
+
+	writeHeader(&buf, "From", msg.From)
+	writeHeader(&buf, "To", strings.Join(msg.To, ", "))
+	writeHeader(&buf, "Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	writeHeader(&buf, "Date", time.Now().Format(time.RFC1123Z))
+	writeHeader(&buf, "Message-ID", newMessageID(msg.From))
+	writeHeader(&buf, "MIME-Version", "1.0")
+	if msg.Unsubscribe != "" {
+		writeHeader(&buf, "List-Unsubscribe", "<"+msg.Unsubscribe+">")
+		writeHeader(&buf, "List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	}
+
+	bodyHeader, body, err := bodyPart(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(msg.Attachments) == 0 {
+		writeHeader(&buf, "Content-Type", bodyHeader.Get("Content-Type"))
+		if cte := bodyHeader.Get("Content-Transfer-Encoding"); cte != "" {
+			writeHeader(&buf, "Content-Transfer-Encoding", cte)
+		}
+		buf.WriteString("\r\n")
+		buf.Write(body)
+		return buf.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(&buf)
+	writeHeader(&buf, "Content-Type", fmt.Sprintf(`multipart/mixed; boundary="%s"`, mw.Boundary()))
+	buf.WriteString("\r\n")
+
+	textPart, err := mw.CreatePart(bodyHeader)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := textPart.Write(body); err != nil {
+		return nil, err
+	}
+
+	for _, a := range msg.Attachments {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(a.ContentType, map[string]string{"name": a.Filename})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeBase64Lines(part, a.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// bodyPart encodes the message text as a single text/plain entity, or as
+// multipart/alternative with plain text first when an HTML version exists.
+func bodyPart(msg Message) (textproto.MIMEHeader, []byte, error) {
+	var body bytes.Buffer
+	if msg.HTML == "" {
+		if err := writeQuotedPrintable(&body, msg.Text); err != nil {
+			return nil, nil, err
+		}
+		return textproto.MIMEHeader{
+			"Content-Type":              {`text/plain; charset="utf-8"`},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		}, body.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(&body)
+	alternatives := []struct{ contentType, content string }{
+		{"text/plain", plainText(msg)},
+		{"text/html", msg.HTML},
+	}
+	for _, alt := range alternatives {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {alt.contentType + `; charset="utf-8"`},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := writeQuotedPrintable(part, alt.content); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, nil, err
+	}
+	return textproto.MIMEHeader{
+		"Content-Type": {fmt.Sprintf(`multipart/alternative; boundary="%s"`, mw.Boundary())},
+	}, body.Bytes(), nil
+}
+
+var (
+	htmlBreaks = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|h[1-6]|li|tr)>`)
+	htmlTags   = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankLines = regexp.MustCompile(`\n[ \t]*(\n[ \t]*)+`)
+)
+
+// plainText returns the text alternative, deriving it from the HTML when the
+// sender only supplied HTML.
+func plainText(msg Message) string {
+	if msg.Text != "" || msg.HTML == "" {
+		return msg.Text
+	}
+	text := htmlBreaks.ReplaceAllString(msg.HTML, "\n")
+	text = htmlTags.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+	text = blankLines.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text) + "\n"
+}
+
+func writeQuotedPrintable(w interface{ Write([]byte) (int, error) }, text string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(text)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func writeBase64Lines(w interface{ Write([]byte) (int, error) }, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err := w.Write([]byte(encoded[:76] + "\r\n")); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err := w.Write([]byte(encoded + "\r\n"))
+	return err
+}
+
+func writeHeader(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	buf.WriteString(": ")
+	buf.WriteString(value)
+	buf.WriteString("\r\n")
+}
+
+func newMessageID(from string) string {
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = from[at+1:]
+	}
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), rand.Text(), domain)
+}
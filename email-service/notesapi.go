@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+type NotesAPIConfig struct {
+	BaseURL            string
+	Token              string
+	Timeout            time.Duration
+	CAFile             string
+	InsecureSkipVerify bool
+	CacheTTL           time.Duration
+	CacheSize          int
+}
+
+// NotesAPI reads notes straight from the notes app so that clients no longer
+// have to push them into /email/store first. Fetched notes are cached.
+type NotesAPI struct {
+	baseURL string
+	token   string
+	client  *http.Client
+	cache   *NoteStore
+}
+
+type apiNote struct {
+	ID        json.Number `json:"id"`
+	Title     string      `json:"title"`
+	Content   string      `json:"content"`
+	OwnerID   json.Number `json:"owner_id"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+func (n apiNote) note() Note {
+	return Note{
+		ID:          n.ID.String(),
+		Title:       n.Title,
+		Content:     n.Content,
+		Description: n.Title,
+		OwnerID:     n.OwnerID.String(),
+		CreatedAt:   n.CreatedAt,
+	}
+}
+
+type apiUser struct {
+	ID          json.Number `json:"id"`
+	Email       string      `json:"email"`
+	Preferences struct {
+		Delivery   string   `json:"delivery"`
+		Events     []string `json:"events"`
+		Timezone   string   `json:"timezone"`
+		SendWindow string   `json:"send_window"`
+		QuietHours string   `json:"quiet_hours"`
+	} `json:"preferences"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func NewNotesAPI(cfg NotesAPIConfig) (*NotesAPI, error) {
+	if _, err := url.Parse(cfg.BaseURL); err != nil {
+		return nil, fmt.Errorf("invalid NOTES_API_URL: %w", err)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read notes API CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &NotesAPI{
+		baseURL: strings.TrimRight(cfg.BaseURL, "/"),
+		token:   cfg.Token,
+		client: &http.Client{
+			Timeout:   cfg.Timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		cache: NewNoteStore(cfg.CacheTTL, cfg.CacheSize),
+	}, nil
+}
+
+// Get returns the note with the given ID. The bool is false when the app
+// reports that the note does not exist.
+func (a *NotesAPI) Get(ctx context.Context, id string) (Note, bool, error) {
+	if note, ok := a.cache.Get(id); ok {
+		return note, true, nil
+	}
+
+	var body apiNote
+	found, err := a.get(ctx, "/notes/"+url.PathEscape(id), &body)
+	if err != nil || !found {
+		return Note{}, false, err
+	}
+
+	note := body.note()
+	a.cache.Put(note)
+	return note, true, nil
+}
+
+// User returns the email address and notification preferences of a user.
+// Caching is left to PreferenceStore.
+func (a *NotesAPI) User(ctx context.Context, id string) (UserPreferences, bool, error) {
+	var body apiUser
+	found, err := a.get(ctx, "/users/"+url.PathEscape(id), &body)
+	if err != nil || !found {
+		return UserPreferences{}, false, err
+	}
+	return UserPreferences{
+		UserID:     body.ID.String(),
+		Email:      body.Email,
+		Delivery:   body.Preferences.Delivery,
+		Events:     body.Preferences.Events,
+		Timezone:   body.Preferences.Timezone,
+		SendWindow: body.Preferences.SendWindow,
+		QuietHours: body.Preferences.QuietHours,
+		UpdatedAt:  body.UpdatedAt,
+	}, true, nil
+}
+
+func (a *NotesAPI) get(ctx context.Context, path string, v any) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.baseURL+path, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("fetch %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode != http.StatusOK:
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return false, fmt.Errorf("fetch %s: %s: %s", path, resp.Status, strings.TrimSpace(string(detail)))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return false, fmt.Errorf("decode %s: %w", path, err)
+	}
+	return true, nil
+}
+
+func (a *NotesAPI) Invalidate(id string) {
+	a.cache.Delete(id)
+}
+
+func (a *NotesAPI) Run(ctx context.Context) {
+	a.cache.Run(ctx)
+}
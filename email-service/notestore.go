@@ -0,0 +1,184 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+type noteEntry struct {
+	note      Note
+	expiresAt time.Time
+}
+
+type StoreStats struct {
+	Entries           int   `json:"entries"`
+	MaxEntries        int   `json:"max_entries"`
+	TTLSeconds        int   `json:"ttl_seconds"`
+	ExpiredEvictions  int64 `json:"expired_evictions"`
+	CapacityEvictions int64 `json:"capacity_evictions"`
+	Deleted           int64 `json:"deleted"`
+}
+
+// NoteStore is an LRU cache of notes. Entries expire ttl after they were last
+// written; when maxEntries is exceeded the least recently used note is
+// dropped. A zero ttl or maxEntries disables that limit.
+type NoteStore struct {
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List
+	ttl        time.Duration
+	maxEntries int
+
+	expired  int64
+	evicted  int64
+	deleted  int64
+	interval time.Duration
+}
+
+func NewNoteStore(ttl time.Duration, maxEntries int) *NoteStore {
+	interval := time.Minute
+	if ttl > 0 && ttl < interval {
+		interval = ttl
+	}
+	return &NoteStore{
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		interval:   interval,
+	}
+}
+
+func (s *NoteStore) Put(note Note) (existed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := noteEntry{note: note}
+	if s.ttl > 0 {
+		entry.expiresAt = time.Now().Add(s.ttl)
+	}
+
+	if el, ok := s.entries[note.ID]; ok {
+		el.Value = entry
+		s.lru.MoveToFront(el)
+		return true
+	}
+
+	s.entries[note.ID] = s.lru.PushFront(entry)
+	for s.maxEntries > 0 && s.lru.Len() > s.maxEntries {
+		s.remove(s.lru.Back())
+		s.evicted++
+	}
+	return false
+}
+
+func (s *NoteStore) Get(id string) (Note, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.entries[id]
+	if !ok {
+		return Note{}, false
+	}
+	entry := el.Value.(noteEntry)
+	if !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+		s.remove(el)
+		s.expired++
+		return Note{}, false
+	}
+	s.lru.MoveToFront(el)
+	return entry.note, true
+}
+
+func (s *NoteStore) Delete(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.entries[id]
+	if !ok {
+		return false
+	}
+	s.remove(el)
+	s.deleted++
+	return true
+}
+
+// Clear drops every note and returns how many there were. Cleared notes are
+// not counted as deleted.
+func (s *NoteStore) Clear() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.lru.Len()
+	clear(s.entries)
+	s.lru.Init()
+	return n
+}
+
+func (s *NoteStore) ResetStats() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expired, s.evicted, s.deleted = 0, 0, 0
+}
+
+func (s *NoteStore) remove(el *list.Element) {
+	s.lru.Remove(el)
+	delete(s.entries, el.Value.(noteEntry).note.ID)
+}
+
+func (s *NoteStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+func (s *NoteStore) Stats() StoreStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return StoreStats{
+		Entries:           s.lru.Len(),
+		MaxEntries:        s.maxEntries,
+		TTLSeconds:        int(s.ttl.Seconds()),
+		ExpiredEvictions:  s.expired,
+		CapacityEvictions: s.evicted,
+		Deleted:           s.deleted,
+	}
+}
+
+func (s *NoteStore) sweep() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	removed := 0
+	for el := s.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if exp := el.Value.(noteEntry).expiresAt; !exp.IsZero() && now.After(exp) {
+			s.remove(el)
+			s.expired++
+			removed++
+		}
+		el = prev
+	}
+	return removed
+}
+
+// Run periodically drops expired notes so that ones nobody reads again don't
+// stay in memory until they are pushed out by capacity.
+func (s *NoteStore) Run(ctx context.Context) {
+	if s.ttl <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sweep()
+		}
+	}
+}
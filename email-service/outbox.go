@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// The notes app writes email_outbox rows in the same transaction as the note
+// change, so an email is requested if and only if the change committed.
+const outboxSchema = `
+CREATE TABLE IF NOT EXISTS email_outbox (
+    id           BIGSERIAL PRIMARY KEY,
+    payload      JSONB NOT NULL,
+    created_at   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    available_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    attempts     INT NOT NULL DEFAULT 0,
+    last_error   TEXT,
+    processed_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS email_outbox_pending_idx ON email_outbox (available_at) WHERE processed_at IS NULL;
+`
+
+type OutboxConfig struct {
+	DSN          string
+	PollInterval time.Duration
+	BatchSize    int
+	RetryDelay   time.Duration
+}
+
+// Outbox polls the app's outbox table. Rows are claimed with FOR UPDATE SKIP
+// LOCKED inside a transaction that stays open until the row is marked
+// processed, so several email-service instances never handle the same row.
+// Each row becomes a task with the ID outbox-<row id>, so a row replayed
+// after a failed commit is recognised by the status history, and by the
+// Postgres queue even across restarts, instead of being sent twice.
+type Outbox struct {
+	db  *sql.DB
+	cfg OutboxConfig
+}
+
+type OutboxStats struct {
+	Pending   int `json:"pending"`
+	Failed    int `json:"failed"`
+	Processed int `json:"processed"`
+}
+
+func NewOutbox(cfg OutboxConfig) (*Outbox, error) {
+	db, err := sql.Open("postgres", cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping outbox database: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, outboxSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create outbox schema: %w", err)
+	}
+	return &Outbox{db: db, cfg: cfg}, nil
+}
+
+func (o *Outbox) Run(ctx context.Context, s *EmailService) {
+	defer o.db.Close()
+
+	ticker := time.NewTicker(o.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		n, err := o.poll(ctx, s)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("Outbox poll failed", "error", err)
+		}
+		// A full batch means more rows are probably waiting.
+		if n == o.cfg.BatchSize && err == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (o *Outbox) poll(ctx context.Context, s *EmailService) (int, error) {
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, payload FROM email_outbox
+		WHERE processed_at IS NULL AND available_at <= CURRENT_TIMESTAMP
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED`, o.cfg.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	type outboxRow struct {
+		id      int64
+		payload []byte
+	}
+	var claimed []outboxRow
+	for rows.Next() {
+		var row outboxRow
+		if err := rows.Scan(&row.id, &row.payload); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		claimed = append(claimed, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, row := range claimed {
+		taskID := fmt.Sprintf("outbox-%d", row.id)
+		logger := slog.With("outbox_id", row.id, "task_id", taskID)
+
+		err := o.handle(ctx, s, taskID, row.payload)
+		switch {
+		case err == nil:
+			_, err = tx.ExecContext(ctx,
+				`UPDATE email_outbox SET processed_at = CURRENT_TIMESTAMP, attempts = attempts + 1, last_error = NULL WHERE id = $1`,
+				row.id)
+		case errors.Is(err, errPermanentEvent):
+			logger.Error("Dropping outbox row", "error", err)
+			_, err = tx.ExecContext(ctx,
+				`UPDATE email_outbox SET processed_at = CURRENT_TIMESTAMP, attempts = attempts + 1, last_error = $2 WHERE id = $1`,
+				row.id, err.Error())
+		default:
+			logger.Warn("Outbox row failed, retrying later", "retry_in", o.cfg.RetryDelay, "error", err)
+			_, err = tx.ExecContext(ctx,
+				`UPDATE email_outbox SET attempts = attempts + 1, last_error = $2,
+				 available_at = CURRENT_TIMESTAMP + make_interval(secs => $3) WHERE id = $1`,
+				row.id, err.Error(), o.cfg.RetryDelay.Seconds())
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(claimed), tx.Commit()
+}
+
+func (o *Outbox) handle(ctx context.Context, s *EmailService, taskID string, payload []byte) error {
+	if _, seen := s.history.Get(taskID); seen {
+		return nil
+	}
+	var event BusEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return fmt.Errorf("%w: decode outbox payload: %v", errPermanentEvent, err)
+	}
+	return s.handleEvent(ctx, event, taskID)
+}
+
+func (o *Outbox) Stats(ctx context.Context) (OutboxStats, error) {
+	var stats OutboxStats
+	err := o.db.QueryRowContext(ctx, `
+		SELECT
+			COUNT(*) FILTER (WHERE processed_at IS NULL),
+			COUNT(*) FILTER (WHERE processed_at IS NOT NULL AND last_error IS NOT NULL),
+			COUNT(*) FILTER (WHERE processed_at IS NOT NULL AND last_error IS NULL)
+		FROM email_outbox`).Scan(&stats.Pending, &stats.Failed, &stats.Processed)
+	return stats, err
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/m-tln/notes/config"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// PDFRenderer converts an HTML document to PDF. The engine behind it is
+// chosen with EMAIL_PDF_RENDERER, so it can be swapped without touching the
+// send path.
+type PDFRenderer interface {
+	Name() string
+	Render(ctx context.Context, html []byte) ([]byte, error)
+}
+
+// NewPDFRendererFromEnv returns nil when PDF attachments are not configured.
+func NewPDFRendererFromEnv() (PDFRenderer, error) {
+	switch kind := config.String("EMAIL_PDF_RENDERER", ""); kind {
+	case "":
+		return nil, nil
+	case "gotenberg":
+		return NewGotenbergRenderer(config.String("EMAIL_PDF_GOTENBERG_URL", "http://gotenberg:3000")), nil
+	case "command":
+		return NewCommandRenderer(config.String("EMAIL_PDF_COMMAND", "wkhtmltopdf --quiet - -"))
+	default:
+		return nil, fmt.Errorf("unknown EMAIL_PDF_RENDERER %q", kind)
+	}
+}
+
+// GotenbergRenderer posts the document to a Gotenberg instance, which prints
+// it with headless Chromium.
+type GotenbergRenderer struct {
+	url    string
+	client *http.Client
+}
+
+func NewGotenbergRenderer(url string) *GotenbergRenderer {
+	return &GotenbergRenderer{
+		url:    strings.TrimSuffix(url, "/") + "/forms/chromium/convert/html",
+		client: &http.Client{},
+	}
+}
+
+func (r *GotenbergRenderer) Name() string { return "gotenberg" }
+
+func (r *GotenbergRenderer) Render(ctx context.Context, html []byte) ([]byte, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("files", "index.html")
+	if err != nil {
+		return nil, err
+	}
+	part.Write(html)
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("gotenberg returned %s: %s", resp.Status, bytes.TrimSpace(detail))
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// CommandRenderer runs a local converter that reads HTML on stdin and writes
+// the PDF to stdout, such as "wkhtmltopdf --quiet - -".
+type CommandRenderer struct {
+	args []string
+}
+
+func NewCommandRenderer(command string) (*CommandRenderer, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("EMAIL_PDF_COMMAND is empty")
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return nil, fmt.Errorf("PDF command: %w", err)
+	}
+	return &CommandRenderer{args: args}, nil
+}
+
+func (r *CommandRenderer) Name() string { return "command" }
+
+func (r *CommandRenderer) Render(ctx context.Context, html []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, r.args[0], r.args[1:]...)
+	cmd.Stdin = bytes.NewReader(html)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", r.args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// Raw HTML in notes is not rendered, so a note cannot pull remote resources
+// into the converter.
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+var noteDocumentTemplate = template.Must(template.New("note").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; font-size: 12pt; line-height: 1.5; margin: 2cm; }
+pre, code { font-family: monospace; background: #f5f5f5; }
+pre { padding: 8px; white-space: pre-wrap; }
+blockquote { border-left: 3px solid #ccc; margin-left: 0; padding-left: 12px; color: #555; }
+.meta { color: #777; font-size: 10pt; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if not .CreatedAt.IsZero}}<p class="meta">Created: {{.CreatedAt.Format "2006-01-02 15:04"}}</p>{{end}}
+{{.Body}}
+</body>
+</html>
+`))
+
+// noteHTML renders the note's Markdown content as a standalone HTML page.
+func noteHTML(note Note) ([]byte, error) {
+	var content bytes.Buffer
+	if err := markdown.Convert([]byte(note.Content), &content); err != nil {
+		return nil, err
+	}
+	var page bytes.Buffer
+	err := noteDocumentTemplate.Execute(&page, struct {
+		Title     string
+		CreatedAt time.Time
+		Body      template.HTML
+	}{note.Title, note.CreatedAt, template.HTML(content.String())})
+	return page.Bytes(), err
+}
+
+// notePDF renders the note for attach_note=pdf. It runs in the worker rather
+// than at request time, so the attachment reflects the note as sent and a
+// converter outage is retried like any other transient failure.
+func (s *EmailService) notePDF(note Note) (Attachment, error) {
+	page, err := noteHTML(note)
+	if err != nil {
+		return Attachment{}, &SendError{Provider: "pdf", Permanent: true, Err: err}
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, s.pdfTimeout)
+	defer cancel()
+	data, err := s.pdf.Render(ctx, page)
+	if err != nil {
+		return Attachment{}, &SendError{Provider: "pdf", Err: err}
+	}
+	if len(data) > s.attachments.maxSize {
+		return Attachment{}, &SendError{Provider: "pdf", Permanent: true,
+			Err: fmt.Errorf("rendered PDF is %d bytes, limit is %d", len(data), s.attachments.maxSize)}
+	}
+	return Attachment{
+		Filename:    fmt.Sprintf("note-%s.pdf", note.ID),
+		ContentType: "application/pdf",
+		Data:        data,
+	}, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DeliveryImmediate = "immediate"
+	DeliveryDigest    = "digest"
+
+	EventNoteCreated = "note_created"
+	EventNoteUpdated = "note_updated"
+	EventReminderDue = "reminder_due"
+	EventDigest      = "digest"
+)
+
+var noteEvents = []string{EventNoteCreated, EventNoteUpdated, EventReminderDue, EventDigest}
+
+type UserPreferences struct {
+	UserID     string    `json:"user_id"`
+	Email      string    `json:"email"`
+	Delivery   string    `json:"delivery"`
+	Events     []string  `json:"events"`
+	Timezone   string    `json:"timezone,omitempty"`
+	SendWindow string    `json:"send_window,omitempty"`
+	QuietHours string    `json:"quiet_hours,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at,omitzero"`
+}
+
+// Allows reports whether the user wants emails for the event. An empty list
+// means every event is enabled.
+func (p UserPreferences) Allows(event string) bool {
+	return len(p.Events) == 0 || slices.Contains(p.Events, event)
+}
+
+func (p *UserPreferences) normalize() error {
+	if p.UserID == "" {
+		return fmt.Errorf("%w: user_id is required", errInvalidRequest)
+	}
+	addr, err := mail.ParseAddress(p.Email)
+	if err != nil {
+		return fmt.Errorf("%w: invalid email for user %s", errInvalidRequest, p.UserID)
+	}
+	p.Email = addr.Address
+
+	switch p.Delivery {
+	case "":
+		p.Delivery = DeliveryImmediate
+	case DeliveryImmediate, DeliveryDigest:
+	default:
+		return fmt.Errorf("%w: unknown delivery %q", errInvalidRequest, p.Delivery)
+	}
+	for _, event := range p.Events {
+		if !slices.Contains(noteEvents, event) {
+			return fmt.Errorf("%w: unknown event %q", errInvalidRequest, event)
+		}
+	}
+
+	if p.Timezone != "" {
+		if _, err := loadTimezone(p.Timezone); err != nil {
+			return err
+		}
+	}
+	if p.SendWindow != "" && p.QuietHours != "" {
+		return fmt.Errorf("%w: set either send_window or quiet_hours for user %s", errInvalidRequest, p.UserID)
+	}
+	if _, _, err := parseWindowSpec(p.SendWindow); err != nil {
+		return err
+	}
+	if _, _, err := parseWindowSpec(p.QuietHours); err != nil {
+		return err
+	}
+	return nil
+}
+
+type cachedPreferences struct {
+	prefs     UserPreferences
+	fetchedAt time.Time
+}
+
+// PreferenceStore caches per-user email preferences. Entries are fetched
+// from the notes app when it is configured and expire after ttl; the app can
+// also push changes through the sync endpoint. Users who pick digest delivery
+// are kept subscribed to the digest.
+type PreferenceStore struct {
+	mu      sync.Mutex
+	entries map[string]cachedPreferences
+	ttl     time.Duration
+	fetch   func(context.Context, string) (UserPreferences, bool, error)
+	digest  *Digest
+}
+
+func NewPreferenceStore(ttl time.Duration, digest *Digest) *PreferenceStore {
+	return &PreferenceStore{
+		entries: make(map[string]cachedPreferences),
+		ttl:     ttl,
+		digest:  digest,
+	}
+}
+
+// Get returns the preferences of a user. When the app can't be reached a
+// stale cached entry is used rather than failing the send.
+func (p *PreferenceStore) Get(ctx context.Context, userID string) (UserPreferences, bool, error) {
+	p.mu.Lock()
+	cached, ok := p.entries[userID]
+	p.mu.Unlock()
+
+	if ok && (p.fetch == nil || time.Since(cached.fetchedAt) < p.ttl) {
+		return cached.prefs, true, nil
+	}
+	if p.fetch == nil {
+		return UserPreferences{}, false, nil
+	}
+
+	prefs, found, err := p.fetch(ctx, userID)
+	if err != nil {
+		if ok {
+			slog.Warn("Using cached preferences", "user_id", userID, "error", err)
+			return cached.prefs, true, nil
+		}
+		return UserPreferences{}, false, err
+	}
+	if !found {
+		p.Delete(userID)
+		return UserPreferences{}, false, nil
+	}
+	if err := p.Put(prefs); err != nil {
+		return UserPreferences{}, false, err
+	}
+	return prefs, true, nil
+}
+
+func (p *PreferenceStore) Put(prefs UserPreferences) error {
+	if err := prefs.normalize(); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	previous, existed := p.entries[prefs.UserID]
+	p.entries[prefs.UserID] = cachedPreferences{prefs: prefs, fetchedAt: time.Now()}
+	p.mu.Unlock()
+
+	if existed {
+		p.unsubscribe(previous.prefs, prefs)
+	}
+	if prefs.Delivery == DeliveryDigest && prefs.Allows(EventDigest) {
+		p.digest.Subscribe(prefs.Email)
+	}
+	return nil
+}
+
+func (p *PreferenceStore) Delete(userID string) {
+	p.mu.Lock()
+	previous, existed := p.entries[userID]
+	delete(p.entries, userID)
+	p.mu.Unlock()
+
+	if existed {
+		p.unsubscribe(previous.prefs, UserPreferences{})
+	}
+}
+
+// unsubscribe drops a digest subscription that only existed because of the
+// previous preferences.
+func (p *PreferenceStore) unsubscribe(previous, current UserPreferences) {
+	if previous.Delivery != DeliveryDigest {
+		return
+	}
+	stillDigest := current.Delivery == DeliveryDigest && current.Allows(EventDigest)
+	if !stillDigest || previous.Email != current.Email {
+		p.digest.Unsubscribe(previous.Email)
+	}
+}
+
+// Refresh drops the cached entry and fetches it again right away.
+func (p *PreferenceStore) Refresh(ctx context.Context, userID string) (UserPreferences, bool, error) {
+	p.mu.Lock()
+	if cached, ok := p.entries[userID]; ok {
+		cached.fetchedAt = time.Time{}
+		p.entries[userID] = cached
+	}
+	p.mu.Unlock()
+	return p.Get(ctx, userID)
+}
+
+func (p *PreferenceStore) List() []UserPreferences {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := make([]UserPreferences, 0, len(p.entries))
+	for _, entry := range p.entries {
+		list = append(list, entry.prefs)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UserID < list[j].UserID })
+	return list
+}
+
+// noteRecipient resolves who should get an email about the note. Notes
+// without an owner go to the global EMAIL_ADDR, which is returned as
+// preferences with only Email set. A non-empty skip reason means the owner
+// doesn't want this email right now.
+func (s *EmailService) noteRecipient(ctx context.Context, note Note, event string) (UserPreferences, string, error) {
+	fallback := UserPreferences{Email: s.emailAddr}
+	if note.OwnerID == "" {
+		return fallback, "", nil
+	}
+
+	prefs, ok, err := s.preferences.Get(ctx, note.OwnerID)
+	if err != nil {
+		return UserPreferences{}, "", fmt.Errorf("load preferences for user %s: %w", note.OwnerID, err)
+	}
+	switch {
+	case !ok:
+		return fallback, "", nil
+	case !prefs.Allows(event):
+		return UserPreferences{}, fmt.Sprintf("user %s disabled %s emails", prefs.UserID, event), nil
+	case prefs.Delivery == DeliveryDigest:
+		return UserPreferences{}, fmt.Sprintf("user %s receives %s in the digest", prefs.UserID, event), nil
+	}
+	return prefs, "", nil
+}
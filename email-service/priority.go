@@ -0,0 +1,34 @@
+package main
+
+import "fmt"
+
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// priorities lists levels in the order workers drain them.
+var priorities = []string{PriorityHigh, PriorityNormal, PriorityLow}
+
+func parsePriority(value string) (string, error) {
+	switch value {
+	case "":
+		return PriorityNormal, nil
+	case PriorityHigh, PriorityNormal, PriorityLow:
+		return value, nil
+	default:
+		return "", fmt.Errorf("%w: priority must be high, normal or low", errInvalidRequest)
+	}
+}
+
+func priorityRank(value string) int {
+	switch value {
+	case PriorityHigh:
+		return 0
+	case PriorityLow:
+		return 2
+	default:
+		return 1
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TaskQueue is the storage behind the worker pool. Dequeue blocks until a task
+// is available or ctx is cancelled; every dequeued task must end in exactly
+// one of Complete, Fail or Retry. EnqueueBatch adds either all tasks or none.
+// Cancel removes a task that no worker has picked up yet and returns it, or
+// errTaskNotFound.
+type TaskQueue interface {
+	Enqueue(ctx context.Context, task EmailTask) error
+	EnqueueBatch(ctx context.Context, tasks []EmailTask) error
+	Dequeue(ctx context.Context) (EmailTask, error)
+	Complete(ctx context.Context, task EmailTask) error
+	Fail(ctx context.Context, task EmailTask, cause error) error
+	Retry(ctx context.Context, task EmailTask, at time.Time) error
+	Cancel(ctx context.Context, id string) (EmailTask, error)
+	// Purge drops every task that no worker has picked up yet and returns
+	// them.
+	Purge(ctx context.Context) ([]EmailTask, error)
+	Len() int
+	Cap() int
+	Close() error
+}
+
+// TaskLookup is implemented by queues that can return a task they still
+// hold by ID, or errTaskNotFound.
+type TaskLookup interface {
+	Lookup(ctx context.Context, id string) (EmailTask, error)
+}
+
+// ReadyCounter is implemented by queues whose Len, the count capacity is
+// checked against, includes work that isn't due yet: scheduled sends and
+// retries waiting out a backoff. Ready leaves those out.
+type ReadyCounter interface {
+	Ready() int
+}
+
+// readyLen is the work a worker could pick up now or is busy with, which
+// is what drain progress and autoscaling go by.
+func readyLen(q TaskQueue) int {
+	if rc, ok := q.(ReadyCounter); ok {
+		return rc.Ready()
+	}
+	return q.Len()
+}
+
+// MemoryQueue keeps one buffered channel per priority level, each holding up
+// to size tasks. Tasks can't be pulled out of a channel, so Cancel leaves a
+// tombstone that Dequeue skips.
+type MemoryQueue struct {
+	tasks     [3]chan EmailTask
+	mu        sync.Mutex
+	waiting   map[string]EmailTask
+	cancelled map[string]bool
+	done      chan struct{}
+	once      sync.Once
+	pending   sync.WaitGroup
+}
+
+func NewMemoryQueue(size int) *MemoryQueue {
+	q := &MemoryQueue{
+		waiting:   make(map[string]EmailTask),
+		cancelled: make(map[string]bool),
+		done:      make(chan struct{}),
+	}
+	for i := range q.tasks {
+		q.tasks[i] = make(chan EmailTask, size)
+	}
+	return q
+}
+
+func (q *MemoryQueue) Enqueue(ctx context.Context, task EmailTask) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-q.done:
+		return errQueueClosed
+	case q.tasks[priorityRank(task.Priority)] <- task:
+		q.waiting[task.ID] = task
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+func (q *MemoryQueue) EnqueueBatch(ctx context.Context, tasks []EmailTask) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var needed [3]int
+	for _, task := range tasks {
+		needed[priorityRank(task.Priority)]++
+	}
+	for i, n := range needed {
+		if cap(q.tasks[i])-len(q.tasks[i]) < n {
+			return errQueueFull
+		}
+	}
+
+	for _, task := range tasks {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-q.done:
+			return errQueueClosed
+		case q.tasks[priorityRank(task.Priority)] <- task:
+			q.waiting[task.ID] = task
+		}
+	}
+	return nil
+}
+
+func (q *MemoryQueue) Dequeue(ctx context.Context) (EmailTask, error) {
+	for {
+		task, err := q.receive(ctx)
+		if err != nil {
+			return EmailTask{}, err
+		}
+
+		q.mu.Lock()
+		skip := q.cancelled[task.ID]
+		delete(q.cancelled, task.ID)
+		delete(q.waiting, task.ID)
+		q.mu.Unlock()
+
+		if !skip {
+			return task, nil
+		}
+	}
+}
+
+func (q *MemoryQueue) receive(ctx context.Context) (EmailTask, error) {
+	for _, tasks := range q.tasks {
+		select {
+		case task := <-tasks:
+			return task, nil
+		default:
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		return EmailTask{}, ctx.Err()
+	case task := <-q.tasks[0]:
+		return task, nil
+	case task := <-q.tasks[1]:
+		return task, nil
+	case task := <-q.tasks[2]:
+		return task, nil
+	}
+}
+
+func (q *MemoryQueue) Complete(ctx context.Context, task EmailTask) error {
+	return nil
+}
+
+func (q *MemoryQueue) Fail(ctx context.Context, task EmailTask, cause error) error {
+	return nil
+}
+
+func (q *MemoryQueue) Retry(ctx context.Context, task EmailTask, at time.Time) error {
+	q.mu.Lock()
+	q.waiting[task.ID] = task
+	q.mu.Unlock()
+
+	q.pending.Add(1)
+	time.AfterFunc(time.Until(at), func() {
+		defer q.pending.Done()
+
+		q.mu.Lock()
+		cancelled := q.cancelled[task.ID]
+		delete(q.cancelled, task.ID)
+		q.mu.Unlock()
+		if cancelled {
+			return
+		}
+
+		select {
+		case <-q.done:
+			taskLogger(task, 0).Warn("Dropping retry, queue closed")
+		case q.tasks[priorityRank(task.Priority)] <- task:
+		}
+	})
+	return nil
+}
+
+func (q *MemoryQueue) Cancel(ctx context.Context, id string) (EmailTask, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	task, ok := q.waiting[id]
+	if !ok {
+		return EmailTask{}, errTaskNotFound
+	}
+	delete(q.waiting, id)
+	q.cancelled[id] = true
+	return task, nil
+}
+
+// Lookup finds tasks waiting in the queue or for a retry; the ones workers
+// hold are gone from it.
+func (q *MemoryQueue) Lookup(ctx context.Context, id string) (EmailTask, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	task, ok := q.waiting[id]
+	if !ok {
+		return EmailTask{}, errTaskNotFound
+	}
+	return task, nil
+}
+
+func (q *MemoryQueue) Purge(ctx context.Context) ([]EmailTask, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tasks := make([]EmailTask, 0, len(q.waiting))
+	for id, task := range q.waiting {
+		tasks = append(tasks, task)
+		q.cancelled[id] = true
+	}
+	clear(q.waiting)
+	return tasks, nil
+}
+
+func (q *MemoryQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
+
+func (q *MemoryQueue) Cap() int {
+	n := 0
+	for _, tasks := range q.tasks {
+		n += cap(tasks)
+	}
+	return n
+}
+
+func (q *MemoryQueue) Close() error {
+	q.once.Do(func() {
+		close(q.done)
+	})
+	return nil
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+const postgresQueueSchema = `
+CREATE TABLE IF NOT EXISTS email_tasks (
+    id           TEXT PRIMARY KEY,
+    type         TEXT NOT NULL,
+    payload      JSONB NOT NULL,
+    status       TEXT NOT NULL DEFAULT 'queued',
+    attempts     INT NOT NULL DEFAULT 0,
+    last_error   TEXT,
+    available_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    claimed_at   TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+ALTER TABLE email_tasks ADD COLUMN IF NOT EXISTS priority INT NOT NULL DEFAULT 1;
+ALTER TABLE email_tasks ADD COLUMN IF NOT EXISTS lease TEXT;
+DROP INDEX IF EXISTS email_tasks_ready_idx;
+CREATE INDEX IF NOT EXISTS email_tasks_ready_priority_idx ON email_tasks (status, priority, available_at);
+`
+
+type PostgresQueue struct {
+	db                *sql.DB
+	capacity          int
+	pollInterval      time.Duration
+	visibilityTimeout time.Duration
+	hold              atomic.Pointer[time.Time]
+}
+
+func NewPostgresQueue(dsn string, capacity int, pollInterval, visibilityTimeout time.Duration) (*PostgresQueue, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping queue database: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, postgresQueueSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create queue schema: %w", err)
+	}
+
+	return &PostgresQueue{
+		db:                db,
+		capacity:          capacity,
+		pollInterval:      pollInterval,
+		visibilityTimeout: visibilityTimeout,
+	}, nil
+}
+
+func (q *PostgresQueue) Enqueue(ctx context.Context, task EmailTask) error {
+	if q.Len() >= q.capacity {
+		return errQueueFull
+	}
+
+	payload, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	// Task IDs derived from outbox rows repeat when a row is replayed; the
+	// first insert wins.
+	_, err = q.db.ExecContext(ctx,
+		`INSERT INTO email_tasks (id, type, payload, attempts, priority) VALUES ($1, $2, $3, $4, $5)
+		 ON CONFLICT (id) DO NOTHING`,
+		task.ID, task.Type, payload, task.Attempts, priorityRank(task.Priority))
+	return err
+}
+
+// Schedule inserts the task with available_at set to its send time, so
+// workers leave it alone until then.
+func (q *PostgresQueue) Schedule(ctx context.Context, task EmailTask) error {
+	if q.Len() >= q.capacity {
+		return errQueueFull
+	}
+
+	payload, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.db.ExecContext(ctx,
+		`INSERT INTO email_tasks (id, type, payload, attempts, priority, available_at) VALUES ($1, $2, $3, $4, $5, $6)
+		 ON CONFLICT (id) DO NOTHING`,
+		task.ID, task.Type, payload, task.Attempts, priorityRank(task.Priority), task.SendAt)
+	return err
+}
+
+// Scheduled lists queued rows whose send_at is still ahead, plus the ones a
+// hold keeps back. Retries waiting out a backoff have a send_at in the past,
+// if any, and are left out.
+func (q *PostgresQueue) Scheduled(ctx context.Context) ([]EmailTask, error) {
+	rows, err := q.db.QueryContext(ctx, `
+		SELECT id, payload FROM email_tasks
+		WHERE status = 'queued'
+		  AND ((available_at > now() AND (payload->>'send_at')::timestamptz > now())
+		    OR (attempts = 0 AND coalesce((payload->>'send_at')::timestamptz > $1::timestamptz, false)))
+		ORDER BY available_at`, q.hold.Load())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []EmailTask
+	for rows.Next() {
+		var id string
+		var payload []byte
+		if err := rows.Scan(&id, &payload); err != nil {
+			return tasks, err
+		}
+		var task EmailTask
+		if err := json.Unmarshal(payload, &task); err != nil {
+			slog.Error("Failed to decode scheduled task", "task_id", id, "error", err)
+			task = EmailTask{ID: id}
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+// Hold keeps claim from picking up scheduled rows whose send_at falls after
+// since, so a draining replica doesn't start on them; a zero since lifts the
+// hold. Retries are still claimed.
+func (q *PostgresQueue) Hold(since time.Time) {
+	if since.IsZero() {
+		q.hold.Store(nil)
+		return
+	}
+	q.hold.Store(&since)
+}
+
+func (q *PostgresQueue) EnqueueBatch(ctx context.Context, tasks []EmailTask) error {
+	if q.Len()+len(tasks) > q.capacity {
+		return errQueueFull
+	}
+
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, task := range tasks {
+		payload, err := json.Marshal(task)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO email_tasks (id, type, payload, attempts, priority) VALUES ($1, $2, $3, $4, $5)`,
+			task.ID, task.Type, payload, task.Attempts, priorityRank(task.Priority)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Dequeue claims the oldest ready row of the highest priority. Rows stuck in 'processing' longer than
+// the visibility timeout belong to a crashed worker and are claimed again.
+func (q *PostgresQueue) Dequeue(ctx context.Context) (EmailTask, error) {
+	for {
+		task, err := q.claim(ctx)
+		if err == nil {
+			return task, nil
+		}
+		if err != sql.ErrNoRows {
+			slog.Error("Failed to claim task", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return EmailTask{}, ctx.Err()
+		case <-time.After(q.pollInterval):
+		}
+	}
+}
+
+func (q *PostgresQueue) claim(ctx context.Context) (EmailTask, error) {
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return EmailTask{}, err
+	}
+	defer tx.Rollback()
+
+	var id string
+	err = tx.QueryRowContext(ctx, `
+		SELECT id FROM email_tasks
+		WHERE (status = 'queued' AND available_at <= now()
+		       AND NOT (attempts = 0 AND coalesce((payload->>'send_at')::timestamptz > $2::timestamptz, false)))
+		   OR (status = 'processing' AND claimed_at < now() - $1 * interval '1 second')
+		ORDER BY priority, available_at
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED`, q.visibilityTimeout.Seconds(), q.hold.Load()).Scan(&id)
+	if err != nil {
+		return EmailTask{}, err
+	}
+
+	// Each claim gets its own lease, so a worker whose row was reclaimed after
+	// the visibility timeout can't overwrite the new owner's outcome. A
+	// reclaim counts the abandoned run as an attempt, so a task that keeps
+	// killing or stalling its worker still runs out of retries.
+	lease := rand.Text()
+	var payload []byte
+	if err := tx.QueryRowContext(ctx, `
+		UPDATE email_tasks
+		SET status = 'processing', lease = $2, claimed_at = now(), updated_at = now(),
+		    attempts = attempts + CASE WHEN status = 'processing' THEN 1 ELSE 0 END,
+		    payload = CASE WHEN status = 'processing'
+		                   THEN jsonb_set(payload, '{attempts}', to_jsonb(attempts + 1))
+		                   ELSE payload END
+		WHERE id = $1
+		RETURNING payload`,
+		id, lease).Scan(&payload); err != nil {
+		return EmailTask{}, err
+	}
+
+	var task EmailTask
+	if err := json.Unmarshal(payload, &task); err != nil {
+		// Left queued, the row would be claimed and fail again by every
+		// worker; it goes to the dead letters instead.
+		err = fmt.Errorf("decode task %s: %w", id, err)
+		if _, uerr := tx.ExecContext(ctx, `
+			UPDATE email_tasks SET status = 'failed', last_error = $2, lease = NULL, updated_at = now()
+			WHERE id = $1`, id, err.Error()); uerr != nil {
+			return EmailTask{}, uerr
+		}
+		if cerr := tx.Commit(); cerr != nil {
+			return EmailTask{}, cerr
+		}
+		return EmailTask{}, err
+	}
+	task.receipt = lease
+
+	return task, tx.Commit()
+}
+
+// settle checks that an update made under a lease touched the row; if not,
+// another worker holds the task now.
+func settle(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errLeaseLost
+	}
+	return nil
+}
+
+func (q *PostgresQueue) Complete(ctx context.Context, task EmailTask) error {
+	return settle(q.db.ExecContext(ctx, `
+		UPDATE email_tasks SET status = 'done', attempts = $2, lease = NULL, updated_at = now()
+		WHERE id = $1 AND lease = $3`,
+		task.ID, task.Attempts, task.receipt))
+}
+
+func (q *PostgresQueue) Fail(ctx context.Context, task EmailTask, cause error) error {
+	task.LastError = cause.Error()
+	payload, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	return settle(q.db.ExecContext(ctx, `
+		UPDATE email_tasks
+		SET status = 'failed', payload = $2, attempts = $3, last_error = $4, lease = NULL, updated_at = now()
+		WHERE id = $1 AND lease = $5`,
+		task.ID, payload, task.Attempts, task.LastError, task.receipt))
+}
+
+func (q *PostgresQueue) Retry(ctx context.Context, task EmailTask, at time.Time) error {
+	payload, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	return settle(q.db.ExecContext(ctx, `
+		UPDATE email_tasks
+		SET status = 'queued', payload = $2, attempts = $3, last_error = $4,
+		    available_at = $5, claimed_at = NULL, lease = NULL, updated_at = now()
+		WHERE id = $1 AND lease = $6`,
+		task.ID, payload, task.Attempts, task.LastError, at, task.receipt))
+}
+
+// DeadLetters lists the rows that ended in 'failed'.
+func (q *PostgresQueue) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	rows, err := q.db.QueryContext(ctx, `
+		SELECT id, payload, coalesce(last_error, ''), updated_at FROM email_tasks
+		WHERE status = 'failed'
+		ORDER BY updated_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []DeadLetter
+	for rows.Next() {
+		var id string
+		var payload []byte
+		var item DeadLetter
+		if err := rows.Scan(&id, &payload, &item.Error, &item.FailedAt); err != nil {
+			return items, err
+		}
+		if err := json.Unmarshal(payload, &item.Task); err != nil {
+			slog.Error("Failed to decode dead letter", "task_id", id, "error", err)
+			item.Task = EmailTask{ID: id}
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// Requeue turns a failed row back into a queued one in place; the row keeps
+// its id, so a plain Enqueue would be dropped by ON CONFLICT.
+func (q *PostgresQueue) Requeue(ctx context.Context, id string) (EmailTask, error) {
+	if q.Len() >= q.capacity {
+		return EmailTask{}, errQueueFull
+	}
+
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return EmailTask{}, err
+	}
+	defer tx.Rollback()
+
+	var payload []byte
+	err = tx.QueryRowContext(ctx,
+		`SELECT payload FROM email_tasks WHERE id = $1 AND status = 'failed' FOR UPDATE`, id).Scan(&payload)
+	if err == sql.ErrNoRows {
+		return EmailTask{}, errTaskNotFound
+	}
+	if err != nil {
+		return EmailTask{}, err
+	}
+
+	var task EmailTask
+	if err := json.Unmarshal(payload, &task); err != nil {
+		return EmailTask{}, fmt.Errorf("decode task %s: %w", id, err)
+	}
+	resetDeadLetter(&task)
+	if payload, err = json.Marshal(task); err != nil {
+		return EmailTask{}, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE email_tasks
+		SET status = 'queued', payload = $2, attempts = 0, last_error = NULL,
+		    available_at = now(), claimed_at = NULL, updated_at = now()
+		WHERE id = $1`,
+		id, payload); err != nil {
+		return EmailTask{}, err
+	}
+	return task, tx.Commit()
+}
+
+func (q *PostgresQueue) Cancel(ctx context.Context, id string) (EmailTask, error) {
+	var payload []byte
+	err := q.db.QueryRowContext(ctx, `
+		UPDATE email_tasks SET status = 'cancelled', updated_at = now()
+		WHERE id = $1 AND status = 'queued'
+		RETURNING payload`, id).Scan(&payload)
+	if err == sql.ErrNoRows {
+		return EmailTask{}, errTaskNotFound
+	}
+	if err != nil {
+		return EmailTask{}, err
+	}
+
+	var task EmailTask
+	if err := json.Unmarshal(payload, &task); err != nil {
+		return EmailTask{}, fmt.Errorf("decode task %s: %w", id, err)
+	}
+	return task, nil
+}
+
+// Lookup finds rows that are queued, scheduled or being worked on.
+func (q *PostgresQueue) Lookup(ctx context.Context, id string) (EmailTask, error) {
+	var payload []byte
+	err := q.db.QueryRowContext(ctx,
+		`SELECT payload FROM email_tasks WHERE id = $1 AND status IN ('queued', 'processing')`, id).Scan(&payload)
+	if err == sql.ErrNoRows {
+		return EmailTask{}, errTaskNotFound
+	}
+	if err != nil {
+		return EmailTask{}, err
+	}
+
+	var task EmailTask
+	if err := json.Unmarshal(payload, &task); err != nil {
+		return EmailTask{}, fmt.Errorf("decode task %s: %w", id, err)
+	}
+	return task, nil
+}
+
+func (q *PostgresQueue) Purge(ctx context.Context) ([]EmailTask, error) {
+	rows, err := q.db.QueryContext(ctx, `
+		UPDATE email_tasks SET status = 'cancelled', updated_at = now()
+		WHERE status = 'queued'
+		RETURNING id, payload`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []EmailTask
+	for rows.Next() {
+		var id string
+		var payload []byte
+		if err := rows.Scan(&id, &payload); err != nil {
+			return tasks, err
+		}
+		var task EmailTask
+		if err := json.Unmarshal(payload, &task); err != nil {
+			slog.Error("Failed to decode purged task", "task_id", id, "error", err)
+			task = EmailTask{ID: id}
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+// Len counts every queued or claimed row, scheduled rows and retries
+// waiting out a backoff included. Capacity is checked against it.
+func (q *PostgresQueue) Len() int {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var n int
+	if err := q.db.QueryRowContext(ctx,
+		`SELECT count(*) FROM email_tasks WHERE status IN ('queued', 'processing')`).Scan(&n); err != nil {
+		slog.Error("Failed to count queued tasks", "error", err)
+	}
+	return n
+}
+
+// Ready counts rows that are claimable now or being worked on. Scheduled
+// rows, the ones a hold keeps back and retries waiting out a backoff are
+// left out.
+func (q *PostgresQueue) Ready() int {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var n int
+	if err := q.db.QueryRowContext(ctx, `
+		SELECT count(*) FROM email_tasks
+		WHERE (status = 'queued' AND available_at <= now()
+		       AND NOT (attempts = 0 AND coalesce((payload->>'send_at')::timestamptz > $1::timestamptz, false)))
+		   OR status = 'processing'`, q.hold.Load()).Scan(&n); err != nil {
+		slog.Error("Failed to count ready tasks", "error", err)
+	}
+	return n
+}
+
+func (q *PostgresQueue) Cap() int {
+	return q.capacity
+}
+
+func (q *PostgresQueue) Close() error {
+	return q.db.Close()
+}
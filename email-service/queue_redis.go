@@ -0,0 +1,624 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// promoteDueScript moves delayed tasks whose time has come into the stream.
+// Running it as a script keeps replicas from promoting the same task twice.
+// ARGV[2], when not 0, is the start of a hold: scheduled sends due after it
+// stay put, while retries due after it are still promoted.
+var promoteDueScript = redis.NewScript(`
+local now, hold = tonumber(ARGV[1]), tonumber(ARGV[2])
+local upto = now
+if hold > 0 and hold < now then
+	upto = hold
+end
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', upto, 'LIMIT', 0, 100)
+for _, payload in ipairs(due) do
+	redis.call('XADD', KEYS[2], '*', 'task', payload)
+	redis.call('ZREM', KEYS[1], payload)
+end
+local promoted = #due
+if upto < now then
+	for _, payload in ipairs(redis.call('ZRANGEBYSCORE', KEYS[1], '(' .. upto, now)) do
+		local task = cjson.decode(payload)
+		if task.attempts ~= 0 or task.send_at == nil then
+			redis.call('XADD', KEYS[2], '*', 'task', payload)
+			redis.call('ZREM', KEYS[1], payload)
+			promoted = promoted + 1
+		end
+	end
+end
+return promoted
+`)
+
+// settleScript acknowledges and deletes a stream entry, after storing the
+// task in the dead letter hash or the delayed set if ARGV[5] asks for it, but
+// only while the entry is still pending for this consumer with the delivery
+// count it was claimed with. XAUTOCLAIM bumps the count, so a worker whose
+// entry was reclaimed, even by another worker in the same process, gets 0
+// back and leaves the entry to its new owner.
+var settleScript = redis.NewScript(`
+local p = redis.call('XPENDING', KEYS[1], ARGV[1], ARGV[2], ARGV[2], 1)
+if #p == 0 or p[1][2] ~= ARGV[3] or p[1][4] ~= tonumber(ARGV[4]) then
+	return 0
+end
+if ARGV[5] == 'hset' then
+	redis.call('HSET', KEYS[2], ARGV[6], ARGV[7])
+elseif ARGV[5] == 'zadd' then
+	redis.call('ZADD', KEYS[2], ARGV[6], ARGV[7])
+end
+redis.call('XACK', KEYS[1], ARGV[1], ARGV[2])
+redis.call('XDEL', KEYS[1], ARGV[2])
+return 1
+`)
+
+// RedisQueue keeps a stream and a delayed set per priority level. Normal
+// priority uses the unsuffixed keys so queues created before priorities
+// existed keep draining.
+type RedisQueue struct {
+	client            *redis.Client
+	streams           [3]string
+	delayed           [3]string
+	failed            string
+	group             string
+	consumer          string
+	capacity          int
+	visibilityTimeout time.Duration
+	hold              atomic.Int64
+}
+
+func NewRedisQueue(addr, password, prefix string, capacity int, visibilityTimeout time.Duration) (*RedisQueue, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: password,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("ping redis: %w", err)
+	}
+
+	q := &RedisQueue{
+		client:            client,
+		failed:            prefix + ":failed",
+		group:             prefix + "-workers",
+		consumer:          consumerName(),
+		capacity:          capacity,
+		visibilityTimeout: visibilityTimeout,
+	}
+
+	for i, priority := range priorities {
+		suffix := ""
+		if priority != PriorityNormal {
+			suffix = ":" + priority
+		}
+		q.streams[i] = prefix + ":tasks" + suffix
+		q.delayed[i] = prefix + ":delayed" + suffix
+
+		err := client.XGroupCreateMkStream(ctx, q.streams[i], q.group, "0").Err()
+		if err != nil && !redis.HasErrorPrefix(err, "BUSYGROUP") {
+			client.Close()
+			return nil, fmt.Errorf("create consumer group: %w", err)
+		}
+	}
+
+	return q, nil
+}
+
+func consumerName() string {
+	host, _ := os.Hostname()
+	return host + "-" + strconv.Itoa(os.Getpid())
+}
+
+func (q *RedisQueue) Enqueue(ctx context.Context, task EmailTask) error {
+	if q.Len() >= q.capacity {
+		return errQueueFull
+	}
+
+	payload, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	return q.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: q.streams[priorityRank(task.Priority)],
+		Values: map[string]any{"task": payload},
+	}).Err()
+}
+
+func (q *RedisQueue) EnqueueBatch(ctx context.Context, tasks []EmailTask) error {
+	if q.Len()+len(tasks) > q.capacity {
+		return errQueueFull
+	}
+
+	pipe := q.client.TxPipeline()
+	for _, task := range tasks {
+		payload, err := json.Marshal(task)
+		if err != nil {
+			return err
+		}
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: q.streams[priorityRank(task.Priority)],
+			Values: map[string]any{"task": payload},
+		})
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Schedule parks the task in the delayed set with its send time as the
+// score; Dequeue promotes it to the stream once it is due.
+func (q *RedisQueue) Schedule(ctx context.Context, task EmailTask) error {
+	if q.Len() >= q.capacity {
+		return errQueueFull
+	}
+
+	payload, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	return q.client.ZAdd(ctx, q.delayed[priorityRank(task.Priority)], redis.Z{
+		Score:  float64(task.SendAt.Unix()),
+		Member: payload,
+	}).Err()
+}
+
+// Scheduled lists delayed entries whose send_at is still ahead, plus the
+// ones a hold keeps back, which leaves out retries waiting out a backoff.
+func (q *RedisQueue) Scheduled(ctx context.Context) ([]EmailTask, error) {
+	now := time.Now()
+	from := now
+	if hold := q.hold.Load(); hold > 0 && hold < now.Unix() {
+		from = time.Unix(hold, 0)
+	}
+	var tasks []EmailTask
+	for i := range q.delayed {
+		members, err := q.client.ZRangeByScore(ctx, q.delayed[i], &redis.ZRangeBy{
+			Min: strconv.FormatInt(from.Unix(), 10),
+			Max: "+inf",
+		}).Result()
+		if err != nil {
+			return tasks, err
+		}
+		for _, member := range members {
+			var task EmailTask
+			if err := json.Unmarshal([]byte(member), &task); err != nil {
+				slog.Error("Failed to decode scheduled task", "error", err)
+				continue
+			}
+			if task.SendAt.After(now) || (task.Attempts == 0 && task.SendAt.After(from)) {
+				tasks = append(tasks, task)
+			}
+		}
+	}
+	return tasks, nil
+}
+
+// Hold stops Dequeue from promoting scheduled sends due after since; a zero
+// since lifts the hold. Retries are still promoted.
+func (q *RedisQueue) Hold(since time.Time) {
+	if since.IsZero() {
+		q.hold.Store(0)
+		return
+	}
+	q.hold.Store(since.Unix())
+}
+
+// Dequeue first reclaims entries left pending by consumers that stopped
+// acknowledging them within the visibility timeout, then reads new entries.
+// Streams are checked from the highest priority down; only when all are empty
+// does it block on all of them at once.
+func (q *RedisQueue) Dequeue(ctx context.Context) (EmailTask, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return EmailTask{}, err
+		}
+
+		for i := range q.streams {
+			if err := promoteDueScript.Run(ctx, q.client,
+				[]string{q.delayed[i], q.streams[i]}, time.Now().Unix(), q.hold.Load()).Err(); err != nil && !errors.Is(err, redis.Nil) {
+				slog.Error("Failed to promote delayed tasks", "error", err)
+			}
+		}
+
+		for _, stream := range q.streams {
+			claimed, _, err := q.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+				Stream:   stream,
+				Group:    q.group,
+				Consumer: q.consumer,
+				MinIdle:  q.visibilityTimeout,
+				Start:    "0",
+				Count:    1,
+			}).Result()
+			if err == nil && len(claimed) > 0 {
+				pending, err := q.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+					Stream: stream,
+					Group:  q.group,
+					Start:  claimed[0].ID,
+					End:    claimed[0].ID,
+					Count:  1,
+				}).Result()
+				if err != nil || len(pending) == 0 {
+					slog.Error("Failed to read reclaimed entry", "id", claimed[0].ID, "error", err)
+					continue
+				}
+				return q.decode(stream, claimed[0], pending[0].RetryCount)
+			}
+
+			ready, err := q.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+				Group:    q.group,
+				Consumer: q.consumer,
+				Streams:  []string{stream, ">"},
+				Count:    1,
+				Block:    -1,
+			}).Result()
+			if err == nil && len(ready) > 0 && len(ready[0].Messages) > 0 {
+				return q.decode(stream, ready[0].Messages[0], 1)
+			}
+		}
+
+		streams, err := q.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    q.group,
+			Consumer: q.consumer,
+			Streams:  append(q.streams[:], ">", ">", ">"),
+			Count:    1,
+			Block:    time.Second,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return EmailTask{}, ctx.Err()
+			}
+			slog.Error("Failed to read from stream", "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				return q.decode(stream.Stream, msg, 1)
+			}
+		}
+	}
+}
+
+// decode turns a claimed entry into a task whose receipt is the entry ID and
+// the delivery count it was claimed with, which settle checks.
+func (q *RedisQueue) decode(stream string, msg redis.XMessage, deliveries int64) (EmailTask, error) {
+	raw, _ := msg.Values["task"].(string)
+
+	var task EmailTask
+	if err := json.Unmarshal([]byte(raw), &task); err != nil {
+		q.client.XAck(context.Background(), stream, q.group, msg.ID)
+		return EmailTask{}, fmt.Errorf("decode stream entry %s: %w", msg.ID, err)
+	}
+	task.receipt = msg.ID + "/" + strconv.FormatInt(deliveries, 10)
+	return task, nil
+}
+
+// settle runs settleScript for the task's entry, with op and its arguments
+// applied to key first. It returns errLeaseLost if the entry was reclaimed.
+func (q *RedisQueue) settle(ctx context.Context, task EmailTask, key, op string, args ...any) error {
+	if task.receipt == "" {
+		return nil
+	}
+	id, deliveries, _ := strings.Cut(task.receipt, "/")
+	stream := q.streams[priorityRank(task.Priority)]
+	if key == "" {
+		key = stream
+	}
+	settled, err := settleScript.Run(ctx, q.client, []string{stream, key},
+		append([]any{q.group, id, q.consumer, deliveries, op}, args...)...).Int()
+	if err != nil {
+		return err
+	}
+	if settled == 0 {
+		return errLeaseLost
+	}
+	return nil
+}
+
+func (q *RedisQueue) Complete(ctx context.Context, task EmailTask) error {
+	return q.settle(ctx, task, "", "")
+}
+
+func (q *RedisQueue) Fail(ctx context.Context, task EmailTask, cause error) error {
+	task.LastError = cause.Error()
+	payload, err := json.Marshal(DeadLetter{Task: task, Error: task.LastError, FailedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	return q.settle(ctx, task, q.failed, "hset", task.ID, payload)
+}
+
+// decodeDeadLetter also reads entries written before Fail stored the failure
+// time, which hold just the task.
+func decodeDeadLetter(raw string) (DeadLetter, error) {
+	var item DeadLetter
+	if err := json.Unmarshal([]byte(raw), &item); err == nil && item.Task.ID != "" {
+		return item, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &item.Task); err != nil {
+		return DeadLetter{}, err
+	}
+	item.Error = item.Task.LastError
+	return item, nil
+}
+
+func (q *RedisQueue) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	entries, err := q.client.HGetAll(ctx, q.failed).Result()
+	if err != nil {
+		return nil, err
+	}
+	items := make([]DeadLetter, 0, len(entries))
+	for id, raw := range entries {
+		item, err := decodeDeadLetter(raw)
+		if err != nil {
+			slog.Error("Failed to decode dead letter", "task_id", id, "error", err)
+			item.Task.ID = id
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Requeue removes the task from the failed hash before adding it to the
+// stream, so two replicas retrying it at once can't both send it. If the
+// stream rejects it, it goes back into the hash.
+func (q *RedisQueue) Requeue(ctx context.Context, id string) (EmailTask, error) {
+	raw, err := q.client.HGet(ctx, q.failed, id).Result()
+	if errors.Is(err, redis.Nil) {
+		return EmailTask{}, errTaskNotFound
+	}
+	if err != nil {
+		return EmailTask{}, err
+	}
+	item, err := decodeDeadLetter(raw)
+	if err != nil {
+		return EmailTask{}, fmt.Errorf("decode task %s: %w", id, err)
+	}
+
+	removed, err := q.client.HDel(ctx, q.failed, id).Result()
+	if err != nil {
+		return EmailTask{}, err
+	}
+	if removed == 0 {
+		return EmailTask{}, errTaskNotFound
+	}
+
+	task := item.Task
+	resetDeadLetter(&task)
+	if err := q.Enqueue(ctx, task); err != nil {
+		if restoreErr := q.client.HSet(ctx, q.failed, id, raw).Err(); restoreErr != nil {
+			slog.Error("Failed to restore dead letter", "task_id", id, "error", restoreErr)
+		}
+		return EmailTask{}, err
+	}
+	return task, nil
+}
+
+func (q *RedisQueue) Retry(ctx context.Context, task EmailTask, at time.Time) error {
+	receipt := task.receipt
+	task.receipt = ""
+	payload, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	task.receipt = receipt
+	return q.settle(ctx, task, q.delayed[priorityRank(task.Priority)], "zadd", at.Unix(), payload)
+}
+
+// Cancel looks for the task among delayed retries and undelivered stream
+// entries. Entries already delivered to a consumer are being worked on and
+// are left alone.
+func (q *RedisQueue) Cancel(ctx context.Context, id string) (EmailTask, error) {
+	for i := range q.streams {
+		members, err := q.client.ZRange(ctx, q.delayed[i], 0, -1).Result()
+		if err != nil {
+			return EmailTask{}, err
+		}
+		for _, member := range members {
+			var task EmailTask
+			if json.Unmarshal([]byte(member), &task) != nil || task.ID != id {
+				continue
+			}
+			removed, err := q.client.ZRem(ctx, q.delayed[i], member).Result()
+			if err != nil {
+				return EmailTask{}, err
+			}
+			if removed == 1 {
+				return task, nil
+			}
+		}
+
+		entries, err := q.client.XRange(ctx, q.streams[i], "-", "+").Result()
+		if err != nil {
+			return EmailTask{}, err
+		}
+		for _, entry := range entries {
+			raw, _ := entry.Values["task"].(string)
+			var task EmailTask
+			if json.Unmarshal([]byte(raw), &task) != nil || task.ID != id {
+				continue
+			}
+			delivered, err := q.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+				Stream: q.streams[i],
+				Group:  q.group,
+				Start:  entry.ID,
+				End:    entry.ID,
+				Count:  1,
+			}).Result()
+			if err != nil {
+				return EmailTask{}, err
+			}
+			if len(delivered) > 0 {
+				return EmailTask{}, errTaskNotFound
+			}
+			if err := q.client.XDel(ctx, q.streams[i], entry.ID).Err(); err != nil {
+				return EmailTask{}, err
+			}
+			return task, nil
+		}
+	}
+	return EmailTask{}, errTaskNotFound
+}
+
+// Lookup scans the delayed sets and the streams, like Cancel, but also
+// finds entries a consumer holds.
+func (q *RedisQueue) Lookup(ctx context.Context, id string) (EmailTask, error) {
+	for i := range q.streams {
+		members, err := q.client.ZRange(ctx, q.delayed[i], 0, -1).Result()
+		if err != nil {
+			return EmailTask{}, err
+		}
+		for _, member := range members {
+			var task EmailTask
+			if json.Unmarshal([]byte(member), &task) == nil && task.ID == id {
+				return task, nil
+			}
+		}
+
+		entries, err := q.client.XRange(ctx, q.streams[i], "-", "+").Result()
+		if err != nil {
+			return EmailTask{}, err
+		}
+		for _, entry := range entries {
+			raw, _ := entry.Values["task"].(string)
+			var task EmailTask
+			if json.Unmarshal([]byte(raw), &task) == nil && task.ID == id {
+				return task, nil
+			}
+		}
+	}
+	return EmailTask{}, errTaskNotFound
+}
+
+// Purge empties the delayed sets and removes stream entries that no consumer
+// has been handed yet, mirroring Cancel.
+func (q *RedisQueue) Purge(ctx context.Context) ([]EmailTask, error) {
+	var tasks []EmailTask
+	decode := func(raw string) {
+		var task EmailTask
+		if err := json.Unmarshal([]byte(raw), &task); err != nil {
+			slog.Error("Failed to decode purged task", "error", err)
+			return
+		}
+		tasks = append(tasks, task)
+	}
+
+	for i := range q.streams {
+		var members *redis.StringSliceCmd
+		_, err := q.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			members = pipe.ZRange(ctx, q.delayed[i], 0, -1)
+			pipe.Del(ctx, q.delayed[i])
+			return nil
+		})
+		if err != nil {
+			return tasks, err
+		}
+		for _, member := range members.Val() {
+			decode(member)
+		}
+
+		entries, err := q.client.XRange(ctx, q.streams[i], "-", "+").Result()
+		if err != nil {
+			return tasks, err
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		delivered := make(map[string]bool)
+		pending, err := q.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: q.streams[i],
+			Group:  q.group,
+			Start:  "-",
+			End:    "+",
+			Count:  int64(len(entries)),
+		}).Result()
+		if err != nil {
+			return tasks, err
+		}
+		for _, p := range pending {
+			delivered[p.ID] = true
+		}
+
+		var ids []string
+		for _, entry := range entries {
+			if delivered[entry.ID] {
+				continue
+			}
+			ids = append(ids, entry.ID)
+			raw, _ := entry.Values["task"].(string)
+			decode(raw)
+		}
+		if len(ids) > 0 {
+			if err := q.client.XDel(ctx, q.streams[i], ids...).Err(); err != nil {
+				return tasks, err
+			}
+		}
+	}
+	return tasks, nil
+}
+
+// Len counts everything the queue holds: stream entries, delivered or not,
+// and the delayed sets with scheduled sends and retries waiting out a
+// backoff. Capacity is checked against it.
+func (q *RedisQueue) Len() int {
+	return q.count(true)
+}
+
+// Ready counts stream entries only, the work that can be picked up now or is
+// being worked on.
+func (q *RedisQueue) Ready() int {
+	return q.count(false)
+}
+
+func (q *RedisQueue) count(delayed bool) int {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	pipe := q.client.Pipeline()
+	var counts []*redis.IntCmd
+	for i := range q.streams {
+		counts = append(counts, pipe.XLen(ctx, q.streams[i]))
+		if delayed {
+			counts = append(counts, pipe.ZCard(ctx, q.delayed[i]))
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("Failed to read queue length", "error", err)
+		return 0
+	}
+	var n int64
+	for _, c := range counts {
+		n += c.Val()
+	}
+	return int(n)
+}
+
+func (q *RedisQueue) Cap() int {
+	return q.capacity
+}
+
+func (q *RedisQueue) Close() error {
+	return q.client.Close()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func dequeueWithin(t *testing.T, q TaskQueue, d time.Duration) (EmailTask, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return q.Dequeue(ctx)
+}
+
+func TestMemoryQueue(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		run     func(q *MemoryQueue) error
+		want    []string
+		wantLen int
+	}{
+		{
+			name: "priority order",
+			run: func(q *MemoryQueue) error {
+				for _, task := range []EmailTask{
+					{ID: "low", Priority: PriorityLow},
+					{ID: "normal", Priority: PriorityNormal},
+					{ID: "high", Priority: PriorityHigh},
+				} {
+					if err := q.Enqueue(ctx, task); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			want: []string{"high", "normal", "low"},
+		},
+		{
+			name: "cancelled task is skipped",
+			run: func(q *MemoryQueue) error {
+				q.Enqueue(ctx, EmailTask{ID: "a"})
+				q.Enqueue(ctx, EmailTask{ID: "b"})
+				_, err := q.Cancel(ctx, "a")
+				return err
+			},
+			want: []string{"b"},
+		},
+		{
+			name: "purge drops waiting tasks",
+			run: func(q *MemoryQueue) error {
+				q.Enqueue(ctx, EmailTask{ID: "a"})
+				q.Enqueue(ctx, EmailTask{ID: "b"})
+				tasks, err := q.Purge(ctx)
+				if len(tasks) != 2 {
+					return errors.New("purge did not return both tasks")
+				}
+				return err
+			},
+		},
+		{
+			name: "batch is all or nothing",
+			run: func(q *MemoryQueue) error {
+				err := q.EnqueueBatch(ctx, []EmailTask{{ID: "a"}, {ID: "b"}, {ID: "c"}})
+				if !errors.Is(err, errQueueFull) {
+					return errors.New("oversized batch was accepted")
+				}
+				return q.EnqueueBatch(ctx, []EmailTask{{ID: "a"}, {ID: "b"}})
+			},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "retry waits out its delay",
+			run: func(q *MemoryQueue) error {
+				return q.Retry(ctx, EmailTask{ID: "later", Attempts: 1}, time.Now().Add(time.Hour))
+			},
+			wantLen: 1,
+		},
+		{
+			name: "due retry is delivered",
+			run: func(q *MemoryQueue) error {
+				return q.Retry(ctx, EmailTask{ID: "now", Attempts: 1}, time.Now())
+			},
+			want: []string{"now"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewMemoryQueue(2)
+			defer q.Close()
+			if err := tt.run(q); err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				task, err := dequeueWithin(t, q, time.Second)
+				if err != nil {
+					t.Fatalf("Dequeue: %v, want %s", err, want)
+				}
+				if task.ID != want {
+					t.Errorf("Dequeue = %s, want %s", task.ID, want)
+				}
+			}
+			if task, err := dequeueWithin(t, q, 20*time.Millisecond); err == nil {
+				t.Errorf("Dequeue = %s, want nothing left", task.ID)
+			}
+			if n := q.Len(); n != tt.wantLen {
+				t.Errorf("Len = %d, want %d", n, tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestMemoryQueueFull(t *testing.T) {
+	q := NewMemoryQueue(1)
+	defer q.Close()
+	ctx := context.Background()
+	if err := q.Enqueue(ctx, EmailTask{ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue(ctx, EmailTask{ID: "b"}); !errors.Is(err, errQueueFull) {
+		t.Errorf("Enqueue past capacity = %v, want errQueueFull", err)
+	}
+	if err := q.Enqueue(ctx, EmailTask{ID: "c", Priority: PriorityHigh}); err != nil {
+		t.Errorf("Enqueue at another priority = %v, want nil", err)
+	}
+	q.Close()
+	if err := q.Enqueue(ctx, EmailTask{ID: "d"}); !errors.Is(err, errQueueClosed) {
+		t.Errorf("Enqueue after Close = %v, want errQueueClosed", err)
+	}
+}
+
+type rowsAffected int64
+
+func (n rowsAffected) LastInsertId() (int64, error) { return 0, nil }
+func (n rowsAffected) RowsAffected() (int64, error) { return int64(n), nil }
+
+func TestSettle(t *testing.T) {
+	failed := errors.New("connection reset")
+	tests := []struct {
+		name string
+		res  sql.Result
+		err  error
+		want error
+	}{
+		{"lease held", rowsAffected(1), nil, nil},
+		{"lease lost", rowsAffected(0), nil, errLeaseLost},
+		{"query failed", nil, failed, failed},
+	}
+	for _, tt := range tests {
+		if err := settle(tt.res, tt.err); !errors.Is(err, tt.want) {
+			t.Errorf("%s: settle = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+// A task reclaimed after its worker stalled comes back with the abandoned
+// run counted; once that uses up its attempts it goes to the dead letters
+// without being run again.
+func TestRunTaskReclaimedOutOfAttempts(t *testing.T) {
+	s := &EmailService{
+		ctx:     context.Background(),
+		queue:   NewMemoryQueue(1),
+		retry:   RetryPolicy{MaxAttempts: 2, Timeout: time.Second},
+		dlq:     NewDeadLetterQueue(nil),
+		history: NewStatusTracker(10),
+	}
+	s.runTask(EmailTask{ID: "stuck", Type: "unknown", Attempts: 2}, 1)
+
+	item, ok := s.dlq.Take("stuck")
+	if !ok {
+		t.Fatal("reclaimed task out of attempts was not dead-lettered")
+	}
+	if item.Task.Attempts != 2 || item.Error != errAbandoned.Error() {
+		t.Errorf("dead letter = %d attempts, %q; want 2 attempts, %q", item.Task.Attempts, item.Error, errAbandoned)
+	}
+	if status, _ := s.history.Get("stuck"); status.Status != StatusFailed {
+		t.Errorf("status = %s, want %s", status.Status, StatusFailed)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type RateLimitedError struct {
+	Key        string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("rate limit reached for %s, retry in %v", e.Key, e.RetryAfter.Round(time.Second))
+}
+
+type slidingWindow struct {
+	limit  int
+	window time.Duration
+	mu     sync.Mutex
+	events map[string][]time.Time
+}
+
+func newSlidingWindow(limit int, window time.Duration) *slidingWindow {
+	return &slidingWindow{
+		limit:  limit,
+		window: window,
+		events: make(map[string][]time.Time),
+	}
+}
+
+func (w *slidingWindow) prune(key string, now time.Time) []time.Time {
+	events := w.events[key]
+	cutoff := now.Add(-w.window)
+	i := 0
+	for i < len(events) && !events[i].After(cutoff) {
+		i++
+	}
+	events = events[i:]
+	if len(events) == 0 {
+		delete(w.events, key)
+	} else {
+		w.events[key] = events
+	}
+	return events
+}
+
+func (w *slidingWindow) wait(key string, now time.Time) time.Duration {
+	if w.limit <= 0 {
+		return 0
+	}
+	events := w.prune(key, now)
+	if len(events) < w.limit {
+		return 0
+	}
+	return events[0].Add(w.window).Sub(now)
+}
+
+func (w *slidingWindow) record(key string, now time.Time) {
+	if w.limit <= 0 {
+		return
+	}
+	w.events[key] = append(w.events[key], now)
+}
+
+// RateLimiter throttles deliveries per recipient address and per recipient
+// domain. A zero limit disables the corresponding check.
+type RateLimiter struct {
+	mu        sync.Mutex
+	recipient *slidingWindow
+	domain    *slidingWindow
+}
+
+func NewRateLimiter(perRecipient int, recipientWindow time.Duration, perDomain int, domainWindow time.Duration) *RateLimiter {
+	return &RateLimiter{
+		recipient: newSlidingWindow(perRecipient, recipientWindow),
+		domain:    newSlidingWindow(perDomain, domainWindow),
+	}
+}
+
+// Reserve records a send to every recipient, or none of them if any limit is
+// reached, in which case the returned error says how long to defer the task.
+func (l *RateLimiter) Reserve(recipients []string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for _, rcpt := range recipients {
+		addr := strings.ToLower(rcpt)
+		if d := l.recipient.wait(addr, now); d > 0 {
+			return &RateLimitedError{Key: addr, RetryAfter: d}
+		}
+		domain := emailDomain(addr)
+		if d := l.domain.wait(domain, now); d > 0 {
+			return &RateLimitedError{Key: domain, RetryAfter: d}
+		}
+	}
+
+	for _, rcpt := range recipients {
+		addr := strings.ToLower(rcpt)
+		l.recipient.record(addr, now)
+		l.domain.record(emailDomain(addr), now)
+	}
+	return nil
+}
+
+func emailDomain(addr string) string {
+	if at := strings.LastIndex(addr, "@"); at >= 0 {
+		return addr[at+1:]
+	}
+	return addr
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"slices"
+	"strings"
+
+	"github.com/m-tln/notes/logging"
+)
+
+// parseRecipients validates an explicit recipient list, dropping duplicates.
+func parseRecipients(list []string, limit int) ([]string, error) {
+	var recipients []string
+	for _, raw := range list {
+		addr, err := mail.ParseAddress(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid recipient %q", errInvalidRequest, raw)
+		}
+		if !slices.Contains(recipients, addr.Address) {
+			recipients = append(recipients, addr.Address)
+		}
+	}
+	if len(recipients) > limit {
+		return nil, fmt.Errorf("%w: %d recipients exceed the limit of %d", errInvalidRequest, len(recipients), limit)
+	}
+	return recipients, nil
+}
+
+// recipientList returns every address the task goes to.
+func (t EmailTask) recipientList() []string {
+	if len(t.Recipients) > 0 {
+		return t.Recipients
+	}
+	if t.Recipient != "" {
+		return []string{t.Recipient}
+	}
+	return nil
+}
+
+// sendToRecipients fans a note out to every address of a multi-recipient
+// task, delivering and tracking each one on its own. Addresses that were sent
+// to or rejected for good are remembered on the task, so a retry only goes to
+// the ones that failed temporarily.
+func (s *EmailService) sendToRecipients(ctx context.Context, task *EmailTask, note Note, attachments []Attachment) error {
+	logger := logging.FromContext(ctx)
+	var transient []error
+	for _, rcpt := range task.Recipients {
+		if slices.Contains(task.Delivered, rcpt) || slices.Contains(task.Rejected, rcpt) {
+			continue
+		}
+
+		err := s.sendNote(ctx, *task, note, rcpt, attachments)
+		var limited *RateLimitedError
+		switch {
+		case err == nil:
+			task.Delivered = append(task.Delivered, rcpt)
+			s.history.RecordRecipient(task.ID, rcpt, StatusSent, task.Attempts, nil)
+			logger.Info("Sent email", "recipient", rcpt, "provider", s.sender.Name(), "title", note.Title)
+		case errors.As(err, &limited):
+			// The whole task is deferred; the remaining addresses wait with it.
+			s.history.RecordRecipient(task.ID, rcpt, StatusDeferred, task.Attempts, err)
+			return err
+		case IsPermanent(err):
+			task.Rejected = append(task.Rejected, rcpt)
+			s.history.RecordRecipient(task.ID, rcpt, StatusFailed, task.Attempts, err)
+			logger.Warn("Recipient rejected", "recipient", rcpt, "error", err)
+		default:
+			s.history.RecordRecipient(task.ID, rcpt, StatusRetrying, task.Attempts, err)
+			transient = append(transient, fmt.Errorf("%s: %w", rcpt, err))
+		}
+	}
+
+	if len(transient) > 0 {
+		return &SendError{
+			Provider: s.sender.Name(),
+			Err:      fmt.Errorf("%d of %d recipients failed: %w", len(transient)+len(task.Rejected), len(task.Recipients), errors.Join(transient...)),
+		}
+	}
+	if len(task.Rejected) > 0 {
+		return &SendError{
+			Provider:  s.sender.Name(),
+			Permanent: true,
+			Err:       fmt.Errorf("%d of %d recipients rejected: %s", len(task.Rejected), len(task.Recipients), strings.Join(task.Rejected, ", ")),
+		}
+	}
+	return nil
+}
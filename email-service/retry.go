@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	BackoffExponential = "exponential"
+	BackoffLinear      = "linear"
+	BackoffFixed       = "fixed"
+)
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Timeout     time.Duration
+	Strategy    string
+}
+
+// RetryLimits bound what a single request may ask for in RetryOverride.
+type RetryLimits struct {
+	MaxAttempts int
+	MaxTimeout  time.Duration
+}
+
+// RetryOverride lets a request change the retry policy of its own tasks, so
+// an urgent reminder can keep trying longer than a digest. Zero fields keep
+// the service default.
+type RetryOverride struct {
+	MaxAttempts      int    `json:"max_attempts,omitempty"`
+	TimeoutSeconds   int    `json:"timeout_seconds,omitempty"`
+	Backoff          string `json:"backoff,omitempty"`
+	BaseDelaySeconds int    `json:"base_delay_seconds,omitempty"`
+}
+
+func (o *RetryOverride) validate(limits RetryLimits) error {
+	if o == nil {
+		return nil
+	}
+	switch {
+	case o.MaxAttempts < 0 || o.MaxAttempts > limits.MaxAttempts:
+		return fmt.Errorf("%w: max_attempts must be between 1 and %d", errInvalidRequest, limits.MaxAttempts)
+	case o.TimeoutSeconds < 0 || time.Duration(o.TimeoutSeconds)*time.Second > limits.MaxTimeout:
+		return fmt.Errorf("%w: timeout_seconds must be at most %d", errInvalidRequest, int(limits.MaxTimeout.Seconds()))
+	case o.BaseDelaySeconds < 0:
+		return fmt.Errorf("%w: base_delay_seconds must not be negative", errInvalidRequest)
+	}
+	if o.Backoff != "" && !validBackoff(o.Backoff) {
+		return fmt.Errorf("%w: unknown backoff %q", errInvalidRequest, o.Backoff)
+	}
+	return nil
+}
+
+func validBackoff(name string) bool {
+	switch name {
+	case BackoffExponential, BackoffLinear, BackoffFixed:
+		return true
+	}
+	return false
+}
+
+// With applies the override. The base delay can't exceed the service's
+// MaxDelay, which keeps every retry within the server-side bound.
+func (p RetryPolicy) With(o *RetryOverride) RetryPolicy {
+	if o == nil {
+		return p
+	}
+	if o.MaxAttempts > 0 {
+		p.MaxAttempts = o.MaxAttempts
+	}
+	if o.TimeoutSeconds > 0 {
+		p.Timeout = time.Duration(o.TimeoutSeconds) * time.Second
+	}
+	if o.Backoff != "" {
+		p.Strategy = o.Backoff
+	}
+	if o.BaseDelaySeconds > 0 {
+		p.BaseDelay = min(time.Duration(o.BaseDelaySeconds)*time.Second, p.MaxDelay)
+	}
+	return p
+}
+
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	switch p.Strategy {
+	case BackoffFixed:
+	case BackoffLinear:
+		delay = p.BaseDelay * time.Duration(max(attempt, 1))
+	default:
+		for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+			delay *= 2
+		}
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	jitter := time.Duration(rand.Int64N(int64(delay)/5 + 1))
+	return delay + jitter
+}
+
+type DeadLetter struct {
+	Task     EmailTask `json:"task"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// DeadLetterStore is implemented by queue backends that keep failed tasks
+// themselves, so the dead-letter queue survives a restart and is shared by
+// every replica. Requeue moves a failed task back to the queue with a fresh
+// retry budget and returns it, or returns errTaskNotFound.
+type DeadLetterStore interface {
+	DeadLetters(ctx context.Context) ([]DeadLetter, error)
+	Requeue(ctx context.Context, id string) (EmailTask, error)
+}
+
+// DeadLetterQueue lists failed tasks from the queue backend when it is a
+// DeadLetterStore and keeps them in memory otherwise.
+type DeadLetterQueue struct {
+	mu    sync.Mutex
+	items map[string]DeadLetter
+	store DeadLetterStore
+}
+
+func NewDeadLetterQueue(store DeadLetterStore) *DeadLetterQueue {
+	return &DeadLetterQueue{items: make(map[string]DeadLetter), store: store}
+}
+
+// Add records a task that failed for good. A store already has it from
+// TaskQueue.Fail.
+func (q *DeadLetterQueue) Add(task EmailTask, err error) {
+	if q.store != nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items[task.ID] = DeadLetter{Task: task, Error: err.Error(), FailedAt: time.Now()}
+}
+
+func (q *DeadLetterQueue) Take(id string) (DeadLetter, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	item, ok := q.items[id]
+	if ok {
+		delete(q.items, id)
+	}
+	return item, ok
+}
+
+func (q *DeadLetterQueue) List(ctx context.Context) ([]DeadLetter, error) {
+	var items []DeadLetter
+	if q.store != nil {
+		var err error
+		if items, err = q.store.DeadLetters(ctx); err != nil {
+			return nil, err
+		}
+	} else {
+		q.mu.Lock()
+		items = make([]DeadLetter, 0, len(q.items))
+		for _, item := range q.items {
+			items = append(items, item)
+		}
+		q.mu.Unlock()
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].FailedAt.Before(items[j].FailedAt)
+	})
+	return items, nil
+}
+
+func (q *DeadLetterQueue) Len() int {
+	if q.store == nil {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return len(q.items)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	items, err := q.store.DeadLetters(ctx)
+	if err != nil {
+		slog.Error("Failed to count dead letters", "error", err)
+	}
+	return len(items)
+}
+
+// resetDeadLetter gives a failed task a fresh retry budget. Rejected
+// recipients get another chance; delivered ones are not resent.
+func resetDeadLetter(task *EmailTask) {
+	task.Attempts = 0
+	task.LastError = ""
+	task.Rejected = nil
+}
+
+func newTaskID() string {
+	b := make([]byte, 8)
+	cryptorand.Read(b)
+	return hex.EncodeToString(b)
+}
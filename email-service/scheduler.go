@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ScheduleStore is implemented by queue backends that can hold a task until
+// its SendAt, so scheduled sends survive a restart like queued ones. The
+// backend releases due tasks by itself, and its Cancel and Purge cover them.
+// Hold keeps tasks that come due after since from being released, until it
+// is called again with a zero time.
+type ScheduleStore interface {
+	Schedule(ctx context.Context, task EmailTask) error
+	Scheduled(ctx context.Context) ([]EmailTask, error)
+	Hold(since time.Time)
+}
+
+// Scheduler hands scheduled tasks to the queue backend when it is a
+// ScheduleStore and holds them in memory until they are due otherwise.
+type Scheduler struct {
+	mu      sync.Mutex
+	tasks   map[string]EmailTask
+	hold    time.Time
+	enqueue func(context.Context, EmailTask) error
+	history *StatusTracker
+	store   ScheduleStore
+}
+
+func NewScheduler(enqueue func(context.Context, EmailTask) error, history *StatusTracker, store ScheduleStore) *Scheduler {
+	return &Scheduler{
+		tasks:   make(map[string]EmailTask),
+		enqueue: enqueue,
+		history: history,
+		store:   store,
+	}
+}
+
+func (s *Scheduler) Add(ctx context.Context, task EmailTask) error {
+	if s.store != nil {
+		return s.store.Schedule(ctx, task)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks[task.ID] = task
+	return nil
+}
+
+// Cancel removes a task held in memory. Tasks in a ScheduleStore are
+// cancelled through the queue.
+func (s *Scheduler) Cancel(id string) (EmailTask, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task, ok := s.tasks[id]
+	if ok {
+		delete(s.tasks, id)
+	}
+	return task, ok
+}
+
+// Get returns a task held in memory. Tasks in a ScheduleStore are found
+// through the queue.
+func (s *Scheduler) Get(id string) (EmailTask, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task, ok := s.tasks[id]
+	return task, ok
+}
+
+func (s *Scheduler) List(ctx context.Context) ([]EmailTask, error) {
+	var tasks []EmailTask
+	if s.store != nil {
+		var err error
+		if tasks, err = s.store.Scheduled(ctx); err != nil {
+			return nil, err
+		}
+	} else {
+		tasks = s.held()
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].SendAt.Before(tasks[j].SendAt)
+	})
+	return tasks, nil
+}
+
+func (s *Scheduler) held() []EmailTask {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tasks := make([]EmailTask, 0, len(s.tasks))
+	for _, task := range s.tasks {
+		tasks = append(tasks, task)
+	}
+	return tasks
+}
+
+// Hold keeps tasks that come due after since from being released, so a
+// draining service isn't handed work it would refuse; a zero since lifts
+// the hold. With a ScheduleStore the backend does the holding.
+func (s *Scheduler) Hold(since time.Time) {
+	if s.store != nil {
+		s.store.Hold(since)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hold = since
+}
+
+func (s *Scheduler) Len() int {
+	if s.store == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.tasks)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	tasks, err := s.store.Scheduled(ctx)
+	if err != nil {
+		slog.Error("Failed to count scheduled tasks", "error", err)
+	}
+	return len(tasks)
+}
+
+func (s *Scheduler) Run(ctx context.Context) {
+	if s.store != nil {
+		return
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.releaseDue(ctx, now)
+		}
+	}
+}
+
+// releaseDue hands due tasks to the queue. A task that cannot be enqueued
+// (e.g. the queue is full) stays scheduled and is retried on the next tick.
+// Tasks due after the hold stay put.
+func (s *Scheduler) releaseDue(ctx context.Context, now time.Time) {
+	s.mu.Lock()
+	if !s.hold.IsZero() && s.hold.Before(now) {
+		now = s.hold
+	}
+	s.mu.Unlock()
+	tasks, _ := s.List(ctx)
+	for _, task := range tasks {
+		if task.SendAt.After(now) {
+			return
+		}
+		if _, ok := s.Cancel(task.ID); !ok {
+			continue
+		}
+		if err := s.enqueue(ctx, task); err != nil {
+			taskLogger(task, 0).Error("Failed to release scheduled task", "error", err)
+			s.history.Record(task, StatusScheduled, err)
+			s.Add(ctx, task)
+			return
+		}
+		taskLogger(task, 0).Info("Scheduled task released", "send_at", task.SendAt)
+	}
+}
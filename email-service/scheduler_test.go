@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSchedulerHoldsTasksWhileDraining(t *testing.T) {
+	var released []string
+	s := NewScheduler(func(ctx context.Context, task EmailTask) error {
+		released = append(released, task.ID)
+		return nil
+	}, NewStatusTracker(10), nil)
+
+	ctx := context.Background()
+	start := time.Now()
+	if err := s.Add(ctx, EmailTask{ID: "soon", Type: "send", SendAt: start.Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Hold(start)
+	for tick := range 3 {
+		s.releaseDue(ctx, start.Add(time.Duration(2+tick)*time.Minute))
+	}
+	if len(released) != 0 || s.Len() != 1 {
+		t.Fatalf("released %v while held, %d left; want none released, 1 left", released, s.Len())
+	}
+	if status, ok := s.history.Get("soon"); ok {
+		t.Errorf("held task got status %s, want no history", status.Status)
+	}
+
+	s.Hold(time.Time{})
+	s.releaseDue(ctx, start.Add(2*time.Minute))
+	if len(released) != 1 || s.Len() != 0 {
+		t.Errorf("released %v after the hold was lifted, %d left; want [soon], 0 left", released, s.Len())
+	}
+}
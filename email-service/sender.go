@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/m-tln/notes/config"
+	"github.com/m-tln/notes/logging"
+)
+
+type Message struct {
+	From        string
+	To          []string
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []Attachment
+	Unsubscribe string
+}
+
+type Sender interface {
+	Name() string
+	Send(ctx context.Context, msg Message) error
+	Close()
+}
+
+// SendError carries the provider's verdict on whether a failed send is worth
+// retrying. Errors that are not a *SendError are treated as transient.
+type SendError struct {
+	Provider  string
+	Permanent bool
+	Code      string
+	Err       error
+}
+
+func (e *SendError) Error() string {
+	kind := "transient"
+	if e.Permanent {
+		kind = "permanent"
+	}
+	if e.Code != "" {
+		return fmt.Sprintf("%s: %s error (%s): %v", e.Provider, kind, e.Code, e.Err)
+	}
+	return fmt.Sprintf("%s: %s error: %v", e.Provider, kind, e.Err)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+func IsPermanent(err error) bool {
+	var sendErr *SendError
+	return errors.As(err, &sendErr) && sendErr.Permanent
+}
+
+type LogSender struct{}
+
+func (LogSender) Name() string { return "log" }
+
+func (LogSender) Send(ctx context.Context, msg Message) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(100 * time.Millisecond):
+		logging.FromContext(ctx).Info("Email logged instead of sent", "provider", "log", "to", msg.To, "subject", msg.Subject)
+		return nil
+	}
+}
+
+func (LogSender) Close() {}
+
+func NewSenderFromEnv() (Sender, error) {
+	provider := config.String("EMAIL_PROVIDER", "")
+	if provider == "" {
+		provider = "log"
+		if config.String("SMTP_HOST", "") != "" {
+			provider = "smtp"
+		}
+	}
+
+	dkim, err := NewDKIMSignerFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	switch provider {
+	case "log":
+		return LogSender{}, nil
+	case "smtp":
+		return NewSMTPSender(SMTPConfig{
+			Host:        config.String("SMTP_HOST", ""),
+			Port:        config.String("SMTP_PORT", "587"),
+			Username:    config.String("SMTP_USERNAME", ""),
+			Password:    config.Secret("SMTP_PASSWORD", ""),
+			TLSMode:     config.String("SMTP_TLS", "starttls"),
+			MaxConns:    config.Int("SMTP_MAX_CONNS", 2),
+			IdleTimeout: config.Duration("SMTP_IDLE_TIMEOUT", 30*time.Second),
+			DKIM:        dkim,
+		})
+	case "sendgrid":
+		return NewSendGridSender(
+			config.Secret("SENDGRID_API_KEY", ""),
+			config.String("SENDGRID_ENDPOINT", "https://api.sendgrid.com/v3/mail/send"),
+		)
+	case "ses":
+		region := config.String("AWS_REGION", "us-east-1")
+		return NewSESSender(SESConfig{
+			Region:          region,
+			AccessKeyID:     config.String("AWS_ACCESS_KEY_ID", ""),
+			SecretAccessKey: config.Secret("AWS_SECRET_ACCESS_KEY", ""),
+			SessionToken:    config.Secret("AWS_SESSION_TOKEN", ""),
+			Endpoint:        config.String("SES_ENDPOINT", "https://email."+region+".amazonaws.com"),
+			DKIM:            dkim,
+		})
+	default:
+		return nil, fmt.Errorf("unknown EMAIL_PROVIDER %q", provider)
+	}
+}
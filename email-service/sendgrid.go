@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+type SendGridSender struct {
+	apiKey   string
+	endpoint string
+	client   *http.Client
+}
+
+func NewSendGridSender(apiKey, endpoint string) (*SendGridSender, error) {
+	if apiKey == "" {
+		return nil, fmt.Errorf("SENDGRID_API_KEY is required")
+	}
+	return &SendGridSender{
+		apiKey:   apiKey,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (s *SendGridSender) Name() string { return "sendgrid" }
+
+func (s *SendGridSender) Close() {}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridAttachment struct {
+	Content     []byte `json:"content"`
+	Type        string `json:"type"`
+	Filename    string `json:"filename"`
+	Disposition string `json:"disposition"`
+}
+
+type sendGridPersonalization struct {
+	To []sendGridAddress `json:"to"`
+}
+
+type sendGridRequest struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+	Attachments      []sendGridAttachment      `json:"attachments,omitempty"`
+	Headers          map[string]string         `json:"headers,omitempty"`
+}
+
+func (s *SendGridSender) Send(ctx context.Context, msg Message) error {
+	var to []sendGridAddress
+	for _, addr := range msg.To {
+		to = append(to, sendGridAddress{Email: addr})
+	}
+
+	payload := sendGridRequest{
+		Personalizations: []sendGridPersonalization{{To: to}},
+		From:             sendGridAddress{Email: msg.From},
+		Subject:          msg.Subject,
+		Content:          []sendGridContent{{Type: "text/plain", Value: plainText(msg)}},
+	}
+	if msg.HTML != "" {
+		payload.Content = append(payload.Content, sendGridContent{Type: "text/html", Value: msg.HTML})
+	}
+
+	if msg.Unsubscribe != "" {
+		payload.Headers = map[string]string{
+			"List-Unsubscribe":      "<" + msg.Unsubscribe + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		}
+	}
+
+	for _, a := range msg.Attachments {
+		payload.Attachments = append(payload.Attachments, sendGridAttachment{
+			Content:     a.Data,
+			Type:        a.ContentType,
+			Filename:    a.Filename,
+			Disposition: "attachment",
+		})
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return &SendError{Provider: s.Name(), Permanent: true, Err: err}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return &SendError{Provider: s.Name(), Permanent: true, Err: err}
+	}
+	req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return &SendError{Provider: s.Name(), Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return &SendError{
+		Provider:  s.Name(),
+		Permanent: !isTransientHTTPStatus(resp.StatusCode),
+		Code:      resp.Status,
+		Err:       fmt.Errorf("%s", bytes.TrimSpace(detail)),
+	}
+}
+
+func isTransientHTTPStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code == http.StatusRequestTimeout || code >= 500
+}
+
+// parseSendGridWebhookKey reads the verification key shown in the SendGrid
+// Signed Event Webhook settings: a base64 DER-encoded ECDSA public key.
+func parseSendGridWebhookKey(raw string) (*ecdsa.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, fmt.Errorf("decode SendGrid webhook key: %w", err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("parse SendGrid webhook key: %w", err)
+	}
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("SendGrid webhook key is not an ECDSA key")
+	}
+	return key, nil
+}
+
+// verifySendGridSignature checks the X-Twilio-Email-Event-Webhook-Signature
+// header, an ECDSA signature over the timestamp header followed by the raw
+// body.
+func verifySendGridSignature(key *ecdsa.PublicKey, timestamp, signature string, body []byte) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || timestamp == "" {
+		return errors.New("missing or malformed signature")
+	}
+	digest := sha256.Sum256(append([]byte(timestamp), body...))
+	if !ecdsa.VerifyASN1(key, digest[:], sig) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SendWindow is the part of the day, in the recipient's timezone, when
+// emails may go out. Start and End are minutes after midnight; the window may
+// wrap midnight (22:00-06:00), and Start == End means any time.
+type SendWindow struct {
+	Start    int
+	End      int
+	Location *time.Location
+}
+
+// parseWindowSpec parses "HH:MM-HH:MM". An empty spec is the whole day.
+func parseWindowSpec(spec string) (int, int, error) {
+	if spec == "" {
+		return 0, 0, nil
+	}
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: window %q must look like 08:00-21:00", errInvalidRequest, spec)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid time of day %q", errInvalidRequest, value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func loadTimezone(name string) (*time.Location, error) {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unknown timezone %q", errInvalidRequest, name)
+	}
+	return loc, nil
+}
+
+// NewSendWindow builds the default window from EMAIL_SEND_WINDOW or, as its
+// complement, EMAIL_QUIET_HOURS.
+func NewSendWindow(window, quietHours, timezone string) (SendWindow, error) {
+	if window != "" && quietHours != "" {
+		return SendWindow{}, fmt.Errorf("set either a send window or quiet hours, not both")
+	}
+	loc, err := loadTimezone(timezone)
+	if err != nil {
+		return SendWindow{}, err
+	}
+	w := SendWindow{Location: loc}
+	if quietHours != "" {
+		w.End, w.Start, err = parseWindowSpec(quietHours)
+	} else {
+		w.Start, w.End, err = parseWindowSpec(window)
+	}
+	return w, err
+}
+
+func (w SendWindow) Always() bool {
+	return w.Start == w.End
+}
+
+func (w SendWindow) contains(minute int) bool {
+	if w.Start < w.End {
+		return minute >= w.Start && minute < w.End
+	}
+	return minute >= w.Start || minute < w.End
+}
+
+// Next returns t if it falls inside the window, otherwise the moment the
+// window opens next.
+func (w SendWindow) Next(t time.Time) time.Time {
+	if w.Always() {
+		return t
+	}
+	local := t.In(w.Location)
+	if w.contains(local.Hour()*60 + local.Minute()) {
+		return t
+	}
+	year, month, day := local.Date()
+	open := time.Date(year, month, day, w.Start/60, w.Start%60, 0, 0, w.Location)
+	if !open.After(local) {
+		open = time.Date(year, month, day+1, w.Start/60, w.Start%60, 0, 0, w.Location)
+	}
+	return open
+}
+
+func (w SendWindow) String() string {
+	if w.Always() {
+		return "any time"
+	}
+	return fmt.Sprintf("%02d:%02d-%02d:%02d %s", w.Start/60, w.Start%60, w.End/60, w.End%60, w.Location)
+}
+
+// recipientWindow applies the user's own timezone and window or quiet hours
+// on top of the service default.
+func (s *EmailService) recipientWindow(prefs UserPreferences) SendWindow {
+	w := s.sendWindow
+	if prefs.Timezone != "" {
+		if loc, err := loadTimezone(prefs.Timezone); err == nil {
+			w.Location = loc
+		}
+	}
+	switch {
+	case prefs.SendWindow != "":
+		w.Start, w.End, _ = parseWindowSpec(prefs.SendWindow)
+	case prefs.QuietHours != "":
+		w.End, w.Start, _ = parseWindowSpec(prefs.QuietHours)
+	}
+	return w
+}
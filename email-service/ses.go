@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type SESConfig struct {
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Endpoint        string
+	DKIM            *DKIMSigner
+}
+
+type SESSender struct {
+	cfg    SESConfig
+	client *http.Client
+}
+
+func NewSESSender(cfg SESConfig) (*SESSender, error) {
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+	}
+	return &SESSender{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (s *SESSender) Name() string { return "ses" }
+
+func (s *SESSender) Close() {}
+
+var sesPermanentErrors = map[string]bool{
+	"MessageRejected":                    true,
+	"MailFromDomainNotVerifiedException": true,
+	"AccountSuspendedException":          true,
+	"SendingPausedException":             true,
+	"NotFoundException":                  true,
+	"BadRequestException":                true,
+}
+
+func (s *SESSender) Send(ctx context.Context, msg Message) error {
+	raw, err := buildMessage(msg)
+	if err == nil && s.cfg.DKIM != nil {
+		raw, err = s.cfg.DKIM.Sign(raw)
+	}
+	if err != nil {
+		return &SendError{Provider: s.Name(), Permanent: true, Err: err}
+	}
+
+	payload := map[string]any{
+		"FromEmailAddress": msg.From,
+		"Destination":      map[string]any{"ToAddresses": msg.To},
+		"Content":          map[string]any{"Raw": map[string]any{"Data": raw}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return &SendError{Provider: s.Name(), Permanent: true, Err: err}
+	}
+
+	endpoint := strings.TrimRight(s.cfg.Endpoint, "/") + "/v2/email/outbound-emails"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return &SendError{Provider: s.Name(), Permanent: true, Err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signV4(req, body, s.cfg, "ses", time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return &SendError{Provider: s.Name(), Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	code := resp.Header.Get("X-Amzn-ErrorType")
+	if i := strings.Index(code, ":"); i >= 0 {
+		code = code[:i]
+	}
+	if code == "" {
+		code = resp.Status
+	}
+
+	permanent := sesPermanentErrors[code]
+	if !permanent && !isTransientHTTPStatus(resp.StatusCode) && resp.StatusCode != http.StatusForbidden {
+		permanent = true
+	}
+
+	return &SendError{
+		Provider:  s.Name(),
+		Permanent: permanent,
+		Code:      code,
+		Err:       fmt.Errorf("%s", bytes.TrimSpace(detail)),
+	}
+}
+
+func signV4(req *http.Request, body []byte, cfg SESConfig, service string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", cfg.SessionToken)
+	}
+
+	signed := []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	if cfg.SessionToken != "" {
+		signed = append(signed, "x-amz-security-token")
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, h := range signed {
+		value := req.Header.Get(h)
+		if h == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + cfg.Region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+cfg.SecretAccessKey), date)
+	key = hmacSHA256(key, cfg.Region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		cfg.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func canonicalQuery(values url.Values) string {
+	return strings.ReplaceAll(values.Encode(), "+", "%20")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
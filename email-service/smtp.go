@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
+)
+
+type SMTPConfig struct {
+	Host        string
+	Port        string
+	Username    string
+	Password    string
+	TLSMode     string
+	MaxConns    int
+	IdleTimeout time.Duration
+	DKIM        *DKIMSigner
+}
+
+type smtpConn struct {
+	client   *smtp.Client
+	conn     net.Conn
+	lastUsed time.Time
+}
+
+type SMTPSender struct {
+	cfg  SMTPConfig
+	idle chan *smtpConn
+}
+
+func NewSMTPSender(cfg SMTPConfig) (*SMTPSender, error) {
+	switch cfg.TLSMode {
+	case "starttls", "tls", "none":
+	default:
+		return nil, fmt.Errorf("unknown SMTP TLS mode %q", cfg.TLSMode)
+	}
+	if cfg.MaxConns < 1 {
+		cfg.MaxConns = 1
+	}
+
+	return &SMTPSender{
+		cfg:  cfg,
+		idle: make(chan *smtpConn, cfg.MaxConns),
+	}, nil
+}
+
+func (s *SMTPSender) dial(ctx context.Context) (*smtpConn, error) {
+	addr := net.JoinHostPort(s.cfg.Host, s.cfg.Port)
+	tlsConfig := &tls.Config{ServerName: s.cfg.Host, MinVersion: tls.VersionTLS12}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if s.cfg.TLSMode == "tls" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", addr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, s.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("smtp handshake: %w", err)
+	}
+
+	if s.cfg.TLSMode == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			client.Close()
+			return nil, fmt.Errorf("server %s does not support STARTTLS", addr)
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("starttls: %w", err)
+		}
+	}
+
+	if s.cfg.Username != "" {
+		auth := smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host)
+		if err := client.Auth(auth); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("smtp auth: %w", err)
+		}
+	}
+
+	return &smtpConn{client: client, conn: conn, lastUsed: time.Now()}, nil
+}
+
+func (s *SMTPSender) acquire(ctx context.Context) (*smtpConn, error) {
+	for {
+		select {
+		case c := <-s.idle:
+			if time.Since(c.lastUsed) > s.cfg.IdleTimeout {
+				c.client.Close()
+				continue
+			}
+			if deadline, ok := ctx.Deadline(); ok {
+				c.conn.SetDeadline(deadline)
+			} else {
+				c.conn.SetDeadline(time.Time{})
+			}
+			if err := c.client.Noop(); err != nil {
+				c.client.Close()
+				continue
+			}
+			return c, nil
+		default:
+			return s.dial(ctx)
+		}
+	}
+}
+
+func (s *SMTPSender) release(c *smtpConn) {
+	c.lastUsed = time.Now()
+	c.conn.SetDeadline(time.Time{})
+	select {
+	case s.idle <- c:
+	default:
+		c.client.Quit()
+	}
+}
+
+func (s *SMTPSender) Name() string { return "smtp" }
+
+func (s *SMTPSender) Send(ctx context.Context, msg Message) error {
+	body, err := buildMessage(msg)
+	if err == nil && s.cfg.DKIM != nil {
+		body, err = s.cfg.DKIM.Sign(body)
+	}
+	if err != nil {
+		return &SendError{Provider: s.Name(), Permanent: true, Err: err}
+	}
+
+	c, err := s.acquire(ctx)
+	if err != nil {
+		return smtpError(err)
+	}
+
+	if err := s.transmit(c.client, msg, body); err != nil {
+		c.client.Close()
+		return smtpError(err)
+	}
+
+	if err := c.client.Reset(); err != nil {
+		c.client.Close()
+		return nil
+	}
+	s.release(c)
+	return nil
+}
+
+func (s *SMTPSender) transmit(client *smtp.Client, msg Message, body []byte) error {
+	if err := client.Mail(msg.From); err != nil {
+		return fmt.Errorf("MAIL FROM: %w", err)
+	}
+	for _, rcpt := range msg.To {
+		if err := client.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("RCPT TO %s: %w", rcpt, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("DATA: %w", err)
+	}
+	if _, err := w.Write(body); err != nil {
+		w.Close()
+		return fmt.Errorf("write body: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("end of data: %w", err)
+	}
+	return nil
+}
+
+func (s *SMTPSender) Close() {
+	for {
+		select {
+		case c := <-s.idle:
+			c.client.Quit()
+		default:
+			return
+		}
+	}
+}
+
+func smtpError(err error) error {
+	sendErr := &SendError{Provider: "smtp", Err: err}
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		sendErr.Code = strconv.Itoa(protoErr.Code)
+		sendErr.Permanent = protoErr.Code >= 500
+	}
+	return sendErr
+}
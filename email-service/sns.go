@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snsHost matches the regional SNS endpoints that serve signing
+// certificates and subscription confirmations.
+var snsHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+type snsEnvelope struct {
+	Type             string `json:"Type"`
+	MessageID        string `json:"MessageId"`
+	Token            string `json:"Token"`
+	TopicArn         string `json:"TopicArn"`
+	Subject          string `json:"Subject"`
+	Message          string `json:"Message"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+	SigningCertURL   string `json:"SigningCertURL"`
+	SubscribeURL     string `json:"SubscribeURL"`
+}
+
+// snsURL accepts only https URLs on an SNS endpoint, so a forged message
+// can't make the service fetch an arbitrary address.
+func snsURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || !snsHost.MatchString(u.Hostname()) || u.Port() != "" {
+		return nil, fmt.Errorf("%q is not an SNS URL", raw)
+	}
+	return u, nil
+}
+
+// signedString builds the text SNS signs: the message's fields in a fixed
+// order, each as "name\nvalue\n".
+func (e snsEnvelope) signedString() string {
+	var b strings.Builder
+	add := func(name, value string) {
+		b.WriteString(name + "\n" + value + "\n")
+	}
+	add("Message", e.Message)
+	add("MessageId", e.MessageID)
+	if e.Type == "Notification" {
+		if e.Subject != "" {
+			add("Subject", e.Subject)
+		}
+	} else {
+		add("SubscribeURL", e.SubscribeURL)
+	}
+	add("Timestamp", e.Timestamp)
+	if e.Type != "Notification" {
+		add("Token", e.Token)
+	}
+	add("TopicArn", e.TopicArn)
+	add("Type", e.Type)
+	return b.String()
+}
+
+// SNSVerifier checks that SNS messages come from one of the configured topics
+// and carry a valid signature from an SNS certificate. Certificates are
+// cached by URL.
+type SNSVerifier struct {
+	topics map[string]bool
+	client *http.Client
+
+	mu    sync.Mutex
+	certs map[string]*x509.Certificate
+}
+
+func NewSNSVerifier(topics []string) *SNSVerifier {
+	v := &SNSVerifier{
+		topics: make(map[string]bool),
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			// Only the checked URL is fetched, never where it redirects.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		certs: make(map[string]*x509.Certificate),
+	}
+	for _, topic := range topics {
+		v.topics[topic] = true
+	}
+	return v
+}
+
+func (v *SNSVerifier) Verify(e snsEnvelope) error {
+	if len(v.topics) == 0 {
+		return errors.New("no SNS topics are allowed, set EMAIL_SNS_TOPIC_ARNS")
+	}
+	if !v.topics[e.TopicArn] {
+		return fmt.Errorf("topic %q is not allowed", e.TopicArn)
+	}
+
+	var hash crypto.Hash
+	switch e.SignatureVersion {
+	case "1":
+		hash = crypto.SHA1
+	case "2":
+		hash = crypto.SHA256
+	default:
+		return fmt.Errorf("unsupported signature version %q", e.SignatureVersion)
+	}
+	sig, err := base64.StdEncoding.DecodeString(e.Signature)
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+	cert, err := v.cert(e.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("signing certificate has no RSA key")
+	}
+
+	h := hash.New()
+	h.Write([]byte(e.signedString()))
+	if err := rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), sig); err != nil {
+		return fmt.Errorf("bad signature: %w", err)
+	}
+	return nil
+}
+
+func (v *SNSVerifier) cert(raw string) (*x509.Certificate, error) {
+	u, err := snsURL(raw)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(u.Path, ".pem") {
+		return nil, fmt.Errorf("%q is not a certificate URL", raw)
+	}
+
+	v.mu.Lock()
+	cert, ok := v.certs[u.String()]
+	v.mu.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	resp, err := v.client.Get(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("fetch signing certificate: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("signing certificate URL returned %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("signing certificate is not PEM")
+	}
+	if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+		return nil, fmt.Errorf("parse signing certificate: %w", err)
+	}
+	if now := time.Now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, errors.New("signing certificate is expired")
+	}
+
+	v.mu.Lock()
+	v.certs[u.String()] = cert
+	v.mu.Unlock()
+	return cert, nil
+}
+
+// Confirm visits the SubscribeURL of a verified confirmation message.
+func (v *SNSVerifier) Confirm(subscribeURL string) error {
+	u, err := snsURL(subscribeURL)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("subscribe URL returned %s", resp.Status)
+	}
+	return nil
+}
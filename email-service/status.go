@@ -0,0 +1,292 @@
+package main
+
+import (
+	"container/list"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	StatusQueued    = "queued"
+	StatusScheduled = "scheduled"
+	StatusSending   = "sending"
+	StatusSent      = "sent"
+	StatusDeferred  = "deferred"
+	StatusRetrying  = "retrying"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+type StatusEvent struct {
+	Status  string    `json:"status"`
+	Attempt int       `json:"attempt"`
+	Error   string    `json:"error,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// RecipientStatus tracks one address of a multi-recipient task.
+type RecipientStatus struct {
+	Address   string    `json:"address"`
+	Status    string    `json:"status"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type TaskStatus struct {
+	ID         string        `json:"id"`
+	Type       string        `json:"type"`
+	NoteID     string        `json:"note_id,omitempty"`
+	Recipients []string      `json:"recipients,omitempty"`
+	Priority   string        `json:"priority,omitempty"`
+	BatchID    string        `json:"batch_id,omitempty"`
+	SendAt     time.Time     `json:"send_at,omitzero"`
+	Status     string        `json:"status"`
+	Attempts   int           `json:"attempts"`
+	Error      string        `json:"error,omitempty"`
+	CreatedAt  time.Time     `json:"created_at"`
+	UpdatedAt  time.Time     `json:"updated_at"`
+	History    []StatusEvent `json:"history"`
+	// Deliveries is set for tasks with more than one recipient.
+	Deliveries []RecipientStatus `json:"deliveries,omitempty"`
+	// Task is the task as it waits in the scheduler or the queue, with its
+	// payload, metadata, retry override and last error. Only TaskDetail
+	// sets it.
+	Task *EmailTask `json:"task,omitempty"`
+}
+
+type TaskEvent struct {
+	TaskID    string      `json:"task_id"`
+	Type      string      `json:"type"`
+	NoteID    string      `json:"note_id,omitempty"`
+	Recipient string      `json:"recipient,omitempty"`
+	Event     StatusEvent `json:"event"`
+}
+
+type HistoryFilter struct {
+	Status string
+	Type   string
+	NoteID string
+	Limit  int
+	// Pending keeps only tasks that haven't reached a final status.
+	Pending bool
+	// StaleFor keeps only tasks whose status hasn't changed for that long.
+	StaleFor time.Duration
+}
+
+func isFinalStatus(status string) bool {
+	return status == StatusSent || status == StatusFailed || status == StatusCancelled
+}
+
+// StatusTracker records the lifecycle of every task. Once maxEntries is
+// exceeded the least recently updated entries are forgotten; recency keeps
+// the IDs in update order, oldest first, so that takes constant time. Every
+// recorded transition is also published to subscribers; slow subscribers
+// miss events rather than block workers.
+type StatusTracker struct {
+	mu          sync.RWMutex
+	tasks       map[string]*TaskStatus
+	recency     *list.List
+	positions   map[string]*list.Element
+	maxEntries  int
+	subscribers map[chan TaskEvent]struct{}
+}
+
+func NewStatusTracker(maxEntries int) *StatusTracker {
+	return &StatusTracker{
+		tasks:       make(map[string]*TaskStatus),
+		recency:     list.New(),
+		positions:   make(map[string]*list.Element),
+		maxEntries:  maxEntries,
+		subscribers: make(map[chan TaskEvent]struct{}),
+	}
+}
+
+func (t *StatusTracker) Record(task EmailTask, status string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	entry, ok := t.tasks[task.ID]
+	if !ok {
+		entry = &TaskStatus{
+			ID:        task.ID,
+			Type:      task.Type,
+			NoteID:    task.NoteID,
+			BatchID:   task.BatchID,
+			CreatedAt: now,
+		}
+		if task.Recipient != "" {
+			entry.Recipients = []string{task.Recipient}
+		}
+		if len(task.Recipients) > 0 {
+			entry.Recipients = task.Recipients
+		}
+		t.tasks[task.ID] = entry
+	}
+
+	event := StatusEvent{Status: status, Attempt: task.Attempts, At: now}
+	if err != nil {
+		event.Error = err.Error()
+		entry.Error = event.Error
+	} else if status == StatusSent {
+		entry.Error = ""
+	}
+
+	if task.Priority != "" {
+		entry.Priority = task.Priority
+	}
+	entry.SendAt = task.SendAt
+	entry.Status = status
+	entry.Attempts = task.Attempts
+	entry.UpdatedAt = now
+	entry.History = append(entry.History, event)
+	t.touch(entry.ID)
+	t.evict()
+
+	// Recipients not attempted yet follow the task, and a task that failed or
+	// was cancelled as a whole takes its outstanding recipients with it.
+	abandoned := isFinalStatus(status) && status != StatusSent
+	for i := range entry.Deliveries {
+		if d := &entry.Deliveries[i]; !isFinalStatus(d.Status) && (d.Attempts == 0 || abandoned) {
+			d.Status, d.Error, d.UpdatedAt = status, event.Error, now
+		}
+	}
+
+	t.publish(TaskEvent{TaskID: entry.ID, Type: entry.Type, NoteID: entry.NoteID, Event: event})
+}
+
+// RecordRecipient records the outcome of one address of a multi-recipient
+// task.
+func (t *StatusTracker) RecordRecipient(id, address, status string, attempt int, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.tasks[id]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	i := slices.IndexFunc(entry.Deliveries, func(d RecipientStatus) bool { return d.Address == address })
+	if i < 0 {
+		entry.Deliveries = append(entry.Deliveries, RecipientStatus{Address: address})
+		i = len(entry.Deliveries) - 1
+	}
+	d := &entry.Deliveries[i]
+	d.Status, d.Attempts, d.Error, d.UpdatedAt = status, attempt, "", now
+	if err != nil {
+		d.Error = err.Error()
+	}
+	entry.UpdatedAt = now
+	t.touch(id)
+
+	event := StatusEvent{Status: status, Attempt: attempt, Error: d.Error, At: now}
+	t.publish(TaskEvent{TaskID: entry.ID, Type: entry.Type, NoteID: entry.NoteID, Recipient: address, Event: event})
+}
+
+func (t *StatusTracker) publish(event TaskEvent) {
+	for ch := range t.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func (t *StatusTracker) Subscribe(buffer int) (<-chan TaskEvent, func()) {
+	ch := make(chan TaskEvent, buffer)
+	t.mu.Lock()
+	t.subscribers[ch] = struct{}{}
+	t.mu.Unlock()
+
+	return ch, func() {
+		t.mu.Lock()
+		delete(t.subscribers, ch)
+		t.mu.Unlock()
+	}
+}
+
+func (t *StatusTracker) SetRecipients(id string, recipients []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, ok := t.tasks[id]
+	if !ok {
+		return
+	}
+	entry.Recipients = recipients
+	if len(recipients) > 1 {
+		entry.Deliveries = nil
+		for _, rcpt := range recipients {
+			entry.Deliveries = append(entry.Deliveries, RecipientStatus{Address: rcpt, Status: entry.Status, UpdatedAt: entry.UpdatedAt})
+		}
+	}
+}
+
+// touch moves id to the most recently updated end of recency.
+func (t *StatusTracker) touch(id string) {
+	if e, ok := t.positions[id]; ok {
+		t.recency.MoveToBack(e)
+		return
+	}
+	t.positions[id] = t.recency.PushBack(id)
+}
+
+func (t *StatusTracker) evict() {
+	for t.maxEntries > 0 && len(t.tasks) > t.maxEntries {
+		id := t.recency.Remove(t.recency.Front()).(string)
+		delete(t.positions, id)
+		delete(t.tasks, id)
+	}
+}
+
+func (t *StatusTracker) Get(id string) (TaskStatus, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	entry, ok := t.tasks[id]
+	if !ok {
+		return TaskStatus{}, false
+	}
+	copied := *entry
+	copied.History = append([]StatusEvent(nil), entry.History...)
+	copied.Deliveries = slices.Clone(entry.Deliveries)
+	return copied, true
+}
+
+func (t *StatusTracker) List(f HistoryFilter) []TaskStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	now := time.Now()
+	var result []TaskStatus
+	for _, entry := range t.tasks {
+		if f.Pending && isFinalStatus(entry.Status) {
+			continue
+		}
+		if f.StaleFor > 0 && now.Sub(entry.UpdatedAt) < f.StaleFor {
+			continue
+		}
+		if f.Status != "" && entry.Status != f.Status {
+			continue
+		}
+		if f.Type != "" && entry.Type != f.Type {
+			continue
+		}
+		if f.NoteID != "" && entry.NoteID != f.NoteID {
+			continue
+		}
+		copied := *entry
+		copied.History = nil
+		copied.Deliveries = slices.Clone(entry.Deliveries)
+		result = append(result, copied)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].UpdatedAt.After(result[j].UpdatedAt)
+	})
+	if f.Limit > 0 && len(result) > f.Limit {
+		result = result[:f.Limit]
+	}
+	return result
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestStatusTrackerEvictsLeastRecentlyUpdated(t *testing.T) {
+	tracker := NewStatusTracker(2)
+	tracker.Record(EmailTask{ID: "a"}, StatusQueued, nil)
+	tracker.Record(EmailTask{ID: "b"}, StatusQueued, nil)
+	tracker.Record(EmailTask{ID: "a"}, StatusSending, nil)
+	tracker.Record(EmailTask{ID: "c"}, StatusQueued, nil)
+
+	for id, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := tracker.Get(id); ok != want {
+			t.Errorf("Get(%q) found = %v, want %v", id, ok, want)
+		}
+	}
+
+	tracker.RecordRecipient("a", "x@example.com", StatusSent, 1, nil)
+	tracker.Record(EmailTask{ID: "d"}, StatusQueued, nil)
+	if _, ok := tracker.Get("c"); ok {
+		t.Error("c outlived a, which was updated after it")
+	}
+	if _, ok := tracker.Get("a"); !ok {
+		t.Error("a was evicted right after a recipient update")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Suppression struct {
+	Email  string    `json:"email"`
+	Reason string    `json:"reason"`
+	Source string    `json:"source"`
+	At     time.Time `json:"at"`
+}
+
+type SuppressionList struct {
+	mu      sync.RWMutex
+	entries map[string]Suppression
+}
+
+func NewSuppressionList() *SuppressionList {
+	return &SuppressionList{entries: make(map[string]Suppression)}
+}
+
+func (l *SuppressionList) Add(email, reason, source string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := strings.ToLower(strings.TrimSpace(email))
+	l.entries[key] = Suppression{Email: key, Reason: reason, Source: source, At: time.Now()}
+}
+
+func (l *SuppressionList) Remove(email string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := strings.ToLower(strings.TrimSpace(email))
+	_, ok := l.entries[key]
+	delete(l.entries, key)
+	return ok
+}
+
+func (l *SuppressionList) Lookup(email string) (Suppression, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	entry, ok := l.entries[strings.ToLower(strings.TrimSpace(email))]
+	return entry, ok
+}
+
+func (l *SuppressionList) List() []Suppression {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	list := make([]Suppression, 0, len(l.entries))
+	for _, entry := range l.entries {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].At.After(list[j].At)
+	})
+	return list
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type RenderedEmail struct {
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	HTML    string `json:"html"`
+}
+
+type NoteEmailData struct {
+	Note           Note
+	Event          string
+	Recipient      string
+	UnsubscribeURL string
+	Metadata       map[string]string
+}
+
+var noteTemplate = template.Must(template.New("note").Parse(`{{with .Metadata.sharer_name}}{{.}} shared a note with you.
+
+{{end}}{{with .Metadata.message}}> {{.}}
+
+{{end}}{{.Note.Content}}
+{{if .UnsubscribeURL}}
+--
+Unsubscribe: {{.UnsubscribeURL}}
+{{end}}`))
+
+var htmlFuncs = htmltemplate.FuncMap{"paragraphs": paragraphs}
+
+var noteHTMLTemplate = htmltemplate.Must(htmltemplate.New("note.html").Funcs(htmlFuncs).Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; line-height: 1.4">
+{{with .Metadata.sharer_name}}<p>{{.}} shared a note with you.</p>
+{{end}}{{with .Metadata.message}}<blockquote style="border-left: 3px solid #ccc; margin: 0; padding-left: 1em">{{range paragraphs .}}<p>{{range $i, $line := .}}{{if $i}}<br>{{end}}{{$line}}{{end}}</p>{{end}}</blockquote>
+{{end}}<h2>{{.Note.Title}}</h2>
+{{range paragraphs .Note.Content}}<p>{{range $i, $line := .}}{{if $i}}<br>{{end}}{{$line}}{{end}}</p>
+{{end}}{{if .UnsubscribeURL}}<hr>
+<p style="font-size: small; color: #666"><a href="{{.UnsubscribeURL}}">Unsubscribe</a></p>
+{{end}}</body>
+</html>
+`))
+
+var digestHTMLTemplate = htmltemplate.Must(htmltemplate.New("digest.html").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; line-height: 1.4">
+<h2>Notes digest for {{.Date}}</h2>
+{{if .Created}}<h3>Created ({{len .Created}})</h3>
+<ul>
+{{range .Created}}<li>#{{.Note.ID}} {{.Note.Title}} ({{.At.Format "15:04"}})</li>
+{{end}}</ul>
+{{end}}{{if .Updated}}<h3>Updated ({{len .Updated}})</h3>
+<ul>
+{{range .Updated}}<li>#{{.Note.ID}} {{.Note.Title}} ({{.At.Format "15:04"}})</li>
+{{end}}</ul>
+{{end}}{{if .UnsubscribeURL}}<hr>
+<p style="font-size: small; color: #666"><a href="{{.UnsubscribeURL}}">Unsubscribe</a></p>
+{{end}}</body>
+</html>
+`))
+
+// paragraphs splits plain note content on blank lines, keeping single line
+// breaks inside a paragraph.
+func paragraphs(content string) [][]string {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	var result [][]string
+	for _, block := range strings.Split(content, "\n\n") {
+		if block = strings.Trim(block, "\n"); strings.TrimSpace(block) != "" {
+			result = append(result, strings.Split(block, "\n"))
+		}
+	}
+	return result
+}
+
+// render executes the plain-text and HTML versions of one email. Both are
+// sent so that gateways rejecting HTML-only mail still accept it.
+func render(subject string, text *template.Template, html *htmltemplate.Template, data any) (RenderedEmail, error) {
+	var textBody, htmlBody bytes.Buffer
+	if err := text.Execute(&textBody, data); err != nil {
+		return RenderedEmail{}, err
+	}
+	if err := html.Execute(&htmlBody, data); err != nil {
+		return RenderedEmail{}, err
+	}
+	return RenderedEmail{Subject: subject, Text: textBody.String(), HTML: htmlBody.String()}, nil
+}
+
+func renderNote(data NoteEmailData) (RenderedEmail, error) {
+	subject := fmt.Sprintf("Note #%s: %s", data.Note.ID, data.Note.Title)
+	switch sharer := singleLine(data.Metadata[MetaSharerName]); {
+	case data.Event == EventReminderDue:
+		subject = fmt.Sprintf("Reminder: note #%s: %s", data.Note.ID, data.Note.Title)
+	case sharer != "":
+		subject = fmt.Sprintf("%s shared note #%s: %s", sharer, data.Note.ID, data.Note.Title)
+	}
+	return render(subject, noteTemplate, noteHTMLTemplate, data)
+}
+
+func renderDigest(data DigestData) (RenderedEmail, error) {
+	subject := fmt.Sprintf("Notes digest for %s: %d created, %d updated", data.Date, len(data.Created), len(data.Updated))
+	return render(subject, digestTemplate, digestHTMLTemplate, data)
+}
+
+type PreviewRequest struct {
+	Template  string            `json:"template"`
+	NoteID    string            `json:"note_id,omitempty"`
+	Note      *Note             `json:"note,omitempty"`
+	Recipient string            `json:"recipient,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+type PreviewResponse struct {
+	Template string `json:"template"`
+	RenderedEmail
+}
+
+// Preview renders a template exactly as a worker would, without sending.
+// The digest preview uses the given note as its single created entry.
+func (s *EmailService) Preview(ctx context.Context, req PreviewRequest) (PreviewResponse, error) {
+	if req.Template == "" {
+		req.Template = "note"
+	}
+	if req.Recipient == "" {
+		req.Recipient = s.emailAddr
+	}
+	if err := validateMetadata(req.Metadata); err != nil {
+		return PreviewResponse{}, err
+	}
+
+	var note Note
+	switch {
+	case req.Note != nil:
+		note = *req.Note
+	case req.NoteID != "":
+		found, exists, err := s.lookupNote(ctx, req.NoteID)
+		if err != nil {
+			return PreviewResponse{}, err
+		}
+		if !exists {
+			return PreviewResponse{}, errNoteNotFound
+		}
+		note = found
+	default:
+		return PreviewResponse{}, fmt.Errorf("%w: note or note_id is required", errInvalidRequest)
+	}
+
+	var rendered RenderedEmail
+	var err error
+	switch req.Template {
+	case "note":
+		rendered, err = renderNote(NoteEmailData{
+			Note:           note,
+			Recipient:      req.Recipient,
+			UnsubscribeURL: s.unsubscriber.URL(req.Recipient),
+			Metadata:       req.Metadata,
+		})
+	case "digest":
+		rendered, err = renderDigest(DigestData{
+			Recipient:      req.Recipient,
+			Date:           time.Now().In(s.digest.location).Format("2006-01-02"),
+			Created:        []NoteEvent{{Type: "created", Note: note, At: time.Now()}},
+			UnsubscribeURL: s.unsubscriber.URL(req.Recipient),
+		})
+	default:
+		return PreviewResponse{}, fmt.Errorf("%w: unknown template %q", errInvalidRequest, req.Template)
+	}
+	if err != nil {
+		return PreviewResponse{}, err
+	}
+	return PreviewResponse{Template: req.Template, RenderedEmail: rendered}, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/m-tln/notes/config"
+)
+
+// serverTLSConfig builds the listener TLS settings from the same variables as
+// the sidecar: TLS_CERT and TLS_KEY for the server certificate and CA_CERT
+// for the mesh CA. TLS_CLIENT_AUTH (none, optional or require) turns on
+// client certificate verification against that CA. A nil config means plain
+// HTTP.
+func serverTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := config.String("TLS_CERT", ""), config.String("TLS_KEY", "")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both TLS_CERT and TLS_KEY are required")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate: %w", err)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if ca := config.String("CA_CERT", ""); ca != "" {
+		if cfg.ClientCAs, err = loadCertPool(ca); err != nil {
+			return nil, err
+		}
+	}
+
+	switch mode := config.String("TLS_CLIENT_AUTH", "none"); mode {
+	case "none":
+	case "optional", "require":
+		if cfg.ClientCAs == nil {
+			return nil, fmt.Errorf("TLS_CLIENT_AUTH=%s needs CA_CERT", mode)
+		}
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if mode == "require" {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	default:
+		return nil, fmt.Errorf("unknown TLS_CLIENT_AUTH %q", mode)
+	}
+	return cfg, nil
+}
+
+// loadCertPool accepts either a path or, like the sidecar, the PEM itself.
+func loadCertPool(ca string) (*x509.CertPool, error) {
+	pem := []byte(ca)
+	if !strings.HasPrefix(strings.TrimSpace(ca), "-----BEGIN") {
+		var err error
+		if pem, err = os.ReadFile(ca); err != nil {
+			return nil, fmt.Errorf("read CA_CERT: %w", err)
+		}
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in CA_CERT")
+	}
+	return pool, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/m-tln/notes/logging"
+)
+
+// Unsubscriber builds and checks signed unsubscribe links. The token is an
+// HMAC of the address, so links cannot be forged for other recipients.
+type Unsubscriber struct {
+	baseURL string
+	secret  []byte
+}
+
+func NewUnsubscriber(baseURL, secret string) *Unsubscriber {
+	key := []byte(secret)
+	if secret == "" {
+		slog.Warn("EMAIL_UNSUBSCRIBE_SECRET is not set, unsubscribe links will stop working after a restart")
+		key = []byte(rand.Text())
+	}
+	return &Unsubscriber{baseURL: strings.TrimRight(baseURL, "/"), secret: key}
+}
+
+func (u *Unsubscriber) token(email string) string {
+	mac := hmac.New(sha256.New, u.secret)
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (u *Unsubscriber) URL(email string) string {
+	query := url.Values{"email": {email}, "token": {u.token(email)}}
+	return u.baseURL + "/email/unsubscribe?" + query.Encode()
+}
+
+func (u *Unsubscriber) Verify(email, token string) bool {
+	return email != "" && hmac.Equal([]byte(token), []byte(u.token(email)))
+}
+
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Unsubscribe</title></head>
+<body>
+<p>Stop sending notes emails to {{.Email}}?</p>
+<form method="post" action="{{.Action}}"><button type="submit">Unsubscribe</button></form>
+</body>
+</html>
+`))
+
+// HandleUnsubscribePage answers the link in the email body with a
+// confirmation form instead of unsubscribing, since link scanners and
+// prefetchers follow GET links on their own.
+func (s *EmailService) HandleUnsubscribePage(w http.ResponseWriter, r *http.Request) {
+	email, token := r.URL.Query().Get("email"), r.URL.Query().Get("token")
+	if !s.unsubscriber.Verify(email, token) {
+		http.Error(w, "Invalid unsubscribe link", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	unsubscribePage.Execute(w, map[string]string{
+		"Email":  email,
+		"Action": "?" + url.Values{"email": {email}, "token": {token}}.Encode(),
+	})
+}
+
+// HandleUnsubscribe takes the POST from the confirmation form and RFC 8058
+// one-click requests from mail clients.
+func (s *EmailService) HandleUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	if !s.unsubscriber.Verify(email, r.URL.Query().Get("token")) {
+		http.Error(w, "Invalid unsubscribe link", http.StatusForbidden)
+		return
+	}
+
+	s.suppression.Add(email, "unsubscribed", "link")
+	s.digest.Unsubscribe(email)
+	logging.FromContext(r.Context()).Info("Unsubscribed via link", "email", email)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("You have been unsubscribed from notes emails.\n"))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestUnsubscriberVerify(t *testing.T) {
+	u := NewUnsubscriber("https://notes.example/", "secret")
+	link, err := url.Parse(u.URL("Alice@Example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Host != "notes.example" || link.Path != "/email/unsubscribe" {
+		t.Fatalf("URL = %s", link)
+	}
+	token := link.Query().Get("token")
+
+	tests := []struct {
+		name  string
+		email string
+		token string
+		want  bool
+	}{
+		{"same address", "Alice@Example.com", token, true},
+		{"case and spaces ignored", " alice@example.com", token, true},
+		{"other address", "bob@example.com", token, false},
+		{"empty address", "", u.token(""), false},
+		{"bad token", "alice@example.com", token[:len(token)-1], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := u.Verify(tt.email, tt.token); got != tt.want {
+				t.Errorf("Verify(%q) = %v, want %v", tt.email, got, tt.want)
+			}
+		})
+	}
+
+	other := NewUnsubscriber("https://notes.example", "other secret")
+	if other.Verify("alice@example.com", token) {
+		t.Error("token accepted under a different secret")
+	}
+}
+
+func TestHandleUnsubscribe(t *testing.T) {
+	s := &EmailService{
+		unsubscriber: NewUnsubscriber("https://notes.example", "secret"),
+		suppression:  NewSuppressionList(),
+		digest:       &Digest{subscribers: map[string]bool{"alice@example.com": true}},
+	}
+	link, _ := url.Parse(s.unsubscriber.URL("alice@example.com"))
+	target := link.RequestURI()
+
+	rec := httptest.NewRecorder()
+	s.HandleUnsubscribePage(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `method="post"`) {
+		t.Fatalf("GET = %d %q, want a confirmation form", rec.Code, rec.Body.String())
+	}
+	if _, ok := s.suppression.Lookup("alice@example.com"); ok {
+		t.Fatal("GET unsubscribed the address")
+	}
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader("List-Unsubscribe=One-Click"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	s.HandleUnsubscribe(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST = %d", rec.Code)
+	}
+	if _, ok := s.suppression.Lookup("alice@example.com"); !ok {
+		t.Error("POST did not suppress the address")
+	}
+	if len(s.digest.Subscribers()) != 0 {
+		t.Error("POST did not unsubscribe from the digest")
+	}
+
+	rec = httptest.NewRecorder()
+	s.HandleUnsubscribe(rec, httptest.NewRequest(http.MethodPost, "/email/unsubscribe?email=bob@example.com&token=x", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("forged POST = %d, want 403", rec.Code)
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+type walRecord struct {
+	Op   string     `json:"op"`
+	ID   string     `json:"id"`
+	Task *EmailTask `json:"task,omitempty"`
+	At   time.Time  `json:"at,omitzero"`
+}
+
+// WALQueue wraps an in-memory queue with an append-only log of accepted and
+// finished tasks. On startup the log is replayed so tasks that were queued
+// when the process died are not lost; it is compacted once enough finished
+// records pile up. Tasks that failed for good stay in the log as dead
+// letters until they are requeued. Scheduled tasks are logged when they
+// are accepted and held here until their send time; retries are logged with
+// their retry time and replayed with what is left of their backoff.
+type WALQueue struct {
+	TaskQueue
+
+	mu        sync.Mutex
+	path      string
+	file      *os.File
+	pending   map[string]EmailTask
+	retryAt   map[string]time.Time
+	order     []string
+	dead      map[string]DeadLetter
+	scheduled map[string]EmailTask
+	hold      time.Time
+	finished  int
+	compactAt int
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewWALQueue(inner TaskQueue, path string, compactAt int) (*WALQueue, error) {
+	q := &WALQueue{
+		TaskQueue: inner,
+		path:      path,
+		pending:   make(map[string]EmailTask),
+		retryAt:   make(map[string]time.Time),
+		dead:      make(map[string]DeadLetter),
+		scheduled: make(map[string]EmailTask),
+		compactAt: compactAt,
+		stop:      make(chan struct{}),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+
+	restored, dropped := 0, 0
+	now := time.Now()
+	for _, id := range q.order {
+		task := q.pending[id]
+		if task.SendAt.After(now) {
+			q.scheduled[id] = task
+			restored++
+			continue
+		}
+		enqueue := inner.Enqueue
+		if at := q.retryAt[id]; at.After(now) {
+			enqueue = func(ctx context.Context, task EmailTask) error {
+				return inner.Retry(ctx, task, at)
+			}
+		}
+		if err := enqueue(context.Background(), task); err != nil {
+			dropped++
+			slog.Error("Failed to restore task from WAL", "task_id", id, "error", err)
+			continue
+		}
+		restored++
+	}
+	if restored > 0 || dropped > 0 {
+		slog.Info("Restored tasks from WAL", "wal", path, "restored", restored, "dropped", dropped)
+	}
+	go q.run()
+	return q, nil
+}
+
+func (q *WALQueue) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.stop:
+			return
+		case now := <-ticker.C:
+			q.releaseDue(now)
+		}
+	}
+}
+
+// releaseDue moves due scheduled tasks into the inner queue. They are
+// already in the log, so nothing is written. A task the queue rejects stays
+// scheduled and is retried on the next tick.
+func (q *WALQueue) releaseDue(now time.Time) {
+	q.mu.Lock()
+	if !q.hold.IsZero() && q.hold.Before(now) {
+		now = q.hold
+	}
+	var due []EmailTask
+	for id, task := range q.scheduled {
+		if !task.SendAt.After(now) {
+			due = append(due, task)
+			delete(q.scheduled, id)
+		}
+	}
+	q.mu.Unlock()
+
+	for _, task := range due {
+		if err := q.TaskQueue.Enqueue(context.Background(), task); err != nil {
+			taskLogger(task, 0).Error("Failed to release scheduled task", "error", err)
+			q.mu.Lock()
+			q.scheduled[task.ID] = task
+			q.mu.Unlock()
+			continue
+		}
+		taskLogger(task, 0).Info("Scheduled task released", "send_at", task.SendAt)
+	}
+}
+
+// Schedule logs the task like Enqueue but holds it until its send time.
+// Held tasks count against the queue's capacity.
+func (q *WALQueue) Schedule(ctx context.Context, task EmailTask) error {
+	if q.Len() >= q.Cap() {
+		return errQueueFull
+	}
+	if err := q.write(addRecord(task)); err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.scheduled[task.ID] = task
+	return nil
+}
+
+// Hold keeps scheduled tasks due after since out of the queue; a zero since
+// lifts the hold.
+func (q *WALQueue) Hold(since time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.hold = since
+}
+
+// Len counts the scheduled tasks held here as well as the inner queue's.
+func (q *WALQueue) Len() int {
+	q.mu.Lock()
+	scheduled := len(q.scheduled)
+	q.mu.Unlock()
+	return q.TaskQueue.Len() + scheduled
+}
+
+// Ready leaves out the scheduled tasks held here.
+func (q *WALQueue) Ready() int {
+	return readyLen(q.TaskQueue)
+}
+
+func (q *WALQueue) Scheduled(ctx context.Context) ([]EmailTask, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	tasks := make([]EmailTask, 0, len(q.scheduled))
+	for _, task := range q.scheduled {
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+func (q *WALQueue) load() error {
+	f, err := os.Open(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open WAL: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var rec walRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// A torn final write after a crash is expected; anything else is logged too.
+			slog.Warn("Skipping corrupt WAL record", "line", line, "error", err)
+			continue
+		}
+		q.apply(rec)
+	}
+	return scanner.Err()
+}
+
+func (q *WALQueue) apply(rec walRecord) {
+	switch rec.Op {
+	case "add":
+		if rec.Task == nil {
+			return
+		}
+		if _, ok := q.pending[rec.ID]; !ok {
+			q.order = append(q.order, rec.ID)
+		}
+		task := *rec.Task
+		task.receipt = ""
+		q.pending[rec.ID] = task
+		if rec.At.IsZero() {
+			delete(q.retryAt, rec.ID)
+		} else {
+			q.retryAt[rec.ID] = rec.At
+		}
+		delete(q.dead, rec.ID)
+	case "done":
+		if _, ok := q.pending[rec.ID]; ok {
+			delete(q.pending, rec.ID)
+			delete(q.retryAt, rec.ID)
+			q.finished++
+		}
+	case "dead":
+		if rec.Task == nil {
+			return
+		}
+		if _, ok := q.pending[rec.ID]; ok {
+			delete(q.pending, rec.ID)
+			delete(q.retryAt, rec.ID)
+			q.finished++
+		}
+		q.dead[rec.ID] = DeadLetter{Task: *rec.Task, Error: rec.Task.LastError, FailedAt: rec.At}
+	}
+}
+
+// compact rewrites the log with only the dead letters and pending tasks and
+// swaps it in atomically via rename.
+func (q *WALQueue) compact() error {
+	tmp := q.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("create WAL: %w", err)
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, item := range q.dead {
+		if err := enc.Encode(deadRecord(item)); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	var order []string
+	for _, id := range q.order {
+		task, ok := q.pending[id]
+		if !ok {
+			continue
+		}
+		order = append(order, id)
+		if err := enc.Encode(walRecord{Op: "add", ID: id, Task: &task, At: q.retryAt[id]}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, q.path); err != nil {
+		return fmt.Errorf("replace WAL: %w", err)
+	}
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file, err = os.OpenFile(q.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("open WAL: %w", err)
+	}
+	q.order = order
+	q.finished = 0
+	return nil
+}
+
+func (q *WALQueue) write(records ...walRecord) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var buf []byte
+	for _, rec := range records {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+	if _, err := q.file.Write(buf); err != nil {
+		return fmt.Errorf("write WAL: %w", err)
+	}
+	if err := q.file.Sync(); err != nil {
+		return fmt.Errorf("sync WAL: %w", err)
+	}
+
+	for _, rec := range records {
+		q.apply(rec)
+	}
+	if q.compactAt > 0 && q.finished >= q.compactAt {
+		if err := q.compact(); err != nil {
+			slog.Error("WAL compaction failed", "error", err)
+		}
+	}
+	return nil
+}
+
+func addRecord(task EmailTask) walRecord {
+	task.receipt = ""
+	return walRecord{Op: "add", ID: task.ID, Task: &task}
+}
+
+func deadRecord(item DeadLetter) walRecord {
+	task := item.Task
+	task.receipt = ""
+	return walRecord{Op: "dead", ID: task.ID, Task: &task, At: item.FailedAt}
+}
+
+func (q *WALQueue) Enqueue(ctx context.Context, task EmailTask) error {
+	if err := q.write(addRecord(task)); err != nil {
+		return err
+	}
+	if err := q.TaskQueue.Enqueue(ctx, task); err != nil {
+		q.write(walRecord{Op: "done", ID: task.ID})
+		return err
+	}
+	return nil
+}
+
+func (q *WALQueue) EnqueueBatch(ctx context.Context, tasks []EmailTask) error {
+	records := make([]walRecord, 0, len(tasks))
+	for _, task := range tasks {
+		records = append(records, addRecord(task))
+	}
+	if err := q.write(records...); err != nil {
+		return err
+	}
+	if err := q.TaskQueue.EnqueueBatch(ctx, tasks); err != nil {
+		for i, task := range tasks {
+			records[i] = walRecord{Op: "done", ID: task.ID}
+		}
+		q.write(records...)
+		return err
+	}
+	return nil
+}
+
+func (q *WALQueue) Complete(ctx context.Context, task EmailTask) error {
+	if err := q.write(walRecord{Op: "done", ID: task.ID}); err != nil {
+		slog.Error("Failed to write WAL record", "task_id", task.ID, "error", err)
+	}
+	return q.TaskQueue.Complete(ctx, task)
+}
+
+func (q *WALQueue) Fail(ctx context.Context, task EmailTask, cause error) error {
+	task.LastError = cause.Error()
+	if err := q.write(deadRecord(DeadLetter{Task: task, FailedAt: time.Now()})); err != nil {
+		slog.Error("Failed to write WAL record", "task_id", task.ID, "error", err)
+	}
+	return q.TaskQueue.Fail(ctx, task, cause)
+}
+
+func (q *WALQueue) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := make([]DeadLetter, 0, len(q.dead))
+	for _, item := range q.dead {
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Requeue takes the dead letter out first so concurrent retries of the same
+// task enqueue it once; if the queue rejects it, it is logged as dead again.
+func (q *WALQueue) Requeue(ctx context.Context, id string) (EmailTask, error) {
+	q.mu.Lock()
+	item, ok := q.dead[id]
+	delete(q.dead, id)
+	q.mu.Unlock()
+	if !ok {
+		return EmailTask{}, errTaskNotFound
+	}
+
+	task := item.Task
+	resetDeadLetter(&task)
+	if err := q.Enqueue(ctx, task); err != nil {
+		if werr := q.write(deadRecord(item)); werr != nil {
+			slog.Error("Failed to write WAL record", "task_id", id, "error", werr)
+		}
+		return EmailTask{}, err
+	}
+	return task, nil
+}
+
+// Retry records the updated attempt count and the retry time, so a replayed
+// task neither gets a fresh retry budget nor skips its backoff.
+func (q *WALQueue) Retry(ctx context.Context, task EmailTask, at time.Time) error {
+	rec := addRecord(task)
+	rec.At = at
+	if err := q.write(rec); err != nil {
+		slog.Error("Failed to write WAL record", "task_id", task.ID, "error", err)
+	}
+	return q.TaskQueue.Retry(ctx, task, at)
+}
+
+func (q *WALQueue) Cancel(ctx context.Context, id string) (EmailTask, error) {
+	q.mu.Lock()
+	task, scheduled := q.scheduled[id]
+	delete(q.scheduled, id)
+	q.mu.Unlock()
+
+	if !scheduled {
+		var err error
+		if task, err = q.TaskQueue.Cancel(ctx, id); err != nil {
+			return EmailTask{}, err
+		}
+	}
+	if err := q.write(walRecord{Op: "done", ID: id}); err != nil {
+		slog.Error("Failed to write WAL record", "task_id", task.ID, "error", err)
+	}
+	return task, nil
+}
+
+// Lookup finds scheduled tasks and every task the log still has open,
+// including ones a worker holds.
+func (q *WALQueue) Lookup(ctx context.Context, id string) (EmailTask, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if task, ok := q.scheduled[id]; ok {
+		return task, nil
+	}
+	if task, ok := q.pending[id]; ok {
+		return task, nil
+	}
+	return EmailTask{}, errTaskNotFound
+}
+
+func (q *WALQueue) Purge(ctx context.Context) ([]EmailTask, error) {
+	tasks, err := q.TaskQueue.Purge(ctx)
+	q.mu.Lock()
+	for id, task := range q.scheduled {
+		tasks = append(tasks, task)
+		delete(q.scheduled, id)
+	}
+	q.mu.Unlock()
+	records := make([]walRecord, 0, len(tasks))
+	for _, task := range tasks {
+		records = append(records, walRecord{Op: "done", ID: task.ID})
+	}
+	if werr := q.write(records...); werr != nil {
+		slog.Error("Failed to write WAL record", "tasks", len(tasks), "error", werr)
+	}
+	return tasks, err
+}
+
+func (q *WALQueue) Close() error {
+	q.closeOnce.Do(func() { close(q.stop) })
+	err := q.TaskQueue.Close()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if cerr := q.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWALReplayKeepsRetryBackoff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.wal")
+	ctx := context.Background()
+
+	q, err := NewWALQueue(NewMemoryQueue(4), path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue(ctx, EmailTask{ID: "t1", Type: "send"}); err != nil {
+		t.Fatal(err)
+	}
+	task, err := q.Dequeue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.Attempts = 1
+	if err := q.Retry(ctx, task, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	q, err = NewWALQueue(NewMemoryQueue(4), path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	dequeueCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if task, err := q.Dequeue(dequeueCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Dequeue after replay = %+v, %v; want the retry held until its backoff ends", task, err)
+	}
+	if n := q.Len(); n != 1 {
+		t.Errorf("Len after replay = %d, want 1", n)
+	}
+	if tasks, _ := q.Scheduled(ctx); len(tasks) != 0 {
+		t.Errorf("Scheduled after replay = %d tasks, want the retry left out", len(tasks))
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	ctx := context.Background()
+	claim := func(q *WALQueue) EmailTask {
+		t.Helper()
+		task, err := q.Dequeue(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return task
+	}
+	tests := []struct {
+		name          string
+		compactAt     int
+		run           func(q *WALQueue)
+		wantQueued    int
+		wantScheduled int
+		wantDead      int
+	}{
+		{
+			name: "unfinished task is restored",
+			run: func(q *WALQueue) {
+				q.Enqueue(ctx, EmailTask{ID: "a", Type: "send"})
+				claim(q)
+			},
+			wantQueued: 1,
+		},
+		{
+			name: "completed task is dropped",
+			run: func(q *WALQueue) {
+				q.Enqueue(ctx, EmailTask{ID: "a", Type: "send"})
+				q.Complete(ctx, claim(q))
+			},
+		},
+		{
+			name: "failed task stays a dead letter",
+			run: func(q *WALQueue) {
+				q.Enqueue(ctx, EmailTask{ID: "a", Type: "send"})
+				q.Fail(ctx, claim(q), errors.New("rejected"))
+			},
+			wantDead: 1,
+		},
+		{
+			name: "future task stays scheduled",
+			run: func(q *WALQueue) {
+				q.Schedule(ctx, EmailTask{ID: "a", Type: "send", SendAt: time.Now().Add(time.Hour)})
+			},
+			wantScheduled: 1,
+		},
+		{
+			name: "cancelled task is dropped",
+			run: func(q *WALQueue) {
+				q.Enqueue(ctx, EmailTask{ID: "a", Type: "send"})
+				q.Cancel(ctx, "a")
+			},
+		},
+		{
+			name:      "state survives compaction",
+			compactAt: 2,
+			run: func(q *WALQueue) {
+				for _, id := range []string{"a", "b", "c"} {
+					q.Enqueue(ctx, EmailTask{ID: id, Type: "send"})
+				}
+				q.Complete(ctx, claim(q))
+				q.Fail(ctx, claim(q), errors.New("rejected"))
+			},
+			wantQueued: 1,
+			wantDead:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "queue.wal")
+			compactAt := tt.compactAt
+			if compactAt == 0 {
+				compactAt = 100
+			}
+			q, err := NewWALQueue(NewMemoryQueue(4), path, compactAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.run(q)
+			q.Close()
+
+			q, err = NewWALQueue(NewMemoryQueue(4), path, compactAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer q.Close()
+			if n := q.Ready(); n != tt.wantQueued {
+				t.Errorf("Ready after replay = %d, want %d", n, tt.wantQueued)
+			}
+			if tasks, _ := q.Scheduled(ctx); len(tasks) != tt.wantScheduled {
+				t.Errorf("Scheduled after replay = %d, want %d", len(tasks), tt.wantScheduled)
+			}
+			if items, _ := q.DeadLetters(ctx); len(items) != tt.wantDead {
+				t.Errorf("DeadLetters after replay = %d, want %d", len(items), tt.wantDead)
+			}
+		})
+	}
+}
+
+// Scheduled tasks count against capacity like queued ones, but only queued
+// ones are ready work.
+func TestWALScheduleAtCapacity(t *testing.T) {
+	q, err := NewWALQueue(NewMemoryQueue(1), filepath.Join(t.TempDir(), "queue.wal"), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	ctx := context.Background()
+
+	if err := q.Enqueue(ctx, EmailTask{ID: "now", Type: "send"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"later", "much-later"} {
+		if err := q.Schedule(ctx, EmailTask{ID: id, Type: "send", SendAt: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Schedule(ctx, EmailTask{ID: "too-many", Type: "send", SendAt: time.Now().Add(time.Hour)}); !errors.Is(err, errQueueFull) {
+		t.Errorf("Schedule at capacity = %v, want errQueueFull", err)
+	}
+	if n := q.Len(); n != q.Cap() {
+		t.Errorf("Len = %d, want %d", n, q.Cap())
+	}
+	if n := readyLen(q); n != 1 {
+		t.Errorf("ready = %d, want 1", n)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type CallbackPayload struct {
+	TaskID   string    `json:"task_id"`
+	NoteID   string    `json:"note_id,omitempty"`
+	Status   string    `json:"status"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// Notifier POSTs delivery outcomes to caller-supplied callback URLs. Bodies
+// are signed with HMAC-SHA256 over "<timestamp>.<body>" so receivers can
+// verify origin and reject replays. Callbacks run on the notifier's own
+// context, so stopping the workers does not cut off the ones in flight. A nil
+// Notifier means callbacks are disabled.
+type Notifier struct {
+	secret      []byte
+	client      *http.Client
+	maxAttempts int
+	sem         chan struct{}
+	wg          sync.WaitGroup
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+func NewNotifier(secret string, timeout time.Duration, maxAttempts, concurrency int) (*Notifier, error) {
+	if secret == "" {
+		return nil, errors.New("callbacks need a signing secret: set EMAIL_WEBHOOK_SECRET or EMAIL_CALLBACKS=false")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Notifier{
+		secret:      []byte(secret),
+		client:      &http.Client{Timeout: timeout},
+		maxAttempts: maxAttempts,
+		sem:         make(chan struct{}, concurrency),
+		ctx:         ctx,
+		cancel:      cancel,
+	}, nil
+}
+
+func (n *Notifier) Notify(url string, payload CallbackPayload) {
+	if n == nil || url == "" {
+		return
+	}
+	ctx := n.ctx
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+
+		n.sem <- struct{}{}
+		defer func() { <-n.sem }()
+
+		for attempt := 1; attempt <= n.maxAttempts; attempt++ {
+			err := n.post(ctx, url, payload)
+			if err == nil {
+				slog.Info("Callback delivered", "task_id", payload.TaskID, "url", url, "attempt", attempt)
+				return
+			}
+			slog.Warn("Callback failed", "task_id", payload.TaskID, "url", url,
+				"attempt", attempt, "max_attempts", n.maxAttempts, "error", err)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(attempt*attempt) * time.Second):
+			}
+		}
+	}()
+}
+
+func (n *Notifier) post(ctx context.Context, url string, payload CallbackPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Email-Timestamp", timestamp)
+	req.Header.Set("X-Email-Signature", "sha256="+n.sign(timestamp, body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("callback returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (n *Notifier) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, n.secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Close waits for callbacks in flight, including their retries, until ctx is
+// done, and then abandons the rest.
+func (n *Notifier) Close(ctx context.Context) error {
+	if n == nil {
+		return nil
+	}
+	defer n.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
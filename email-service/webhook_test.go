@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotifierSign(t *testing.T) {
+	n, err := NewNotifier("secret", time.Second, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// HMAC-SHA256("secret", "1700000000.{\"task_id\":\"t1\"}")
+	const want = "4713bd83f6d4c7f0e97c0e224a66883f09173b9aca594a8481838eadb8b67c36"
+	if got := n.sign("1700000000", []byte(`{"task_id":"t1"}`)); got != want {
+		t.Errorf("sign = %s, want %s", got, want)
+	}
+	if n.sign("1700000001", []byte(`{"task_id":"t1"}`)) == want {
+		t.Error("signature does not cover the timestamp")
+	}
+
+	if _, err := NewNotifier("", time.Second, 1, 1); err == nil {
+		t.Error("NewNotifier accepted an empty secret")
+	}
+}
+
+func TestNotifierPost(t *testing.T) {
+	received := make(chan CallbackPayload, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(r.Header.Get("X-Email-Timestamp") + "."))
+		mac.Write(body)
+		if r.Header.Get("X-Email-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		var payload CallbackPayload
+		json.Unmarshal(body, &payload)
+		received <- payload
+	}))
+	defer srv.Close()
+
+	n, err := NewNotifier("secret", time.Second, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Notify(srv.URL, CallbackPayload{TaskID: "t1", Status: "sent"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := n.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case payload := <-received:
+		if payload.TaskID != "t1" || payload.Status != "sent" {
+			t.Errorf("received %+v", payload)
+		}
+	default:
+		t.Fatal("callback was not delivered with a valid signature")
+	}
+
+	var disabled *Notifier
+	disabled.Notify(srv.URL, CallbackPayload{TaskID: "t2"})
+	if err := disabled.Close(ctx); err != nil {
+		t.Errorf("nil Notifier Close = %v", err)
+	}
+}
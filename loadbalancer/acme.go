@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/m-tln/notes/config"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeCerts gets the load balancer's certificate from the mesh CA over
+// ACME instead of from TLS_CERT and TLS_KEY, and presents it both to
+// clients and, as a client certificate, to backends. The CA proves the name
+// with a tls-alpn-01 challenge on the listener.
+type acmeCerts struct {
+	name    string
+	manager *autocert.Manager
+}
+
+// acmeFromEnv configures ACME from ACME_DIRECTORY, ACME_NAME, ACME_CACHE and
+// ACME_RENEW_BEFORE, trusting the CA in CA_CERT. It returns nil if
+// ACME_DIRECTORY isn't set.
+func acmeFromEnv() (*acmeCerts, error) {
+	directory := config.String("ACME_DIRECTORY", "")
+	if directory == "" {
+		return nil, nil
+	}
+	name := config.String("ACME_NAME", "")
+	if name == "" {
+		return nil, fmt.Errorf("ACME_NAME is required with ACME_DIRECTORY")
+	}
+	caFile := config.String("CA_CERT", "")
+	if caFile == "" {
+		return nil, fmt.Errorf("CA_CERT is required with ACME_DIRECTORY")
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CA bundle: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	cacheDir := config.String("ACME_CACHE", "/tmp/loadbalancer-acme")
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &acmeCerts{
+		name: name,
+		manager: &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			HostPolicy:  autocert.HostWhitelist(name),
+			Cache:       autocert.DirCache(cacheDir),
+			RenewBefore: config.Duration("ACME_RENEW_BEFORE", 30*24*time.Hour),
+			Client: &acme.Client{
+				DirectoryURL: directory,
+				HTTPClient: &http.Client{
+					Timeout:   30 * time.Second,
+					Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}},
+				},
+			},
+		},
+	}, nil
+}
+
+// serverConfig is the listener's TLS config: challenge handshakes get the
+// challenge certificate, everyone else the one for the configured name.
+func (a *acmeCerts) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{acme.ALPNProto},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+				return a.manager.GetCertificate(hello)
+			}
+			named := *hello
+			named.ServerName = a.name
+			return a.manager.GetCertificate(&named)
+		},
+	}
+}
+
+// getClientCertificate asks for the same ECDSA certificate clients get; a
+// bare hello would make autocert get an RSA one too.
+func (a *acmeCerts) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return a.manager.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:   a.name,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+}
+
+// prefetch gets the certificate once the listener is up, retrying until the
+// CA issues it.
+func (a *acmeCerts) prefetch() {
+	delay := time.Second
+	for {
+		time.Sleep(delay)
+		cert, err := a.getClientCertificate(nil)
+		if err == nil {
+			slog.Info("ACME certificate obtained", "name", a.name, "not_after", cert.Leaf.NotAfter.Format(time.RFC3339))
+			return
+		}
+		delay = min(2*delay, time.Minute)
+		slog.Warn("Getting an ACME certificate failed", "name", a.name, "retry_in", delay, "error", err)
+	}
+}
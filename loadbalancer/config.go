@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/m-tln/notes/config"
+)
+
+type BackendTLSConfig struct {
+	CAFile             string `json:"ca_file"`
+	CRLFile            string `json:"crl_file"`
+	ServerName         string `json:"server_name"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+	InsecureSkipVerify *bool  `json:"insecure_skip_verify"`
+}
+
+type BackendConfig struct {
+	URL string           `json:"url"`
+	TLS BackendTLSConfig `json:"tls"`
+}
+
+func defaultBackendTLS() BackendTLSConfig {
+	cfg := BackendTLSConfig{
+		CAFile:   config.String("BACKEND_CA_FILE", ""),
+		CRLFile:  config.String("BACKEND_CRL_FILE", ""),
+		CertFile: config.String("BACKEND_CLIENT_CERT", ""),
+		KeyFile:  config.String("BACKEND_CLIENT_KEY", ""),
+	}
+	// Unset leaves it to the CA bundle, so it can't be a plain Bool.
+	if v := config.String("BACKEND_TLS_INSECURE", ""); v != "" {
+		insecure, err := strconv.ParseBool(v)
+		config.Check(err == nil, "BACKEND_TLS_INSECURE: invalid value %q", v)
+		cfg.InsecureSkipVerify = &insecure
+	}
+	return cfg
+}
+
+func loadBackendConfigs(path string) ([]BackendConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []BackendConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	defaults := defaultBackendTLS()
+	for i := range configs {
+		if configs[i].URL == "" {
+			return nil, fmt.Errorf("backend %d: url is required", i)
+		}
+		configs[i].TLS = configs[i].TLS.withDefaults(defaults)
+	}
+	return configs, nil
+}
+
+func (c BackendTLSConfig) withDefaults(d BackendTLSConfig) BackendTLSConfig {
+	if c.CAFile == "" {
+		c.CAFile = d.CAFile
+	}
+	if c.CRLFile == "" {
+		c.CRLFile = d.CRLFile
+	}
+	if c.CertFile == "" && c.KeyFile == "" {
+		c.CertFile = d.CertFile
+		c.KeyFile = d.KeyFile
+	}
+	if c.InsecureSkipVerify == nil {
+		c.InsecureSkipVerify = d.InsecureSkipVerify
+	}
+	return c
+}
+
+// Build returns the client TLS config for a backend. Without a CA bundle or an
+// explicit insecure_skip_verify, verification is skipped as it always was.
+// With a CRL, backends whose certificate it revokes are refused, which needs
+// verification: without it there is no chain to check the CRL's signer on.
+func (c BackendTLSConfig) Build() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: c.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if c.InsecureSkipVerify != nil {
+		cfg.InsecureSkipVerify = *c.InsecureSkipVerify
+	} else {
+		cfg.InsecureSkipVerify = c.CAFile == ""
+	}
+
+	if c.CRLFile != "" {
+		if cfg.InsecureSkipVerify {
+			return nil, fmt.Errorf("crl_file %s needs the backend certificate verified: set ca_file, without insecure_skip_verify", c.CRLFile)
+		}
+		crl, err := loadCRL(c.CRLFile)
+		if err != nil {
+			return nil, fmt.Errorf("load CRL: %w", err)
+		}
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return crl.verify(cs.VerifiedChains)
+		}
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
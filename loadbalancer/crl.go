@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// crlUnchecked counts backend handshakes whose certificate no CRL could
+// check, for /status.
+var crlUnchecked atomic.Int64
+
+// crlFile is the mesh CA's revocation list, read again when the file
+// changes. A file that fails to load keeps the list in use, and a list from
+// another CA says nothing about the backend: it is let through, counted in
+// crlUnchecked and logged once per issuer.
+type crlFile struct {
+	path string
+
+	mu        sync.Mutex
+	list      *x509.RevocationList
+	revoked   map[string]bool
+	signer    []byte
+	warned    map[string]bool
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func loadCRL(path string) (*crlFile, error) {
+	c := &crlFile{path: path}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *crlFile) load() error {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(c.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", c.path, err)
+	}
+	revoked := make(map[string]bool, len(list.RevokedCertificateEntries))
+	for _, entry := range list.RevokedCertificateEntries {
+		revoked[entry.SerialNumber.String()] = true
+	}
+	c.list, c.revoked, c.signer, c.warned, c.modTime = list, revoked, nil, make(map[string]bool), info.ModTime()
+	return nil
+}
+
+func (c *crlFile) verify(chains [][]*x509.Certificate) error {
+	if len(chains) == 0 || len(chains[0]) < 2 {
+		return nil
+	}
+	leaf, issuer := chains[0][0], chains[0][1]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := time.Now(); now.Sub(c.lastCheck) >= time.Second {
+		c.lastCheck = now
+		if err := c.load(); err != nil {
+			slog.Warn("CRL reload failed, keeping the current list", "error", err)
+		}
+	}
+	if !bytes.Equal(c.signer, issuer.Raw) {
+		if !bytes.Equal(c.list.RawIssuer, leaf.RawIssuer) || c.list.CheckSignatureFrom(issuer) != nil {
+			c.unchecked(leaf, issuer)
+			return nil
+		}
+		c.signer = issuer.Raw
+	}
+	if c.revoked[leaf.SerialNumber.String()] {
+		return fmt.Errorf("certificate %x of %q is revoked", leaf.SerialNumber, leaf.Subject.CommonName)
+	}
+	return nil
+}
+
+func (c *crlFile) unchecked(leaf, issuer *x509.Certificate) {
+	crlUnchecked.Add(1)
+	if c.warned[string(issuer.Raw)] {
+		return
+	}
+	c.warned[string(issuer.Raw)] = true
+	slog.Warn("CRL is not signed by the backend's issuer, revocation not checked",
+		"backend", leaf.Subject.CommonName, "issuer", issuer.Subject.String(), "crl_issuer", c.list.Issuer.String())
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type trustedProxies []netip.Prefix
+
+func parseTrustedProxies(s string) (trustedProxies, error) {
+	var prefixes trustedProxies
+	for part := range strings.SplitSeq(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			addr, err := netip.ParseAddr(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", part, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", part, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func (t trustedProxies) Contains(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range t {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientIP walks X-Forwarded-For from the right and returns the first hop
+// that is not a trusted proxy. Headers from untrusted peers are ignored.
+func (t trustedProxies) clientIP(r *http.Request) string {
+	peer := remoteIP(r)
+	if !t.Contains(peer) {
+		return peer
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !t.Contains(hop) {
+			return hop
+		}
+		peer = hop
+	}
+	return peer
+}
+
+// setForwardedHeaders prepares forwarding headers on the outgoing request.
+// X-Forwarded-For itself is appended to by httputil.ReverseProxy, so it is
+// only cleared here when the peer is not allowed to set it.
+func (t trustedProxies) setForwardedHeaders(req *http.Request) {
+	trusted := t.Contains(remoteIP(req))
+
+	if !trusted {
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Del("X-Forwarded-Host")
+		req.Header.Del("X-Forwarded-Proto")
+	}
+
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", "https")
+	}
+	req.Header.Set("X-Real-IP", t.clientIP(req))
+}
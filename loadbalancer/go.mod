@@ -1,3 +1,16 @@
 module note-service/loadbalancer
 
 go 1.25.5
+
+require (
+	github.com/m-tln/notes v0.0.0-00010101000000-000000000000
+	golang.org/x/crypto v0.49.0
+)
+
+require (
+	golang.org/x/net v0.51.0 // indirect
+	golang.org/x/text v0.35.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace github.com/m-tln/notes => ../
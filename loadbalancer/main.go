@@ -5,17 +5,22 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/m-tln/notes/config"
+	"github.com/m-tln/notes/logging"
 )
 
 type Backend struct {
@@ -25,6 +30,7 @@ type Backend struct {
 	ReverseProxy *httputil.ReverseProxy
 	FailureCount int
 	LastCheck    time.Time
+	Transport    *http.Transport
 }
 
 func (b *Backend) SetAlive(alive bool) {
@@ -87,119 +93,235 @@ func (s *ServerPool) GetNextPeer() *Backend {
 }
 
 func (s *ServerPool) HealthCheck() {
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
-	}
-
-	client := http.Client{
-		Timeout:   2 * time.Second,
-		Transport: transport,
-	}
-
 	for _, b := range s.backends {
 		if !b.IsAlive() && b.FailureCount > 3 && time.Since(b.LastCheck) < 30*time.Second {
-			log.Printf("Backend %s is in circuit breaker state (failures: %d)", b.URL.String(), b.FailureCount)
+			slog.Debug("Backend is in circuit breaker state", "backend", b.URL.String(), "failures", b.FailureCount)
 			continue
 		}
 
 		status := b.IsAlive()
 
+		client := http.Client{
+			Timeout:   2 * time.Second,
+			Transport: b.Transport,
+		}
+
 		resp, err := client.Get(b.URL.String() + "/health")
 		if err != nil {
-			log.Printf("Backend %s is down: %v", b.URL.String(), err)
+			slog.Warn("Backend is down", "backend", b.URL.String(), "error", err)
 			b.SetAlive(false)
 			continue
 		}
 		resp.Body.Close()
 
 		if resp.StatusCode != http.StatusOK {
-			log.Printf("Backend %s returned non-200: %d", b.URL.String(), resp.StatusCode)
+			slog.Warn("Backend returned non-200", "backend", b.URL.String(), "status", resp.StatusCode)
 			b.SetAlive(false)
 			continue
 		}
 
 		if !status {
-			log.Printf("Backend %s is back up (was down for %v)", b.URL.String(), time.Since(b.LastCheck))
+			slog.Info("Backend is back up", "backend", b.URL.String(), "down_for", time.Since(b.LastCheck))
 		}
 		b.SetAlive(true)
 	}
 }
 
 func loadBalancer(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
 	peer := serverPool.GetNextPeer()
 	if peer != nil {
-		log.Printf("Routing request to: %s", peer.URL.String())
+		logger.Debug("Routing request", "backend", peer.URL.String(), "method", r.Method, "path", r.URL.Path)
+		if isStreamingRequest(r) {
+			extendDeadlines(w, r)
+		}
 		peer.ReverseProxy.ServeHTTP(w, r)
 		return
 	}
-	log.Printf("No healthy backends available")
+	logger.Error("No healthy backends available")
 	http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
 }
 
 var serverPool ServerPool
 
+var (
+	inFlight int64
+	draining atomic.Bool
+)
+
+func trackInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// drain fails /health and /status at once but keeps serving for delay, so
+// whatever probes them takes the load balancer out of rotation before the
+// listener closes; in-flight requests then get until timeout to finish.
+func drain(server *http.Server, delay, timeout time.Duration) {
+	draining.Store(true)
+	server.SetKeepAlivesEnabled(false)
+	slog.Info("Draining: marked not ready", "in_flight", atomic.LoadInt64(&inFlight), "close_in", delay)
+	time.Sleep(delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Shutdown(ctx)
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				slog.Warn("Forced shutdown", "in_flight", atomic.LoadInt64(&inFlight), "error", err)
+				return
+			}
+			slog.Info("Draining: all in-flight requests completed")
+			return
+		case <-ticker.C:
+			slog.Info("Draining", "in_flight", atomic.LoadInt64(&inFlight))
+		}
+	}
+}
+
 func main() {
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	configErr := config.Load("LOADBALANCER_CONFIG", os.Args[1:])
+	logging.Setup("loadbalancer")
+	if configErr != nil {
+		logging.Fatal("Invalid configuration", "error", configErr)
+	}
 
-	var backends []string
+	var backends []BackendConfig
 
-	if envBackends := os.Getenv("BACKENDS"); envBackends != "" {
-		log.Printf("Parsing backends from environment variable: %s", envBackends)
-		backends = parseBackendsFromEnv(envBackends)
+	if configFile := config.String("BACKENDS_CONFIG", ""); configFile != "" {
+		slog.Info("Loading backends from config file", "path", configFile)
+		var err error
+		backends, err = loadBackendConfigs(configFile)
+		if err != nil {
+			logging.Fatal("Failed to load backends config", "error", err)
+		}
 	} else {
-		backends = []string{
-			"http://app1:8080",
-			"http://app2:8080",
-			"http://app3:8080",
+		var urls []string
+		if envBackends := config.String("BACKENDS", ""); envBackends != "" {
+			slog.Info("Parsing backends from BACKENDS", "backends", envBackends)
+			urls = parseBackendsFromEnv(envBackends)
+		} else {
+			urls = []string{
+				"http://app1:8080",
+				"http://app2:8080",
+				"http://app3:8080",
+			}
+			slog.Info("Using default backends", "backends", urls)
+		}
+
+		defaults := defaultBackendTLS()
+		for _, u := range urls {
+			backends = append(backends, BackendConfig{URL: u, TLS: defaults})
 		}
-		log.Printf("Using default backends: %v", backends)
 	}
 
 	if len(backends) == 0 {
-		log.Fatal("No backends configured. Set BACKENDS environment variable with comma-separated URLs")
+		logging.Fatal("No backends configured. Set BACKENDS environment variable with comma-separated URLs or BACKENDS_CONFIG")
 	}
 
-	log.Printf("Initializing load balancer with %d backends", len(backends))
+	slog.Info("Initializing load balancer", "backends", len(backends))
+
+	trusted, err := parseTrustedProxies(config.String("TRUSTED_PROXIES", ""))
+	if err != nil {
+		logging.Fatal("Failed to parse TRUSTED_PROXIES", "error", err)
+	}
+	slog.Info("Trusted proxies", "proxies", trusted)
+
+	certs, err := acmeFromEnv()
+	if err != nil {
+		logging.Fatal("Failed to configure ACME", "error", err)
+	}
+
+	flushInterval := config.Duration("FLUSH_INTERVAL", 100*time.Millisecond)
+	responseHeaderTimeout := config.Duration("BACKEND_RESPONSE_HEADER_TIMEOUT", 2*time.Second)
+	streamTimeout = config.Duration("STREAM_TIMEOUT", 0)
+	longPollPaths = config.List("LONG_POLL_PATHS", "")
+	debug := config.Bool("DEBUG", false)
+	port := config.Int("PORT", 443)
+	shutdownDelay := config.Duration("SHUTDOWN_DELAY", 10*time.Second)
+	drainTimeout := config.Duration("DRAIN_TIMEOUT", 30*time.Second)
+	readTimeout := config.Duration("READ_TIMEOUT", 5*time.Second)
+	writeTimeout := config.Duration("WRITE_TIMEOUT", 10*time.Second)
+	adminPort := config.String("ADMIN_PORT", "")
+	adminBind := config.String("ADMIN_BIND", "127.0.0.1")
+	certFile := config.String("TLS_CERT", "")
+	keyFile := config.String("TLS_KEY", "")
+	if certs != nil {
+		certFile, keyFile = "", ""
+	} else {
+		config.Check(certFile != "" && keyFile != "", "TLS_CERT and TLS_KEY are required for HTTPS")
+	}
+
+	config.Dump()
+	if err := config.Err(); err != nil {
+		logging.Fatal("Invalid configuration", "error", err)
+	}
 
 	for _, b := range backends {
-		backendUrl, err := url.Parse(b)
+		backendUrl, err := url.Parse(b.URL)
 		if err != nil {
-			log.Fatalf("Failed to parse backend URL %s: %v", b, err)
+			logging.Fatal("Failed to parse backend URL", "backend", b.URL, "error", err)
+		}
+
+		tlsConfig, err := b.TLS.Build()
+		if err != nil {
+			logging.Fatal("Failed to configure TLS for backend", "backend", b.URL, "error", err)
+		}
+		if certs != nil && len(tlsConfig.Certificates) == 0 {
+			tlsConfig.GetClientCertificate = certs.getClientCertificate
 		}
 
 		proxy := httputil.NewSingleHostReverseProxy(backendUrl)
+		proxy.FlushInterval = flushInterval
 
-		proxy.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-			ResponseHeaderTimeout: 2 * time.Second,
+		transport := &http.Transport{
+			TLSClientConfig:       tlsConfig,
+			ResponseHeaderTimeout: responseHeaderTimeout,
 			IdleConnTimeout:       2 * time.Second,
 			MaxIdleConns:          100,
 			MaxIdleConnsPerHost:   100,
 		}
+		stream := transport.Clone()
+		stream.ResponseHeaderTimeout = 0
+		proxy.Transport = streamAwareTransport{normal: transport, stream: stream}
 
 		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-			log.Printf("Error proxying to %s: %v", backendUrl.String(), err)
+			logger := logging.FromContext(r.Context())
+			logger.Error("Error proxying", "backend", backendUrl.String(), "error", err)
 			serverPool.MarkBackendStatus(backendUrl, false)
 
+			if !canRetry(r) {
+				logger.Warn("Not retrying request with a partially sent body")
+				http.Error(w, "Bad gateway", http.StatusBadGateway)
+				return
+			}
+
 			peer := serverPool.GetNextPeer()
 			if peer != nil && peer.URL.String() != backendUrl.String() {
-				log.Printf("Retrying request with: %s", peer.URL.String())
+				logger.Info("Retrying request", "backend", peer.URL.String())
 				peer.ReverseProxy.ServeHTTP(w, r)
 				return
 			}
 
-			log.Printf("No healthy backends available for retry")
+			logger.Error("No healthy backends available for retry")
 			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
 		}
 
 		proxy.Director = func(req *http.Request) {
-			req.Header.Set("X-Forwarded-Host", req.Host)
-			req.Header.Set("X-Forwarded-Proto", "https")
-			req.Header.Set("X-Real-IP", req.RemoteAddr)
+			trusted.setForwardedHeaders(req)
 			req.URL.Scheme = backendUrl.Scheme
 			req.URL.Host = backendUrl.Host
 			req.Host = backendUrl.Host
@@ -210,34 +332,34 @@ func main() {
 			Alive:        true,
 			ReverseProxy: proxy,
 			LastCheck:    time.Now(),
+			Transport:    transport,
 		})
 
-		log.Printf("Configured backend: %s", backendUrl.String())
+		slog.Info("Configured backend", "backend", backendUrl.String(), "server_name", tlsConfig.ServerName,
+			"ca", b.TLS.CAFile, "skip_verify", tlsConfig.InsecureSkipVerify)
 	}
 
 	go func() {
 		time.Sleep(5 * time.Second)
-		log.Println("Performing initial health check...")
+		slog.Info("Performing initial health check")
 		serverPool.HealthCheck()
 
 		ticker := time.NewTicker(10 * time.Second)
 		defer ticker.Stop()
 
 		for range ticker.C {
-			log.Println("Starting periodic health check...")
+			slog.Debug("Starting periodic health check")
 			serverPool.HealthCheck()
 			healthyCount := countHealthyBackends()
-			log.Printf("Health check completed. Healthy backends: %d/%d",
-				healthyCount, len(serverPool.backends))
+			slog.Debug("Health check completed", "healthy", healthyCount, "backends", len(serverPool.backends))
 
-			if os.Getenv("DEBUG") == "true" {
+			if debug {
 				for i, b := range serverPool.backends {
 					status := "up"
 					if !b.IsAlive() {
 						status = "down"
 					}
-					log.Printf("  Backend %d: %s [%s] failures: %d",
-						i, b.URL.String(), status, b.FailureCount)
+					slog.Info("Backend status", "index", i, "backend", b.URL.String(), "status", status, "failures", b.FailureCount)
 				}
 			}
 		}
@@ -248,52 +370,52 @@ func main() {
 	mux.HandleFunc("/health", healthHandler)
 	mux.HandleFunc("/status", statusHandler)
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "443"
-	}
-
 	server := &http.Server{
-		Addr:         ":" + port,
-		Handler:      mux,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  120 * time.Second,
+		Addr:              ":" + strconv.Itoa(port),
+		Handler:           trackInFlight(logging.Middleware(mux)),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       120 * time.Second,
 		TLSConfig: &tls.Config{
-            MinVersion: tls.VersionTLS12,
-        },
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+
+	if certs != nil {
+		server.TLSConfig = certs.serverConfig()
+		go certs.prefetch()
+	}
+
+	if adminPort != "" {
+		admin := http.NewServeMux()
+		admin.Handle("/log/level", logging.LevelHandler())
+		go func() {
+			// /log/level has no authentication, so only local callers reach it.
+			addr := net.JoinHostPort(adminBind, adminPort)
+			slog.Info("Admin endpoints listening", "addr", addr)
+			logging.Fatal("Admin server failed", "error", http.ListenAndServe(addr, admin))
+		}()
 	}
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
 
 	go func() {
-		log.Printf("Load balancer server starting on port %s (HTTPS)", port)
-        log.Printf("Monitoring %d backends", len(serverPool.backends))
-        
-        certFile := os.Getenv("TLS_CERT")
-        keyFile := os.Getenv("TLS_KEY")
-        
-        if certFile != "" && keyFile != "" {
-            if err := server.ListenAndServeTLS(certFile, keyFile); err != nil && err != http.ErrServerClosed {
-                log.Fatalf("Server error: %v", err)
-            }
-        } else {
-            log.Fatal("TLS_CERT and TLS_KEY environment variables are required for HTTPS")
-        }
+		slog.Info("Load balancer server starting (HTTPS)", "port", port)
+		slog.Info("Monitoring backends", "backends", len(serverPool.backends))
+
+		if err := server.ListenAndServeTLS(certFile, keyFile); err != nil && err != http.ErrServerClosed {
+			logging.Fatal("Server error", "error", err)
+		}
 	}()
 
 	<-stop
-	log.Println("Shutdown signal received...")
+	slog.Info("Shutdown signal received")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("Forced shutdown: %v", err)
-	}
+	drain(server, shutdownDelay, drainTimeout)
 
-	log.Println("Load balancer stopped gracefully")
+	slog.Info("Load balancer stopped")
 }
 
 func parseBackendsFromEnv(envString string) []string {
@@ -306,7 +428,7 @@ func parseBackendsFromEnv(envString string) []string {
 		if backend != "" {
 			if !strings.HasPrefix(backend, "http://") && !strings.HasPrefix(backend, "https://") {
 				backend = "http://" + backend
-				log.Printf("Added http:// prefix to backend: %s", backend)
+				slog.Info("Added http:// prefix to backend", "backend", backend)
 			}
 			backends = append(backends, backend)
 		}
@@ -326,18 +448,24 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	type StatusResponse struct {
-		Status          string          `json:"status"`
-		TotalBackends   int             `json:"total_backends"`
-		HealthyBackends int             `json:"healthy_backends"`
-		CurrentIndex    int             `json:"current_index"`
-		Backends        []BackendStatus `json:"backends"`
+		Status           string          `json:"status"`
+		Draining         bool            `json:"draining"`
+		InFlightRequests int64           `json:"in_flight_requests"`
+		TotalBackends    int             `json:"total_backends"`
+		HealthyBackends  int             `json:"healthy_backends"`
+		CurrentIndex     int             `json:"current_index"`
+		CRLUnchecked     int64           `json:"crl_unchecked"`
+		Backends         []BackendStatus `json:"backends"`
 	}
 
 	response := StatusResponse{
-		Status:          "operational",
-		TotalBackends:   len(serverPool.backends),
-		HealthyBackends: countHealthyBackends(),
-		CurrentIndex:    int(atomic.LoadUint64(&serverPool.current)),
+		Status:           "operational",
+		Draining:         draining.Load(),
+		InFlightRequests: atomic.LoadInt64(&inFlight),
+		TotalBackends:    len(serverPool.backends),
+		HealthyBackends:  countHealthyBackends(),
+		CurrentIndex:     int(atomic.LoadUint64(&serverPool.current)),
+		CRLUnchecked:     crlUnchecked.Load(),
 	}
 
 	for _, b := range serverPool.backends {
@@ -357,7 +485,10 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 		response.Backends = append(response.Backends, backendStatus)
 	}
 
-	if response.HealthyBackends == 0 {
+	if response.Draining {
+		response.Status = "draining"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else if response.HealthyBackends == 0 {
 		response.Status = "degraded"
 		w.WriteHeader(http.StatusServiceUnavailable)
 	}
@@ -366,6 +497,12 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "DRAINING: %d in-flight requests", atomic.LoadInt64(&inFlight))
+		return
+	}
+
 	healthyCount := countHealthyBackends()
 
 	if healthyCount == 0 {
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/m-tln/notes/logging"
+)
+
+const largeBodyThreshold = 1 << 20
+
+// streamTimeout is STREAM_TIMEOUT and longPollPaths LONG_POLL_PATHS, read
+// at startup.
+var (
+	streamTimeout time.Duration
+	longPollPaths []string
+)
+
+func isStreamingRequest(r *http.Request) bool {
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") || isLongPoll(r.URL.Path) {
+		return true
+	}
+	return r.ContentLength < 0 || r.ContentLength > largeBodyThreshold
+}
+
+// isLongPoll matches path against LONG_POLL_PATHS, where a trailing * matches
+// any suffix. A backend holds such a request until it has something to say,
+// so neither it nor its response headers are on the usual clock.
+func isLongPoll(path string) bool {
+	for _, pattern := range longPollPaths {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(path, prefix) || pattern == path {
+			return true
+		}
+	}
+	return false
+}
+
+// streamAwareTransport sends streaming requests through a transport without
+// the response header timeout, which a long poll would always run into.
+type streamAwareTransport struct {
+	normal http.RoundTripper
+	stream http.RoundTripper
+}
+
+func (t streamAwareTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if isStreamingRequest(r) {
+		return t.stream.RoundTrip(r)
+	}
+	return t.normal.RoundTrip(r)
+}
+
+// extendDeadlines lifts the server-wide read/write timeouts for SSE,
+// long-poll and large or chunked bodies, which would otherwise be cut off.
+func extendDeadlines(w http.ResponseWriter, r *http.Request) {
+	var deadline time.Time
+	if streamTimeout > 0 {
+		deadline = time.Now().Add(streamTimeout)
+	}
+
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(deadline); err != nil {
+		logging.FromContext(r.Context()).Warn("Failed to extend read deadline", "path", r.URL.Path, "error", err)
+	}
+	if err := rc.SetWriteDeadline(deadline); err != nil {
+		logging.FromContext(r.Context()).Warn("Failed to extend write deadline", "path", r.URL.Path, "error", err)
+	}
+}
+
+func canRetry(r *http.Request) bool {
+	return r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0
+}
@@ -0,0 +1,128 @@
+// Package logging sets up the structured logger every service logs through:
+// JSON lines on stderr, or key=value with LOG_FORMAT=text, from LOG_LEVEL up,
+// each with the service and the instance it comes from. Request and task IDs
+// travel in the context, so every line about one request or task carries
+// them, and LevelHandler changes the level while the service runs.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/m-tln/notes/config"
+)
+
+var level = new(slog.LevelVar)
+
+// Setup installs the default logger for service. The instance is INSTANCE,
+// or the host name, which in a container is its ID. Whatever still writes
+// through the log package ends up in the same stream at info level.
+func Setup(service string) {
+	if err := level.UnmarshalText([]byte(config.String("LOG_LEVEL", "info"))); err != nil {
+		config.Check(false, "LOG_LEVEL: %v", err)
+	}
+	host, _ := os.Hostname()
+	instance := config.String("INSTANCE", host)
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch format := config.String("LOG_FORMAT", "json"); strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		config.Check(strings.EqualFold(format, "json"), "LOG_FORMAT: want json or text, not %q", format)
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler).With("service", service, "instance", instance))
+}
+
+// Fatal logs msg as an error and exits.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// LevelHandler shows the level on GET and sets it on PUT or POST, from
+// ?level= or a JSON body {"level": "debug"}. It is meant for admin ports
+// and endpoints only.
+func LevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			req := struct {
+				Level string `json:"level"`
+			}{Level: r.URL.Query().Get("level")}
+			if req.Level == "" {
+				if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil {
+					http.Error(w, "want ?level= or {\"level\": ...}", http.StatusBadRequest)
+					return
+				}
+			}
+			old := level.Level()
+			if err := level.UnmarshalText([]byte(req.Level)); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			slog.Warn("Log level changed", "from", old.String(), "to", level.Level().String(), "remote_addr", r.RemoteAddr)
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"level": level.Level().String()})
+	})
+}
+
+type loggerKey struct{}
+
+// NewContext returns ctx carrying logger, so code further down logs with
+// the same correlation fields.
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext is the logger stored in ctx, or the default one.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+const RequestIDHeader = "X-Request-ID"
+
+// RequestID keeps the caller's ID so the load balancer's, the sidecar's and
+// the service's logs line up, and makes one up when there is none or it
+// isn't something that can safely go into logs.
+func RequestID(r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if len(id) == 0 || len(id) > 128 {
+		return rand.Text()
+	}
+	for _, c := range []byte(id) {
+		if c <= ' ' || c >= 0x7f || c == '"' || c == '\\' {
+			return rand.Text()
+		}
+	}
+	return id
+}
+
+// Middleware gives every request its ID, passes it on in the request
+// headers and back in the response's, and puts a logger with request_id in
+// the request's context.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := RequestID(r)
+		r.Header.Set(RequestIDHeader, id)
+		w.Header().Set(RequestIDHeader, id)
+		ctx := NewContext(r.Context(), FromContext(r.Context()).With("request_id", id))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
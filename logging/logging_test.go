@@ -0,0 +1,93 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		keep bool
+	}{
+		{"caller's ID", "3QKJ7Z2WBXN5MVYH6FQOTRL4DE", true},
+		{"none", "", false},
+		{"too long", strings.Repeat("a", 129), false},
+		{"space", "a b", false},
+		{"quote", `a"b`, false},
+		{"backslash", `a\b`, false},
+		{"non-ASCII", "ид", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set(RequestIDHeader, tt.id)
+			got := RequestID(r)
+			if (got == tt.id) != tt.keep {
+				t.Errorf("RequestID(%q) = %q, want kept=%v", tt.id, got, tt.keep)
+			}
+			if got == "" {
+				t.Error("RequestID returned an empty ID")
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	var seen string
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get(RequestIDHeader)
+		FromContext(r.Context()).Info("handled")
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(RequestIDHeader, "abc")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+
+	if seen != "abc" || rec.Header().Get(RequestIDHeader) != "abc" {
+		t.Errorf("request ID = %q, response ID = %q, want abc", seen, rec.Header().Get(RequestIDHeader))
+	}
+	if !strings.Contains(buf.String(), "request_id=abc") {
+		t.Errorf("log line %q has no request_id", buf.String())
+	}
+}
+
+func TestLevelHandler(t *testing.T) {
+	defer level.Set(level.Level())
+	level.Set(slog.LevelInfo)
+	h := LevelHandler()
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := do(http.MethodGet, "/log/level", ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"INFO"`) {
+		t.Errorf("GET = %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPut, "/log/level?level=debug", ""); rec.Code != http.StatusOK || level.Level() != slog.LevelDebug {
+		t.Errorf("PUT ?level=debug = %d, level %s", rec.Code, level.Level())
+	}
+	if rec := do(http.MethodPost, "/log/level", `{"level": "warn"}`); rec.Code != http.StatusOK || level.Level() != slog.LevelWarn {
+		t.Errorf("POST {warn} = %d, level %s", rec.Code, level.Level())
+	}
+	if rec := do(http.MethodPut, "/log/level?level=loud", ""); rec.Code != http.StatusBadRequest || level.Level() != slog.LevelWarn {
+		t.Errorf("PUT ?level=loud = %d, level %s", rec.Code, level.Level())
+	}
+	if rec := do(http.MethodPost, "/log/level", "debug"); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST without JSON = %d, want 400", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/log/level", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE = %d, want 405", rec.Code)
+	}
+}
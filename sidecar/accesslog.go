@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SampleRule logs Rate (0 to 1) of the requests whose path matches Path,
+// which may end in "*" to match by prefix.
+type SampleRule struct {
+	Path string  `yaml:"path"`
+	Rate float64 `yaml:"rate"`
+}
+
+// AccessLogConfig samples access log lines by path; the first matching rule
+// wins and unmatched paths are always logged. Failed requests, with a status
+// of 400 and above or a non-zero grpc-status, are logged whatever the rules
+// say.
+type AccessLogConfig struct {
+	Sample []SampleRule `yaml:"sample"`
+}
+
+func (c *AccessLogConfig) sampled(path string, failed bool) bool {
+	if failed {
+		return true
+	}
+	for _, rule := range c.Sample {
+		if matchPath(rule.Path, path) {
+			return rule.Rate >= 1 || rand.Float64() < rule.Rate
+		}
+	}
+	return true
+}
+
+// accessLogger writes one JSON line per proxied request to stdout, apart
+// from the operational log on stderr.
+var accessLogger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// upstreamTiming collects what the upstream transport saw of one request.
+// Attempts run one after another, so it needs no locking.
+type upstreamTiming struct {
+	attempts int
+	latency  time.Duration
+	replica  string
+}
+
+type upstreamTimingKey struct{}
+
+func withUpstreamTiming(ctx context.Context) (context.Context, *upstreamTiming) {
+	t := &upstreamTiming{}
+	return context.WithValue(ctx, upstreamTimingKey{}, t), t
+}
+
+func recordUpstreamTiming(ctx context.Context, d time.Duration) {
+	if t, ok := ctx.Value(upstreamTimingKey{}).(*upstreamTiming); ok {
+		t.attempts++
+		t.latency += d
+	}
+}
+
+// recordUpstreamReplica notes the replica of the latest attempt.
+func recordUpstreamReplica(ctx context.Context, replica string) {
+	if t, ok := ctx.Value(upstreamTimingKey{}).(*upstreamTiming); ok {
+		t.replica = replica
+	}
+}
+
+type accessEntry struct {
+	requestID string
+	r         *http.Request
+	upstream  string
+	rec       *statusRecorder
+	start     time.Time
+	timing    *upstreamTiming
+}
+
+func (s *SidecarProxy) logAccess(e accessEntry) {
+	grpcCode := grpcStatus(e.rec.Header())
+	failed := e.rec.status >= http.StatusBadRequest || grpcCode != "" && grpcCode != "0"
+	if !s.accessLog.Load().sampled(e.r.URL.Path, failed) {
+		return
+	}
+	clientIP, _, err := net.SplitHostPort(e.r.RemoteAddr)
+	if err != nil {
+		clientIP = e.r.RemoteAddr
+	}
+	attrs := []slog.Attr{
+		slog.String("request_id", e.requestID),
+		slog.String("client", peerIdentity(e.r)),
+		slog.String("spiffe_id", peerSPIFFEID(e.r)),
+		slog.String("client_ip", clientIP),
+		slog.String("method", e.r.Method),
+		slog.String("path", e.r.URL.Path),
+		slog.String("proto", e.r.Proto),
+		slog.Int("status", e.rec.status),
+		slog.Int64("bytes", e.rec.bytes),
+		slog.Float64("duration_ms", milliseconds(time.Since(e.start))),
+		slog.String("upstream", e.upstream),
+		slog.String("replica", e.timing.replica),
+		slog.Int("upstream_attempts", e.timing.attempts),
+		slog.Float64("upstream_latency_ms", milliseconds(e.timing.latency)),
+		slog.String("user_agent", e.r.UserAgent()),
+	}
+	if grpcCode != "" {
+		attrs = append(attrs, slog.String("grpc_status", grpcCode))
+	}
+	accessLogger.LogAttrs(context.Background(), slog.LevelInfo, "access", attrs...)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// parseSampleRules reads "path=rate,..." pairs.
+func parseSampleRules(s string) ([]SampleRule, error) {
+	var rules []SampleRule
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		path, rate, ok := strings.Cut(item, "=")
+		path = strings.TrimSpace(path)
+		if !ok || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("%q: want /path=rate", item)
+		}
+		r, err := strconv.ParseFloat(strings.TrimSpace(rate), 64)
+		if err != nil || r < 0 || r > 1 {
+			return nil, fmt.Errorf("%q: rate must be between 0 and 1", item)
+		}
+		rules = append(rules, SampleRule{Path: path, Rate: r})
+	}
+	return rules, nil
+}
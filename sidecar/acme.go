@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEConfig gets the sidecar's certificate from the mesh CA over ACME
+// instead of from files. Name is the DNS name the certificate is for; the
+// CA proves it with a tls-alpn-01 challenge on the sidecar's port.
+type ACMEConfig struct {
+	Directory   string        `yaml:"directory"`
+	Name        string        `yaml:"name"`
+	CacheDir    string        `yaml:"cache_dir"`
+	RenewBefore time.Duration `yaml:"renew_before"`
+}
+
+// certSource supplies the sidecar's own certificate for its listener and
+// for egress connections.
+type certSource interface {
+	GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+}
+
+// ACMECerts is a certSource backed by autocert, which keeps the
+// certificate in CacheDir and renews it RenewBefore its expiry.
+type ACMECerts struct {
+	name    string
+	manager *autocert.Manager
+}
+
+func NewACMECerts(cfg ACMEConfig, roots *x509.CertPool) (*ACMECerts, error) {
+	if err := os.MkdirAll(cfg.CacheDir, 0700); err != nil {
+		return nil, err
+	}
+	return &ACMECerts{
+		name: cfg.Name,
+		manager: &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			HostPolicy:  autocert.HostWhitelist(cfg.Name),
+			Cache:       autocert.DirCache(cfg.CacheDir),
+			RenewBefore: cfg.RenewBefore,
+			Client: &acme.Client{
+				DirectoryURL: cfg.Directory,
+				HTTPClient: &http.Client{
+					Timeout:   30 * time.Second,
+					Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}},
+				},
+			},
+		},
+	}, nil
+}
+
+// GetCertificate answers challenge handshakes from the CA and otherwise
+// serves the certificate for the configured name, whatever name the client
+// asked for, as the file-based certificate would.
+func (a *ACMECerts) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+		return a.manager.GetCertificate(hello)
+	}
+	named := *hello
+	named.ServerName = a.name
+	return a.manager.GetCertificate(&named)
+}
+
+// GetClientCertificate asks for the same ECDSA certificate the listener
+// serves to mesh peers; a bare hello would make autocert get an RSA one too.
+func (a *ACMECerts) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return a.manager.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:   a.name,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+}
+
+// Prefetch gets the certificate once the listener is up rather than on the
+// first handshake, retrying until the CA issues it.
+func (a *ACMECerts) Prefetch() {
+	delay := time.Second
+	for {
+		time.Sleep(delay)
+		cert, err := a.GetClientCertificate(nil)
+		if err == nil {
+			slog.Info("Certificate obtained", "component", "acme", "name", a.name, "not_after", cert.Leaf.NotAfter.Format(time.RFC3339))
+			return
+		}
+		delay = min(2*delay, time.Minute)
+		slog.Warn("Getting a certificate failed", "component", "acme", "name", a.name, "retry_in", delay, "error", err)
+	}
+}
+
+// acceptACMEChallenges lets the CA's tls-alpn-01 handshakes through
+// without a client certificate. They negotiate only acme-tls/1, so the
+// HTTP server closes them right after the handshake.
+func acceptACMEChallenges(cfg *tls.Config) {
+	next := cfg.GetConfigForClient
+	challenge := &tls.Config{
+		GetCertificate: cfg.GetCertificate,
+		NextProtos:     []string{acme.ALPNProto},
+		MinVersion:     tls.VersionTLS12,
+	}
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+			return challenge, nil
+		}
+		if next != nil {
+			return next(hello)
+		}
+		return nil, nil
+	}
+}
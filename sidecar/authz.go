@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AuthzRule lets the listed identities (SPIFFE IDs, common names or DNS
+// SANs) call the listed methods on the listed paths. "*" matches any identity
+// or method, including callers without a verified certificate; an identity or
+// path ending in "*" matches by prefix.
+type AuthzRule struct {
+	Identities []string `json:"identities"`
+	Methods    []string `json:"methods"`
+	Paths      []string `json:"paths"`
+}
+
+// AuthzPolicy allows a request if any rule matches it.
+type AuthzPolicy struct {
+	Rules []AuthzRule `json:"rules"`
+}
+
+func loadAuthzPolicy(path string) (*AuthzPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policy AuthzPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i, rule := range policy.Rules {
+		if len(rule.Identities) == 0 || len(rule.Methods) == 0 || len(rule.Paths) == 0 {
+			return nil, fmt.Errorf("rule %d: identities, methods and paths are required", i)
+		}
+		for _, p := range rule.Paths {
+			if !strings.HasPrefix(p, "/") && p != "*" {
+				return nil, fmt.Errorf("rule %d: path %q must start with /", i, p)
+			}
+		}
+	}
+	return &policy, nil
+}
+
+// Allows refuses paths with dot segments outright: the upstream gets the
+// path as sent and may resolve /notes/../users to a path no rule allows.
+func (p *AuthzPolicy) Allows(names []string, method, path string) bool {
+	if hasDotSegment(path) {
+		return false
+	}
+	for _, rule := range p.Rules {
+		if rule.matchesIdentity(names) && rule.matchesMethod(method) && rule.matchesPath(path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r AuthzRule) matchesIdentity(names []string) bool {
+	for _, id := range r.Identities {
+		if id == "*" || slices.ContainsFunc(names, func(name string) bool { return matchPath(id, name) }) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r AuthzRule) matchesMethod(method string) bool {
+	for _, m := range r.Methods {
+		if m == "*" || strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r AuthzRule) matchesPath(path string) bool {
+	return slices.ContainsFunc(r.Paths, func(pattern string) bool { return matchPath(pattern, path) })
+}
+
+// matchPath compares path with pattern exactly, or by prefix when the
+// pattern ends in "*".
+func matchPath(pattern, path string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(path, prefix)
+	}
+	return path == pattern
+}
+
+// hasDotSegment reports whether the decoded path has a "." or ".." segment,
+// splitting on backslashes too since some servers treat them as slashes.
+// Percent-encoded dots and slashes are decoded by then, so they are caught
+// as well.
+func hasDotSegment(path string) bool {
+	for _, segment := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorizer applies the policy in a file and re-reads it when it changes.
+// Without a file every request is allowed.
+type Authorizer struct {
+	mu      sync.RWMutex
+	path    string
+	policy  *AuthzPolicy
+	modTime time.Time
+
+	denied atomic.Int64
+}
+
+func NewAuthorizer(path string) (*Authorizer, error) {
+	a := &Authorizer{}
+	if err := a.SetPath(path); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// SetPath switches to the policy in another file, or to allowing everything
+// if path is empty. The current policy stays if the new one doesn't load.
+func (a *Authorizer) SetPath(path string) error {
+	a.mu.RLock()
+	same := path == a.path && (path == "" || a.policy != nil)
+	a.mu.RUnlock()
+	if same {
+		return nil
+	}
+
+	var policy *AuthzPolicy
+	var modTime time.Time
+	if path != "" {
+		var err error
+		if modTime, err = latestModTime(path); err != nil {
+			return err
+		}
+		if policy, err = loadAuthzPolicy(path); err != nil {
+			return err
+		}
+	}
+	a.mu.Lock()
+	a.path, a.policy, a.modTime = path, policy, modTime
+	a.mu.Unlock()
+	return nil
+}
+
+// Authorize reports whether the caller may make the request and, if not, the
+// identity it was refused for.
+func (a *Authorizer) Authorize(r *http.Request) (string, bool) {
+	a.mu.RLock()
+	policy := a.policy
+	a.mu.RUnlock()
+	if policy == nil {
+		return "", true
+	}
+	names := peerNames(r)
+	if policy.Allows(names, r.Method, r.URL.Path) {
+		return "", true
+	}
+	a.denied.Add(1)
+	if len(names) == 0 {
+		return "anonymous", false
+	}
+	return names[0], false
+}
+
+// reload works like CertReloader.reload: a policy that fails to load leaves
+// the current one in force.
+func (a *Authorizer) reload() (path string, rules int, err error) {
+	a.mu.RLock()
+	path, loaded := a.path, a.modTime
+	a.mu.RUnlock()
+	if path == "" {
+		return "", 0, nil
+	}
+	modTime, err := latestModTime(path)
+	if err != nil || modTime.Equal(loaded) {
+		return "", 0, err
+	}
+
+	policy, err := loadAuthzPolicy(path)
+	if err != nil {
+		return "", 0, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.path != path {
+		return "", 0, nil
+	}
+	a.policy = policy
+	a.modTime = modTime
+	return path, len(policy.Rules), nil
+}
+
+// Watch keeps checking even without a policy file, since a config reload may
+// add one.
+func (a *Authorizer) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		path, rules, err := a.reload()
+		switch {
+		case err != nil:
+			slog.Error("Reload failed, keeping current policy", "component", "authz", "error", err)
+		case path != "":
+			slog.Info("Reloaded policy", "component", "authz", "path", path, "rules", rules)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/notes", "/notes", true},
+		{"/notes", "/notes/1", false},
+		{"/notes", "/note", false},
+		{"/notes/*", "/notes/1", true},
+		{"/notes/*", "/notes/", true},
+		{"/notes/*", "/notes", false},
+		{"/notes*", "/notesecret", true},
+		{"*", "/anything", true},
+		{"spiffe://notes.local/*", "spiffe://notes.local/app", true},
+		{"spiffe://notes.local/*", "spiffe://other.local/app", false},
+	}
+	for _, tt := range tests {
+		if got := matchPath(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("matchPath(%q, %q) = %t, want %t", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestAuthzPolicyAllows(t *testing.T) {
+	policy := &AuthzPolicy{Rules: []AuthzRule{
+		{Identities: []string{"spiffe://notes.local/app"}, Methods: []string{"GET"}, Paths: []string{"/notes/*"}},
+		{Identities: []string{"spiffe://notes.local/admin*"}, Methods: []string{"*"}, Paths: []string{"/users"}},
+		{Identities: []string{"*"}, Methods: []string{"GET"}, Paths: []string{"/health"}},
+	}}
+	app := []string{"spiffe://notes.local/app", "app", "app.notes.local"}
+	admin := []string{"spiffe://notes.local/admin-1"}
+
+	tests := []struct {
+		name   string
+		names  []string
+		method string
+		path   string
+		want   bool
+	}{
+		{"prefix rule", app, "GET", "/notes/1", true},
+		{"method is case-insensitive", app, "get", "/notes/1", true},
+		{"other method", app, "DELETE", "/notes/1", false},
+		{"other path", app, "GET", "/users", false},
+		{"identity prefix", admin, "DELETE", "/users", true},
+		{"exact path only", admin, "DELETE", "/users/1", false},
+		{"anyone", nil, "GET", "/health", true},
+		{"anonymous", nil, "GET", "/notes/1", false},
+		{"dot-dot escapes the prefix", app, "GET", "/notes/../users", false},
+		{"dot-dot inside the prefix", app, "GET", "/notes/a/../b", false},
+		{"dot segment", app, "GET", "/notes/./1", false},
+		{"backslash dot-dot", app, "GET", `/notes/..\users`, false},
+		{"dots within a name", app, "GET", "/notes/..hidden", true},
+	}
+	for _, tt := range tests {
+		if got := policy.Allows(tt.names, tt.method, tt.path); got != tt.want {
+			t.Errorf("%s: Allows(%v, %s, %q) = %t, want %t", tt.name, tt.names, tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+// Encoded dots and slashes reach the policy decoded, so they are refused
+// like plain ones.
+func TestAuthorizeEncodedPaths(t *testing.T) {
+	a := &Authorizer{policy: &AuthzPolicy{Rules: []AuthzRule{
+		{Identities: []string{"*"}, Methods: []string{"GET"}, Paths: []string{"/notes/*"}},
+	}}}
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{"/notes/1", true},
+		{"/notes/%2e%2e/users", false},
+		{"/notes/%2E%2E/users", false},
+		{"/notes/..%2fusers", false},
+		{"/notes/%2e/1", false},
+		{"/notes/a%2fb", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if _, got := a.Authorize(r); got != tt.want {
+			t.Errorf("Authorize(%s) = %t, want %t", tt.target, got, tt.want)
+		}
+	}
+}
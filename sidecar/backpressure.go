@@ -0,0 +1,178 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// BackpressureConfig makes the sidecar honour Retry-After on 429 and 503
+// responses from the upstream. Until the time runs out, but for no longer
+// than MaxWait, the sidecar answers matching requests itself with the same
+// status and the time left: every request after a 503, the same client's
+// after a 429. A zero MaxWait turns this off.
+type BackpressureConfig struct {
+	MaxWait time.Duration `yaml:"max_wait"`
+}
+
+type backoff struct {
+	status int
+	until  time.Time
+}
+
+// Backpressure tracks the Retry-After windows of one upstream, keyed by
+// client; the key for the whole upstream is "".
+type Backpressure struct {
+	name string
+
+	mu        sync.Mutex
+	cfg       BackpressureConfig
+	backoffs  map[string]backoff
+	lastSweep time.Time
+
+	signals atomic.Int64
+	shed    atomic.Int64
+}
+
+func NewBackpressure(name string, cfg BackpressureConfig) *Backpressure {
+	return &Backpressure{name: name, cfg: cfg, backoffs: make(map[string]backoff), lastSweep: time.Now()}
+}
+
+// setConfig keeps the current windows unless backpressure is turned off.
+func (b *Backpressure) setConfig(cfg BackpressureConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cfg = cfg
+	if cfg.MaxWait <= 0 {
+		clear(b.backoffs)
+	}
+}
+
+// allow reports whether a request from client may go to the upstream. A
+// rejected request gets the status to answer with and the time left.
+func (b *Backpressure) allow(client string) (status int, retryAfter time.Duration, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for _, key := range []string{"", client} {
+		if bo, found := b.backoffs[key]; found && now.Before(bo.until) {
+			b.shed.Add(1)
+			return bo.status, bo.until.Sub(now), false
+		}
+	}
+	return 0, 0, true
+}
+
+// record starts a window for a 429 or 503 with a usable Retry-After and
+// rewrites the header as whole seconds no longer than MaxWait, so callers
+// don't come back before the sidecar lets them through, nor wait for hours
+// because of an upstream's mistake.
+func (b *Backpressure) record(client string, resp *http.Response) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return
+	}
+	now := time.Now()
+	wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	if !ok {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cfg.MaxWait <= 0 {
+		return
+	}
+	wait = min(wait, b.cfg.MaxWait)
+	resp.Header.Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+	b.signals.Add(1)
+
+	if now.Sub(b.lastSweep) > rateLimitSweepInterval {
+		b.sweep(now)
+	}
+	key, who := client, "client "+client
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		key, who = "", "all clients"
+	}
+	until := now.Add(wait)
+	current, found := b.backoffs[key]
+	if found && !current.until.Before(until) {
+		return
+	}
+	if !found || !now.Before(current.until) {
+		slog.Warn("Upstream asked to back off", "component", "backpressure", "upstream", b.name, "status", resp.StatusCode, "holding_back", who, "for", wait.Round(time.Millisecond))
+	}
+	b.backoffs[key] = backoff{status: resp.StatusCode, until: until}
+}
+
+func (b *Backpressure) sweep(now time.Time) {
+	for key, bo := range b.backoffs {
+		if !now.Before(bo.until) {
+			delete(b.backoffs, key)
+		}
+	}
+	b.lastSweep = now
+}
+
+// active counts the windows still running.
+func (b *Backpressure) active() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	now := time.Now()
+	for _, bo := range b.backoffs {
+		if now.Before(bo.until) {
+			n++
+		}
+	}
+	return n
+}
+
+// parseRetryAfter reads either form of Retry-After: seconds or an HTTP date.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second, secs > 0
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now), true
+	}
+	return 0, false
+}
+
+type backpressureError struct {
+	status     int
+	retryAfter time.Duration
+}
+
+func (e *backpressureError) Error() string {
+	return "upstream asked to back off"
+}
+
+type backpressureTransport struct {
+	next         http.RoundTripper
+	backpressure *Backpressure
+	clientKey    func(*http.Request) string
+}
+
+func (t *backpressureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	client := t.clientKey(req)
+	if status, retryAfter, ok := t.backpressure.allow(client); !ok {
+		trace.SpanFromContext(req.Context()).SetAttributes(attribute.Bool("sidecar.backpressure", true))
+		return nil, &backpressureError{status: status, retryAfter: retryAfter}
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err == nil {
+		t.backpressure.record(client, resp)
+	}
+	return resp, err
+}
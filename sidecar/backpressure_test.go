@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBackpressureTransport(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		retryAfter  string
+		wantHeader  string
+		sameClient  bool // shed for the client that got the response
+		otherClient bool // shed for everyone else
+	}{
+		{"429 holds back the client", http.StatusTooManyRequests, "1", "1", true, false},
+		{"503 holds back everyone", http.StatusServiceUnavailable, "1", "1", true, true},
+		{"wait is capped", http.StatusServiceUnavailable, "3600", "2", true, true},
+		{"no Retry-After", http.StatusServiceUnavailable, "", "", false, false},
+		{"other status", http.StatusInternalServerError, "1", "1", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer upstream.Close()
+
+			rt := &backpressureTransport{
+				next:         http.DefaultTransport,
+				backpressure: NewBackpressure("notes", BackpressureConfig{MaxWait: 2 * time.Second}),
+				clientKey:    func(r *http.Request) string { return r.Header.Get("X-Client") },
+			}
+			send := func(client string) (*http.Response, error) {
+				req := httptest.NewRequest(http.MethodGet, upstream.URL, nil)
+				req.RequestURI = ""
+				req.Header.Set("X-Client", client)
+				resp, err := rt.RoundTrip(req)
+				if err == nil {
+					resp.Body.Close()
+				}
+				return resp, err
+			}
+
+			resp, err := send("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resp.Header.Get("Retry-After"); got != tt.wantHeader {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantHeader)
+			}
+			for client, wantShed := range map[string]bool{"a": tt.sameClient, "b": tt.otherClient} {
+				_, err := send(client)
+				var shed *backpressureError
+				if errors.As(err, &shed) != wantShed {
+					t.Errorf("client %s: err = %v, want shed %t", client, err, wantShed)
+				}
+				if wantShed && shed.status != tt.status {
+					t.Errorf("client %s: shed with %d, want %d", client, shed.status, tt.status)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in     string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"30", 30 * time.Second, true},
+		{"0", 0, false},
+		{"-5", 0, false},
+		{now.Add(time.Minute).Format(http.TimeFormat), time.Minute, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, false},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.in, now)
+		if ok != tt.wantOK || ok && got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %s, %t; want %s, %t", tt.in, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+//go:generate protoc -I ../ca/proto --go_out=capb --go_opt=paths=source_relative,Mca.proto=sidecar/capb --go-grpc_out=capb --go-grpc_opt=paths=source_relative,Mca.proto=sidecar/capb ca.proto
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"sidecar/capb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// BootstrapConfig gets the sidecar's certificates from the CA's gRPC port
+// (ca-service:9443) rather than from files the CA writes on a shared
+// volume. Without a certificate in tls_cert, the sidecar makes its keys and
+// gets the first certificates with Token, a one-time token from
+// ca bootstrap-token for Service. Until ca_cert exists it trusts only the
+// root whose key hashes to CAHash, and then writes the CA's bundle there.
+// The certificates are renewed on the same port two thirds into their
+// lifetime, authenticated with themselves.
+type BootstrapConfig struct {
+	Address string `yaml:"address"`
+	Service string `yaml:"service"`
+	Token   string `yaml:"token"`
+	CAHash  string `yaml:"ca_hash"`
+}
+
+var caHashPattern = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+const (
+	bootstrapTimeout       = 30 * time.Second
+	bootstrapCheckInterval = 10 * time.Minute
+)
+
+// Bootstrapper writes the certificates it gets to tls_cert and tls_key,
+// the client certificate to egress_cert and egress_key if they are set,
+// where the sidecar loads them from as usual.
+type Bootstrapper struct {
+	cfg  BootstrapConfig
+	cert string
+	key  string
+	// The client certificate, for a service whose own is for serving only.
+	clientCert string
+	clientKey  string
+	ca         string
+}
+
+func NewBootstrapper(cfg Config) *Bootstrapper {
+	return &Bootstrapper{
+		cfg:        cfg.Bootstrap,
+		cert:       cfg.CertFile,
+		key:        cfg.KeyFile,
+		clientCert: cfg.EgressCertFile,
+		clientKey:  cfg.EgressKeyFile,
+		ca:         cfg.CACert,
+	}
+}
+
+// Init gets the first certificates unless there are current ones already,
+// as after a restart.
+func (b *Bootstrapper) Init() error {
+	leaf, err := loadLeaf(b.cert)
+	if err == nil && time.Now().Before(leaf.NotAfter) && (b.clientCert == "" || fileExists(b.clientCert)) {
+		return nil
+	}
+	if b.cfg.Token == "" {
+		return fmt.Errorf("no current certificate in %s and no bootstrap token (SIDECAR_BOOTSTRAP_TOKEN) to get one", b.cert)
+	}
+	roots, err := b.trust()
+	if err != nil {
+		return err
+	}
+	if err := b.request(roots, nil); err != nil {
+		return err
+	}
+	slog.Info("Got certificates", "component", "bootstrap", "service", b.cfg.Service, "ca", b.cfg.Address)
+	return nil
+}
+
+// trust is ca_cert, or the pinned root of the CA's bundle if there is no
+// ca_cert yet.
+func (b *Bootstrapper) trust() (*x509.CertPool, error) {
+	pool, err := loadCertPool(b.ca)
+	if !errors.Is(err, os.ErrNotExist) {
+		return pool, err
+	}
+	if b.cfg.CAHash == "" {
+		return nil, fmt.Errorf("%s does not exist and there is no CA hash (SIDECAR_BOOTSTRAP_CA_HASH) to trust the CA by", b.ca)
+	}
+	// The bundle comes over a connection nothing is verified on yet; only
+	// the root that matches the hash is trusted.
+	conn, err := grpc.NewClient(b.cfg.Address, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	})))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), bootstrapTimeout)
+	defer cancel()
+	resp, err := capb.NewCertificatesClient(conn).Roots(ctx, &capb.RootsRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("get the CA's roots: %w", err)
+	}
+	for _, root := range parseCerts(resp.Ca) {
+		sum := sha256.Sum256(root.RawSubjectPublicKeyInfo)
+		if "sha256:"+hex.EncodeToString(sum[:]) == b.cfg.CAHash {
+			pool := x509.NewCertPool()
+			pool.AddCert(root)
+			return pool, nil
+		}
+	}
+	return nil, fmt.Errorf("no root of %s matches the CA hash %s", b.cfg.Address, b.cfg.CAHash)
+}
+
+// Run renews the certificates once they are two thirds into their lifetime.
+func (b *Bootstrapper) Run() {
+	for range time.Tick(bootstrapCheckInterval) {
+		leaf, err := loadLeaf(b.cert)
+		if err != nil {
+			slog.Error("Loading the certificate failed", "component", "bootstrap", "error", err)
+			continue
+		}
+		if time.Now().Before(leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) * 2 / 3)) {
+			continue
+		}
+		if err := b.renew(); err != nil {
+			slog.Warn("Renewal failed", "component", "bootstrap", "retry_in", bootstrapCheckInterval, "error", err)
+			continue
+		}
+		slog.Info("Renewed the certificates", "component", "bootstrap", "service", b.cfg.Service)
+	}
+}
+
+// renew presents the client certificate, or the sidecar's own if it has
+// none, which the CA accepts in place of a token.
+func (b *Bootstrapper) renew() error {
+	roots, err := loadCertPool(b.ca)
+	if err != nil {
+		return err
+	}
+	certFile, keyFile := b.cert, b.key
+	if b.clientCert != "" {
+		certFile, keyFile = b.clientCert, b.clientKey
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	return b.request(roots, &pair)
+}
+
+// request asks for new certificates with new keys, with the token if there
+// is no client certificate, and writes them.
+func (b *Bootstrapper) request(roots *x509.CertPool, client *tls.Certificate) error {
+	tlsConfig := &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	req := &capb.SignRequest{}
+	if client != nil {
+		tlsConfig.Certificates = []tls.Certificate{*client}
+	} else {
+		req.BootstrapToken = b.cfg.Token
+	}
+	key, csr, err := newCSR(b.cfg.Service)
+	if err != nil {
+		return err
+	}
+	req.Csr = csr
+	var clientKey []byte
+	if b.clientCert != "" {
+		if clientKey, req.ClientCsr, err = newCSR(b.cfg.Service); err != nil {
+			return err
+		}
+	}
+
+	conn, err := grpc.NewClient(b.cfg.Address, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), bootstrapTimeout)
+	defer cancel()
+	resp, err := capb.NewCertificatesClient(conn).Sign(ctx, req)
+	if err != nil {
+		return fmt.Errorf("sign: %w", err)
+	}
+
+	if b.clientCert != "" {
+		if err := writePair(b.clientCert, b.clientKey, resp.ClientCertificate, clientKey); err != nil {
+			return err
+		}
+	}
+	if err := writePair(b.cert, b.key, resp.Certificate, key); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(strings.TrimSpace(b.ca), "-----BEGIN") {
+		return writeFileAtomic(b.ca, resp.Ca, 0644)
+	}
+	return nil
+}
+
+// newCSR makes a P-256 key and a CSR for service with no names, so the CA
+// puts in those configured for it. Both come back as PEM.
+func newCSR(service string) (keyPEM, csrPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: service}}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// loadLeaf is the first certificate in a PEM file.
+func loadLeaf(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	certs := parseCerts(data)
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate in %s", path)
+	}
+	return certs[0], nil
+}
+
+func parseCerts(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			return certs
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil && block.Type == "CERTIFICATE" {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+// writePair writes the key first: the sidecar reloads a pair once both
+// files have changed and they load together.
+func writePair(certFile, keyFile string, certPEM, keyPEM []byte) error {
+	if err := writeFileAtomic(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	return writeFileAtomic(certFile, certPEM, 0644)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// writeFileAtomic replaces path in one rename, so the sidecar never loads
+// half a file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
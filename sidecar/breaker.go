@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+// BreakerConfig opens the circuit when at least MinRequests requests were
+// seen within Window and FailureRate of them failed. After OpenFor,
+// HalfOpenProbes requests are let through; if all succeed the circuit closes,
+// a single failure opens it again. A zero FailureRate disables the breaker.
+type BreakerConfig struct {
+	FailureRate    float64       `yaml:"failure_rate"`
+	MinRequests    int           `yaml:"min_requests"`
+	Window         time.Duration `yaml:"window"`
+	OpenFor        time.Duration `yaml:"open_for"`
+	HalfOpenProbes int           `yaml:"half_open_probes"`
+}
+
+type CircuitBreaker struct {
+	name string
+
+	mu          sync.Mutex
+	cfg         BreakerConfig
+	state       string
+	windowStart time.Time
+	requests    int
+	failures    int
+	openUntil   time.Time
+	probes      int
+	successes   int
+
+	opened   atomic.Int64
+	rejected atomic.Int64
+}
+
+func NewCircuitBreaker(name string, cfg BreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{name: name, cfg: cfg, state: CircuitClosed, windowStart: time.Now()}
+}
+
+// setConfig keeps the current state; a new window starts with the new
+// thresholds.
+func (b *CircuitBreaker) setConfig(cfg BreakerConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if cfg == b.cfg {
+		return
+	}
+	b.cfg = cfg
+	b.windowStart, b.requests, b.failures = time.Now(), 0, 0
+	if cfg.FailureRate <= 0 {
+		b.state = CircuitClosed
+	}
+}
+
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// allow reports whether a request may go to the upstream and whether it is a
+// half-open probe. A rejected request gets the time until the next probe.
+func (b *CircuitBreaker) allow() (probe bool, retryAfter time.Duration, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cfg.FailureRate <= 0 {
+		return false, 0, true
+	}
+
+	now := time.Now()
+	if b.state == CircuitOpen {
+		if now.Before(b.openUntil) {
+			b.rejected.Add(1)
+			return false, b.openUntil.Sub(now), false
+		}
+		b.state, b.probes, b.successes = CircuitHalfOpen, 0, 0
+		slog.Info("Circuit half-open", "component", "circuit", "upstream", b.name, "probes", b.cfg.HalfOpenProbes)
+	}
+	if b.state == CircuitHalfOpen {
+		if b.probes >= b.cfg.HalfOpenProbes {
+			b.rejected.Add(1)
+			return false, time.Second, false
+		}
+		b.probes++
+		return true, 0, true
+	}
+	return false, 0, true
+}
+
+func (b *CircuitBreaker) record(probe, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cfg.FailureRate <= 0 {
+		return
+	}
+
+	now := time.Now()
+	switch {
+	case probe && b.state == CircuitHalfOpen:
+		if failed {
+			b.open(now, "probe failed")
+			return
+		}
+		b.successes++
+		if b.successes >= b.cfg.HalfOpenProbes {
+			b.state = CircuitClosed
+			b.windowStart, b.requests, b.failures = now, 0, 0
+			slog.Info("Circuit closed", "component", "circuit", "upstream", b.name, "successful_probes", b.successes)
+		}
+	case !probe && b.state == CircuitClosed:
+		if now.Sub(b.windowStart) > b.cfg.Window {
+			b.windowStart, b.requests, b.failures = now, 0, 0
+		}
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if b.requests >= b.cfg.MinRequests && float64(b.failures) >= b.cfg.FailureRate*float64(b.requests) {
+			b.open(now, fmt.Sprintf("%d of %d requests failed", b.failures, b.requests))
+		}
+	}
+}
+
+// releaseProbe frees the slot of a probe whose caller went away before the
+// upstream answered.
+func (b *CircuitBreaker) releaseProbe() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+func (b *CircuitBreaker) open(now time.Time, reason string) {
+	b.state = CircuitOpen
+	b.openUntil = now.Add(b.cfg.OpenFor)
+	b.opened.Add(1)
+	slog.Warn("Circuit open", "component", "circuit", "upstream", b.name, "open_for", b.cfg.OpenFor, "reason", reason)
+}
+
+type circuitOpenError struct {
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return "upstream circuit is open"
+}
+
+// RetryAfterSeconds rounds up so callers never come back before a probe is
+// possible.
+func (e *circuitOpenError) RetryAfterSeconds() int {
+	return retryAfterSeconds(e.retryAfter)
+}
+
+type breakerTransport struct {
+	next    http.RoundTripper
+	breaker *CircuitBreaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	probe, retryAfter, ok := t.breaker.allow()
+	if !ok {
+		return nil, &circuitOpenError{retryAfter: retryAfter}
+	}
+	resp, err := t.next.RoundTrip(req)
+	// Callers giving up say nothing about the upstream.
+	if req.Context().Err() == nil {
+		t.breaker.record(probe, err != nil || resp.StatusCode >= http.StatusInternalServerError)
+	} else if probe {
+		t.breaker.releaseProbe()
+	}
+	return resp, err
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreakerTransport(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer upstream.Close()
+
+	breaker := NewCircuitBreaker("notes", BreakerConfig{FailureRate: 0.5, MinRequests: 4, Window: time.Minute, OpenFor: 50 * time.Millisecond, HalfOpenProbes: 1})
+	rt := &breakerTransport{next: http.DefaultTransport, breaker: breaker}
+	send := func() (*http.Response, error) {
+		req := httptest.NewRequest(http.MethodGet, upstream.URL, nil)
+		req.RequestURI = ""
+		resp, err := rt.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	steps := []struct {
+		name      string
+		wait      time.Duration
+		failing   bool
+		wantOpen  bool
+		wantState string
+	}{
+		{name: "failures below the minimum", failing: true, wantState: CircuitClosed},
+		{name: "failures below the minimum", failing: true, wantState: CircuitClosed},
+		{name: "failures below the minimum", failing: true, wantState: CircuitClosed},
+		{name: "failure rate reached", failing: true, wantState: CircuitOpen},
+		{name: "open circuit rejects", wantOpen: true, wantState: CircuitOpen},
+		{name: "failed probe reopens", wait: 60 * time.Millisecond, failing: true, wantState: CircuitOpen},
+		{name: "reopened circuit rejects", wantOpen: true, wantState: CircuitOpen},
+		{name: "successful probe closes", wait: 60 * time.Millisecond, wantState: CircuitClosed},
+		{name: "closed circuit passes", wantState: CircuitClosed},
+	}
+	for i, step := range steps {
+		time.Sleep(step.wait)
+		failing.Store(step.failing)
+		_, err := send()
+		var open *circuitOpenError
+		if gotOpen := errors.As(err, &open); gotOpen != step.wantOpen {
+			t.Fatalf("step %d (%s): err = %v, want circuit open %t", i, step.name, err, step.wantOpen)
+		}
+		if state := breaker.State(); state != step.wantState {
+			t.Fatalf("step %d (%s): state = %s, want %s", i, step.name, state, step.wantState)
+		}
+	}
+	if n := breaker.opened.Load(); n != 2 {
+		t.Errorf("opened = %d, want 2", n)
+	}
+	if n := breaker.rejected.Load(); n != 2 {
+		t.Errorf("rejected = %d, want 2", n)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheRoute overrides the lifetime of cached responses for paths matching
+// Path, which may end in "*" to match by prefix. A zero TTL keeps the path
+// out of the cache.
+type CacheRoute struct {
+	Path string        `yaml:"path"`
+	TTL  time.Duration `yaml:"ttl"`
+}
+
+// CacheConfig keeps up to MaxEntries GET responses of at most MaxBody bytes.
+// Responses are kept for as long as their Cache-Control allows unless a
+// route says otherwise. Zero MaxEntries disables the cache.
+type CacheConfig struct {
+	MaxEntries int          `yaml:"size"`
+	MaxBody    int64        `yaml:"max_body"`
+	Routes     []CacheRoute `yaml:"ttl_routes"`
+}
+
+type cacheEntry struct {
+	key     string
+	path    string
+	vary    []string
+	varied  string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+// ResponseCache is an LRU of upstream responses. Requests are told apart by
+// URL, the caller's verified SPIFFE ID and Authorization, so one caller never
+// gets another's response. A response with Vary is only served to requests
+// with the same values of the headers it names.
+type ResponseCache struct {
+	cfg atomic.Pointer[CacheConfig]
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func NewResponseCache(cfg CacheConfig) *ResponseCache {
+	c := &ResponseCache{entries: make(map[string]*list.Element), lru: list.New()}
+	c.cfg.Store(&cfg)
+	return c
+}
+
+// setConfig keeps what is already cached unless the cache shrinks or the
+// lifetimes change.
+func (c *ResponseCache) setConfig(cfg CacheConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old := c.cfg.Swap(&cfg)
+	if !slices.Equal(old.Routes, cfg.Routes) {
+		c.lru.Init()
+		clear(c.entries)
+	}
+	c.evict(cfg.MaxEntries)
+}
+
+func (c *ResponseCache) Enabled() bool {
+	return c.cfg.Load().MaxEntries > 0
+}
+
+func (c *ResponseCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func cacheKey(r *http.Request) string {
+	return r.URL.RequestURI() + "\x00" + peerSPIFFEID(r) + "\x00" + r.Header.Get("Authorization")
+}
+
+// varyNames lists the request headers named by the response's Vary.
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// varyValues joins the values of the named request headers, so two requests
+// get the same varied response only if they all match.
+func varyValues(r *http.Request, names []string) string {
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + ":" + strings.Join(r.Header.Values(name), ",") + "\x00")
+	}
+	return b.String()
+}
+
+func (c *ResponseCache) get(key string, now time.Time) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := el.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return entry
+}
+
+func (c *ResponseCache) put(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[entry.key]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.evict(c.cfg.Load().MaxEntries)
+}
+
+func (c *ResponseCache) evict(size int) {
+	for c.lru.Len() > size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// invalidate drops everything cached for path, whatever the query or caller.
+func (c *ResponseCache) invalidate(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if entry := el.Value.(*cacheEntry); entry.path == path {
+			c.lru.Remove(el)
+			delete(c.entries, entry.key)
+		}
+		el = next
+	}
+}
+
+// ttl is how long resp may be served from the cache.
+func (c *ResponseCache) ttl(path string, resp *http.Response) time.Duration {
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Set-Cookie") != "" || resp.Header.Get("Vary") == "*" ||
+		strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return 0
+	}
+	directives := cacheControl(resp.Header)
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[d]; ok {
+			return 0
+		}
+	}
+	for _, route := range c.cfg.Load().Routes {
+		if matchPath(route.Path, path) {
+			return route.TTL
+		}
+	}
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := directives[d]; ok {
+			seconds, err := strconv.Atoi(v)
+			if err != nil {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return 0
+}
+
+func cacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(strings.Join(h.Values("Cache-Control"), ","), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name != "" {
+			directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return directives
+}
+
+// cacheTransport answers GETs from the cache and stores cacheable upstream
+// responses. Successful unsafe requests evict their path.
+type cacheTransport struct {
+	next  http.RoundTripper
+	cache *ResponseCache
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.cache.Enabled() {
+		return t.next.RoundTrip(req)
+	}
+	if req.Method != http.MethodGet {
+		resp, err := t.next.RoundTrip(req)
+		if err == nil && req.Method != http.MethodHead && req.Method != http.MethodOptions && resp.StatusCode < http.StatusBadRequest {
+			t.cache.invalidate(req.URL.Path)
+		}
+		return resp, err
+	}
+
+	directives := cacheControl(req.Header)
+	_, noCache := directives["no-cache"]
+	_, noStore := directives["no-store"]
+	if req.Header.Get("Range") != "" || req.Header.Get("Upgrade") != "" || noStore {
+		return t.next.RoundTrip(req)
+	}
+
+	key := cacheKey(req)
+	now := time.Now()
+	if !noCache {
+		if entry := t.cache.get(key, now); entry != nil && entry.varied == varyValues(req, entry.vary) {
+			t.cache.hits.Add(1)
+			return entry.response(req, now), nil
+		}
+	}
+	t.cache.misses.Add(1)
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	ttl := t.cache.ttl(req.URL.Path, resp)
+	maxBody := t.cache.cfg.Load().MaxBody
+	if ttl <= 0 || resp.ContentLength > maxBody {
+		return resp, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBody+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if int64(len(body)) > maxBody {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	vary := varyNames(resp.Header)
+	t.cache.put(&cacheEntry{
+		key:     key,
+		path:    req.URL.Path,
+		vary:    vary,
+		varied:  varyValues(req, vary),
+		status:  resp.StatusCode,
+		header:  resp.Header.Clone(),
+		body:    body,
+		stored:  now,
+		expires: now.Add(ttl),
+	})
+	resp.Header.Set("X-Cache", "MISS")
+	return resp, nil
+}
+
+func (e *cacheEntry) response(req *http.Request, now time.Time) *http.Response {
+	header := e.header.Clone()
+	header.Set("Age", strconv.Itoa(int(now.Sub(e.stored).Seconds())))
+	header.Set("X-Cache", "HIT")
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.status, http.StatusText(e.status)),
+		StatusCode:    e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// parseCacheRoutes reads "path=ttl,..." pairs; the first matching path wins.
+func parseCacheRoutes(s string) ([]CacheRoute, error) {
+	var routes []CacheRoute
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		path, ttl, ok := strings.Cut(item, "=")
+		path = strings.TrimSpace(path)
+		if !ok || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("%q: want /path=ttl", item)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(ttl))
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("%q: invalid ttl", item)
+		}
+		routes = append(routes, CacheRoute{Path: path, TTL: d})
+	}
+	return routes, nil
+}
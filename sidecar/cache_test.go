@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheTransport(t *testing.T) {
+	var calls atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		switch r.URL.Path {
+		case "/cached":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+		}
+		fmt.Fprintf(w, "response %d", n)
+	}))
+	defer upstream.Close()
+
+	type request struct {
+		method string
+		path   string
+		header http.Header
+	}
+	tests := []struct {
+		name      string
+		requests  []request
+		wantCache []string
+		wantCalls int64
+	}{
+		{
+			name:      "repeat GET is a hit",
+			requests:  []request{{"GET", "/cached", nil}, {"GET", "/cached", nil}},
+			wantCache: []string{"MISS", "HIT"},
+			wantCalls: 1,
+		},
+		{
+			name:      "private response is not stored",
+			requests:  []request{{"GET", "/private", nil}, {"GET", "/private", nil}},
+			wantCache: []string{"", ""},
+			wantCalls: 2,
+		},
+		{
+			name:      "callers are kept apart",
+			requests:  []request{{"GET", "/cached", http.Header{"Authorization": {"Bearer a"}}}, {"GET", "/cached", http.Header{"Authorization": {"Bearer b"}}}},
+			wantCache: []string{"MISS", "MISS"},
+			wantCalls: 2,
+		},
+		{
+			name:      "no-cache request goes upstream",
+			requests:  []request{{"GET", "/cached", nil}, {"GET", "/cached", http.Header{"Cache-Control": {"no-cache"}}}},
+			wantCache: []string{"MISS", "MISS"},
+			wantCalls: 2,
+		},
+		{
+			name:      "write invalidates the path",
+			requests:  []request{{"GET", "/cached", nil}, {"PUT", "/cached", nil}, {"GET", "/cached", nil}},
+			wantCache: []string{"MISS", "", "MISS"},
+			wantCalls: 3,
+		},
+		{
+			name: "vary keeps variants apart",
+			requests: []request{
+				{"GET", "/vary", http.Header{"Accept-Language": {"ru"}}},
+				{"GET", "/vary", http.Header{"Accept-Language": {"en"}}},
+				{"GET", "/vary", http.Header{"Accept-Language": {"en"}}},
+			},
+			wantCache: []string{"MISS", "MISS", "HIT"},
+			wantCalls: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls.Store(0)
+			rt := &cacheTransport{next: http.DefaultTransport, cache: NewResponseCache(CacheConfig{MaxEntries: 8, MaxBody: 1 << 10})}
+			var prev string
+			for i, r := range tt.requests {
+				req := httptest.NewRequest(r.method, upstream.URL+r.path, nil)
+				req.RequestURI = ""
+				for k, v := range r.header {
+					req.Header[k] = v
+				}
+				resp, err := rt.RoundTrip(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if got := resp.Header.Get("X-Cache"); got != tt.wantCache[i] {
+					t.Errorf("request %d: X-Cache = %q, want %q", i, got, tt.wantCache[i])
+				}
+				if tt.wantCache[i] == "HIT" && string(body) != prev {
+					t.Errorf("request %d: cached body = %q, want %q", i, body, prev)
+				}
+				prev = string(body)
+			}
+			if n := calls.Load(); n != tt.wantCalls {
+				t.Errorf("upstream calls = %d, want %d", n, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestResponseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewResponseCache(CacheConfig{MaxEntries: 2})
+	now := time.Now()
+	expires := now.Add(time.Hour)
+	for _, key := range []string{"a", "b"} {
+		c.put(&cacheEntry{key: key, expires: expires})
+	}
+	c.get("a", now)
+	c.put(&cacheEntry{key: "c", expires: expires})
+
+	if c.get("b", now) != nil {
+		t.Error("least recently used entry was kept")
+	}
+	if c.get("a", now) == nil || c.get("c", now) == nil {
+		t.Error("recently used entries were evicted")
+	}
+}
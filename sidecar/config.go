@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/m-tln/notes/config"
+	"github.com/m-tln/notes/logging"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is everything the sidecar is set up with. The environment variables
+// and flags give the defaults and the YAML file in SIDECAR_CONFIG overrides
+// them.
+// Listener, certificate and egress settings are read once at startup; the
+// embedded ProxyConfig is applied again on every reload.
+type Config struct {
+	Port                string              `yaml:"port"`
+	AdminPort           string              `yaml:"admin_port"`
+	AdminBind           string              `yaml:"admin_bind"`
+	CertFile            string              `yaml:"tls_cert"`
+	KeyFile             string              `yaml:"tls_key"`
+	CACert              string              `yaml:"ca_cert"`
+	CRLFile             string              `yaml:"crl_file"`
+	MTLS                string              `yaml:"mtls"`
+	AllowedClients      []string            `yaml:"allowed_clients"`
+	IdleTimeout         time.Duration       `yaml:"idle_timeout"`
+	ShutdownDelay       time.Duration       `yaml:"shutdown_delay"`
+	DrainTimeout        time.Duration       `yaml:"drain_timeout"`
+	CertReloadInterval  time.Duration       `yaml:"cert_reload_interval"`
+	AuthzReloadInterval time.Duration       `yaml:"authz_reload_interval"`
+	EgressPort          string              `yaml:"egress_port"`
+	EgressBind          string              `yaml:"egress_bind"`
+	EgressClients       []string            `yaml:"egress_clients"`
+	EgressRoutes        map[string]string   `yaml:"egress_routes"`
+	EgressIdentities    map[string]string   `yaml:"egress_identities"`
+	EgressPaths         map[string][]string `yaml:"egress_paths"`
+	EgressCertFile      string              `yaml:"egress_cert"`
+	EgressKeyFile       string              `yaml:"egress_key"`
+	TCP                 TCPConfig           `yaml:"tcp"`
+	Pool                PoolConfig          `yaml:"pool"`
+	ACME                ACMEConfig          `yaml:"acme"`
+	Bootstrap           BootstrapConfig     `yaml:"bootstrap"`
+
+	ProxyConfig `yaml:",inline"`
+}
+
+func configFromEnv() Config {
+	cfg := Config{
+		Port:                config.String("SIDECAR_PORT", "8443"),
+		AdminPort:           config.String("SIDECAR_ADMIN_PORT", "9901"),
+		AdminBind:           config.String("SIDECAR_ADMIN_BIND", "127.0.0.1"),
+		CertFile:            config.String("TLS_CERT", ""),
+		KeyFile:             config.String("TLS_KEY", ""),
+		CACert:              config.String("CA_CERT", ""),
+		CRLFile:             config.String("SIDECAR_CRL_FILE", ""),
+		MTLS:                config.String("SIDECAR_MTLS", MTLSStrict),
+		AllowedClients:      config.List("SIDECAR_ALLOWED_CLIENTS", ""),
+		IdleTimeout:         config.Duration("SIDECAR_IDLE_TIMEOUT", 0),
+		ShutdownDelay:       config.Duration("SIDECAR_SHUTDOWN_DELAY", 10*time.Second),
+		DrainTimeout:        config.Duration("SIDECAR_DRAIN_TIMEOUT", 15*time.Second),
+		CertReloadInterval:  config.Duration("SIDECAR_CERT_RELOAD_INTERVAL", 30*time.Second),
+		AuthzReloadInterval: config.Duration("SIDECAR_AUTHZ_RELOAD_INTERVAL", 10*time.Second),
+		EgressPort:          config.String("SIDECAR_EGRESS_PORT", ""),
+		EgressBind:          config.String("SIDECAR_EGRESS_BIND", "127.0.0.1"),
+		EgressClients:       config.List("SIDECAR_EGRESS_CLIENTS", "127.0.0.0/8,::1"),
+		EgressCertFile:      config.String("SIDECAR_EGRESS_CERT", ""),
+		EgressKeyFile:       config.String("SIDECAR_EGRESS_KEY", ""),
+		Pool: PoolConfig{
+			MaxIdleConns:        config.Int("SIDECAR_POOL_MAX_IDLE_CONNS", 100),
+			MaxIdleConnsPerHost: config.Int("SIDECAR_POOL_MAX_IDLE_CONNS_PER_HOST", 100),
+			MaxConnsPerHost:     config.Int("SIDECAR_POOL_MAX_CONNS_PER_HOST", 0),
+			IdleConnTimeout:     config.Duration("SIDECAR_POOL_IDLE_CONN_TIMEOUT", 90*time.Second),
+			DialTimeout:         config.Duration("SIDECAR_POOL_DIAL_TIMEOUT", 5*time.Second),
+			HTTP2:               config.Bool("SIDECAR_POOL_HTTP2", true),
+		},
+		TCP: TCPConfig{
+			Port:           config.String("SIDECAR_TCP_PORT", ""),
+			Upstream:       config.String("SIDECAR_TCP_UPSTREAM", ""),
+			MaxConnections: config.Int("SIDECAR_TCP_MAX_CONNECTIONS", 1000),
+			IdleTimeout:    config.Duration("SIDECAR_TCP_IDLE_TIMEOUT", 5*time.Minute),
+			ConnectTimeout: config.Duration("SIDECAR_TCP_CONNECT_TIMEOUT", 5*time.Second),
+		},
+		ProxyConfig: ProxyConfig{
+			UpstreamURL:   config.String("UPSTREAM_SERVICE", ""),
+			HealthPath:    config.String("SIDECAR_HEALTH_PATH", ""),
+			HealthTimeout: config.Duration("SIDECAR_HEALTH_TIMEOUT", 2*time.Second),
+			Replicas:      config.List("SIDECAR_UPSTREAM_REPLICAS", ""),
+			Fallback:      config.String("SIDECAR_FALLBACK_UPSTREAM", ""),
+			CORS: CORSConfig{
+				AllowOrigins:     config.List("SIDECAR_CORS_ALLOW_ORIGINS", ""),
+				AllowMethods:     config.List("SIDECAR_CORS_ALLOW_METHODS", "GET,HEAD,POST,PUT,PATCH,DELETE"),
+				AllowHeaders:     config.List("SIDECAR_CORS_ALLOW_HEADERS", "Content-Type,Authorization"),
+				ExposeHeaders:    config.List("SIDECAR_CORS_EXPOSE_HEADERS", logging.RequestIDHeader),
+				AllowCredentials: config.Bool("SIDECAR_CORS_ALLOW_CREDENTIALS", false),
+				MaxAge:           config.Duration("SIDECAR_CORS_MAX_AGE", 10*time.Minute),
+			},
+			Outlier: OutlierConfig{
+				ConsecutiveErrors: config.Int("SIDECAR_OUTLIER_CONSECUTIVE_ERRORS", 5),
+				BaseEjection:      config.Duration("SIDECAR_OUTLIER_BASE_EJECTION", 30*time.Second),
+				MaxEjection:       config.Duration("SIDECAR_OUTLIER_MAX_EJECTION", 5*time.Minute),
+				MaxEjectedPercent: config.Int("SIDECAR_OUTLIER_MAX_EJECTED_PERCENT", 50),
+			},
+			Failover: FailoverConfig{
+				Interval:           config.Duration("SIDECAR_FAILOVER_INTERVAL", 5*time.Second),
+				UnhealthyThreshold: config.Int("SIDECAR_FAILOVER_UNHEALTHY_THRESHOLD", 3),
+				HealthyThreshold:   config.Int("SIDECAR_FAILOVER_HEALTHY_THRESHOLD", 2),
+			},
+			Retry: RetryPolicy{
+				MaxAttempts:   config.Int("SIDECAR_RETRY_ATTEMPTS", 3),
+				BaseDelay:     config.Duration("SIDECAR_RETRY_BASE_DELAY", 50*time.Millisecond),
+				MaxDelay:      config.Duration("SIDECAR_RETRY_MAX_DELAY", time.Second),
+				PerTryTimeout: config.Duration("SIDECAR_RETRY_PER_TRY_TIMEOUT", 3*time.Second),
+			},
+			Breaker: BreakerConfig{
+				FailureRate:    config.Float("SIDECAR_CB_FAILURE_RATE", 0.5),
+				MinRequests:    config.Int("SIDECAR_CB_MIN_REQUESTS", 20),
+				Window:         config.Duration("SIDECAR_CB_WINDOW", 10*time.Second),
+				OpenFor:        config.Duration("SIDECAR_CB_OPEN_DURATION", 30*time.Second),
+				HalfOpenProbes: max(config.Int("SIDECAR_CB_HALF_OPEN_PROBES", 3), 1),
+			},
+			Backpressure: BackpressureConfig{
+				MaxWait: config.Duration("SIDECAR_BACKPRESSURE_MAX_WAIT", 30*time.Second),
+			},
+			Cache: CacheConfig{
+				MaxEntries: config.Int("SIDECAR_CACHE_SIZE", 0),
+				MaxBody:    int64(config.Int("SIDECAR_CACHE_MAX_BODY", 1<<20)),
+			},
+			RateLimit: RateLimitConfig{
+				Rate:   config.Float("SIDECAR_RATE_LIMIT", 0),
+				Burst:  config.Int("SIDECAR_RATE_LIMIT_BURST", 0),
+				Header: config.String("SIDECAR_RATE_LIMIT_HEADER", ""),
+			},
+			AuthzPolicy: config.String("SIDECAR_AUTHZ_POLICY", ""),
+			MaxInFlight: config.Int("SIDECAR_MAX_IN_FLIGHT", 0),
+			Headers: HeaderPolicy{
+				TrustedCallers: config.List("SIDECAR_TRUSTED_CALLERS", "loadbalancer"),
+				TrustedOnly:    config.List("SIDECAR_TRUSTED_HEADERS", "X-Real-IP,X-Forwarded-For,X-Forwarded-Host"),
+				AllowRequest:   config.List("SIDECAR_REQUEST_HEADERS_ALLOW", ""),
+				ResponseDeny:   config.List("SIDECAR_RESPONSE_HEADERS_DENY", "Server,X-Powered-By,X-Internal-*"),
+			},
+			Mirror: MirrorConfig{
+				Upstream: config.String("SIDECAR_MIRROR_UPSTREAM", ""),
+				Percent:  config.Float("SIDECAR_MIRROR_PERCENT", 0),
+				Timeout:  config.Duration("SIDECAR_MIRROR_TIMEOUT", 5*time.Second),
+			},
+			Limits: Limits{
+				ReadTimeout:           config.Duration("SIDECAR_READ_TIMEOUT", 5*time.Second),
+				WriteTimeout:          config.Duration("SIDECAR_WRITE_TIMEOUT", 10*time.Second),
+				ResponseHeaderTimeout: config.Duration("SIDECAR_RESPONSE_HEADER_TIMEOUT", 0),
+				MaxRequestBody:        int64(config.Int("SIDECAR_MAX_REQUEST_BODY", 0)),
+			},
+		},
+		ACME: ACMEConfig{
+			Directory:   config.String("SIDECAR_ACME_DIRECTORY", ""),
+			Name:        config.String("SIDECAR_ACME_NAME", ""),
+			CacheDir:    config.String("SIDECAR_ACME_CACHE", "/tmp/sidecar-acme"),
+			RenewBefore: config.Duration("SIDECAR_ACME_RENEW_BEFORE", 30*24*time.Hour),
+		},
+		Bootstrap: BootstrapConfig{
+			Address: config.String("SIDECAR_BOOTSTRAP_ADDRESS", ""),
+			Service: config.String("SIDECAR_BOOTSTRAP_SERVICE", ""),
+			Token:   config.Secret("SIDECAR_BOOTSTRAP_TOKEN", ""),
+			CAHash:  config.String("SIDECAR_BOOTSTRAP_CA_HASH", ""),
+		},
+	}
+	var err error
+	if cfg.Routes, err = parseRoutes(config.String("SIDECAR_ROUTES", "")); err != nil {
+		logging.Fatal("Invalid SIDECAR_ROUTES", "error", err)
+	}
+	if cfg.Cache.Routes, err = parseCacheRoutes(config.String("SIDECAR_CACHE_TTL_ROUTES", "")); err != nil {
+		logging.Fatal("Invalid SIDECAR_CACHE_TTL_ROUTES", "error", err)
+	}
+	if cfg.AccessLog.Sample, err = parseSampleRules(config.String("SIDECAR_ACCESS_LOG_SAMPLE", "")); err != nil {
+		logging.Fatal("Invalid SIDECAR_ACCESS_LOG_SAMPLE", "error", err)
+	}
+	if cfg.RateLimit.Overrides, err = parseRateOverrides(config.String("SIDECAR_RATE_LIMIT_OVERRIDES", "")); err != nil {
+		logging.Fatal("Invalid SIDECAR_RATE_LIMIT_OVERRIDES", "error", err)
+	}
+	if cfg.EgressRoutes, err = parseHostMap(config.String("SIDECAR_EGRESS_ROUTES", "")); err != nil {
+		logging.Fatal("Invalid SIDECAR_EGRESS_ROUTES", "error", err)
+	}
+	if cfg.EgressIdentities, err = parseHostMap(config.String("SIDECAR_EGRESS_IDENTITIES", "")); err != nil {
+		logging.Fatal("Invalid SIDECAR_EGRESS_IDENTITIES", "error", err)
+	}
+	if cfg.EgressPaths, err = parseEgressPaths(config.String("SIDECAR_EGRESS_PATHS", "")); err != nil {
+		logging.Fatal("Invalid SIDECAR_EGRESS_PATHS", "error", err)
+	}
+	return cfg
+}
+
+// loadConfig reads the environment and, if path is set, the file on top.
+// Unknown keys in the file are errors, so typos don't go unnoticed.
+func loadConfig(path string) (Config, error) {
+	cfg := configFromEnv()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return Config{}, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	checkCORS := func(cors CORSConfig, key string) {
+		for _, origin := range cors.AllowOrigins {
+			check(validOrigin(origin), "%s.allow_origins: %q is not *, scheme://host[:port] or scheme://*.domain", key, origin)
+		}
+		check(cors.MaxAge >= 0, "%s.max_age must not be negative", key)
+	}
+
+	check(c.UpstreamURL != "", "upstream (UPSTREAM_SERVICE) is required")
+	if c.ACME.Directory == "" {
+		check(c.CertFile != "" && c.KeyFile != "", "tls_cert and tls_key (TLS_CERT, TLS_KEY) are required")
+	} else {
+		check(c.CertFile == "" && c.KeyFile == "", "acme.directory replaces tls_cert and tls_key; set one or the other")
+		check(strings.HasPrefix(c.ACME.Directory, "https://"), "acme.directory (SIDECAR_ACME_DIRECTORY) must be an https URL")
+		check(strings.Contains(c.ACME.Name, "."), "acme.name (SIDECAR_ACME_NAME) must be a fully qualified name, got %q", c.ACME.Name)
+		check(c.CACert != "", "acme needs ca_cert (CA_CERT) to trust the CA")
+		check(c.ACME.CacheDir != "" && c.ACME.RenewBefore > 0, "acme needs a cache_dir and a positive renew_before")
+	}
+	if b := c.Bootstrap; b.Address != "" {
+		_, _, err := net.SplitHostPort(b.Address)
+		check(err == nil, "bootstrap.address (SIDECAR_BOOTSTRAP_ADDRESS): want host:port, got %q", b.Address)
+		check(c.ACME.Directory == "", "bootstrap and acme both get the sidecar's certificate; set one or the other")
+		check(b.Service != "", "bootstrap.service (SIDECAR_BOOTSTRAP_SERVICE) is required")
+		check(c.CACert != "", "bootstrap needs ca_cert (CA_CERT), where the CA's bundle is kept")
+		check(b.CAHash == "" || caHashPattern.MatchString(b.CAHash), "bootstrap.ca_hash (SIDECAR_BOOTSTRAP_CA_HASH): want sha256:<64 hex digits>, as ca bootstrap-token prints it")
+	}
+	check(c.MTLS == MTLSStrict || c.MTLS == MTLSPermissive || c.MTLS == MTLSOff, "mtls: unknown mode %q", c.MTLS)
+	check(c.MTLS == MTLSOff || c.CACert != "", "mtls %s needs ca_cert (CA_CERT)", c.MTLS)
+	check(c.CRLFile == "" || c.CACert != "", "crl_file (SIDECAR_CRL_FILE) needs ca_cert (CA_CERT)")
+	check(c.MTLS != MTLSOff || len(c.AllowedClients) == 0, "allowed_clients needs mtls strict or permissive")
+	for _, id := range c.AllowedClients {
+		check(validSPIFFEPattern(id), "allowed_clients: invalid SPIFFE ID %q", id)
+	}
+
+	if c.UpstreamURL != "" {
+		check(validUpstream(c.UpstreamURL), "upstream: invalid URL %q", c.UpstreamURL)
+	}
+	check(c.HealthPath == "" || strings.HasPrefix(c.HealthPath, "/"), "health_path must start with /")
+	check(c.HealthTimeout >= 0, "health_timeout must not be negative")
+	check(c.Fallback == "" || validUpstream(c.Fallback), "fallback: invalid URL %q", c.Fallback)
+	for _, replica := range c.Replicas {
+		check(validReplica(c.UpstreamURL, replica), "replicas: %q must differ from upstream only in scheme and host", replica)
+	}
+	err := c.Transform.validate()
+	check(err == nil, "transform: %v", err)
+	checkCORS(c.CORS, "cors")
+	o := c.Outlier
+	check(o.ConsecutiveErrors >= 0, "outlier_detection.consecutive_errors must not be negative")
+	check(o.ConsecutiveErrors == 0 || o.BaseEjection > 0 && o.MaxEjection >= o.BaseEjection,
+		"outlier_detection: base_ejection must be positive and max_ejection at least as long")
+	check(o.MaxEjectedPercent >= 0 && o.MaxEjectedPercent <= 100, "outlier_detection.max_ejected_percent must be between 0 and 100")
+	check(c.Failover.Interval > 0 && c.Failover.UnhealthyThreshold >= 1 && c.Failover.HealthyThreshold >= 1,
+		"failover: interval and thresholds must be positive")
+	check(c.IdleTimeout >= 0 && c.Limits.valid(), "timeouts and max_request_body must not be negative")
+	check(c.ShutdownDelay >= 0 && c.DrainTimeout >= 0, "shutdown_delay and drain_timeout must not be negative")
+	for i, route := range c.Routes {
+		check(strings.HasPrefix(route.Path, "/"), "routes[%d]: path %q must start with /", i, route.Path)
+		check(validUpstream(route.Upstream), "routes[%d]: invalid upstream %q", i, route.Upstream)
+		check(route.HealthPath == "" || strings.HasPrefix(route.HealthPath, "/"), "routes[%d]: health_path must start with /", i)
+		check(route.Limits.valid(), "routes[%d]: timeouts and max_request_body must not be negative", i)
+		check(route.Fallback == "" || validUpstream(route.Fallback), "routes[%d]: invalid fallback %q", i, route.Fallback)
+		checkCORS(route.CORS, fmt.Sprintf("routes[%d].cors", i))
+		err := route.Transform.validate()
+		check(err == nil, "routes[%d].transform: %v", i, err)
+		for _, replica := range route.Replicas {
+			check(validReplica(route.Upstream, replica), "routes[%d]: replica %q must differ from upstream only in scheme and host", i, replica)
+		}
+	}
+
+	r := c.Retry
+	check(r.MaxAttempts >= 0 && r.BaseDelay >= 0 && r.MaxDelay >= 0 && r.PerTryTimeout >= 0, "retry: values must not be negative")
+
+	b := c.Breaker
+	check(b.FailureRate >= 0 && b.FailureRate <= 1, "circuit_breaker.failure_rate must be between 0 and 1")
+	check(b.FailureRate == 0 || b.MinRequests >= 1 && b.HalfOpenProbes >= 1 && b.Window > 0 && b.OpenFor > 0,
+		"circuit_breaker: min_requests, half_open_probes, window and open_for must be positive")
+
+	check(c.Backpressure.MaxWait >= 0, "backpressure.max_wait must not be negative")
+
+	rl := c.RateLimit
+	check(rl.Rate >= 0 && rl.Burst >= 0, "rate_limit: rate and burst must not be negative")
+	for client, limit := range rl.Overrides {
+		check(limit.Rate >= 0 && limit.Burst >= 0, "rate_limit.overrides[%s]: rate and burst must not be negative", client)
+	}
+
+	check(c.Cache.MaxEntries >= 0, "cache.size must not be negative")
+	check(c.Cache.MaxEntries == 0 || c.Cache.MaxBody > 0, "cache.max_body must be positive")
+	for i, route := range c.Cache.Routes {
+		check(strings.HasPrefix(route.Path, "/") && route.TTL >= 0, "cache.ttl_routes[%d]: want a /path and a non-negative ttl", i)
+	}
+
+	check(c.MaxInFlight >= 0, "max_in_flight must not be negative")
+	check(c.Mirror.Percent >= 0 && c.Mirror.Percent <= 100, "mirror.percent must be between 0 and 100")
+	check(c.Mirror.Percent == 0 || validUpstream(c.Mirror.Upstream), "mirror.upstream: invalid URL %q", c.Mirror.Upstream)
+	check(c.Mirror.Timeout >= 0, "mirror.timeout must not be negative")
+	for i, rule := range c.AccessLog.Sample {
+		check(strings.HasPrefix(rule.Path, "/") && rule.Rate >= 0 && rule.Rate <= 1, "access_log.sample[%d]: want a /path and a rate between 0 and 1", i)
+	}
+
+	check(c.EgressPort == "" || len(c.EgressRoutes) > 0, "egress_port needs egress_routes")
+	_, err = parseEgressClients(c.EgressClients)
+	check(err == nil, "egress_clients (SIDECAR_EGRESS_CLIENTS): %v", err)
+	check(c.EgressPort == "" || len(c.EgressClients) > 0, "egress_clients must not be empty")
+	check((c.EgressCertFile == "") == (c.EgressKeyFile == ""), "egress_cert and egress_key (SIDECAR_EGRESS_CERT, SIDECAR_EGRESS_KEY) go together")
+	for host, target := range c.EgressRoutes {
+		_, err := egressTarget(target)
+		check(err == nil, "egress_routes[%s]: %v", host, err)
+	}
+	check(c.Pool.valid(), "pool: limits and timeouts must not be negative")
+	if c.TCP.Port != "" {
+		_, _, err := net.SplitHostPort(c.TCP.Upstream)
+		check(err == nil, "tcp.upstream (SIDECAR_TCP_UPSTREAM): want host:port, got %q", c.TCP.Upstream)
+		check(c.TCP.Port != c.Port && c.TCP.Port != c.AdminPort && c.TCP.Port != c.EgressPort, "tcp.port must differ from the other ports")
+		check(c.TCP.MaxConnections >= 0 && c.TCP.IdleTimeout >= 0 && c.TCP.ConnectTimeout >= 0, "tcp: limits and timeouts must not be negative")
+	}
+	for host, id := range c.EgressIdentities {
+		target, ok := c.EgressRoutes[host]
+		check(ok, "egress_identities[%s]: no egress route for the host", host)
+		check(!ok || strings.HasPrefix(target, "https://"), "egress_identities[%s]: route must use https", host)
+		check(validSPIFFEPattern(id), "egress_identities[%s]: invalid SPIFFE ID %q", host, id)
+	}
+	for host, paths := range c.EgressPaths {
+		_, ok := c.EgressRoutes[host]
+		check(ok, "egress_paths[%s]: no egress route for the host", host)
+		for _, path := range paths {
+			check(strings.HasPrefix(path, "/"), "egress_paths[%s]: want /path, got %q", host, path)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validUpstream(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && u.Host != "" && (u.Scheme == "http" || u.Scheme == "https" || u.Scheme == "h2c")
+}
+
+// validReplica keeps a replica interchangeable with its upstream: requests
+// only get another scheme and host.
+func validReplica(upstream, replica string) bool {
+	u, err := url.Parse(upstream)
+	r, rerr := url.Parse(replica)
+	return err == nil && rerr == nil && validUpstream(replica) && r.Path == u.Path
+}
+
+// watchConfig loads path again on SIGHUP and whenever the file changes, and
+// hands the result to apply. A file that doesn't load or validate leaves the
+// running configuration alone.
+func watchConfig(path string, interval time.Duration, apply func(Config) error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.Tick(interval)
+	}
+	modTime, _ := latestModTime(path)
+
+	for {
+		select {
+		case <-hup:
+			slog.Info("SIGHUP, reloading", "component", "config", "path", path)
+		case <-tick:
+			changed, err := latestModTime(path)
+			if err != nil || changed.Equal(modTime) {
+				continue
+			}
+			modTime = changed
+		}
+
+		cfg, err := loadConfig(path)
+		if err == nil {
+			err = apply(cfg)
+		}
+		if err != nil {
+			slog.Error("Reload failed, keeping current configuration", "component", "config", "error", err)
+			continue
+		}
+		slog.Info("Reloaded", "component", "config", "path", path)
+	}
+}
+
+// sameRestartSettings compares the settings a reload can't change.
+func sameRestartSettings(a, b Config) bool {
+	a.ProxyConfig, b.ProxyConfig = ProxyConfig{}, ProxyConfig{}
+	return reflect.DeepEqual(a, b)
+}
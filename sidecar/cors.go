@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig lets browsers on AllowOrigins call the app across origins. An
+// origin is "*", scheme://host[:port], or scheme://*.domain for any
+// subdomain. The sidecar answers preflight requests itself and sets the CORS
+// headers on every response, replacing any the upstream sent. Empty
+// AllowOrigins turns CORS handling off.
+//
+// A route's fields left empty take the global value; a route turns CORS off
+// with an explicitly empty allow_origins.
+type CORSConfig struct {
+	AllowOrigins     []string      `yaml:"allow_origins"`
+	AllowMethods     []string      `yaml:"allow_methods"`
+	AllowHeaders     []string      `yaml:"allow_headers"`
+	ExposeHeaders    []string      `yaml:"expose_headers"`
+	AllowCredentials bool          `yaml:"allow_credentials"`
+	MaxAge           time.Duration `yaml:"max_age"`
+}
+
+func (c CORSConfig) or(fallback CORSConfig) CORSConfig {
+	if c.AllowOrigins == nil {
+		c.AllowOrigins = fallback.AllowOrigins
+	}
+	if c.AllowMethods == nil {
+		c.AllowMethods = fallback.AllowMethods
+	}
+	if c.AllowHeaders == nil {
+		c.AllowHeaders = fallback.AllowHeaders
+	}
+	if c.ExposeHeaders == nil {
+		c.ExposeHeaders = fallback.ExposeHeaders
+	}
+	c.AllowCredentials = c.AllowCredentials || fallback.AllowCredentials
+	if c.MaxAge == 0 {
+		c.MaxAge = fallback.MaxAge
+	}
+	return c
+}
+
+func (c CORSConfig) enabled() bool {
+	return len(c.AllowOrigins) > 0
+}
+
+func validOrigin(origin string) bool {
+	if origin == "*" {
+		return true
+	}
+	u, err := url.Parse(strings.Replace(origin, "://*.", "://", 1))
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.Path == "" && u.RawQuery == ""
+}
+
+func (c CORSConfig) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	return slices.ContainsFunc(c.AllowOrigins, func(p string) bool {
+		p = strings.ToLower(p)
+		if scheme, domain, ok := strings.Cut(p, "://*."); ok {
+			host, found := strings.CutPrefix(origin, scheme+"://")
+			return found && strings.HasSuffix(host, "."+domain)
+		}
+		return p == "*" || p == origin
+	})
+}
+
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// setHeaders allows the request's origin, if it is allowed, to read the
+// response. Credentials need the origin itself rather than "*".
+func (c CORSConfig) setHeaders(h http.Header, r *http.Request) bool {
+	h.Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" || !c.allowsOrigin(origin) {
+		return false
+	}
+	if slices.Contains(c.AllowOrigins, "*") && !c.AllowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(c.ExposeHeaders) > 0 && !isPreflight(r) {
+		h.Set("Access-Control-Expose-Headers", strings.Join(c.ExposeHeaders, ", "))
+	}
+	return true
+}
+
+// preflight answers a preflight request from an allowed origin without
+// bothering the upstream. The browser checks the method and headers against
+// the lists itself.
+func (c CORSConfig) preflight(w http.ResponseWriter) {
+	h := w.Header()
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	h.Set("Access-Control-Allow-Methods", strings.Join(c.AllowMethods, ", "))
+	if len(c.AllowHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowHeaders, ", "))
+	}
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// stripCORS drops the upstream's own CORS headers where the sidecar sets
+// them.
+func stripCORS(h http.Header) {
+	for name := range h {
+		if strings.HasPrefix(name, "Access-Control-") {
+			h.Del(name)
+		}
+	}
+}
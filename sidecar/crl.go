@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const crlCheckInterval = time.Second
+
+// CRL refuses peers whose certificate the mesh CA has revoked. The list is
+// read from a file the CA keeps current and read again when it changes; a
+// file that fails to load keeps the list already in use. A list signed by
+// another CA, such as one left from before the CA was replaced, says nothing
+// about the peer; such peers are let through, but counted in
+// sidecar_crl_unchecked_total and logged once per issuer.
+type CRL struct {
+	path    string
+	metrics *Metrics
+
+	mu        sync.Mutex
+	list      *x509.RevocationList
+	revoked   map[string]bool
+	signer    []byte
+	warned    map[string]bool
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func LoadCRL(path string) (*CRL, error) {
+	c := &CRL{path: path}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *CRL) load() error {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(c.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", c.path, err)
+	}
+	revoked := make(map[string]bool, len(list.RevokedCertificateEntries))
+	for _, entry := range list.RevokedCertificateEntries {
+		revoked[entry.SerialNumber.String()] = true
+	}
+	c.list, c.revoked, c.signer, c.warned, c.modTime = list, revoked, nil, make(map[string]bool), info.ModTime()
+	slog.Info("Loaded CRL", "component", "crl", "path", c.path, "revoked", len(revoked), "next_update", list.NextUpdate.Format(time.RFC3339))
+	return nil
+}
+
+// verify checks the leaf of the first verified chain. A nil CRL lets
+// everything through.
+func (c *CRL) verify(chains [][]*x509.Certificate) error {
+	if c == nil || len(chains) == 0 || len(chains[0]) < 2 {
+		return nil
+	}
+	leaf, issuer := chains[0][0], chains[0][1]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := time.Now(); now.Sub(c.lastCheck) >= crlCheckInterval {
+		c.lastCheck = now
+		if err := c.load(); err != nil {
+			slog.Error("Reload failed, keeping the current list", "component", "crl", "error", err)
+		}
+	}
+	if !bytes.Equal(c.signer, issuer.Raw) {
+		if !bytes.Equal(c.list.RawIssuer, leaf.RawIssuer) || c.list.CheckSignatureFrom(issuer) != nil {
+			c.unchecked(leaf, issuer)
+			return nil
+		}
+		c.signer = issuer.Raw
+	}
+	if c.revoked[leaf.SerialNumber.String()] {
+		return fmt.Errorf("certificate %x of %q is revoked", leaf.SerialNumber, leaf.Subject.CommonName)
+	}
+	return nil
+}
+
+// unchecked records a peer whose issuer didn't sign the list. The warning
+// is logged once per issuer until the list changes.
+func (c *CRL) unchecked(leaf, issuer *x509.Certificate) {
+	if c.metrics != nil {
+		c.metrics.crlUnchecked.Add(1)
+	}
+	if c.warned[string(issuer.Raw)] {
+		return
+	}
+	c.warned[string(issuer.Raw)] = true
+	slog.Warn("CRL is not signed by the peer's issuer, revocation not checked", "component", "crl",
+		"peer", leaf.Subject.CommonName, "issuer", issuer.Subject.String(), "crl_issuer", c.list.Issuer.String())
+}
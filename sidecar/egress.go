@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/m-tln/notes/logging"
+)
+
+// EgressProxy takes the local app's outbound calls, either as an HTTP proxy
+// (HTTP_PROXY) or addressed to the egress port directly, and forwards them to
+// the mesh service routed for the request's host over mTLS with the
+// sidecar's own certificate. Hosts without a route are refused. A route with
+// an expected identity only talks to a server whose certificate carries a
+// matching SPIFFE ID. The port speaks plain HTTP without credentials, so only
+// callers from the clients list, by default the loopback addresses of the
+// app sharing the sidecar's network, may use it.
+type EgressProxy struct {
+	routes  map[string]*httputil.ReverseProxy
+	targets map[string]string
+	paths   map[string][]string
+	clients []netip.Prefix
+	metrics *Metrics
+}
+
+// parseEgressPaths reads "host=/path|/prefix*,..." into the paths each route
+// is limited to.
+func parseEgressPaths(s string) (map[string][]string, error) {
+	hosts, err := parseHostMap(s)
+	if err != nil {
+		return nil, err
+	}
+	paths := make(map[string][]string, len(hosts))
+	for host, list := range hosts {
+		paths[host] = strings.Split(list, "|")
+	}
+	return paths, nil
+}
+
+// pathAllowed reports whether a route may carry the path. A route without a
+// list carries every path; a pattern ending in * matches by prefix. Paths
+// with dot segments are refused on routes with a list, as the target may
+// resolve them outside it.
+func (e *EgressProxy) pathAllowed(host, path string) bool {
+	patterns, ok := e.paths[host]
+	if !ok {
+		return true
+	}
+	if hasDotSegment(path) {
+		return false
+	}
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(path, prefix) || pattern == path {
+			return true
+		}
+	}
+	return false
+}
+
+// parseEgressClients reads the addresses allowed to use the egress port,
+// each an IP or a CIDR prefix.
+func parseEgressClients(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range list {
+		if addr, err := netip.ParseAddr(item); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("%q: want an IP or a CIDR prefix", item)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func (e *EgressProxy) allowed(remoteAddr string) bool {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+	for _, prefix := range e.clients {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHostMap reads "host=value,..." pairs, such as egress routes
+// (host=https://service:port) or identities (host=spiffe://notes/service).
+func parseHostMap(s string) (map[string]string, error) {
+	routes := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		host, target, ok := strings.Cut(item, "=")
+		host = strings.TrimSpace(host)
+		if !ok || host == "" {
+			return nil, fmt.Errorf("%q: want host=value", item)
+		}
+		routes[host] = strings.TrimSpace(target)
+	}
+	return routes, nil
+}
+
+func egressTarget(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return nil, fmt.Errorf("invalid target URL %q", raw)
+	}
+	return u, nil
+}
+
+func NewEgressProxy(routes, identities map[string]string, paths map[string][]string, clients []netip.Prefix, rootCAs *x509.CertPool, crl *CRL, certs certSource, pool PoolConfig, retry RetryPolicy, metrics *Metrics) (*EgressProxy, error) {
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs:              rootCAs,
+			GetClientCertificate: certs.GetClientCertificate,
+			MinVersion:           tls.VersionTLS12,
+		},
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if crl != nil {
+		transport.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return crl.verify(cs.VerifiedChains)
+		}
+	}
+	pool.apply(transport, metrics.egressPool)
+	retries := newRetryTransport(&pooledTransport{next: transport, stats: metrics.egressPool}, retry)
+
+	e := &EgressProxy{
+		routes:  make(map[string]*httputil.ReverseProxy, len(routes)),
+		targets: make(map[string]string, len(routes)),
+		paths:   make(map[string][]string, len(paths)),
+		clients: clients,
+		metrics: metrics,
+	}
+	for host, list := range paths {
+		e.paths[strings.ToLower(host)] = list
+	}
+	for host, raw := range routes {
+		id := identities[host]
+		host = strings.ToLower(host)
+		target, err := egressTarget(raw)
+		if err != nil {
+			return nil, err
+		}
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.Transport = retries
+		proxy.ErrorHandler = proxyErrorHandler
+		if id != "" {
+			verified := transport.Clone()
+			expectSPIFFE(verified.TLSClientConfig, id)
+			proxy.Transport = newRetryTransport(&pooledTransport{next: verified, stats: metrics.egressPool}, retry)
+			slog.Info("Egress route", "component", "egress", "host", host, "target", target, "spiffe_id", id)
+		}
+		e.routes[host] = proxy
+		e.targets[host] = target.String()
+	}
+	return e, nil
+}
+
+func (e *EgressProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		http.Error(w, "CONNECT is not supported, call the service over plain HTTP and the sidecar adds TLS", http.StatusMethodNotAllowed)
+		return
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	id := logging.RequestID(r)
+	r.Header.Set(logging.RequestIDHeader, id)
+	logger := logging.FromContext(r.Context()).With("component", "egress", "request_id", id)
+	if !e.allowed(r.RemoteAddr) {
+		logger.Warn("Egress caller refused", "remote_addr", r.RemoteAddr, "host", host)
+		e.metrics.recordEgress("refused", http.StatusForbidden)
+		http.Error(w, "egress is only open to the local app", http.StatusForbidden)
+		return
+	}
+	proxy, ok := e.routes[host]
+	if !ok {
+		logger.Warn("No egress route", "host", host, "method", r.Method, "path", r.URL.Path)
+		e.metrics.recordEgress("unrouted", http.StatusForbidden)
+		http.Error(w, "no egress route for "+host, http.StatusForbidden)
+		return
+	}
+	if !e.pathAllowed(host, r.URL.Path) {
+		logger.Warn("Egress path not allowed", "host", host, "method", r.Method, "path", r.URL.Path)
+		e.metrics.recordEgress(host, http.StatusForbidden)
+		http.Error(w, "path not allowed for "+host, http.StatusForbidden)
+		return
+	}
+	logger.Debug("Egress request", "method", r.Method, "host", host, "path", r.URL.Path, "target", e.targets[host])
+	r = r.WithContext(logging.NewContext(r.Context(), logger))
+
+	rec := &statusRecorder{ResponseWriter: w}
+	proxy.ServeHTTP(rec, r)
+	e.metrics.recordEgress(host, rec.status)
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestEgressPathAllowed(t *testing.T) {
+	e := &EgressProxy{paths: map[string][]string{"api.mail.test": {"/v3/send", "/v3/templates/*"}}}
+	tests := []struct {
+		host, path string
+		want       bool
+	}{
+		{"api.mail.test", "/v3/send", true},
+		{"api.mail.test", "/v3/templates/welcome", true},
+		{"api.mail.test", "/v3/accounts", false},
+		{"api.mail.test", "/v3/templates/../accounts", false},
+		{"api.mail.test", "/v3/templates/./welcome", false},
+		{"unlisted.test", "/anything/../else", true},
+	}
+	for _, tt := range tests {
+		if got := e.pathAllowed(tt.host, tt.path); got != tt.want {
+			t.Errorf("pathAllowed(%s, %q) = %t, want %t", tt.host, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FailoverConfig controls how upstreams with a fallback are watched: every
+// Interval the health checks of the primary and its replicas run, and
+// UnhealthyThreshold failures in a row send traffic to the fallback and
+// HealthyThreshold successes bring it back.
+type FailoverConfig struct {
+	Interval           time.Duration `yaml:"interval"`
+	UnhealthyThreshold int           `yaml:"unhealthy_threshold"`
+	HealthyThreshold   int           `yaml:"healthy_threshold"`
+}
+
+// failoverState outlives reloads as long as the primary and fallback stay
+// the same. The counters are only touched by watchFailover.
+type failoverState struct {
+	active    atomic.Bool
+	switches  atomic.Int64
+	failures  int
+	successes int
+}
+
+type fallback struct {
+	url   *url.URL
+	proxy *httputil.ReverseProxy
+	state *failoverState
+}
+
+// target is where requests for u go right now: the fallback while the
+// primary fails its health checks or all its replicas are ejected. Requests
+// for the primary carry its replica set.
+func (u *upstream) target() (*httputil.ReverseProxy, string, *replicaSet) {
+	if fb := u.fallback; fb != nil && (fb.state.active.Load() || u.replicas.allEjected()) {
+		return fb.proxy, u.route.Fallback, nil
+	}
+	return u.proxy, u.route.Upstream, u.replicas
+}
+
+func (s *SidecarProxy) watchFailover() {
+	for {
+		cfg := s.failover.Load()
+		time.Sleep(cfg.Interval)
+		var wg sync.WaitGroup
+		for _, u := range *s.upstreams.Load() {
+			if u.fallback != nil {
+				wg.Go(func() { s.probe(u, cfg) })
+			}
+		}
+		wg.Wait()
+	}
+}
+
+func (s *SidecarProxy) probe(u *upstream, cfg *FailoverConfig) {
+	st := u.fallback.state
+	err := s.checkReplicas(context.Background(), u)
+	if err != nil {
+		st.successes = 0
+		st.failures++
+		if !st.active.Load() && st.failures >= cfg.UnhealthyThreshold {
+			st.active.Store(true)
+			st.switches.Add(1)
+			slog.Warn("Upstream failed health checks, switching to fallback", "component", "failover",
+				"upstream", u.route.Upstream, "failures", st.failures, "error", err, "fallback", u.route.Fallback)
+		}
+		return
+	}
+	st.failures = 0
+	st.successes++
+	if st.active.Load() && st.successes >= cfg.HealthyThreshold {
+		st.active.Store(false)
+		slog.Info("Upstream healthy again, switching back", "component", "failover", "upstream", u.route.Upstream, "fallback", u.route.Fallback)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// grpcHealthPath is the standard gRPC health check method. A route with this
+// health path is checked over gRPC instead of with a GET.
+const grpcHealthPath = "/grpc.health.v1.Health/Check"
+
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcCodes maps the sidecar's own error responses to the gRPC status codes
+// a client library would expect.
+var grpcCodes = map[int]int{
+	http.StatusForbidden:             7,  // PERMISSION_DENIED
+	http.StatusRequestEntityTooLarge: 8,  // RESOURCE_EXHAUSTED
+	http.StatusTooManyRequests:       8,  // RESOURCE_EXHAUSTED
+	http.StatusBadGateway:            14, // UNAVAILABLE
+	http.StatusServiceUnavailable:    14, // UNAVAILABLE
+	http.StatusGatewayTimeout:        4,  // DEADLINE_EXCEEDED
+}
+
+// httpError works like http.Error, except that gRPC callers get a
+// Trailers-Only response carrying the matching grpc-status.
+func httpError(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	if !isGRPC(r) {
+		http.Error(w, msg, code)
+		return
+	}
+	status, ok := grpcCodes[code]
+	if !ok {
+		status = 2 // UNKNOWN
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(status))
+	w.Header().Set("Grpc-Message", url.PathEscape(msg))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcStatus finds grpc-status in the headers of a Trailers-Only response or
+// among the trailers httputil.ReverseProxy copied over.
+func grpcStatus(h http.Header) string {
+	if v := h.Get("Grpc-Status"); v != "" {
+		return v
+	}
+	return h.Get(http.TrailerPrefix + "Grpc-Status")
+}
+
+// checkGRPCHealth calls grpc.health.v1.Health/Check for the whole server: an
+// empty HealthCheckRequest in, status SERVING (field 1 = 1) expected back.
+func (s *SidecarProxy) checkGRPCHealth(ctx context.Context, target *url.URL) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.JoinPath(grpcHealthPath).String(),
+		bytes.NewReader([]byte{0, 0, 0, 0, 0}))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	resp, err := s.health.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if err != nil {
+		return err
+	}
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if status != "0" {
+		return fmt.Errorf("health check failed with grpc-status %q", status)
+	}
+	if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 || !bytes.Equal(body[5:], []byte{0x08, 0x01}) {
+		return fmt.Errorf("upstream is not SERVING")
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// HeaderPolicy decides which headers cross the sidecar. Patterns are header
+// names, or prefixes ending in "*", matched case-insensitively.
+//
+// Headers matching TrustedOnly are dropped from requests unless the caller's
+// verified identity is in TrustedCallers, so only the load balancer can tell
+// the app who the end client is. A non-empty AllowRequest drops every other
+// request header. ResponseDeny hides upstream-internal headers from callers.
+// The sidecar's own headers are set after the policy and always pass.
+type HeaderPolicy struct {
+	TrustedCallers []string `yaml:"trusted_callers"`
+	TrustedOnly    []string `yaml:"trusted_headers"`
+	AllowRequest   []string `yaml:"request_allow"`
+	ResponseDeny   []string `yaml:"response_deny"`
+}
+
+func matchHeader(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	return slices.ContainsFunc(patterns, func(p string) bool { return matchPath(strings.ToLower(p), name) })
+}
+
+func (p HeaderPolicy) sanitizeRequest(r *http.Request) {
+	trusted := slices.ContainsFunc(peerNames(r), func(name string) bool {
+		return slices.Contains(p.TrustedCallers, name)
+	})
+	for name := range r.Header {
+		if !trusted && matchHeader(p.TrustedOnly, name) ||
+			len(p.AllowRequest) > 0 && !matchHeader(p.AllowRequest, name) {
+			r.Header.Del(name)
+		}
+	}
+}
+
+func (p HeaderPolicy) sanitizeResponse(resp *http.Response) error {
+	for name := range resp.Header {
+		if matchHeader(p.ResponseDeny, name) {
+			resp.Header.Del(name)
+		}
+	}
+	return nil
+}
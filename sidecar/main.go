@@ -1,116 +1,568 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"crypto/x509"
+	"errors"
+	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/m-tln/notes/config"
+	"github.com/m-tln/notes/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type SidecarProxy struct {
-	upstreamURL string
-	proxy       *httputil.ReverseProxy
-	certFile    string
-	keyFile     string
+	upstreams     atomic.Pointer[[]*upstream]
+	health        *http.Client
+	healthTimeout atomic.Int64
+	retry         *retryTransport
+	cache         *ResponseCache
+	limiter       *RateLimiter
+	authz         *Authorizer
+	maxInFlight   atomic.Int64
+	headers       atomic.Pointer[HeaderPolicy]
+	accessLog     atomic.Pointer[AccessLogConfig]
+	mirror        *Mirror
+	failover      atomic.Pointer[FailoverConfig]
+	metrics       *Metrics
+	draining      atomic.Bool
 }
 
-func NewSidecarProxy(upstreamURL, certFile, keyFile string) (*SidecarProxy, error) {
-	upstream, err := url.Parse(upstreamURL)
-	if err != nil {
+// ProxyConfig is the part of the configuration a reload can change.
+type ProxyConfig struct {
+	UpstreamURL   string             `yaml:"upstream"`
+	HealthPath    string             `yaml:"health_path"`
+	HealthTimeout time.Duration      `yaml:"health_timeout"`
+	Replicas      []string           `yaml:"replicas"`
+	Fallback      string             `yaml:"fallback"`
+	Outlier       OutlierConfig      `yaml:"outlier_detection"`
+	Transform     TransformConfig    `yaml:"transform"`
+	CORS          CORSConfig         `yaml:"cors"`
+	Failover      FailoverConfig     `yaml:"failover"`
+	Routes        []Route            `yaml:"routes"`
+	Retry         RetryPolicy        `yaml:"retry"`
+	Breaker       BreakerConfig      `yaml:"circuit_breaker"`
+	Backpressure  BackpressureConfig `yaml:"backpressure"`
+	Cache         CacheConfig        `yaml:"cache"`
+	RateLimit     RateLimitConfig    `yaml:"rate_limit"`
+	AuthzPolicy   string             `yaml:"authz_policy"`
+	MaxInFlight   int                `yaml:"max_in_flight"`
+	Headers       HeaderPolicy       `yaml:"headers"`
+	AccessLog     AccessLogConfig    `yaml:"access_log"`
+	Mirror        MirrorConfig       `yaml:"mirror"`
+	Limits        `yaml:",inline"`
+}
+
+// NewSidecarProxy sets up the pools once; a reload doesn't change them.
+func NewSidecarProxy(cfg ProxyConfig, pool PoolConfig, rootCAs *x509.CertPool) (*SidecarProxy, error) {
+	metrics := NewMetrics()
+	transport := newProtocolTransport(rootCAs, pool, metrics.upstreamPool)
+	s := &SidecarProxy{
+		health:  &http.Client{Transport: newProtocolTransport(rootCAs, pool, nil)},
+		retry:   newRetryTransport(&replicaTransport{next: &upstreamTransport{next: transport, metrics: metrics}}, cfg.Retry),
+		cache:   NewResponseCache(cfg.Cache),
+		limiter: NewRateLimiter(cfg.RateLimit),
+		authz:   &Authorizer{},
+		mirror:  NewMirror(rootCAs, pool),
+		metrics: metrics,
+	}
+	if err := s.Apply(cfg); err != nil {
 		return nil, err
 	}
+	return s, nil
+}
 
-	proxy := httputil.NewSingleHostReverseProxy(upstream)
+// Apply switches to cfg without dropping connections, counters, circuit state
+// or cached responses. Nothing changes if cfg can't be applied in full.
+func (s *SidecarProxy) Apply(cfg ProxyConfig) error {
+	// Each upstream gets its own circuit, so a failing side process doesn't
+	// cut off the app. An upstream that stays keeps its circuit.
+	// Backpressure windows, replica ejections and failover state carry over
+	// the same way.
+	circuits := make(map[string]*CircuitBreaker)
+	backpressures := make(map[string]*Backpressure)
+	replicas := make(map[string]*replica)
+	failovers := make(map[[2]string]*failoverState)
+	if current := s.upstreams.Load(); current != nil {
+		for _, u := range *current {
+			circuits[u.route.Upstream] = u.breaker
+			backpressures[u.route.Upstream] = u.backpressure
+			for _, r := range u.replicas.replicas {
+				replicas[r.url.String()] = r
+			}
+			if u.fallback != nil {
+				failovers[[2]string{u.route.Upstream, u.route.Fallback}] = u.fallback.state
+			}
+		}
+	}
+	routes := append(slices.Clone(cfg.Routes), Route{Path: "/*", Upstream: cfg.UpstreamURL, Replicas: cfg.Replicas, HealthPath: cfg.HealthPath, Fallback: cfg.Fallback, Transform: cfg.Transform})
+	upstreams := make([]*upstream, 0, len(routes))
+	for _, route := range routes {
+		target, err := url.Parse(route.Upstream)
+		if err != nil || target.Host == "" {
+			return fmt.Errorf("invalid upstream %q for %s", route.Upstream, route.Path)
+		}
+		if route.HealthPath == "" {
+			route.HealthPath = defaultHealthPath
+		}
+		route.Limits = route.Limits.or(cfg.Limits)
+		route.CORS = route.CORS.or(cfg.CORS)
+		transform, err := route.Transform.compile()
+		if err != nil {
+			return fmt.Errorf("transform for %s: %w", route.Path, err)
+		}
+		circuit, ok := circuits[route.Upstream]
+		if !ok {
+			circuit = NewCircuitBreaker(route.Upstream, cfg.Breaker)
+			circuits[route.Upstream] = circuit
+		}
+		set := &replicaSet{upstream: route.Upstream, cfg: cfg.Outlier, canEjectAll: route.Fallback != ""}
+		for _, raw := range append([]string{route.Upstream}, route.Replicas...) {
+			u, err := url.Parse(raw)
+			if err != nil || u.Host == "" {
+				return fmt.Errorf("invalid replica %q for %s", raw, route.Path)
+			}
+			r, ok := replicas[u.String()]
+			if !ok {
+				r = &replica{url: u}
+				replicas[u.String()] = r
+			}
+			set.replicas = append(set.replicas, r)
+		}
+		backpressure, ok := backpressures[route.Upstream]
+		if !ok {
+			backpressure = NewBackpressure(route.Upstream, cfg.Backpressure)
+			backpressures[route.Upstream] = backpressure
+		}
+		u := &upstream{
+			route: route,
+			url:   target,
+			proxy: s.newReverseProxy(target, &backpressureTransport{
+				next:         &breakerTransport{next: s.retry, breaker: circuit},
+				backpressure: backpressure,
+				clientKey:    s.clientKey,
+			}, transform, route.CORS),
+			breaker:      circuit,
+			backpressure: backpressure,
+			replicas:     set,
+		}
+		if route.Fallback != "" {
+			fbURL, err := url.Parse(route.Fallback)
+			if err != nil || fbURL.Host == "" {
+				return fmt.Errorf("invalid fallback %q for %s", route.Fallback, route.Path)
+			}
+			key := [2]string{route.Upstream, route.Fallback}
+			state, ok := failovers[key]
+			if !ok {
+				state = &failoverState{}
+				failovers[key] = state
+			}
+			u.fallback = &fallback{url: fbURL, proxy: s.newReverseProxy(fbURL, s.retry, transform, route.CORS), state: state}
+		}
+		upstreams = append(upstreams, u)
+	}
+	mirror, err := newMirrorTarget(cfg.Mirror)
+	if err != nil {
+		return err
+	}
+	if err := s.authz.SetPath(cfg.AuthzPolicy); err != nil {
+		return fmt.Errorf("authorization policy: %w", err)
+	}
 
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM([]byte(os.Getenv("CA_CERT")))
+	for _, u := range upstreams {
+		u.breaker.setConfig(cfg.Breaker)
+		u.backpressure.setConfig(cfg.Backpressure)
+	}
+	s.retry.setPolicy(cfg.Retry)
+	s.cache.setConfig(cfg.Cache)
+	s.limiter.setConfig(cfg.RateLimit)
+	s.maxInFlight.Store(int64(cfg.MaxInFlight))
+	s.healthTimeout.Store(int64(cfg.HealthTimeout))
+	s.headers.Store(&cfg.Headers)
+	s.accessLog.Store(&cfg.AccessLog)
+	s.mirror.target.Store(mirror)
+	s.failover.Store(&cfg.Failover)
+	s.upstreams.Store(&upstreams)
+	return nil
+}
 
-	proxy.Transport = &http.Transport{
-		TLSClientConfig: &tls.Config{
-			RootCAs: caCertPool,
-		},
-		MaxIdleConns:        100,
-		MaxIdleConnsPerHost: 100,
-		IdleConnTimeout:     90 * time.Second,
+// newReverseProxy runs transform, if set, on the way to target and back.
+// The cache sits below it, so cached responses are transformed again on
+// every hit.
+func (s *SidecarProxy) newReverseProxy(target *url.URL, next http.RoundTripper, transform *transformer, cors CORSConfig) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = &cacheTransport{next: next, cache: s.cache}
+	proxy.ErrorHandler = proxyErrorHandler
+	if transform != nil {
+		director := proxy.Director
+		proxy.Director = func(r *http.Request) {
+			transform.Request(r)
+			director(r)
+		}
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// The caller already has the request ID from ServeHTTP.
+		resp.Header.Del(logging.RequestIDHeader)
+		if cors.enabled() {
+			stripCORS(resp.Header)
+		}
+		if transform != nil {
+			if err := transform.Response(resp); err != nil {
+				return err
+			}
+		}
+		return s.headers.Load().sanitizeResponse(resp)
 	}
+	return proxy
+}
+
+// clientKey tells clients apart the way the rate limiter does.
+func (s *SidecarProxy) clientKey(r *http.Request) string {
+	return s.limiter.cfg.Load().clientKey(r)
+}
 
-	return &SidecarProxy{
-		upstreamURL: upstreamURL,
-		proxy:       proxy,
-		certFile:    certFile,
-		keyFile:     keyFile,
-	}, nil
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	var open *circuitOpenError
+	if errors.As(err, &open) {
+		w.Header().Set("Retry-After", strconv.Itoa(open.RetryAfterSeconds()))
+		httpError(w, r, "upstream unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	var backoff *backpressureError
+	if errors.As(err, &backoff) {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(backoff.retryAfter)))
+		httpError(w, r, strings.ToLower(http.StatusText(backoff.status)), backoff.status)
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		httpError(w, r, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	logging.FromContext(r.Context()).Error("Proxy error", "error", err)
+	if isGRPC(r) {
+		httpError(w, r, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusBadGateway)
 }
 
 func (s *SidecarProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[SIDECAR] %s %s -> %s", r.Method, r.URL.Path, s.upstreamURL)
+	start := time.Now()
+	up := s.route(r)
+	proxy, target, replicas := up.target()
+	id := logging.RequestID(r)
+	logger := logging.FromContext(r.Context()).With("request_id", id)
 
+	s.headers.Load().sanitizeRequest(r)
+	r.Header.Set(logging.RequestIDHeader, id)
+	w.Header().Set(logging.RequestIDHeader, id)
 	r.Header.Set("X-Forwarded-Proto", "https")
 	r.Header.Set("X-Forwarded-Port", "443")
 	r.Header.Set("X-Service-Mesh", "sidecar-proxy")
 
-	s.proxy.ServeHTTP(w, r)
+	// The span continues the caller's trace, and the upstream continues ours.
+	propagator := otel.GetTextMapPropagator()
+	clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ctx, span := tracer.Start(propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header)), r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLPath(r.URL.Path),
+			semconv.URLScheme("https"),
+			semconv.ClientAddress(clientIP),
+			semconv.UserAgentOriginal(r.UserAgent()),
+			attribute.String("sidecar.upstream", target),
+			attribute.String("sidecar.request_id", id),
+			attribute.String("sidecar.client.spiffe_id", peerSPIFFEID(r)),
+		))
+	defer span.End()
+	ctx, timing := withUpstreamTiming(logging.NewContext(ctx, logger))
+	if replicas != nil {
+		ctx = withReplicas(ctx, replicas)
+	}
+	r = r.WithContext(ctx)
+	propagator.Inject(ctx, propagation.HeaderCarrier(r.Header))
+
+	rec := &statusRecorder{ResponseWriter: w, onHijack: func() {
+		s.metrics.upgraded.Add(1)
+		s.metrics.upgradedTotal.Add(1)
+	}}
+	cors := up.route.CORS
+	corsAllowed := cors.enabled() && cors.setHeaders(rec.Header(), r)
+	if cors.enabled() && isPreflight(r) {
+		// Browsers send preflights without credentials, so they are
+		// answered before authorization and rate limits.
+		s.metrics.corsPreflight.Add(1)
+		if corsAllowed {
+			cors.preflight(rec)
+		} else {
+			s.metrics.corsRejected.Add(1)
+			httpError(rec, r, "origin not allowed", http.StatusForbidden)
+		}
+	} else if caller, ok := s.authz.Authorize(r); !ok {
+		logger.Warn("Request denied", "component", "authz", "caller", caller, "method", r.Method, "path", r.URL.Path)
+		span.SetAttributes(attribute.String("sidecar.denied_caller", caller))
+		httpError(rec, r, "forbidden", http.StatusForbidden)
+	} else if client, wait, ok := s.limiter.Allow(r); !ok {
+		logger.Warn("Client over rate limit", "component", "ratelimit", "client", client, "retry_in", wait.Round(time.Millisecond))
+		span.SetAttributes(attribute.String("sidecar.rate_limited_client", client))
+		rec.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+		httpError(rec, r, "rate limit exceeded", http.StatusTooManyRequests)
+	} else {
+		s.forward(rec, r, up.route.Limits, proxy)
+	}
+	if rec.hijacked {
+		s.metrics.upgraded.Add(-1)
+	}
+	s.metrics.recordRequest(r.Method, rec.status)
+
+	span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+	if rec.status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(rec.status))
+	}
+	s.logAccess(accessEntry{requestID: id, r: r, upstream: target, rec: rec, start: start, timing: timing})
 }
 
-func main() {
-	upstream := os.Getenv("UPSTREAM_SERVICE")
-	if upstream == "" {
-		log.Fatal("UPSTREAM_SERVICE environment variable is required")
+// forward sheds requests beyond maxInFlight with an immediate 503 instead of
+// piling them up behind a slow upstream, then applies the route's limits.
+func (s *SidecarProxy) forward(w http.ResponseWriter, r *http.Request, limits Limits, proxy *httputil.ReverseProxy) {
+	start := time.Now()
+	n := s.metrics.inFlight.Add(1)
+	defer s.metrics.inFlight.Add(-1)
+	if limit := s.maxInFlight.Load(); limit > 0 && n > limit {
+		s.metrics.shed.Add(1)
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.Bool("sidecar.shed", true))
+		w.Header().Set("Retry-After", "1")
+		httpError(w, r, "overloaded", http.StatusServiceUnavailable)
+		return
 	}
 
-	port := os.Getenv("SIDECAR_PORT")
-	if port == "" {
-		port = "8443"
+	if limits.MaxRequestBody > 0 {
+		if r.ContentLength > limits.MaxRequestBody {
+			httpError(w, r, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limits.MaxRequestBody)
+	}
+	// gRPC streams may stay open for as long as the call's own deadline,
+	// which the upstream enforces.
+	rc := http.NewResponseController(w)
+	if isGRPC(r) {
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+	} else {
+		if limits.ReadTimeout > 0 {
+			rc.SetReadDeadline(start.Add(limits.ReadTimeout))
+		}
+		if limits.WriteTimeout > 0 {
+			rc.SetWriteDeadline(start.Add(limits.WriteTimeout))
+		}
+	}
+	s.mirror.copy(r)
+	proxy.ServeHTTP(w, r.WithContext(withResponseHeaderTimeout(r.Context(), limits.ResponseHeaderTimeout)))
+}
+
+func main() {
+	configErr := config.Load("", os.Args[1:])
+	logging.Setup("sidecar")
+	if configErr != nil {
+		logging.Fatal("Invalid configuration", "error", configErr)
+	}
+	configPath := config.String("SIDECAR_CONFIG", "")
+	reloadInterval := config.Duration("SIDECAR_CONFIG_RELOAD_INTERVAL", 10*time.Second)
+	cfg, err := loadConfig(configPath)
+	config.Dump()
+	if configPath != "" {
+		slog.Info("The configuration file overrides these where it sets them", "component", "config", "path", configPath)
+	}
+	if err := errors.Join(err, config.Err()); err != nil {
+		logging.Fatal("Invalid configuration", "error", err)
 	}
 
-	certFile := os.Getenv("TLS_CERT")
-	keyFile := os.Getenv("TLS_KEY")
+	if cfg.Bootstrap.Address != "" {
+		bootstrap := NewBootstrapper(cfg)
+		if err := bootstrap.Init(); err != nil {
+			logging.Fatal("Failed to bootstrap certificates", "error", err)
+		}
+		go bootstrap.Run()
+	}
 
-	if certFile == "" || keyFile == "" {
-		log.Fatal("TLS_CERT and TLS_KEY environment variables are required")
+	var caCertPool *x509.CertPool
+	if cfg.CACert != "" {
+		pool, err := loadCertPool(cfg.CACert)
+		if err != nil {
+			logging.Fatal("Failed to load CA certificate", "error", err)
+		}
+		caCertPool = pool
+	}
+	var crl *CRL
+	if cfg.CRLFile != "" {
+		if crl, err = LoadCRL(cfg.CRLFile); err != nil {
+			logging.Fatal("Failed to load CRL", "error", err)
+		}
 	}
 
-	proxy, err := NewSidecarProxy(upstream, certFile, keyFile)
+	shutdownTracing, err := setupTracing(context.Background())
 	if err != nil {
-		log.Fatalf("Failed to create sidecar proxy: %v", err)
+		logging.Fatal("Failed to set up tracing", "error", err)
 	}
+	defer shutdownTracing(context.Background())
 
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		resp, err := http.Get(strings.Replace(upstream, "https", "http", 1) + "/health")
-		if err != nil || resp.StatusCode != http.StatusOK {
-			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte("Upstream unavailable"))
-			return
-		}
-		defer resp.Body.Close()
+	proxy, err := NewSidecarProxy(cfg.ProxyConfig, cfg.Pool, caCertPool)
+	if err != nil {
+		logging.Fatal("Failed to create sidecar proxy", "error", err)
+	}
+	if crl != nil {
+		crl.metrics = proxy.metrics
+	}
+	if cfg.AuthzReloadInterval > 0 {
+		go proxy.authz.Watch(cfg.AuthzReloadInterval)
+	}
+	go proxy.watchFailover()
+	if configPath != "" {
+		slog.Info("Loaded", "component", "config", "path", configPath)
+		go watchConfig(configPath, reloadInterval, func(next Config) error {
+			if !sameRestartSettings(cfg, next) {
+				slog.Warn("Listener, certificate and egress changes take effect after a restart", "component", "config")
+			}
+			return proxy.Apply(next.ProxyConfig)
+		})
+	}
 
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
+	http.HandleFunc("/health", proxy.HandleHealth)
 
 	http.HandleFunc("/", proxy.ServeHTTP)
 
-	log.Printf("Sidecar proxy listening on :%s for upstream: %s", port, upstream)
+	slog.Info("Sidecar proxy listening", "port", cfg.Port, "upstream", cfg.UpstreamURL)
+
+	var certs certSource
+	if cfg.ACME.Directory != "" {
+		acmeCerts, err := NewACMECerts(cfg.ACME, caCertPool)
+		if err != nil {
+			logging.Fatal("Failed to set up ACME", "error", err)
+		}
+		slog.Info("Certificate from ACME", "component", "acme", "name", cfg.ACME.Name, "directory", cfg.ACME.Directory)
+		go acmeCerts.Prefetch()
+		certs = acmeCerts
+	} else {
+		fileCerts, err := NewCertReloader(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			logging.Fatal("Failed to load certificates", "error", err)
+		}
+		if cfg.CertReloadInterval > 0 {
+			go fileCerts.Watch(cfg.CertReloadInterval)
+		}
+		certs = fileCerts
+	}
 
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	tlsConfig, err := serverTLSConfig(certs.GetCertificate, caCertPool, crl, cfg.MTLS, cfg.AllowedClients)
 	if err != nil {
-		log.Fatalf("Failed to load certificates: %v", err)
+		logging.Fatal("Invalid mTLS configuration", "error", err)
+	}
+	slog.Info("Client certificate mode", "component", "mtls", "mode", cfg.MTLS)
+	if len(cfg.AllowedClients) > 0 {
+		slog.Info("Allowed client SPIFFE IDs", "component", "mtls", "clients", cfg.AllowedClients)
+	}
+
+	admin := http.NewServeMux()
+	admin.HandleFunc("GET /metrics", proxy.HandleMetrics)
+	admin.Handle("/log/level", logging.LevelHandler())
+	go func() {
+		// Nothing on the admin port is authenticated, so it stays on
+		// loopback unless metrics must be scraped from outside.
+		addr := net.JoinHostPort(cfg.AdminBind, cfg.AdminPort)
+		slog.Info("Admin endpoints listening", "addr", addr)
+		logging.Fatal("Admin server failed", "error", http.ListenAndServe(addr, admin))
+	}()
+
+	if cfg.EgressPort != "" {
+		// A client-only certificate of its own, if there is one: the
+		// listener's may be for serving only.
+		egressCerts := certs
+		if cfg.EgressCertFile != "" {
+			fileCerts, err := NewCertReloader(cfg.EgressCertFile, cfg.EgressKeyFile)
+			if err != nil {
+				logging.Fatal("Failed to load egress certificates", "error", err)
+			}
+			if cfg.CertReloadInterval > 0 {
+				go fileCerts.Watch(cfg.CertReloadInterval)
+			}
+			egressCerts = fileCerts
+		}
+		clients, _ := parseEgressClients(cfg.EgressClients)
+		egress, err := NewEgressProxy(cfg.EgressRoutes, cfg.EgressIdentities, cfg.EgressPaths, clients, caCertPool, crl, egressCerts, cfg.Pool, cfg.Retry, proxy.metrics)
+		if err != nil {
+			logging.Fatal("Invalid egress routes", "error", err)
+		}
+		go func() {
+			addr := net.JoinHostPort(cfg.EgressBind, cfg.EgressPort)
+			slog.Info("Egress proxy listening", "addr", addr, "clients", cfg.EgressClients, "routes", len(cfg.EgressRoutes))
+			logging.Fatal("Egress proxy failed", "error", http.ListenAndServe(addr, egress))
+		}()
+	}
+
+	var tcp *TCPProxy
+	if cfg.TCP.Port != "" {
+		tcp = NewTCPProxy(cfg.TCP, tlsConfig, proxy.metrics)
+		go func() {
+			slog.Info("TCP passthrough listening", "port", cfg.TCP.Port, "upstream", cfg.TCP.Upstream)
+			if err := tcp.ListenAndServe(); err != nil {
+				logging.Fatal("TCP passthrough failed", "error", err)
+			}
+		}()
 	}
 
+	serverTLS := tlsConfig
+	if cfg.ACME.Directory != "" {
+		// Only the main listener answers challenges; the TCP port forwards
+		// whatever completes a handshake.
+		serverTLS = tlsConfig.Clone()
+		acceptACMEChallenges(serverTLS)
+	}
 	server := &http.Server{
-		Addr: ":" + port,
-		TLSConfig: &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			MinVersion:   tls.VersionTLS12,
-		},
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		Addr:         ":" + cfg.Port,
+		TLSConfig:    serverTLS,
+		ErrorLog:     log.New(handshakeErrorLog{metrics: proxy.metrics, out: log.Writer()}, "", 0),
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
 	}
 
-	log.Fatal(server.ListenAndServeTLS("", ""))
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		if err := server.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+			logging.Fatal("Server failed", "error", err)
+		}
+	}()
+
+	<-stop
+	var wg sync.WaitGroup
+	if tcp != nil {
+		wg.Go(func() { tcp.shutdown(cfg.ShutdownDelay, cfg.DrainTimeout) })
+	}
+	proxy.shutdown(server, cfg.ShutdownDelay, cfg.DrainTimeout)
+	wg.Wait()
+	slog.Info("Sidecar proxy stopped")
 }
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// write prints the histogram with extra labels, such as `pool="egress"`, if
+// labels is set.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	bucketLabels, totalLabels := "", ""
+	if labels != "" {
+		bucketLabels, totalLabels = labels+",", "{"+labels+"}"
+	}
+	for i, le := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", name, bucketLabels, le, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, bucketLabels, h.count)
+	fmt.Fprintf(w, "%s_sum%s %g\n%s_count%s %d\n", name, totalLabels, h.sum, name, totalLabels, h.count)
+}
+
+type requestKey struct {
+	method string
+	code   int
+}
+
+type egressKey struct {
+	destination string
+	code        int
+}
+
+// Metrics collects per-instance proxy statistics for /metrics on the admin
+// port.
+type Metrics struct {
+	inFlight        atomic.Int64
+	upgraded        atomic.Int64
+	upgradedTotal   atomic.Int64
+	shed            atomic.Int64
+	corsPreflight   atomic.Int64
+	corsRejected    atomic.Int64
+	upstreamErrors  atomic.Int64
+	handshakeErrors atomic.Int64
+	crlUnchecked    atomic.Int64
+	tcpActive       atomic.Int64
+	tcpTotal        atomic.Int64
+	tcpRejected     atomic.Int64
+	tcpErrors       atomic.Int64
+	tcpBytesIn      atomic.Int64
+	tcpBytesOut     atomic.Int64
+	upstreamLatency *histogram
+	upstreamPool    *poolStats
+	egressPool      *poolStats
+
+	mu       sync.Mutex
+	requests map[requestKey]int64
+	egress   map[egressKey]int64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		upstreamLatency: newHistogram(latencyBuckets),
+		upstreamPool:    newPoolStats("upstream"),
+		egressPool:      newPoolStats("egress"),
+		requests:        make(map[requestKey]int64),
+		egress:          make(map[egressKey]int64),
+	}
+}
+
+func (m *Metrics) recordRequest(method string, code int) {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+	default:
+		method = "OTHER"
+	}
+	m.mu.Lock()
+	m.requests[requestKey{method, code}]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) recordEgress(destination string, code int) {
+	m.mu.Lock()
+	m.egress[egressKey{destination, code}]++
+	m.mu.Unlock()
+}
+
+// handshakeErrorLog is the server's ErrorLog output. It counts failed TLS
+// handshakes, which net/http only reports there.
+type handshakeErrorLog struct {
+	metrics *Metrics
+	out     io.Writer
+}
+
+func (l handshakeErrorLog) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("TLS handshake error")) {
+		l.metrics.handshakeErrors.Add(1)
+	}
+	return l.out.Write(p)
+}
+
+// upstreamTransport times every attempt that reaches the upstream, retries
+// included.
+type upstreamTransport struct {
+	next    http.RoundTripper
+	metrics *Metrics
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	elapsed := time.Since(start)
+	recordUpstreamTiming(req.Context(), elapsed)
+	if err != nil {
+		t.metrics.upstreamErrors.Add(1)
+		return nil, err
+	}
+	t.metrics.upstreamLatency.Observe(elapsed.Seconds())
+	return resp, nil
+}
+
+// statusRecorder notes the response code and size. It also lifts the server's
+// read/write timeouts for connections that outlive a normal response:
+// upgraded ones (WebSocket), which httputil.ReverseProxy hijacks, and
+// server-sent event streams.
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	hijacked bool
+	onHijack func()
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+		if strings.HasPrefix(r.Header().Get("Content-Type"), "text/event-stream") {
+			http.NewResponseController(r.ResponseWriter).SetWriteDeadline(time.Time{})
+		}
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	r.status = http.StatusSwitchingProtocols
+	r.hijacked = true
+	if r.onHijack != nil {
+		r.onHijack()
+	}
+	return conn, brw, nil
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (s *SidecarProxy) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	m := s.metrics
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintf(w, "# HELP sidecar_requests_total Proxied requests by method and response code.\n# TYPE sidecar_requests_total counter\n")
+	m.mu.Lock()
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b requestKey) int {
+		if a.method != b.method {
+			return strings.Compare(a.method, b.method)
+		}
+		return a.code - b.code
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "sidecar_requests_total{method=%q,code=\"%d\"} %d\n", key.method, key.code, m.requests[key])
+	}
+	fmt.Fprintf(w, "# HELP sidecar_egress_requests_total Outbound requests from the local app by destination and response code.\n# TYPE sidecar_egress_requests_total counter\n")
+	egressKeys := make([]egressKey, 0, len(m.egress))
+	for key := range m.egress {
+		egressKeys = append(egressKeys, key)
+	}
+	slices.SortFunc(egressKeys, func(a, b egressKey) int {
+		if a.destination != b.destination {
+			return strings.Compare(a.destination, b.destination)
+		}
+		return a.code - b.code
+	})
+	for _, key := range egressKeys {
+		fmt.Fprintf(w, "sidecar_egress_requests_total{destination=%q,code=\"%d\"} %d\n", key.destination, key.code, m.egress[key])
+	}
+	m.mu.Unlock()
+
+	inFlight, maxInFlight := m.inFlight.Load(), s.maxInFlight.Load()
+	fmt.Fprintf(w, "# HELP sidecar_requests_in_flight Requests currently being proxied.\n# TYPE sidecar_requests_in_flight gauge\nsidecar_requests_in_flight %d\n", inFlight)
+	if maxInFlight > 0 {
+		fmt.Fprintf(w, "# HELP sidecar_max_in_flight Concurrency limit beyond which requests are shed.\n# TYPE sidecar_max_in_flight gauge\nsidecar_max_in_flight %d\n", maxInFlight)
+		fmt.Fprintf(w, "# HELP sidecar_saturation Share of the concurrency limit in use.\n# TYPE sidecar_saturation gauge\nsidecar_saturation %g\n", float64(min(inFlight, maxInFlight))/float64(maxInFlight))
+	}
+	fmt.Fprintf(w, "# HELP sidecar_upgraded_connections Upgraded connections (WebSocket) currently open.\n# TYPE sidecar_upgraded_connections gauge\nsidecar_upgraded_connections %d\n", m.upgraded.Load())
+	fmt.Fprintf(w, "# HELP sidecar_upgraded_connections_total Connections upgraded since start.\n# TYPE sidecar_upgraded_connections_total counter\nsidecar_upgraded_connections_total %d\n", m.upgradedTotal.Load())
+	fmt.Fprintf(w, "# HELP sidecar_shed_total Requests answered 503 because the concurrency limit was reached.\n# TYPE sidecar_shed_total counter\nsidecar_shed_total %d\n", m.shed.Load())
+	fmt.Fprintf(w, "# HELP sidecar_cors_preflight_total CORS preflight requests answered by the sidecar.\n# TYPE sidecar_cors_preflight_total counter\nsidecar_cors_preflight_total %d\n", m.corsPreflight.Load())
+	fmt.Fprintf(w, "# HELP sidecar_cors_rejected_total CORS preflight requests refused because the origin is not allowed.\n# TYPE sidecar_cors_rejected_total counter\nsidecar_cors_rejected_total %d\n", m.corsRejected.Load())
+	fmt.Fprintf(w, "# HELP sidecar_upstream_latency_seconds Time until the upstream's response headers, per attempt.\n# TYPE sidecar_upstream_latency_seconds histogram\n")
+	m.upstreamLatency.write(w, "sidecar_upstream_latency_seconds", "")
+	writePoolMetrics(w, m.upstreamPool, m.egressPool)
+	fmt.Fprintf(w, "# HELP sidecar_upstream_errors_total Attempts that got no response from the upstream.\n# TYPE sidecar_upstream_errors_total counter\nsidecar_upstream_errors_total %d\n", m.upstreamErrors.Load())
+	fmt.Fprintf(w, "# HELP sidecar_tls_handshake_errors_total Failed inbound TLS handshakes.\n# TYPE sidecar_tls_handshake_errors_total counter\nsidecar_tls_handshake_errors_total %d\n", m.handshakeErrors.Load())
+	fmt.Fprintf(w, "# HELP sidecar_crl_unchecked_total Peer certificates whose revocation the CRL could not check because another CA signed it.\n# TYPE sidecar_crl_unchecked_total counter\nsidecar_crl_unchecked_total %d\n", m.crlUnchecked.Load())
+	fmt.Fprintf(w, "# HELP sidecar_tcp_connections TCP passthrough connections currently open.\n# TYPE sidecar_tcp_connections gauge\nsidecar_tcp_connections %d\n", m.tcpActive.Load())
+	fmt.Fprintf(w, "# HELP sidecar_tcp_connections_total TCP passthrough connections accepted.\n# TYPE sidecar_tcp_connections_total counter\nsidecar_tcp_connections_total %d\n", m.tcpTotal.Load())
+	fmt.Fprintf(w, "# HELP sidecar_tcp_rejected_total TCP connections refused because max_connections were open.\n# TYPE sidecar_tcp_rejected_total counter\nsidecar_tcp_rejected_total %d\n", m.tcpRejected.Load())
+	fmt.Fprintf(w, "# HELP sidecar_tcp_upstream_errors_total TCP connections the upstream didn't accept.\n# TYPE sidecar_tcp_upstream_errors_total counter\nsidecar_tcp_upstream_errors_total %d\n", m.tcpErrors.Load())
+	fmt.Fprintf(w, "# HELP sidecar_tcp_bytes_total Bytes passed through TCP connections, in from clients and out to them.\n# TYPE sidecar_tcp_bytes_total counter\nsidecar_tcp_bytes_total{direction=\"in\"} %d\nsidecar_tcp_bytes_total{direction=\"out\"} %d\n", m.tcpBytesIn.Load(), m.tcpBytesOut.Load())
+	fmt.Fprintf(w, "# HELP sidecar_upstream_retries_total Retried upstream attempts.\n# TYPE sidecar_upstream_retries_total counter\nsidecar_upstream_retries_total %d\n", s.retry.retries.Load())
+	fmt.Fprintf(w, "# HELP sidecar_upstream_retries_exhausted_total Requests still failing after the last attempt.\n# TYPE sidecar_upstream_retries_exhausted_total counter\nsidecar_upstream_retries_exhausted_total %d\n", s.retry.exhausted.Load())
+
+	upstreams := *s.upstreams.Load()
+	fmt.Fprintf(w, "# HELP sidecar_circuit_state Current circuit breaker state per upstream.\n# TYPE sidecar_circuit_state gauge\n")
+	for _, u := range upstreams {
+		state := u.breaker.State()
+		for _, st := range []string{CircuitClosed, CircuitOpen, CircuitHalfOpen} {
+			value := 0
+			if st == state {
+				value = 1
+			}
+			fmt.Fprintf(w, "sidecar_circuit_state{upstream=%q,state=%q} %d\n", u.route.Upstream, st, value)
+		}
+	}
+	fmt.Fprintf(w, "# HELP sidecar_circuit_opened_total Times the circuit opened.\n# TYPE sidecar_circuit_opened_total counter\n")
+	for _, u := range upstreams {
+		fmt.Fprintf(w, "sidecar_circuit_opened_total{upstream=%q} %d\n", u.route.Upstream, u.breaker.opened.Load())
+	}
+	fmt.Fprintf(w, "# HELP sidecar_circuit_rejected_total Requests answered 503 by the open circuit.\n# TYPE sidecar_circuit_rejected_total counter\n")
+	for _, u := range upstreams {
+		fmt.Fprintf(w, "sidecar_circuit_rejected_total{upstream=%q} %d\n", u.route.Upstream, u.breaker.rejected.Load())
+	}
+	fmt.Fprintf(w, "# HELP sidecar_backpressure_signals_total 429 and 503 responses with Retry-After from the upstream.\n# TYPE sidecar_backpressure_signals_total counter\n")
+	for _, u := range upstreams {
+		fmt.Fprintf(w, "sidecar_backpressure_signals_total{upstream=%q} %d\n", u.route.Upstream, u.backpressure.signals.Load())
+	}
+	fmt.Fprintf(w, "# HELP sidecar_backpressure_shed_total Requests the sidecar answered itself while the upstream's Retry-After ran.\n# TYPE sidecar_backpressure_shed_total counter\n")
+	for _, u := range upstreams {
+		fmt.Fprintf(w, "sidecar_backpressure_shed_total{upstream=%q} %d\n", u.route.Upstream, u.backpressure.shed.Load())
+	}
+	fmt.Fprintf(w, "# HELP sidecar_backpressure_active Retry-After windows currently running, for the whole upstream or single clients.\n# TYPE sidecar_backpressure_active gauge\n")
+	for _, u := range upstreams {
+		fmt.Fprintf(w, "sidecar_backpressure_active{upstream=%q} %d\n", u.route.Upstream, u.backpressure.active())
+	}
+	fmt.Fprintf(w, "# HELP sidecar_failover_active Whether requests for the upstream go to its fallback.\n# TYPE sidecar_failover_active gauge\n")
+	for _, u := range upstreams {
+		if u.fallback != nil {
+			active := 0
+			if u.fallback.state.active.Load() {
+				active = 1
+			}
+			fmt.Fprintf(w, "sidecar_failover_active{upstream=%q} %d\n", u.route.Upstream, active)
+		}
+	}
+	fmt.Fprintf(w, "# HELP sidecar_failovers_total Times traffic switched to the fallback.\n# TYPE sidecar_failovers_total counter\n")
+	for _, u := range upstreams {
+		if u.fallback != nil {
+			fmt.Fprintf(w, "sidecar_failovers_total{upstream=%q} %d\n", u.route.Upstream, u.fallback.state.switches.Load())
+		}
+	}
+	fmt.Fprintf(w, "# HELP sidecar_outlier_ejected Whether the replica is out of rotation.\n# TYPE sidecar_outlier_ejected gauge\n")
+	now := time.Now()
+	for _, u := range upstreams {
+		for _, r := range u.replicas.replicas {
+			ejected := 0
+			if r.ejected(now) {
+				ejected = 1
+			}
+			fmt.Fprintf(w, "sidecar_outlier_ejected{upstream=%q,replica=%q} %d\n", u.route.Upstream, r.url, ejected)
+		}
+	}
+	fmt.Fprintf(w, "# HELP sidecar_outlier_ejections_total Times the replica was taken out of rotation.\n# TYPE sidecar_outlier_ejections_total counter\n")
+	for _, u := range upstreams {
+		for _, r := range u.replicas.replicas {
+			fmt.Fprintf(w, "sidecar_outlier_ejections_total{upstream=%q,replica=%q} %d\n", u.route.Upstream, r.url, r.ejectedTotal.Load())
+		}
+	}
+	fmt.Fprintf(w, "# HELP sidecar_cache_hits_total GET requests answered from the response cache.\n# TYPE sidecar_cache_hits_total counter\nsidecar_cache_hits_total %d\n", s.cache.hits.Load())
+	fmt.Fprintf(w, "# HELP sidecar_cache_misses_total GET requests the response cache passed to the upstream.\n# TYPE sidecar_cache_misses_total counter\nsidecar_cache_misses_total %d\n", s.cache.misses.Load())
+	fmt.Fprintf(w, "# HELP sidecar_cache_entries Responses currently cached.\n# TYPE sidecar_cache_entries gauge\nsidecar_cache_entries %d\n", s.cache.Len())
+	fmt.Fprintf(w, "# HELP sidecar_rate_limited_total Requests answered 429 by the per-client rate limit.\n# TYPE sidecar_rate_limited_total counter\nsidecar_rate_limited_total %d\n", s.limiter.limited.Load())
+	fmt.Fprintf(w, "# HELP sidecar_mirror_requests_total Copies of requests sent to the mirror upstream.\n# TYPE sidecar_mirror_requests_total counter\nsidecar_mirror_requests_total %d\n", s.mirror.sent.Load())
+	fmt.Fprintf(w, "# HELP sidecar_mirror_errors_total Mirror requests that got no response or a 5xx.\n# TYPE sidecar_mirror_errors_total counter\nsidecar_mirror_errors_total %d\n", s.mirror.failed.Load())
+	fmt.Fprintf(w, "# HELP sidecar_mirror_dropped_total Requests not mirrored because too many mirror requests were in flight.\n# TYPE sidecar_mirror_dropped_total counter\nsidecar_mirror_dropped_total %d\n", s.mirror.dropped.Load())
+	fmt.Fprintf(w, "# HELP sidecar_authz_denied_total Requests answered 403 by the authorization policy.\n# TYPE sidecar_authz_denied_total counter\nsidecar_authz_denied_total %d\n", s.authz.denied.Load())
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/m-tln/notes/logging"
+)
+
+const (
+	// Requests with bigger bodies go to the primary only, so mirroring never
+	// holds a large upload in memory.
+	maxMirrorBody = 1 << 20
+	// Beyond this many outstanding mirror requests new ones are dropped
+	// rather than piling up behind a slow mirror.
+	maxMirrorsInFlight = 100
+)
+
+// MirrorConfig sends a copy of Percent percent of proxied requests to
+// Upstream, say a new app build running beside the current one. Mirror
+// responses are discarded and never delay or change the caller's response.
+type MirrorConfig struct {
+	Upstream string        `yaml:"upstream"`
+	Percent  float64       `yaml:"percent"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+type mirrorTarget struct {
+	cfg MirrorConfig
+	url *url.URL
+}
+
+type Mirror struct {
+	target atomic.Pointer[mirrorTarget]
+	client *http.Client
+	slots  chan struct{}
+
+	sent    atomic.Int64
+	failed  atomic.Int64 // no response or a 5xx
+	dropped atomic.Int64 // skipped because too many were in flight
+}
+
+func NewMirror(rootCAs *x509.CertPool, pool PoolConfig) *Mirror {
+	return &Mirror{
+		client: &http.Client{Transport: newProtocolTransport(rootCAs, pool, nil)},
+		slots:  make(chan struct{}, maxMirrorsInFlight),
+	}
+}
+
+// newMirrorTarget returns nil when mirroring is off.
+func newMirrorTarget(cfg MirrorConfig) (*mirrorTarget, error) {
+	if cfg.Upstream == "" || cfg.Percent <= 0 {
+		return nil, nil
+	}
+	u, err := url.Parse(cfg.Upstream)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid mirror upstream %q", cfg.Upstream)
+	}
+	return &mirrorTarget{cfg: cfg, url: u}, nil
+}
+
+// copy picks r for mirroring and, if it is, sends the mirror request in the
+// background. The body is read into memory first and r gets it back
+// unchanged; upgrades and gRPC streams are never mirrored.
+func (m *Mirror) copy(r *http.Request) {
+	target := m.target.Load()
+	if target == nil || rand.Float64()*100 >= target.cfg.Percent ||
+		r.Header.Get("Upgrade") != "" || isGRPC(r) || r.ContentLength > maxMirrorBody {
+		return
+	}
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxMirrorBody+1))
+		// The primary request sees the same bytes and, past them, the same
+		// error or the rest of the body.
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		if err != nil || len(body) > maxMirrorBody {
+			return
+		}
+	}
+
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		m.dropped.Add(1)
+		return
+	}
+	out := r.Clone(context.Background())
+	out.URL = target.url.JoinPath(r.URL.Path)
+	if !strings.HasPrefix(out.URL.Path, "/") {
+		out.URL.Path = "/" + out.URL.Path
+	}
+	out.URL.RawQuery = r.URL.RawQuery
+	out.Host = ""
+	out.RequestURI = ""
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	out.Header.Set("X-Sidecar-Mirror", "true")
+	go m.send(out, target.cfg.Timeout)
+}
+
+func (m *Mirror) send(req *http.Request, timeout time.Duration) {
+	defer func() { <-m.slots }()
+	m.sent.Add(1)
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		m.failed.Add(1)
+		slog.Warn("Mirrored request failed", "component", "mirror", "method", req.Method, "path", req.URL.Path, "request_id", req.Header.Get(logging.RequestIDHeader), "error", err)
+		return
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxMirrorBody))
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		m.failed.Add(1)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PoolConfig sizes the connection pools to upstreams and egress targets.
+// MaxConnsPerHost caps the connections to one host, idle or busy; requests
+// beyond it wait for a free connection. HTTP2 lets HTTPS upstreams that offer
+// HTTP/2 multiplex requests over a few connections. Zero limits mean no limit.
+type PoolConfig struct {
+	MaxIdleConns        int           `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int           `yaml:"max_conns_per_host"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`
+	DialTimeout         time.Duration `yaml:"dial_timeout"`
+	HTTP2               bool          `yaml:"http2"`
+}
+
+func (c PoolConfig) valid() bool {
+	return c.MaxIdleConns >= 0 && c.MaxIdleConnsPerHost >= 0 && c.MaxConnsPerHost >= 0 && c.IdleConnTimeout >= 0 && c.DialTimeout >= 0
+}
+
+// apply sets the pool up on t; stats, if set, counts its connections.
+func (c PoolConfig) apply(t *http.Transport, stats *poolStats) {
+	t.MaxIdleConns = c.MaxIdleConns
+	t.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	t.MaxConnsPerHost = c.MaxConnsPerHost
+	t.IdleConnTimeout = c.IdleConnTimeout
+	t.ForceAttemptHTTP2 = c.HTTP2
+	dialer := &net.Dialer{Timeout: c.DialTimeout, KeepAlive: 30 * time.Second}
+	t.DialContext = dialer.DialContext
+	if stats != nil {
+		stats.maxPerHost = c.MaxConnsPerHost
+		t.DialContext = stats.dialContext(dialer)
+	}
+}
+
+// poolStats tells how busy a pool is: connections open per host, how many
+// requests needed a new one, and how long requests waited for one.
+type poolStats struct {
+	name       string
+	maxPerHost int
+	dials      atomic.Int64
+	reused     atomic.Int64
+	wait       *histogram
+
+	mu   sync.Mutex
+	open map[string]int64
+}
+
+func newPoolStats(name string) *poolStats {
+	return &poolStats{name: name, wait: newHistogram(latencyBuckets), open: make(map[string]int64)}
+}
+
+func (p *poolStats) dialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		p.dials.Add(1)
+		p.mu.Lock()
+		p.open[addr]++
+		p.mu.Unlock()
+		return &pooledConn{Conn: conn, stats: p, addr: addr}, nil
+	}
+}
+
+type pooledConn struct {
+	net.Conn
+	stats *poolStats
+	addr  string
+	once  sync.Once
+}
+
+func (c *pooledConn) Close() error {
+	c.once.Do(func() {
+		c.stats.mu.Lock()
+		c.stats.open[c.addr]--
+		c.stats.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// pooledTransport adds the pool's trace to requests for a plain
+// http.Transport.
+type pooledTransport struct {
+	next  http.RoundTripper
+	stats *poolStats
+}
+
+func (t *pooledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.next.RoundTrip(t.stats.trace(req))
+}
+
+// trace times the wait for a connection from the pool.
+func (p *poolStats) trace(req *http.Request) *http.Request {
+	var start time.Time
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GetConn: func(string) { start = time.Now() },
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				p.reused.Add(1)
+			}
+			p.wait.Observe(time.Since(start).Seconds())
+		},
+	}))
+}
+
+// writePoolMetrics lists every metric for all pools together, as the text
+// format wants each metric family in one piece.
+func writePoolMetrics(w io.Writer, pools ...*poolStats) {
+	fmt.Fprintf(w, "# HELP sidecar_pool_connections Connections open per pool and host, idle or busy.\n# TYPE sidecar_pool_connections gauge\n")
+	var limited []*poolStats
+	for _, p := range pools {
+		p.mu.Lock()
+		for _, addr := range slices.Sorted(maps.Keys(p.open)) {
+			fmt.Fprintf(w, "sidecar_pool_connections{pool=%q,host=%q} %d\n", p.name, addr, p.open[addr])
+		}
+		p.mu.Unlock()
+		if p.maxPerHost > 0 {
+			limited = append(limited, p)
+		}
+	}
+	if len(limited) > 0 {
+		fmt.Fprintf(w, "# HELP sidecar_pool_utilization Share of max_conns_per_host open per pool and host.\n# TYPE sidecar_pool_utilization gauge\n")
+		for _, p := range limited {
+			p.mu.Lock()
+			for _, addr := range slices.Sorted(maps.Keys(p.open)) {
+				fmt.Fprintf(w, "sidecar_pool_utilization{pool=%q,host=%q} %g\n", p.name, addr, float64(p.open[addr])/float64(p.maxPerHost))
+			}
+			p.mu.Unlock()
+		}
+	}
+	fmt.Fprintf(w, "# HELP sidecar_pool_dials_total New connections opened per pool.\n# TYPE sidecar_pool_dials_total counter\n")
+	for _, p := range pools {
+		fmt.Fprintf(w, "sidecar_pool_dials_total{pool=%q} %d\n", p.name, p.dials.Load())
+	}
+	fmt.Fprintf(w, "# HELP sidecar_pool_reused_total Requests sent over a connection already open.\n# TYPE sidecar_pool_reused_total counter\n")
+	for _, p := range pools {
+		fmt.Fprintf(w, "sidecar_pool_reused_total{pool=%q} %d\n", p.name, p.reused.Load())
+	}
+	fmt.Fprintf(w, "# HELP sidecar_pool_wait_seconds Time a request waited for a connection, new or from the pool.\n# TYPE sidecar_pool_wait_seconds histogram\n")
+	for _, p := range pools {
+		p.wait.write(w, "sidecar_pool_wait_seconds", fmt.Sprintf("pool=%q", p.name))
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"time"
+)
+
+// protocolTransport sends requests for h2c:// upstreams as HTTP/2 without
+// TLS, which gRPC servers expect, and everything else over HTTP/1.1 or, for
+// HTTPS upstreams that offer it, HTTP/2.
+type protocolTransport struct {
+	http  *http.Transport
+	h2c   *http.Transport
+	stats *poolStats
+}
+
+// newProtocolTransport sizes both pools by pool; stats may be nil.
+func newProtocolTransport(rootCAs *x509.CertPool, pool PoolConfig, stats *poolStats) *protocolTransport {
+	h1 := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs: rootCAs,
+		},
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	pool.apply(h1, stats)
+	h2c := &http.Transport{
+		Protocols: new(http.Protocols),
+	}
+	pool.apply(h2c, stats)
+	h2c.Protocols.SetUnencryptedHTTP2(true)
+	return &protocolTransport{http: h1, h2c: h2c, stats: stats}
+}
+
+func (t *protocolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.stats != nil {
+		req = t.stats.trace(req)
+	}
+	if req.URL.Scheme != "h2c" {
+		return t.http.RoundTrip(req)
+	}
+	// Retries send the same request again, so it's left as it was.
+	out := *req
+	u := *req.URL
+	u.Scheme = "http"
+	out.URL = &u
+	return t.h2c.RoundTrip(&out)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Idle buckets are dropped once they would have refilled anyway.
+const rateLimitSweepInterval = time.Minute
+
+type rateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// capacity defaults to one second's worth of requests.
+func (l rateLimit) capacity() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return max(1, math.Ceil(l.Rate))
+}
+
+// RateLimitConfig gives every client its own token bucket of Rate requests
+// per second with room for Burst at once. Clients are told apart by the value
+// of Header when it is set and present, then by the verified certificate
+// identity, then by the remote address. Overrides replaces the limit for
+// particular client keys. A zero Rate disables the limiter.
+type RateLimitConfig struct {
+	Rate      float64              `yaml:"rate"`
+	Burst     int                  `yaml:"burst"`
+	Header    string               `yaml:"header"`
+	Overrides map[string]rateLimit `yaml:"overrides"`
+}
+
+type tokenBucket struct {
+	limit  rateLimit
+	tokens float64
+	last   time.Time
+}
+
+type RateLimiter struct {
+	cfg atomic.Pointer[RateLimitConfig]
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+
+	limited atomic.Int64
+}
+
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	l := &RateLimiter{buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+	l.cfg.Store(&cfg)
+	return l
+}
+
+// setConfig starts every client over with a full bucket of the new size.
+func (l *RateLimiter) setConfig(cfg RateLimitConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cfg.Store(&cfg)
+	clear(l.buckets)
+}
+
+func (c *RateLimitConfig) enabled() bool {
+	return c.Rate > 0 || len(c.Overrides) > 0
+}
+
+func (c *RateLimitConfig) clientKey(r *http.Request) string {
+	if c.Header != "" {
+		if v := strings.TrimSpace(r.Header.Get(c.Header)); v != "" {
+			return v
+		}
+	}
+	if id := peerIdentity(r); id != "" {
+		return id
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Allow takes a token from the client's bucket. A rejected request gets the
+// client key and the time until a token is available.
+func (l *RateLimiter) Allow(r *http.Request) (key string, retryAfter time.Duration, ok bool) {
+	cfg := l.cfg.Load()
+	if !cfg.enabled() {
+		return "", 0, true
+	}
+	key = cfg.clientKey(r)
+	limit, found := cfg.Overrides[key]
+	if !found {
+		limit = rateLimit{Rate: cfg.Rate, Burst: cfg.Burst}
+	}
+	if limit.Rate <= 0 {
+		return key, 0, true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		l.sweep(now)
+	}
+	b, found := l.buckets[key]
+	if !found {
+		b = &tokenBucket{limit: limit, tokens: limit.capacity(), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(b.limit.capacity(), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		l.limited.Add(1)
+		return key, time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return key, 0, true
+}
+
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate >= b.limit.capacity() {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+func retryAfterSeconds(d time.Duration) int {
+	return max(1, int(math.Ceil(d.Seconds())))
+}
+
+// parseRateOverrides reads "client=rate[:burst],..." pairs. Without a burst
+// the client may send one second's worth of requests at once.
+func parseRateOverrides(s string) (map[string]rateLimit, error) {
+	overrides := make(map[string]rateLimit)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("%q: want client=rate[:burst]", item)
+		}
+		rateStr, burstStr, hasBurst := strings.Cut(value, ":")
+		rate, err := strconv.ParseFloat(strings.TrimSpace(rateStr), 64)
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("%q: invalid rate", item)
+		}
+		burst := 0
+		if hasBurst {
+			if burst, err = strconv.Atoi(strings.TrimSpace(burstStr)); err != nil || burst < 1 {
+				return nil, fmt.Errorf("%q: invalid burst", item)
+			}
+		}
+		overrides[strings.TrimSpace(key)] = rateLimit{Rate: rate, Burst: burst}
+	}
+	return overrides, nil
+}
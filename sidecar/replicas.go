@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OutlierConfig takes a replica out of rotation after ConsecutiveErrors
+// attempts in a row got no response or a 5xx from it. It stays out for
+// BaseEjection times the number of times it was ejected lately, up to
+// MaxEjection, then gets requests again. Without a fallback at most
+// MaxEjectedPercent of an upstream's replicas are out at once; with one all
+// may be, and requests go to the fallback meanwhile. A zero
+// ConsecutiveErrors turns ejection off.
+type OutlierConfig struct {
+	ConsecutiveErrors int           `yaml:"consecutive_errors"`
+	BaseEjection      time.Duration `yaml:"base_ejection"`
+	MaxEjection       time.Duration `yaml:"max_ejection"`
+	MaxEjectedPercent int           `yaml:"max_ejected_percent"`
+}
+
+// replica is one process serving an upstream. Its state outlives reloads as
+// long as its URL stays.
+type replica struct {
+	url *url.URL
+
+	mu           sync.Mutex
+	errors       int
+	ejectedUntil time.Time
+	ejections    int
+	readmitted   time.Time
+
+	ejectedTotal atomic.Int64
+}
+
+// available readmits the replica once its ejection is over.
+func (r *replica) available(now time.Time, upstream string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ejectedUntil.IsZero() {
+		return true
+	}
+	if now.Before(r.ejectedUntil) {
+		return false
+	}
+	r.ejectedUntil, r.errors, r.readmitted = time.Time{}, 0, now
+	slog.Info("Replica back in rotation", "component", "outlier", "upstream", upstream, "replica", r.url)
+	return true
+}
+
+func (r *replica) ejected(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return now.Before(r.ejectedUntil)
+}
+
+// replicaSet spreads an upstream's requests over its replicas in turn,
+// skipping ejected ones.
+type replicaSet struct {
+	upstream    string
+	replicas    []*replica
+	cfg         OutlierConfig
+	canEjectAll bool
+
+	next atomic.Uint64
+	mu   sync.Mutex
+}
+
+// pick returns the next available replica. If all are ejected it still
+// returns one rather than fail the request.
+func (rs *replicaSet) pick() *replica {
+	now := time.Now()
+	start := rs.next.Add(1)
+	n := uint64(len(rs.replicas))
+	for i := range n {
+		if r := rs.replicas[(start+i)%n]; r.available(now, rs.upstream) {
+			return r
+		}
+	}
+	return rs.replicas[start%n]
+}
+
+func (rs *replicaSet) allEjected() bool {
+	if rs.cfg.ConsecutiveErrors <= 0 {
+		return false
+	}
+	now := time.Now()
+	for _, r := range rs.replicas {
+		if !r.ejected(now) {
+			return false
+		}
+	}
+	return true
+}
+
+func (rs *replicaSet) record(r *replica, failed bool) {
+	cfg := rs.cfg
+	if cfg.ConsecutiveErrors <= 0 {
+		return
+	}
+	r.mu.Lock()
+	if !failed {
+		r.errors = 0
+		r.mu.Unlock()
+		return
+	}
+	r.errors++
+	due := r.errors >= cfg.ConsecutiveErrors && r.ejectedUntil.IsZero()
+	r.mu.Unlock()
+	if !due {
+		return
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	now := time.Now()
+	ejected := 0
+	for _, other := range rs.replicas {
+		if other.ejected(now) {
+			ejected++
+		}
+	}
+	if !rs.canEjectAll && (ejected+1)*100 > cfg.MaxEjectedPercent*len(rs.replicas) {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.ejectedUntil.IsZero() {
+		return
+	}
+	// A replica that behaved for a while starts over at the base time.
+	if now.Sub(r.readmitted) > cfg.MaxEjection {
+		r.ejections = 0
+	}
+	r.ejections++
+	d := min(cfg.BaseEjection*time.Duration(r.ejections), cfg.MaxEjection)
+	r.ejectedUntil = now.Add(d)
+	r.ejectedTotal.Add(1)
+	slog.Warn("Ejecting replica", "component", "outlier", "upstream", rs.upstream, "replica", r.url, "for", d, "failed_in_a_row", r.errors)
+}
+
+type replicasKey struct{}
+
+func withReplicas(ctx context.Context, rs *replicaSet) context.Context {
+	return context.WithValue(ctx, replicasKey{}, rs)
+}
+
+// replicaTransport sends every attempt to the next replica of the request's
+// upstream, so a retry goes to another process, and tells the replica set
+// how it went.
+type replicaTransport struct {
+	next http.RoundTripper
+}
+
+func (t *replicaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rs, ok := req.Context().Value(replicasKey{}).(*replicaSet)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	r := rs.pick()
+	recordUpstreamReplica(req.Context(), r.url.String())
+	// Retries send the same request again, so it's left as it was.
+	out := *req
+	u := *req.URL
+	u.Scheme, u.Host = r.url.Scheme, r.url.Host
+	out.URL = &u
+	resp, err := t.next.RoundTrip(&out)
+	// Callers giving up say nothing about the replica.
+	if req.Context().Err() == nil {
+		rs.record(r, err != nil || resp.StatusCode >= http.StatusInternalServerError)
+	}
+	return resp, err
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/m-tln/notes/logging"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Bodies larger than this are streamed once instead of being buffered for
+// replay, so such requests are never retried.
+const maxRetryBody = 1 << 20
+
+var errPerTryTimeout = errors.New("per-try timeout")
+
+type headerTimeoutKey struct{}
+
+// withResponseHeaderTimeout bounds every upstream attempt for the request,
+// retried or not.
+func withResponseHeaderTimeout(ctx context.Context, d time.Duration) context.Context {
+	if d <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, headerTimeoutKey{}, d)
+}
+
+// RetryPolicy controls how idempotent requests are retried when the upstream
+// can't be reached or answers 502/503. A 503 with Retry-After is the upstream
+// asking for a break and isn't retried.
+type RetryPolicy struct {
+	MaxAttempts   int           `yaml:"max_attempts"`
+	BaseDelay     time.Duration `yaml:"base_delay"`
+	MaxDelay      time.Duration `yaml:"max_delay"`
+	PerTryTimeout time.Duration `yaml:"per_try_timeout"`
+}
+
+// Backoff doubles the delay with every attempt up to MaxDelay, with full
+// jitter so retries from several sidecars don't line up.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << (attempt - 1)
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return rand.N(delay + 1)
+}
+
+type retryTransport struct {
+	next   http.RoundTripper
+	policy atomic.Pointer[RetryPolicy]
+
+	retries   atomic.Int64 // attempts after the first
+	exhausted atomic.Int64 // requests still failing after the last attempt
+}
+
+func newRetryTransport(next http.RoundTripper, policy RetryPolicy) *retryTransport {
+	t := &retryTransport{next: next}
+	t.setPolicy(policy)
+	return t
+}
+
+// setPolicy applies to requests that start afterwards.
+func (t *retryTransport) setPolicy(policy RetryPolicy) {
+	t.policy.Store(&policy)
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusBadGateway ||
+		resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") == ""
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	policy := t.policy.Load()
+	if policy.MaxAttempts <= 1 || !isIdempotent(req.Method) {
+		return t.attempt(req, 0)
+	}
+
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		body, err := io.ReadAll(io.LimitReader(req.Body, maxRetryBody+1))
+		if err != nil {
+			req.Body.Close()
+			return nil, err
+		}
+		if len(body) > maxRetryBody {
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+			return t.next.RoundTrip(req)
+		}
+		req.Body.Close()
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		req.Body, _ = req.GetBody()
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := t.attempt(req, policy.PerTryTimeout)
+		if !shouldRetry(resp, err) || req.Context().Err() != nil {
+			return resp, err
+		}
+		if attempt >= policy.MaxAttempts {
+			t.exhausted.Add(1)
+			return resp, err
+		}
+
+		reason := fmt.Sprint(err)
+		if err == nil {
+			reason = resp.Status
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		delay := policy.Backoff(attempt)
+		logging.FromContext(req.Context()).Warn("Attempt failed, retrying", "component", "retry", "method", req.Method, "path", req.URL.Path,
+			"attempt", attempt, "max_attempts", policy.MaxAttempts, "reason", reason, "retry_in", delay)
+		trace.SpanFromContext(req.Context()).AddEvent("retry", trace.WithAttributes(
+			attribute.Int("attempt", attempt),
+			attribute.String("reason", reason),
+			attribute.String("delay", delay.String()),
+		))
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		t.retries.Add(1)
+	}
+}
+
+// attempt bounds the time until the upstream's response headers arrive by
+// the shorter of the per-try and response header timeouts; the body is then
+// streamed without a deadline. Upgrades are left alone, the proxy needs the
+// 101 response's body to stay the raw connection, and so are gRPC calls,
+// whose server may hold its headers back until it has a message to send.
+func (t *retryTransport) attempt(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	if d, ok := req.Context().Value(headerTimeoutKey{}).(time.Duration); ok && (timeout <= 0 || d < timeout) {
+		timeout = d
+	}
+	if timeout <= 0 || req.Header.Get("Upgrade") != "" || isGRPC(req) {
+		return t.next.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(timeout, func() { cancel(errPerTryTimeout) })
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	timer.Stop()
+	if err != nil {
+		if errors.Is(context.Cause(ctx), errPerTryTimeout) {
+			err = fmt.Errorf("%w after %s", errPerTryTimeout, timeout)
+		}
+		cancel(nil)
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: func() { cancel(nil) }}
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sequenceUpstream answers with the given statuses in turn, repeating the
+// last one, and counts the requests it saw.
+func sequenceUpstream(t *testing.T, header http.Header, statuses ...int) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var calls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+		if body, _ := io.ReadAll(r.Body); len(body) > 0 && string(body) != "payload" {
+			t.Errorf("attempt %d got body %q, want %q", n, body, "payload")
+		}
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(statuses[min(n, len(statuses))-1])
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		body          string
+		header        http.Header
+		statuses      []int
+		wantStatus    int
+		wantCalls     int64
+		wantExhausted int64
+	}{
+		{"success is not retried", http.MethodGet, "", nil, []int{200}, 200, 1, 0},
+		{"bad gateway is retried", http.MethodGet, "", nil, []int{502, 502, 200}, 200, 3, 0},
+		{"attempts run out", http.MethodGet, "", nil, []int{503}, 503, 3, 1},
+		{"503 with Retry-After is not retried", http.MethodGet, "", http.Header{"Retry-After": {"5"}}, []int{503, 200}, 503, 1, 0},
+		{"500 is not retried", http.MethodGet, "", nil, []int{500, 200}, 500, 1, 0},
+		{"POST is not retried", http.MethodPost, "payload", nil, []int{502, 200}, 502, 1, 0},
+		{"PUT body is replayed", http.MethodPut, "payload", nil, []int{502, 200}, 200, 2, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream, calls := sequenceUpstream(t, tt.header, tt.statuses...)
+			rt := newRetryTransport(http.DefaultTransport, RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond})
+
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			req := httptest.NewRequest(tt.method, upstream.URL, body)
+			req.RequestURI = ""
+			resp, err := rt.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if n := calls.Load(); n != tt.wantCalls {
+				t.Errorf("upstream calls = %d, want %d", n, tt.wantCalls)
+			}
+			if n := rt.retries.Load(); n != tt.wantCalls-1 {
+				t.Errorf("retries = %d, want %d", n, tt.wantCalls-1)
+			}
+			if n := rt.exhausted.Load(); n != tt.wantExhausted {
+				t.Errorf("exhausted = %d, want %d", n, tt.wantExhausted)
+			}
+		})
+	}
+}
+
+func TestRetryTransportPerTryTimeout(t *testing.T) {
+	var calls atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	rt := newRetryTransport(http.DefaultTransport, RetryPolicy{MaxAttempts: 2, MaxDelay: time.Millisecond, PerTryTimeout: 50 * time.Millisecond})
+	req := httptest.NewRequest(http.MethodGet, upstream.URL, nil)
+	req.RequestURI = ""
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" || calls.Load() != 2 {
+		t.Errorf("got %q after %d calls, want %q after 2", body, calls.Load(), "ok")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultHealthPath = "/health"
+
+// Limits bound a request's time and size. ReadTimeout and WriteTimeout count
+// from the moment the sidecar starts handling the request. Zero fields on a
+// route take the global value; a zero global value means no limit.
+type Limits struct {
+	ReadTimeout           time.Duration `yaml:"read_timeout"`
+	WriteTimeout          time.Duration `yaml:"write_timeout"`
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout"`
+	MaxRequestBody        int64         `yaml:"max_request_body"`
+}
+
+func (l Limits) valid() bool {
+	return l.ReadTimeout >= 0 && l.WriteTimeout >= 0 && l.ResponseHeaderTimeout >= 0 && l.MaxRequestBody >= 0
+}
+
+func (l Limits) or(fallback Limits) Limits {
+	l.ReadTimeout = cmp.Or(l.ReadTimeout, fallback.ReadTimeout)
+	l.WriteTimeout = cmp.Or(l.WriteTimeout, fallback.WriteTimeout)
+	l.ResponseHeaderTimeout = cmp.Or(l.ResponseHeaderTimeout, fallback.ResponseHeaderTimeout)
+	l.MaxRequestBody = cmp.Or(l.MaxRequestBody, fallback.MaxRequestBody)
+	return l
+}
+
+// Route sends requests whose path matches Path ("*" at the end matches by
+// prefix) to Upstream, which /health checks at HealthPath. The path is
+// passed on unchanged. Replicas are more processes serving the same, which
+// differ from Upstream only in scheme, host and port; requests take turns
+// between all of them. While Upstream and its replicas fail their health
+// checks, requests go to Fallback if it is set. Transform changes the
+// traffic both ways, and CORS lets browsers on other origins use it.
+type Route struct {
+	Path       string          `yaml:"path"`
+	Upstream   string          `yaml:"upstream"`
+	Replicas   []string        `yaml:"replicas"`
+	HealthPath string          `yaml:"health_path"`
+	Fallback   string          `yaml:"fallback"`
+	Transform  TransformConfig `yaml:"transform"`
+	CORS       CORSConfig      `yaml:"cors"`
+	Limits     `yaml:",inline"`
+}
+
+type upstream struct {
+	route        Route
+	url          *url.URL
+	proxy        *httputil.ReverseProxy
+	breaker      *CircuitBreaker
+	backpressure *Backpressure
+	replicas     *replicaSet
+	fallback     *fallback
+}
+
+// parseRoutes reads "path=url[|health path],..." entries.
+func parseRoutes(s string) ([]Route, error) {
+	var routes []Route
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		path, target, ok := strings.Cut(item, "=")
+		path = strings.TrimSpace(path)
+		if !ok || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("%q: want /path=url[|health path]", item)
+		}
+		target, health, _ := strings.Cut(target, "|")
+		route := Route{Path: path, Upstream: strings.TrimSpace(target), HealthPath: strings.TrimSpace(health)}
+		if route.HealthPath != "" && !strings.HasPrefix(route.HealthPath, "/") {
+			return nil, fmt.Errorf("%q: health path must start with /", item)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// route picks the first upstream whose path matches; the last one is the
+// catch-all UPSTREAM_SERVICE.
+func (s *SidecarProxy) route(r *http.Request) *upstream {
+	upstreams := *s.upstreams.Load()
+	for _, u := range upstreams {
+		if matchPath(u.route.Path, r.URL.Path) {
+			return u
+		}
+	}
+	return upstreams[len(upstreams)-1]
+}
+
+// HandleHealth checks every upstream at once, each bounded by the health
+// timeout. Health checks use their own connection pool, so a saturated proxy
+// pool doesn't make a healthy upstream look down.
+func (s *SidecarProxy) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Draining"))
+		return
+	}
+	// An upstream that has failed over is as healthy as its fallback.
+	upstreams := *s.upstreams.Load()
+	targets := make([]string, len(upstreams))
+	errs := make([]error, len(upstreams))
+	var wg sync.WaitGroup
+	for i, u := range upstreams {
+		targets[i] = u.route.Upstream
+		if fb := u.fallback; fb != nil && fb.state.active.Load() {
+			targets[i] = u.route.Fallback
+			wg.Go(func() { errs[i] = s.checkHealth(r.Context(), fb.url, u.route.HealthPath) })
+			continue
+		}
+		wg.Go(func() { errs[i] = s.checkReplicas(r.Context(), u) })
+	}
+	wg.Wait()
+
+	var down []string
+	for i, err := range errs {
+		if err != nil {
+			slog.Warn("Health check failed", "component", "health", "target", targets[i], "error", err)
+			down = append(down, targets[i])
+		}
+	}
+	if len(down) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Upstream unavailable: " + strings.Join(down, ", ")))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// checkReplicas passes if any replica of the upstream passes its health check.
+func (s *SidecarProxy) checkReplicas(ctx context.Context, u *upstream) error {
+	replicas := u.replicas.replicas
+	errs := make([]error, len(replicas))
+	var wg sync.WaitGroup
+	for i, r := range replicas {
+		wg.Go(func() { errs[i] = s.checkHealth(ctx, r.url, u.route.HealthPath) })
+	}
+	wg.Wait()
+	if slices.Contains(errs, nil) {
+		return nil
+	}
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return errors.Join(errs...)
+}
+
+func (s *SidecarProxy) checkHealth(ctx context.Context, target *url.URL, path string) error {
+	if timeout := time.Duration(s.healthTimeout.Load()); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if path == grpcHealthPath {
+		return s.checkGRPCHealth(ctx, target)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.JoinPath(path).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.health.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", path, resp.Status)
+	}
+	return nil
+}
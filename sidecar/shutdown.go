@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// shutdown takes the sidecar out of rotation before closing it: /health
+// starts failing at once, requests are still served for delay so the load
+// balancer has time to notice, then the listener closes and in-flight
+// requests get until timeout to finish. Upgraded connections, which the
+// server no longer tracks, are waited for as well.
+func (s *SidecarProxy) shutdown(server *http.Server, delay, timeout time.Duration) {
+	s.draining.Store(true)
+	server.SetKeepAlivesEnabled(false)
+	slog.Info("Failing /health, closing listener", "component", "shutdown", "delay", delay)
+	time.Sleep(delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	slog.Info("Draining", "component", "shutdown", "in_flight", s.metrics.inFlight.Load())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Shutdown(ctx)
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				slog.Warn("Forced shutdown", "component", "shutdown", "in_flight", s.metrics.inFlight.Load(), "error", err)
+				return
+			}
+			done = nil
+		case <-ctx.Done():
+			slog.Warn("Forced shutdown", "component", "shutdown", "in_flight", s.metrics.inFlight.Load())
+			return
+		case <-ticker.C:
+			slog.Info("Draining", "component", "shutdown", "in_flight", s.metrics.inFlight.Load())
+		}
+		if done == nil && s.metrics.inFlight.Load() == 0 {
+			slog.Info("All in-flight requests completed", "component", "shutdown")
+			return
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// spiffeID is the first spiffe:// URI SAN of cert, which the mesh CA sets to
+// spiffe://notes/<service>.
+func spiffeID(cert *x509.Certificate) string {
+	for _, u := range cert.URIs {
+		if u.Scheme == "spiffe" && u.Host != "" {
+			return u.String()
+		}
+	}
+	return ""
+}
+
+// validSPIFFEPattern accepts a SPIFFE ID, or a prefix of one ending in "*".
+func validSPIFFEPattern(pattern string) bool {
+	u, err := url.Parse(strings.TrimSuffix(pattern, "*"))
+	return err == nil && u.Scheme == "spiffe" && u.Host != "" && u.RawQuery == "" && u.Fragment == ""
+}
+
+// verifySPIFFE checks that cert carries a SPIFFE ID matching one of patterns,
+// exactly or by prefix for patterns ending in "*".
+func verifySPIFFE(cert *x509.Certificate, patterns []string) error {
+	id := spiffeID(cert)
+	if id == "" {
+		return fmt.Errorf("certificate %q has no SPIFFE ID", cert.Subject.CommonName)
+	}
+	if !slices.ContainsFunc(patterns, func(p string) bool { return matchPath(p, id) }) {
+		return fmt.Errorf("SPIFFE ID %s is not allowed", id)
+	}
+	return nil
+}
+
+// expectSPIFFE makes a client config refuse servers whose certificate doesn't
+// carry a matching SPIFFE ID, after the checks the config already makes. The
+// chain has been verified against RootCAs by the time VerifyConnection runs.
+func expectSPIFFE(cfg *tls.Config, patterns ...string) {
+	next := cfg.VerifyConnection
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if next != nil {
+			if err := next(cs); err != nil {
+				return err
+			}
+		}
+		return verifySPIFFE(cs.PeerCertificates[0], patterns)
+	}
+}
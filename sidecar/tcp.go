@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const tcpHandshakeTimeout = 10 * time.Second
+
+// TCPConfig opens a second mTLS port whose connections are passed through as
+// raw bytes to Upstream (host:port), for services that don't speak HTTP.
+// Connections beyond MaxConnections are refused, and a connection with no
+// traffic either way for IdleTimeout is closed. Zero means no limit.
+type TCPConfig struct {
+	Port           string        `yaml:"port"`
+	Upstream       string        `yaml:"upstream"`
+	MaxConnections int           `yaml:"max_connections"`
+	IdleTimeout    time.Duration `yaml:"idle_timeout"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+}
+
+type TCPProxy struct {
+	cfg       TCPConfig
+	tlsConfig *tls.Config
+	metrics   *Metrics
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+}
+
+func NewTCPProxy(cfg TCPConfig, tlsConfig *tls.Config, metrics *Metrics) *TCPProxy {
+	return &TCPProxy{cfg: cfg, tlsConfig: tlsConfig, metrics: metrics, conns: make(map[net.Conn]struct{})}
+}
+
+func (p *TCPProxy) ListenAndServe() error {
+	ln, err := net.Listen("tcp", ":"+p.cfg.Port)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.listener = ln
+	p.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		if n := p.metrics.tcpActive.Add(1); p.cfg.MaxConnections > 0 && n > int64(p.cfg.MaxConnections) {
+			p.metrics.tcpActive.Add(-1)
+			p.metrics.tcpRejected.Add(1)
+			slog.Warn("Connection limit reached, refusing", "component", "tcp", "max_connections", p.cfg.MaxConnections, "remote_addr", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+		p.metrics.tcpTotal.Add(1)
+		go p.handle(conn)
+	}
+}
+
+func (p *TCPProxy) track(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range conns {
+		p.conns[c] = struct{}{}
+	}
+}
+
+func (p *TCPProxy) untrack(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range conns {
+		delete(p.conns, c)
+	}
+}
+
+func (p *TCPProxy) handle(raw net.Conn) {
+	defer p.metrics.tcpActive.Add(-1)
+	start := time.Now()
+	conn := tls.Server(raw, p.tlsConfig)
+	p.track(conn)
+	defer p.untrack(conn)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), tcpHandshakeTimeout)
+	err := conn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		p.metrics.handshakeErrors.Add(1)
+		slog.Warn("TLS handshake error", "component", "tcp", "remote_addr", raw.RemoteAddr().String(), "error", err)
+		return
+	}
+
+	dialer := net.Dialer{Timeout: p.cfg.ConnectTimeout}
+	upstream, err := dialer.Dial("tcp", p.cfg.Upstream)
+	if err != nil {
+		p.metrics.tcpErrors.Add(1)
+		slog.Error("Dialing the upstream failed", "component", "tcp", "remote_addr", raw.RemoteAddr().String(), "error", err)
+		return
+	}
+	p.track(upstream)
+	defer p.untrack(upstream)
+	defer upstream.Close()
+
+	idle := &idleTimer{timeout: p.cfg.IdleTimeout, conns: []net.Conn{conn, upstream}}
+	idle.touch()
+	var in, out int64
+	var wg sync.WaitGroup
+	wg.Go(func() { in = pipe(upstream, conn, idle, &p.metrics.tcpBytesIn) })
+	wg.Go(func() { out = pipe(conn, upstream, idle, &p.metrics.tcpBytesOut) })
+	wg.Wait()
+
+	cs := conn.ConnectionState()
+	var client, spiffe string
+	if len(cs.VerifiedChains) > 0 {
+		client, spiffe = cs.VerifiedChains[0][0].Subject.CommonName, spiffeID(cs.VerifiedChains[0][0])
+	}
+	clientIP, _, _ := net.SplitHostPort(raw.RemoteAddr().String())
+	accessLogger.LogAttrs(context.Background(), slog.LevelInfo, "tcp",
+		slog.String("client", client),
+		slog.String("spiffe_id", spiffe),
+		slog.String("client_ip", clientIP),
+		slog.String("upstream", p.cfg.Upstream),
+		slog.Int64("bytes_in", in),
+		slog.Int64("bytes_out", out),
+		slog.Float64("duration_ms", milliseconds(time.Since(start))),
+	)
+}
+
+// pipe copies src to dst until src is done, then passes the end of the
+// stream on so the other side can finish its reply.
+func pipe(dst, src net.Conn, idle *idleTimer, counter *atomic.Int64) int64 {
+	buf := make([]byte, 32<<10)
+	var n int64
+	for {
+		nr, err := src.Read(buf)
+		if nr > 0 {
+			idle.touch()
+			nw, werr := dst.Write(buf[:nr])
+			n += int64(nw)
+			counter.Add(int64(nw))
+			if werr != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+	return n
+}
+
+// idleTimer pushes the deadline of both ends forward on traffic in either
+// direction, so a connection that streams one way isn't cut off.
+type idleTimer struct {
+	timeout time.Duration
+	conns   []net.Conn
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (t *idleTimer) touch() {
+	if t.timeout <= 0 {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Moving the deadline costs a syscall per connection, so it's only done
+	// once a tenth of the timeout has passed.
+	if now.Sub(t.last) < t.timeout/10 {
+		return
+	}
+	t.last = now
+	for _, c := range t.conns {
+		c.SetDeadline(now.Add(t.timeout))
+	}
+}
+
+// shutdown works like SidecarProxy.shutdown: new connections are accepted
+// for delay, then the listener closes and open connections get until
+// timeout to finish before they are cut.
+func (p *TCPProxy) shutdown(delay, timeout time.Duration) {
+	time.Sleep(delay)
+	p.mu.Lock()
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	p.mu.Unlock()
+
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for p.metrics.tcpActive.Load() > 0 {
+		select {
+		case <-deadline:
+			p.mu.Lock()
+			slog.Warn("Closing connections still open", "component", "tcp", "open", p.metrics.tcpActive.Load())
+			for c := range p.conns {
+				c.Close()
+			}
+			p.mu.Unlock()
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Client certificate modes for SIDECAR_MTLS.
+const (
+	MTLSStrict     = "strict"
+	MTLSPermissive = "permissive"
+	MTLSOff        = "off"
+)
+
+// loadCertPool accepts either a path or the PEM itself.
+func loadCertPool(ca string) (*x509.CertPool, error) {
+	pem := []byte(ca)
+	if !strings.HasPrefix(strings.TrimSpace(ca), "-----BEGIN") {
+		var err error
+		if pem, err = os.ReadFile(ca); err != nil {
+			return nil, fmt.Errorf("read CA_CERT: %w", err)
+		}
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in CA_CERT")
+	}
+	return pool, nil
+}
+
+// serverTLSConfig requires callers to present a certificate issued by the
+// mesh CA, not revoked in crl if it is set, and, if allowed is set, carrying
+// a SPIFFE ID that matches it. In permissive mode, meant for rolling mTLS
+// out, any client is let through and the ones strict mode would reject are
+// only logged.
+func serverTLSConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), clientCAs *x509.CertPool, crl *CRL, mode string, allowed []string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		GetCertificate: getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	switch mode {
+	case MTLSOff:
+	case MTLSStrict:
+		if clientCAs == nil {
+			return nil, fmt.Errorf("SIDECAR_MTLS=%s needs CA_CERT", mode)
+		}
+		cfg.ClientCAs = clientCAs
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if err := crl.verify(cs.VerifiedChains); err != nil || len(allowed) == 0 {
+				return err
+			}
+			return verifySPIFFE(cs.PeerCertificates[0], allowed)
+		}
+	case MTLSPermissive:
+		if clientCAs == nil {
+			return nil, fmt.Errorf("SIDECAR_MTLS=%s needs CA_CERT", mode)
+		}
+		cfg.ClientCAs = clientCAs
+		cfg.ClientAuth = tls.RequestClientCert
+		cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			conn := cfg.Clone()
+			conn.GetConfigForClient = nil
+			remote := hello.Conn.RemoteAddr().String()
+			conn.VerifyConnection = func(cs tls.ConnectionState) error {
+				if err := verifyClient(cs, clientCAs, crl, allowed); err != nil {
+					slog.Warn("Permissive mode: would reject client", "component", "mtls", "remote_addr", remote, "error", err)
+				}
+				return nil
+			}
+			return conn, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown SIDECAR_MTLS %q", mode)
+	}
+	return cfg, nil
+}
+
+// verifyClient repeats the checks strict mode would make.
+func verifyClient(cs tls.ConnectionState, roots *x509.CertPool, crl *CRL, allowed []string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("no client certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return err
+	}
+	if err := crl.verify(chains); err != nil || len(allowed) == 0 {
+		return err
+	}
+	return verifySPIFFE(cs.PeerCertificates[0], allowed)
+}
+
+// peerIdentity is the common name of a client certificate the handshake
+// verified. Certificates let through by permissive mode don't count.
+func peerIdentity(r *http.Request) string {
+	if leaf := verifiedLeaf(r); leaf != nil {
+		return leaf.Subject.CommonName
+	}
+	return ""
+}
+
+// peerSPIFFEID is the SPIFFE ID of a client certificate the handshake
+// verified.
+func peerSPIFFEID(r *http.Request) string {
+	if leaf := verifiedLeaf(r); leaf != nil {
+		return spiffeID(leaf)
+	}
+	return ""
+}
+
+// peerNames lists the verified client's SPIFFE ID and common name followed by
+// its DNS SANs.
+func peerNames(r *http.Request) []string {
+	leaf := verifiedLeaf(r)
+	if leaf == nil {
+		return nil
+	}
+	names := make([]string, 0, 2+len(leaf.DNSNames))
+	if id := spiffeID(leaf); id != "" {
+		names = append(names, id)
+	}
+	if leaf.Subject.CommonName != "" {
+		names = append(names, leaf.Subject.CommonName)
+	}
+	return append(names, leaf.DNSNames...)
+}
+
+func verifiedLeaf(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
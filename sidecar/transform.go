@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+const defaultTransformMaxBody = 1 << 20
+
+// Transform changes requests on their way to a route's upstream and the
+// responses on their way back. Request runs on the sidecar's copy of the
+// request, so the access log still shows what the caller sent; an error from
+// Response turns into a 502.
+//
+// The rules in TransformConfig cover header mapping, path rewrites and
+// simple body filters. Anything else is written in Go: a file in this
+// package registers the hook from init with RegisterTransform, and routes
+// name it in transform.hooks.
+type Transform interface {
+	Request(r *http.Request)
+	Response(resp *http.Response) error
+}
+
+var (
+	transformsMu sync.RWMutex
+	transforms   = make(map[string]Transform)
+)
+
+func RegisterTransform(name string, t Transform) {
+	transformsMu.Lock()
+	defer transformsMu.Unlock()
+	if _, dup := transforms[name]; dup {
+		panic("sidecar: transform " + name + " registered twice")
+	}
+	transforms[name] = t
+}
+
+func lookupTransform(name string) (Transform, bool) {
+	transformsMu.RLock()
+	defer transformsMu.RUnlock()
+	t, ok := transforms[name]
+	return t, ok
+}
+
+// HeaderRewrite removes the headers matching Remove (names, or prefixes
+// ending in "*"), then renames and sets headers, in that order.
+type HeaderRewrite struct {
+	Remove []string          `yaml:"remove"`
+	Rename map[string]string `yaml:"rename"`
+	Set    map[string]string `yaml:"set"`
+}
+
+func (h HeaderRewrite) apply(header http.Header) {
+	for name := range header {
+		if matchHeader(h.Remove, name) {
+			header.Del(name)
+		}
+	}
+	for from, to := range h.Rename {
+		if values := header.Values(from); len(values) > 0 {
+			header.Del(from)
+			header[http.CanonicalHeaderKey(to)] = values
+		}
+	}
+	for name, value := range h.Set {
+		header.Set(name, value)
+	}
+}
+
+// Replace is a regular expression and what to put in place of its matches;
+// $1 and ${name} refer to its groups.
+type Replace struct {
+	Match   string `yaml:"match"`
+	Replace string `yaml:"replace"`
+}
+
+// TransformConfig is what a route does to the traffic it carries. Path
+// rules rewrite the path sent upstream, one after another. Body rules apply
+// to responses whose media type matches BodyTypes (default text/* and
+// application/json) and that are at most MaxBody bytes (default 1MiB) and
+// not compressed; other responses pass unchanged. Hooks run after the rules,
+// in order.
+type TransformConfig struct {
+	RequestHeaders  HeaderRewrite `yaml:"request_headers"`
+	ResponseHeaders HeaderRewrite `yaml:"response_headers"`
+	Path            []Replace     `yaml:"path"`
+	Body            []Replace     `yaml:"response_body"`
+	BodyTypes       []string      `yaml:"body_types"`
+	MaxBody         int64         `yaml:"max_body"`
+	Hooks           []string      `yaml:"hooks"`
+}
+
+type replaceRule struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+func compileReplace(rules []Replace) ([]replaceRule, error) {
+	compiled := make([]replaceRule, 0, len(rules))
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", rule.Match, err)
+		}
+		compiled = append(compiled, replaceRule{re: re, replace: rule.Replace})
+	}
+	return compiled, nil
+}
+
+// transformer runs a route's rules and hooks.
+type transformer struct {
+	cfg   TransformConfig
+	path  []replaceRule
+	body  []replaceRule
+	hooks []Transform
+}
+
+// compile returns nil when the config asks for nothing.
+func (c TransformConfig) compile() (*transformer, error) {
+	t := &transformer{cfg: c}
+	var err error
+	if t.path, err = compileReplace(c.Path); err != nil {
+		return nil, fmt.Errorf("path: %w", err)
+	}
+	if t.body, err = compileReplace(c.Body); err != nil {
+		return nil, fmt.Errorf("response_body: %w", err)
+	}
+	for _, name := range c.Hooks {
+		hook, ok := lookupTransform(name)
+		if !ok {
+			return nil, fmt.Errorf("hooks: no transform %q", name)
+		}
+		t.hooks = append(t.hooks, hook)
+	}
+	if len(t.cfg.BodyTypes) == 0 {
+		t.cfg.BodyTypes = []string{"text/*", "application/json"}
+	}
+	if t.cfg.MaxBody == 0 {
+		t.cfg.MaxBody = defaultTransformMaxBody
+	}
+	if len(t.path) == 0 && len(t.body) == 0 && len(t.hooks) == 0 &&
+		c.RequestHeaders.empty() && c.ResponseHeaders.empty() {
+		return nil, nil
+	}
+	return t, nil
+}
+
+func (c TransformConfig) validate() error {
+	var errs []error
+	if c.MaxBody < 0 {
+		errs = append(errs, errors.New("max_body must not be negative"))
+	}
+	if _, err := c.compile(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (h HeaderRewrite) empty() bool {
+	return len(h.Remove) == 0 && len(h.Rename) == 0 && len(h.Set) == 0
+}
+
+func (t *transformer) Request(r *http.Request) {
+	t.cfg.RequestHeaders.apply(r.Header)
+	if len(t.body) > 0 {
+		// Left to the transport, compression is undone before the rules see
+		// the body.
+		r.Header.Del("Accept-Encoding")
+	}
+	if len(t.path) > 0 {
+		path := r.URL.Path
+		for _, rule := range t.path {
+			path = rule.re.ReplaceAllString(path, rule.replace)
+		}
+		r.URL.Path, r.URL.RawPath = path, ""
+	}
+	for _, hook := range t.hooks {
+		hook.Request(r)
+	}
+}
+
+func (t *transformer) Response(resp *http.Response) error {
+	t.cfg.ResponseHeaders.apply(resp.Header)
+	if len(t.body) > 0 && t.filtersBody(resp) {
+		if err := t.filterBody(resp); err != nil {
+			return err
+		}
+	}
+	for _, hook := range t.hooks {
+		if err := hook.Response(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *transformer) filtersBody(resp *http.Response) bool {
+	if resp.Header.Get("Content-Encoding") != "" || resp.ContentLength > t.cfg.MaxBody {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	// An event stream never ends, so it can't be read whole.
+	return err == nil && mediaType != "text/event-stream" && slices.ContainsFunc(t.cfg.BodyTypes, func(p string) bool { return matchPath(p, mediaType) })
+}
+
+// filterBody reads the body whole to run the rules over it. A body that
+// turns out longer than MaxBody goes on unchanged.
+func (t *transformer) filterBody(resp *http.Response) error {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, t.cfg.MaxBody+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > t.cfg.MaxBody {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+	for _, rule := range t.body {
+		body = rule.re.ReplaceAll(body, []byte(rule.replace))
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("ETag")
+	return nil
+}